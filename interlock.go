@@ -29,7 +29,7 @@ func main() {
 	flag.BoolVar(&conf.Debug, "d", false, "debug mode")
 	flag.BoolVar(&conf.TestMode, "t", false, "test mode (WARNING: disables authentication)")
 	flag.StringVar(&conf.BindAddress, "b", interlock.BindAddress, "binding address:port pair")
-	flag.StringVar(&op, "o", "", "operation ((open:<volume>)|close|derive:<data>)")
+	flag.StringVar(&op, "o", "", "operation ((open:<volume>)|close|derive:<data>|keyaudit)")
 
 	var configPath = flag.String("c", "interlock.conf", "configuration file path")
 
@@ -15,7 +15,6 @@ import (
 	"crypto/sha256"
 	"errors"
 	"io"
-	"os"
 )
 
 // Symmetric file encryption using AES-256-CTR, key is derived from password
@@ -68,7 +67,7 @@ func (a *aes256CTR) SetPassword(password string) (err error) {
 	return
 }
 
-func (a *aes256CTR) Encrypt(input *os.File, output *os.File, sign bool) (err error) {
+func (a *aes256CTR) Encrypt(input io.Reader, output io.Writer, sign bool) (err error) {
 	if sign {
 		return errors.New("symmetric cipher does not support signing")
 	}
@@ -91,20 +90,26 @@ func (a *aes256CTR) Encrypt(input *os.File, output *os.File, sign bool) (err err
 	return
 }
 
-func (a *aes256CTR) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+func (a *aes256CTR) Decrypt(input io.Reader, output io.Writer, verify bool) (err error) {
 	if verify {
 		return errors.New("symmetric cipher does not support signature verification")
 	}
 
+	in, err := randomAccess(input)
+
+	if err != nil {
+		return
+	}
+
 	salt := make([]byte, 8)
-	_, err = io.ReadFull(input, salt)
+	_, err = io.ReadFull(in, salt)
 
 	if err != nil {
 		return
 	}
 
 	iv := make([]byte, aes.BlockSize)
-	_, err = io.ReadFull(input, iv)
+	_, err = io.ReadFull(in, iv)
 
 	if err != nil {
 		return
@@ -116,7 +121,7 @@ func (a *aes256CTR) Decrypt(input *os.File, output *os.File, verify bool) (err e
 		return
 	}
 
-	err = decryptCTR(key, salt, iv, input, output)
+	err = decryptCTR(key, salt, iv, in, output)
 
 	return
 }
@@ -135,11 +140,11 @@ func (a *aes256CTR) SetKey(k key) error {
 	return errors.New("symmetric cipher does not support key")
 }
 
-func (a *aes256CTR) Sign(i *os.File, o *os.File) error {
+func (a *aes256CTR) Sign(i io.Reader, o io.Writer) error {
 	return errors.New("symmetric cipher does not support signing")
 }
 
-func (a *aes256CTR) Verify(i *os.File, s *os.File) error {
+func (a *aes256CTR) Verify(i io.Reader, s io.Reader) error {
 	return errors.New("symmetric cipher does not support signature verification")
 }
 
@@ -148,7 +153,7 @@ func (a *aes256CTR) GenOTP(timestamp int64) (otp string, exp int64, err error) {
 	return
 }
 
-func encryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.File) (err error) {
+func encryptCTR(key []byte, salt []byte, iv []byte, input io.Reader, output io.Writer) (err error) {
 	block, err := aes.NewCipher(key)
 
 	if err != nil {
@@ -172,28 +177,9 @@ func encryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.F
 	mac.Write(iv)
 
 	stream := cipher.NewCTR(block, iv)
-	buf := make([]byte, 32*1024)
-
-	for {
-		n, er := input.Read(buf)
+	writer := &cipher.StreamWriter{S: stream, W: io.MultiWriter(output, mac)}
 
-		if n > 0 {
-			c := make([]byte, n)
-			stream.XORKeyStream(c, buf[0:n])
-
-			mac.Write(c)
-			output.Write(c)
-		}
-
-		if er == io.EOF {
-			break
-		}
-
-		if er != nil {
-			err = er
-			break
-		}
-	}
+	_, err = io.Copy(writer, input)
 
 	if err != nil {
 		return
@@ -204,20 +190,16 @@ func encryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.F
 	return
 }
 
-func decryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.File) (err error) {
+// decryptCTR authenticates the ciphertext, read from the current input
+// position, before decrypting it in a second pass.
+func decryptCTR(key []byte, salt []byte, iv []byte, input *io.SectionReader, output io.Writer) (err error) {
 	block, err := aes.NewCipher(key)
 
 	if err != nil {
 		return
 	}
 
-	stat, err := input.Stat()
-
-	if err != nil {
-		return
-	}
-
-	headerSize, err := input.Seek(0, 1)
+	headerSize, err := input.Seek(0, io.SeekCurrent)
 
 	if err != nil {
 		return
@@ -228,17 +210,20 @@ func decryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.F
 	mac.Write(iv)
 
 	macSize := int64(mac.Size())
-	limit := stat.Size() - headerSize - macSize
+	limit := input.Size() - headerSize - macSize
 
-	ciphertextReader := io.LimitReader(input, limit)
-	_, err = io.Copy(mac, ciphertextReader)
+	if limit < 0 {
+		return errors.New("invalid ciphertext size")
+	}
+
+	_, err = io.Copy(mac, io.NewSectionReader(input, headerSize, limit))
 
 	if err != nil {
 		return
 	}
 
 	inputMac := make([]byte, mac.Size())
-	_, err = input.ReadAt(inputMac, stat.Size()-macSize)
+	_, err = input.ReadAt(inputMac, input.Size()-macSize)
 
 	if err != nil {
 		return
@@ -251,15 +236,7 @@ func decryptCTR(key []byte, salt []byte, iv []byte, input *os.File, output *os.F
 	stream := cipher.NewCTR(block, iv)
 	writer := &cipher.StreamWriter{S: stream, W: output}
 
-	_, err = input.Seek(headerSize, 0)
-
-	if err != nil {
-		return
-	}
-
-	ciphertextReader = io.LimitReader(input, limit)
-
-	_, err = io.Copy(writer, ciphertextReader)
+	_, err = io.Copy(writer, io.NewSectionReader(input, headerSize, limit))
 
 	return
 }
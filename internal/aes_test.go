@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"io"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -57,3 +58,45 @@ func TestAes(t *testing.T) {
 	decrypted.Close()
 	os.Remove(decrypted.Name())
 }
+
+func TestAesBuffer(t *testing.T) {
+	password := "interlocktest"
+	cleartext := "01234567890ABCDEFGHILMNOPQRSTUVZ!@#"
+
+	a := &aes256CTR{}
+	a.SetPassword(password)
+
+	ciphertext := new(bytes.Buffer)
+	err := a.Encrypt(strings.NewReader(cleartext), ciphertext, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// non random access input must be rejected
+	err = a.Decrypt(io.MultiReader(bytes.NewReader(ciphertext.Bytes())), io.Discard, false)
+
+	if err == nil {
+		t.Error("sequential input accepted for decryption")
+	}
+
+	decrypted := new(bytes.Buffer)
+	err = a.Decrypt(bytes.NewReader(ciphertext.Bytes()), decrypted, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decrypted.String() != cleartext {
+		t.Error("cleartext and ciphertext differ")
+	}
+
+	tampered := ciphertext.Bytes()
+	tampered[len(tampered)/2] ^= 0xff
+
+	err = a.Decrypt(bytes.NewReader(tampered), io.Discard, false)
+
+	if err == nil {
+		t.Error("tampered ciphertext accepted")
+	}
+}
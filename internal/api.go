@@ -48,7 +48,8 @@ func registerHandlers() (err error) {
 
 func apiHandler(w http.ResponseWriter, r *http.Request) {
 	if conf.Debug {
-		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.RequestURI)
+		// the request URI is not logged as it might include tokens
+		log.Printf("%s %s %s", r.RemoteAddr, r.Method, r.URL.Path)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -79,6 +80,16 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 
 			switch u.Path {
 			case "/api/file/upload":
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			case "/api/status/stream":
+				// EventSource clients cannot set custom headers, the
+				// XSRF token is accepted as query parameter for this
+				// read only endpoint
+				if validSessionID && session.ValidXSRFToken(u.Query().Get("token")) {
+					statusStream(w, r)
+					break
+				}
+
 				http.Error(w, err.Error(), http.StatusUnauthorized)
 			case "/api/file/download":
 				// download is an exception as it is already
@@ -86,7 +97,7 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 				// handshake
 				if validSessionID {
 					p, _ := url.ParseQuery(u.RawQuery)
-					fileDownloadByID(w, p["id"][0])
+					fileDownloadByID(w, r, p["id"][0])
 					break
 				}
 				fallthrough
@@ -120,8 +131,18 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = timeRequest(r)
 	case "/api/file/list":
 		res = fileList(r)
+	case "/api/file/search":
+		res = fileSearch(r)
 	case "/api/file/upload":
 		fileUpload(w, r)
+	case "/api/file/upload_status":
+		res = fileUploadStatus(r)
+	case "/api/file/versions":
+		res = fileVersions(r)
+	case "/api/file/restore":
+		res = fileRestore(r)
+	case "/api/file/purge_versions":
+		res = filePurgeVersions(r)
 	case "/api/file/download":
 		res = fileDownload(r)
 	case "/api/file/delete":
@@ -132,10 +153,16 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = fileCopy(r)
 	case "/api/file/new":
 		res = fileNewfile(r)
+	case "/api/file/read":
+		res = fileRead(r)
+	case "/api/file/write":
+		res = fileWrite(r)
 	case "/api/file/mkdir":
 		res = fileMkdir(r)
 	case "/api/file/extract":
 		res = fileExtract(r)
+	case "/api/file/archive_list":
+		res = fileArchiveList(r)
 	case "/api/file/compress":
 		res = fileCompress(w, r)
 	case "/api/file/encrypt":
@@ -146,6 +173,12 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = fileSign(r)
 	case "/api/file/verify":
 		res = fileVerify(r)
+	case "/api/file/manifest":
+		res = fileManifest(r)
+	case "/api/file/manifest_verify":
+		res = fileManifestVerify(r)
+	case "/api/file/duplicates":
+		res = fileDuplicates(r)
 	case "/api/crypto/ciphers":
 		res = ciphers()
 	case "/api/crypto/keys":
@@ -156,6 +189,60 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 		res = uploadKey(r)
 	case "/api/crypto/key_info":
 		res = keyInfo(r)
+	case "/api/crypto/sign_data":
+		res = signData(r)
+	case "/api/crypto/decrypt_data":
+		res = decryptData(r)
+	case "/api/crypto/key_policy":
+		res = keyPolicyInfo(r)
+	case "/api/crypto/set_key_policy":
+		res = setKeyPolicy(r)
+	case "/api/crypto/audit":
+		res = keyAudit()
+	case "/api/crypto/key_store":
+		res = keyStoreInfo()
+	case "/api/crypto/unlock_key_store":
+		res = unlockKeyStore(r)
+	case "/api/crypto/lock_key_store":
+		res = lockKeyStore()
+	case "/api/vault/list":
+		res = vaultList(r)
+	case "/api/vault/search":
+		res = vaultSearch(r)
+	case "/api/vault/get":
+		res = vaultGet(r)
+	case "/api/vault/add":
+		res = vaultAdd(r)
+	case "/api/vault/update":
+		res = vaultUpdate(r)
+	case "/api/vault/delete":
+		res = vaultDelete(r)
+	case "/api/vault/generate":
+		res = vaultGenerate(r)
+	case "/api/vault/import":
+		res = vaultImportFile(r)
+	case "/api/kdbx/open":
+		res = kdbxOpen(r)
+	case "/api/kdbx/close":
+		res = kdbxClose(r)
+	case "/api/kdbx/groups":
+		res = kdbxGroups(r)
+	case "/api/kdbx/entries":
+		res = kdbxEntries(r)
+	case "/api/kdbx/reveal":
+		res = kdbxReveal(r)
+	case "/api/kdbx/otp":
+		res = kdbxOTP(r)
+	case "/api/kdbx/set":
+		res = kdbxSet(r)
+	case "/api/kdbx/save":
+		res = kdbxSave(r)
+	case "/api/jobs/list":
+		res = jobList()
+	case "/api/jobs/get":
+		res = jobGet(r)
+	case "/api/jobs/cancel":
+		res = jobCancel(r)
 	case "/api/status/version":
 		res = versionStatus()
 	case "/api/status/running":
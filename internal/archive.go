@@ -7,17 +7,83 @@
 package interlock
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
 	"log/syslog"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 )
 
-func zipWriter(src []string, dst io.Writer) (written int64, err error) {
+const (
+	_zip   = "zip"
+	_tar   = "tar"
+	_tarGz = "tar.gz"
+	_tarXz = "tar.xz"
+)
+
+var archiveExtensions = []struct {
+	ext    string
+	format string
+}{
+	{".zip", _zip},
+	{".tar", _tar},
+	{".tar.gz", _tarGz},
+	{".tgz", _tarGz},
+	{".tar.xz", _tarXz},
+	{".txz", _tarXz},
+}
+
+// archiveEntry represents a file or directory within an archive, the
+// entry contents can only be accessed within the walkArchive callback.
+type archiveEntry struct {
+	Name           string `json:"name"`
+	Dir            bool   `json:"dir"`
+	Size           int64  `json:"size"`
+	CompressedSize int64  `json:"compressed_size"`
+	Mtime          int64  `json:"mtime"`
+	Encrypted      bool   `json:"encrypted"`
+
+	mode    os.FileMode
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+func archiveFormat(p string) (format string, err error) {
+	name := strings.ToLower(p)
+
+	for _, a := range archiveExtensions {
+		if strings.HasSuffix(name, a.ext) {
+			return a.format, nil
+		}
+	}
+
+	return "", errors.New("unsupported archive format")
+}
+
+// excludedPath returns whether a traversed path must not be archived,
+// INTERLOCK metadata and private keys are never included.
+func excludedPath(osPath string) bool {
+	inKeyPath, private := detectKeyPath(osPath)
+	return metadataPath(osPath) || (inKeyPath && private)
+}
+
+func skipPath(info os.FileInfo) error {
+	if info.IsDir() {
+		return filepath.SkipDir
+	}
+
+	return nil
+}
+
+func zipWriter(src []string, dst io.Writer, password string, j *job) (written int64, err error) {
 	writer := zip.NewWriter(dst)
 	defer writer.Close()
 
@@ -29,6 +95,10 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 			return
 		}
 
+		if excludedPath(osPath) {
+			return skipPath(info)
+		}
+
 		if info.IsDir() {
 			// the downside of this optimization is that
 			// directories mtime is not preserved
@@ -47,20 +117,27 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 		relPath := strings.TrimPrefix(relativePath(osPath), "/")
 		fileHeader.Name = relPath
 
-		f, err = writer.CreateHeader(fileHeader)
+		input, err := os.Open(osPath)
 
 		if err != nil {
 			return
 		}
+		defer input.Close()
 
-		input, err := os.Open(osPath)
+		if password != "" {
+			w, err = createEncrypted(writer, fileHeader, j.Reader(input), password)
+			written += w
+
+			return
+		}
+
+		f, err = writer.CreateHeader(fileHeader)
 
 		if err != nil {
 			return
 		}
-		defer input.Close()
 
-		w, err = io.Copy(f, input)
+		w, err = io.Copy(f, j.Reader(input))
 		written += w
 
 		if err != nil {
@@ -84,105 +161,723 @@ func zipWriter(src []string, dst io.Writer) (written int64, err error) {
 	return
 }
 
-func zipPath(src []string, dst string) (err error) {
-	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+// pathSize returns the overall size of the files found under the argument
+// paths.
+func pathSize(src []string) (size int64) {
+	for _, s := range src {
+		_ = filepath.Walk(s, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				size += info.Size()
+			}
+
+			return nil
+		})
+	}
+
+	return
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func compressor(format string, dst io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case _tarGz:
+		return gzip.NewWriter(dst), nil
+	case _tarXz:
+		return xzCompressor(dst)
+	default:
+		return nopWriteCloser{dst}, nil
+	}
+}
+
+func decompressor(format string, src io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case _tarGz:
+		return gzip.NewReader(src)
+	case _tarXz:
+		return xzDecompressor(src)
+	default:
+		return io.NopCloser(src), nil
+	}
+}
+
+func tarWriter(src []string, dst io.Writer, format string, j *job) (written int64, err error) {
+	c, err := compressor(format, dst)
 
 	if err != nil {
 		return
 	}
 
-	go func() {
-		defer output.Close()
+	writer := tar.NewWriter(c)
 
-		_, err = zipWriter(src, output)
+	walkFn := func(osPath string, info os.FileInfo, e error) (err error) {
+		var w int64
+
+		if e != nil {
+			return e
+		}
+
+		if excludedPath(osPath) {
+			return skipPath(info)
+		}
+
+		// only directories and regular files are archived
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
-		status.Log(syslog.LOG_NOTICE, "completed compression to %s", relativePath(dst))
-	}()
+		header.Name = strings.TrimPrefix(relativePath(osPath), "/")
+
+		if header.Name == "" {
+			return
+		}
+
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		// ownership is not meaningful outside of the device
+		header.Uid = 0
+		header.Gid = 0
+		header.Uname = ""
+		header.Gname = ""
+
+		if err = writer.WriteHeader(header); err != nil {
+			return
+		}
+
+		if info.IsDir() {
+			return
+		}
+
+		n := status.Notify(syslog.LOG_NOTICE, "adding %s to archive", path.Base(osPath))
+		defer status.Remove(n)
+
+		input, err := os.Open(osPath)
+
+		if err != nil {
+			return
+		}
+		defer input.Close()
+
+		w, err = io.Copy(writer, j.Reader(input))
+		written += w
+
+		return
+	}
+
+	for _, s := range src {
+		n := status.Notify(syslog.LOG_NOTICE, "compressing %s", path.Base(s))
+		defer status.Remove(n)
+
+		err = filepath.Walk(s, walkFn)
+
+		if err != nil {
+			break
+		}
+	}
+
+	if e := writer.Close(); err == nil {
+		err = e
+	}
+
+	if e := c.Close(); err == nil {
+		err = e
+	}
 
 	return
 }
 
-func unzipFile(src string, dst string) (err error) {
-	reader, err := zip.OpenReader(src)
+// archiveWriter creates an archive, in the requested format, of the source
+// files and directories.
+func archiveWriter(src []string, dst io.Writer, format string, password string, j *job) (written int64, err error) {
+	if format == _zip {
+		return zipWriter(src, dst, password, j)
+	}
+
+	if password != "" {
+		return 0, errors.New("encryption is only supported for zip archives")
+	}
+
+	return tarWriter(src, dst, format, j)
+}
+
+func archivePath(src []string, dst string, password string) (id string, err error) {
+	format, err := archiveFormat(dst)
 
 	if err != nil {
 		return
 	}
 
-	err = os.MkdirAll(dst, 0700)
+	if password != "" && format != _zip {
+		return "", errors.New("encryption is only supported for zip archives")
+	}
+
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
 
 	if err != nil {
-		defer reader.Close()
 		return
 	}
 
-	go func() {
-		defer reader.Close()
+	id, err = jobs.Submit("compress", dst, pathSize(src), func(j *job) (result interface{}, err error) {
+		_, err = archiveWriter(src, output, format, password, j)
 
-		n := status.Notify(syslog.LOG_NOTICE, "extracting %s", relativePath(src))
-		defer status.Remove(n)
+		if e := output.Close(); err == nil {
+			err = e
+		}
 
-		for _, f := range reader.Reader.File {
-			if strings.Contains(f.Name, traversalPattern) {
-				status.Error(errors.New("path traversal detected"))
-				return
-			}
+		if err != nil {
+			os.Remove(dst)
+			return
+		}
 
-			dstPath := filepath.Join(dst, f.Name)
+		status.Log(syslog.LOG_NOTICE, "completed compression to %s", relativePath(dst))
 
-			if f.FileInfo().IsDir() {
-				err = os.MkdirAll(dstPath, f.Mode())
+		return relativePath(dst), nil
+	})
 
-				if err != nil {
-					status.Error(err)
-					return
+	if err != nil {
+		output.Close()
+	}
+
+	return
+}
+
+func walkZip(src string, password string, j *job, fn func(e *archiveEntry) error) (err error) {
+	reader, err := zip.OpenReader(src)
+
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	for _, f := range reader.Reader.File {
+		if err = j.Err(); err != nil {
+			return
+		}
+
+		f := f
+
+		e := &archiveEntry{
+			Name:           f.Name,
+			Dir:            f.FileInfo().IsDir(),
+			Size:           int64(f.UncompressedSize64),
+			CompressedSize: int64(f.CompressedSize64),
+			Mtime:          f.Modified.Unix(),
+			Encrypted:      f.Flags&zipEncrypted != 0,
+			mode:           f.Mode(),
+			modTime:        f.Modified,
+			open: func() (r io.ReadCloser, err error) {
+				if f.Flags&zipEncrypted != 0 {
+					r, err = openEncrypted(f, password)
+				} else {
+					r, err = f.Open()
 				}
-			} else {
-				err = os.MkdirAll(path.Dir(dstPath), 0700)
 
 				if err != nil {
-					status.Error(err)
 					return
 				}
 
-				n := status.Notify(syslog.LOG_NOTICE, "extracting %s from archive", f.Name)
-				defer status.Remove(n)
+				// progress is tracked on uncompressed data
+				return struct {
+					io.Reader
+					io.Closer
+				}{j.Reader(r), r}, nil
+			},
+		}
 
-				output, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, f.Mode())
+		if err = fn(e); err != nil {
+			return
+		}
+	}
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
-				defer output.Close()
+	return
+}
 
-				input, err := f.Open()
+func walkTar(src string, format string, j *job, fn func(e *archiveEntry) error) (err error) {
+	input, err := os.Open(src)
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
-				defer input.Close()
+	if err != nil {
+		return
+	}
+	defer input.Close()
 
-				_, err = io.Copy(output, input)
+	// progress is tracked on compressed data
+	d, err := decompressor(format, j.Reader(input))
 
-				if err != nil {
-					status.Error(err)
-					return
-				}
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if e := d.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	reader := tar.NewReader(d)
+
+	for {
+		header, err := reader.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// metadata headers (e.g. git archive global PAX headers)
+		// describe no file
+		switch header.Typeflag {
+		case tar.TypeXGlobalHeader, tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			continue
+		}
+
+		info := header.FileInfo()
+		mode := info.Mode()
+
+		// hard links carry no file type bits
+		if header.Typeflag == tar.TypeLink {
+			mode |= os.ModeIrregular
+		}
+
+		e := &archiveEntry{
+			Name:           header.Name,
+			Dir:            info.IsDir(),
+			Size:           header.Size,
+			CompressedSize: -1,
+			Mtime:          header.ModTime.Unix(),
+			mode:           mode,
+			modTime:        header.ModTime,
+			open: func() (io.ReadCloser, error) {
+				return io.NopCloser(reader), nil
+			},
+		}
+
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+// walkArchive invokes fn for each archive entry.
+func walkArchive(src string, password string, j *job, fn func(e *archiveEntry) error) (err error) {
+	format, err := archiveFormat(src)
+
+	if err != nil {
+		return
+	}
+
+	if format == _zip {
+		return walkZip(src, password, j, fn)
+	}
+
+	return walkTar(src, format, j, fn)
+}
 
-				output.Close()
-				os.Chtimes(dstPath, f.ModTime(), f.ModTime())
+// archiveSize returns the amount of data tracked for archive extraction
+// progress, zip archives account only for the selected entries.
+func archiveSize(src string, entries []string) (size int64, err error) {
+	format, err := archiveFormat(src)
+
+	if err != nil {
+		return
+	}
+
+	if format != _zip {
+		stat, err := os.Stat(src)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return stat.Size(), nil
+	}
+
+	sel := newEntrySelection(entries)
+
+	err = walkZip(src, "", nil, func(e *archiveEntry) error {
+		if sel.match(e.Name) {
+			size += e.Size
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// entrySelection tracks the archive entries selected for extraction, a
+// selected directory includes all of its contents.
+type entrySelection map[string]bool
+
+func newEntrySelection(entries []string) (s entrySelection) {
+	if len(entries) == 0 {
+		return
+	}
+
+	s = make(entrySelection)
+
+	for _, e := range entries {
+		s[strings.Trim(e, "/")] = false
+	}
+
+	return
+}
+
+// match returns whether the entry is selected, marking its selection as found.
+func (s entrySelection) match(name string) bool {
+	if s == nil {
+		return true
+	}
+
+	name = strings.Trim(name, "/")
+
+	for sel := range s {
+		if name == sel || strings.HasPrefix(name, sel+"/") {
+			s[sel] = true
+			return true
+		}
+	}
+
+	return false
+}
+
+// missing returns an error for the first selected entry not found.
+func (s entrySelection) missing() error {
+	for sel, found := range s {
+		if !found {
+			return fmt.Errorf("entry %s not found in archive", sel)
+		}
+	}
+
+	return nil
+}
+
+// minimum entry size subject to the compression ratio limit, small entries
+// can legitimately exhibit high ratios
+const extractRatioThreshold = 1 << 20
+
+// extractLimits tracks archive extraction against the configured limits, a
+// zero limit is treated as unlimited, and the destination free space.
+type extractLimits struct {
+	dst     string
+	entries int
+	size    int64
+	free    uint64
+	// archive size, set for formats without per entry compressed size
+	compressed int64
+}
+
+// check validates an archive entry, returning its destination path.
+func (l *extractLimits) check(e *archiveEntry) (dstPath string, err error) {
+	name := filepath.FromSlash(e.Name)
+
+	if filepath.IsAbs(name) || strings.HasPrefix(e.Name, "\\") {
+		return "", fmt.Errorf("absolute path in archive entry %s", e.Name)
+	}
+
+	dstPath = filepath.Join(l.dst, name)
+
+	if dstPath == l.dst {
+		return
+	}
+
+	if strings.Contains(e.Name, traversalPattern) || !strings.HasPrefix(dstPath, l.dst+"/") {
+		return "", errors.New("path traversal detected")
+	}
+
+	switch {
+	case e.mode&os.ModeSymlink != 0:
+		return "", fmt.Errorf("symbolic link in archive entry %s", e.Name)
+	case e.mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0:
+		return "", fmt.Errorf("special permissions in archive entry %s", e.Name)
+	case !e.Dir && !e.mode.IsRegular():
+		return "", fmt.Errorf("unsupported type for archive entry %s", e.Name)
+	}
+
+	l.entries++
+
+	if conf.ExtractMaxEntries > 0 && l.entries > conf.ExtractMaxEntries {
+		return "", fmt.Errorf("archive exceeds the maximum number of entries (%d)", conf.ExtractMaxEntries)
+	}
+
+	rel, _ := filepath.Rel(l.dst, dstPath)
+
+	if depth := len(strings.Split(rel, "/")); conf.ExtractMaxDepth > 0 && depth > conf.ExtractMaxDepth {
+		return "", fmt.Errorf("archive entry %s exceeds the maximum depth (%d)", e.Name, conf.ExtractMaxDepth)
+	}
+
+	if e.Dir {
+		return
+	}
+
+	if e.Size < 0 {
+		return "", fmt.Errorf("invalid size for archive entry %s", e.Name)
+	}
+
+	l.size += e.Size
+
+	if conf.ExtractMaxSize > 0 && l.size > conf.ExtractMaxSize {
+		return "", fmt.Errorf("archive exceeds the maximum extraction size (%d bytes)", conf.ExtractMaxSize)
+	}
+
+	if conf.ExtractMaxRatio > 0 && e.Size > extractRatioThreshold && e.CompressedSize >= 0 {
+		if e.CompressedSize == 0 || e.Size/e.CompressedSize > conf.ExtractMaxRatio {
+			return "", fmt.Errorf("archive entry %s exceeds the maximum compression ratio (%d)", e.Name, conf.ExtractMaxRatio)
+		}
+	}
+
+	// tar entries are compressed as a single stream, the ratio is
+	// therefore tracked on the total size against the archive one
+	if conf.ExtractMaxRatio > 0 && l.size > extractRatioThreshold && l.compressed > 0 {
+		if l.size/l.compressed > conf.ExtractMaxRatio {
+			return "", fmt.Errorf("archive exceeds the maximum compression ratio (%d)", conf.ExtractMaxRatio)
+		}
+	}
+
+	if uint64(l.size) > l.free {
+		return "", fmt.Errorf("insufficient free space for extraction (%d bytes required, %d available)", l.size, l.free)
+	}
+
+	return
+}
+
+// freeSpace returns the free space of the destination filesystem, the
+// destination is not required to exist yet.
+func freeSpace(dst string) (free uint64, err error) {
+	for _, err = os.Stat(dst); os.IsNotExist(err) && dst != filepath.Dir(dst); _, err = os.Stat(dst) {
+		dst = filepath.Dir(dst)
+	}
+
+	_, free, err = fsStatus(dst)
+
+	return
+}
+
+// createDir creates a directory, along with any missing parent, recording
+// the topmost created one for removal on failure. Each path component, within
+// the mount point, is created individually as symbolic links are not
+// followed.
+func createDir(dirPath string, perm os.FileMode, created *[]string) (err error) {
+	var info os.FileInfo
+	var top bool
+
+	rel, err := filepath.Rel(conf.MountPoint, dirPath)
+
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("invalid destination %s", dirPath)
+	}
+
+	d := conf.MountPoint
+
+	for _, c := range strings.Split(rel, string(filepath.Separator)) {
+		if c == "." {
+			continue
+		}
+
+		d = filepath.Join(d, c)
+		info, err = os.Lstat(d)
+
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("symbolic link in destination path %s", relativePath(d))
+		case err == nil && !info.IsDir():
+			return fmt.Errorf("%s is not a directory", relativePath(d))
+		case err == nil:
+			continue
+		case !os.IsNotExist(err):
+			return
+		}
+
+		// an existing path, including symbolic links, is never followed
+		if err = os.Mkdir(d, perm); err != nil {
+			return
+		}
+
+		if !top {
+			*created = append(*created, d)
+			top = true
+		}
+	}
+
+	return
+}
+
+// extractArchive extracts the archive contents, or only the selected entries
+// when specified, to the destination directory. Entries are validated against
+// the configured limits and any output created is removed on failure.
+func extractArchive(src string, dst string, password string, entries []string, j *job) (err error) {
+	var created []string
+	var dirs []*archiveEntry
+
+	dst = filepath.Clean(dst)
+	sel := newEntrySelection(entries)
+
+	format, err := archiveFormat(src)
+
+	if err != nil {
+		return
+	}
+
+	// free space is measured before any output is created
+	free, err := freeSpace(dst)
+
+	if err != nil {
+		return
+	}
+
+	limits := &extractLimits{dst: dst, free: free}
+
+	if format != _zip {
+		if limits.compressed, err = archiveSize(src, nil); err != nil {
+			return
+		}
+	}
+
+	// zip entries are listed upfront, allowing validation before any output
+	if format == _zip {
+		err = walkZip(src, password, nil, func(e *archiveEntry) (err error) {
+			if sel.match(e.Name) {
+				_, err = limits.check(e)
 			}
+
+			return
+		})
+
+		if err != nil {
+			return
+		}
+
+		if err = sel.missing(); err != nil {
+			return
+		}
+
+		limits = &extractLimits{dst: dst, free: free}
+	}
+
+	if err = createDir(dst, 0700, &created); err != nil {
+		return
+	}
+
+	defer func() {
+		if err == nil {
+			return
 		}
 
-		status.Log(syslog.LOG_NOTICE, "completed extraction of %s", relativePath(src))
+		for i := len(created) - 1; i >= 0; i-- {
+			os.RemoveAll(created[i])
+		}
 	}()
 
+	n := status.Notify(syslog.LOG_NOTICE, "extracting %s", relativePath(src))
+	defer status.Remove(n)
+
+	err = walkArchive(src, password, j, func(e *archiveEntry) (err error) {
+		if !sel.match(e.Name) {
+			return
+		}
+
+		dstPath, err := limits.check(e)
+
+		if err != nil {
+			return
+		}
+
+		if e.Dir {
+			dirs = append(dirs, e)
+			return createDir(dstPath, e.mode.Perm()|0700, &created)
+		}
+
+		if err = createDir(filepath.Dir(dstPath), 0700, &created); err != nil {
+			return
+		}
+
+		return extractEntry(e, dstPath, &created)
+	})
+
+	if err != nil {
+		return
+	}
+
+	if err = sel.missing(); err != nil {
+		return
+	}
+
+	// directory times are restored once their contents are in place
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(filepath.Join(dst, dirs[i].Name), dirs[i].modTime, dirs[i].modTime)
+	}
+
+	status.Log(syslog.LOG_NOTICE, "completed extraction of %s", relativePath(src))
+
+	return
+}
+
+func extractEntry(e *archiveEntry, dstPath string, created *[]string) (err error) {
+	n := status.Notify(syslog.LOG_NOTICE, "extracting %s from archive", e.Name)
+	defer status.Remove(n)
+
+	output, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, e.mode.Perm())
+
+	if err != nil {
+		return
+	}
+
+	*created = append(*created, dstPath)
+
+	input, err := e.open()
+
+	if err == nil {
+		var written int64
+
+		// the declared size is enforced regardless of the entry headers
+		written, err = io.Copy(output, io.LimitReader(input, e.Size+1))
+
+		if err == nil && written != e.Size {
+			err = fmt.Errorf("size mismatch for archive entry %s", e.Name)
+		}
+
+		input.Close()
+	}
+
+	if e := output.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	os.Chtimes(dstPath, e.modTime, e.modTime)
+
+	return
+}
+
+// listArchive returns the archive entries.
+func listArchive(src string) (entries []*archiveEntry, err error) {
+	entries = []*archiveEntry{}
+
+	err = walkArchive(src, "", nil, func(e *archiveEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+
 	return
 }
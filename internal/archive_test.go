@@ -0,0 +1,293 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testTar(t *testing.T, path string, headers []*tar.Header) {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+
+	for _, h := range headers {
+		if err := w.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+
+		w.Write(bytes.Repeat([]byte{0x41}, int(h.Size)))
+	}
+
+	w.Close()
+
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	valid := []*tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "dir/file", Typeflag: tar.TypeReg, Mode: 0600, Size: 16},
+	}
+
+	src := filepath.Join(conf.MountPoint, "valid.tar")
+	dst := filepath.Join(conf.MountPoint, "valid")
+	testTar(t, src, valid)
+
+	if err := extractArchive(src, dst, "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dst, "dir", "file")); len(data) != 16 {
+		t.Error("invalid extracted contents")
+	}
+
+	entries, err := listArchive(src)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[1].Name != "dir/file" || entries[1].Size != 16 || entries[1].CompressedSize != -1 {
+		t.Errorf("invalid archive listing %+v", entries)
+	}
+
+	dst = filepath.Join(conf.MountPoint, "selected")
+
+	if err := extractArchive(src, dst, "", []string{"dir/file"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(dst, "dir", "file")); len(data) != 16 {
+		t.Error("invalid selected contents")
+	}
+
+	dst = filepath.Join(conf.MountPoint, "missing")
+
+	if err := extractArchive(src, dst, "", []string{"dir/missing"}, nil); err == nil {
+		t.Error("missing entry accepted")
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+
+	// global PAX headers, as emitted by git archive, are not entries
+	src = filepath.Join(conf.MountPoint, "global.tar")
+	dst = filepath.Join(conf.MountPoint, "global")
+	global := &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": "0123456789abcdef"}}
+	testTar(t, src, append([]*tar.Header{global}, valid...))
+
+	if entries, err = listArchive(src); err != nil || len(entries) != 2 {
+		t.Errorf("invalid archive listing %+v (%v)", entries, err)
+	}
+
+	if err := extractArchive(src, dst, "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(dst, "pax_global_header")); !os.IsNotExist(err) {
+		t.Error("global header extracted as file")
+	}
+
+	invalid := map[string]*tar.Header{
+		"symlink":  {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		"hardlink": {Name: "link", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+		"absolute": {Name: "/tmp/file", Typeflag: tar.TypeReg, Mode: 0600},
+		"parent":   {Name: "..", Typeflag: tar.TypeDir, Mode: 0700},
+		"setuid":   {Name: "suid", Typeflag: tar.TypeReg, Mode: 04755},
+		"device":   {Name: "dev", Typeflag: tar.TypeChar, Mode: 0600},
+	}
+
+	for name, h := range invalid {
+		src := filepath.Join(conf.MountPoint, name+".tar")
+		dst := filepath.Join(conf.MountPoint, name)
+		testTar(t, src, append(valid, h))
+
+		if err := extractArchive(src, dst, "", nil, nil); err == nil {
+			t.Errorf("%s: invalid entry accepted", name)
+		}
+
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("%s: partial output left behind", name)
+		}
+	}
+
+	// existing destinations are preserved, only created output is removed
+	src = filepath.Join(conf.MountPoint, "symlink.tar")
+
+	if err := extractArchive(src, conf.MountPoint, "", nil, nil); err == nil {
+		t.Error("invalid entry accepted")
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.MountPoint, "dir")); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		t.Error("existing destination contents removed")
+	}
+
+	// symbolic links already in the destination are not followed
+	outside := t.TempDir()
+	os.Symlink(outside, filepath.Join(conf.MountPoint, "link"))
+	src = filepath.Join(conf.MountPoint, "escape.tar")
+	testTar(t, src, []*tar.Header{{Name: "link/file", Typeflag: tar.TypeReg, Mode: 0600, Size: 16}})
+
+	if err := extractArchive(src, conf.MountPoint, "", nil, nil); err == nil {
+		t.Error("symbolic link in destination followed")
+	}
+
+	if _, err := os.Stat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Error("output created outside destination")
+	}
+
+	conf.ExtractMaxEntries = 1
+	src = filepath.Join(conf.MountPoint, "valid.tar")
+
+	if err := extractArchive(src, filepath.Join(conf.MountPoint, "entries"), "", nil, nil); err == nil {
+		t.Error("entry limit not enforced")
+	}
+
+	conf.SetDefaults()
+	conf.ExtractMaxSize = 8
+
+	if err := extractArchive(src, filepath.Join(conf.MountPoint, "size"), "", nil, nil); err == nil {
+		t.Error("size limit not enforced")
+	}
+
+	conf.SetDefaults()
+
+	// highly compressible zip entry
+	buf := new(bytes.Buffer)
+	z := zip.NewWriter(buf)
+	f, _ := z.Create("zeros")
+	f.Write(make([]byte, 16<<20))
+	z.Close()
+
+	src = filepath.Join(conf.MountPoint, "ratio.zip")
+	dst = filepath.Join(conf.MountPoint, "ratio")
+	os.WriteFile(src, buf.Bytes(), 0600)
+
+	if err := extractArchive(src, dst, "", nil, nil); err == nil {
+		t.Error("ratio limit not enforced")
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("output created before validation")
+	}
+
+	// highly compressible tar.gz entries, each below the ratio threshold
+	var bomb []*tar.Header
+
+	for i := 0; i < 64; i++ {
+		bomb = append(bomb, &tar.Header{Name: fmt.Sprintf("file%d", i), Typeflag: tar.TypeReg, Mode: 0600, Size: 512 << 10})
+	}
+
+	src = filepath.Join(conf.MountPoint, "bomb.tar")
+	dst = filepath.Join(conf.MountPoint, "bomb")
+	testTar(t, src, bomb)
+
+	data, _ := os.ReadFile(src)
+	buf.Reset()
+	gz := gzip.NewWriter(buf)
+	gz.Write(data)
+	gz.Close()
+
+	src = filepath.Join(conf.MountPoint, "bomb.tar.gz")
+	os.WriteFile(src, buf.Bytes(), 0600)
+	conf.ExtractMaxRatio = 100
+
+	if err := extractArchive(src, dst, "", nil, nil); err == nil {
+		t.Error("tar.gz ratio limit not enforced")
+	}
+
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("partial output left behind")
+	}
+
+	conf.SetDefaults()
+}
+
+func TestArchiveXz(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	src := filepath.Join(conf.MountPoint, "src")
+	dst := filepath.Join(conf.MountPoint, "src.tar.xz")
+	contents := bytes.Repeat([]byte("interlock"), 4096)
+
+	os.Mkdir(src, 0700)
+	os.WriteFile(filepath.Join(src, "file"), contents, 0600)
+
+	buf := new(bytes.Buffer)
+
+	if _, err := archiveWriter([]string{src}, buf, _tarXz, "", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	os.WriteFile(dst, buf.Bytes(), 0600)
+
+	// interoperability with the xz utility, when available
+	if _, err := exec.LookPath("xz"); err == nil {
+		if err := exec.Command("xz", "-t", dst).Run(); err != nil {
+			t.Errorf("xz utility rejected archive (%v)", err)
+		}
+	}
+
+	if entries, err := listArchive(dst); err != nil || len(entries) != 2 {
+		t.Errorf("invalid archive listing %+v (%v)", entries, err)
+	}
+
+	if err := extractArchive(dst, filepath.Join(conf.MountPoint, "extracted"), "", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(conf.MountPoint, "extracted", "src", "file")); !bytes.Equal(data, contents) {
+		t.Error("invalid extracted contents")
+	}
+
+	// corrupted stream check, past the end of the tar archive
+	data := bytes.Clone(buf.Bytes())
+	data[len(data)-20] ^= 0xff
+	os.WriteFile(dst, data, 0600)
+
+	if _, err := listArchive(dst); err == nil {
+		t.Error("corrupted xz stream accepted")
+	}
+
+	// excessive dictionary size (4 GiB) in the block header
+	data = bytes.Clone(buf.Bytes())
+	header := data[xzHeaderSize : xzHeaderSize+(int(data[xzHeaderSize])+1)*4]
+	i := bytes.Index(header, []byte{xzFilterLZMA, 0x01})
+
+	if i < 0 {
+		t.Fatal("LZMA2 filter not found")
+	}
+
+	header[i+2] = 40
+	binary.LittleEndian.PutUint32(header[len(header)-4:], crc32.ChecksumIEEE(header[:len(header)-4]))
+	os.WriteFile(dst, data, 0600)
+
+	if _, err := listArchive(dst); err == nil {
+		t.Error("excessive xz dictionary size accepted")
+	}
+}
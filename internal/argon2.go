@@ -0,0 +1,367 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Argon2 memory-hard key derivation (RFC9106, version 0x13).
+//
+// The golang.org/x/crypto/argon2 package only exposes the Argon2i and Argon2id
+// variants, KeePass databases are commonly protected with Argon2d which is
+// therefore implemented here for all variants.
+
+const (
+	argon2d  = 0
+	argon2i  = 1
+	argon2id = 2
+
+	argon2Version    = 0x13
+	argon2BlockSize  = 1024
+	argon2Words      = argon2BlockSize / 8
+	argon2SyncPoints = 4
+)
+
+type argon2Block [argon2Words]uint64
+
+// argon2Key derives a key of the specified length, memory is expressed in
+// KiB.
+func argon2Key(mode int, password []byte, salt []byte, secret []byte, data []byte, time uint32, memory uint32, threads uint8, keyLen uint32) []byte {
+	key, _ := argon2KeyCheck(mode, password, salt, secret, data, time, memory, threads, keyLen, nil)
+	return key
+}
+
+// argon2KeyCheck derives a key as argon2Key, the check function, if any, is
+// invoked at every synchronization point and interrupts the derivation when
+// returning an error.
+func argon2KeyCheck(mode int, password []byte, salt []byte, secret []byte, data []byte, time uint32, memory uint32, threads uint8, keyLen uint32, check func() error) ([]byte, error) {
+	if time < 1 || threads < 1 {
+		panic("argon2: invalid parameters")
+	}
+
+	h0 := argon2InitHash(mode, password, salt, secret, data, time, memory, uint32(threads), keyLen)
+
+	if memory < 2*argon2SyncPoints*uint32(threads) {
+		memory = 2 * argon2SyncPoints * uint32(threads)
+	}
+
+	memory = memory / (argon2SyncPoints * uint32(threads)) * (argon2SyncPoints * uint32(threads))
+	B := argon2InitBlocks(h0, memory, uint32(threads))
+
+	if err := argon2Fill(B, mode, time, memory, uint32(threads), check); err != nil {
+		return nil, err
+	}
+
+	return argon2Extract(B, memory, uint32(threads), keyLen), nil
+}
+
+func argon2InitHash(mode int, password []byte, salt []byte, secret []byte, data []byte, time uint32, memory uint32, threads uint32, keyLen uint32) (h0 [blake2b.Size + 8]byte) {
+	var params [24]byte
+	var tmp [4]byte
+
+	h, _ := blake2b.New512(nil)
+
+	binary.LittleEndian.PutUint32(params[0:4], threads)
+	binary.LittleEndian.PutUint32(params[4:8], keyLen)
+	binary.LittleEndian.PutUint32(params[8:12], memory)
+	binary.LittleEndian.PutUint32(params[12:16], time)
+	binary.LittleEndian.PutUint32(params[16:20], argon2Version)
+	binary.LittleEndian.PutUint32(params[20:24], uint32(mode))
+	h.Write(params[:])
+
+	for _, v := range [][]byte{password, salt, secret, data} {
+		binary.LittleEndian.PutUint32(tmp[:], uint32(len(v)))
+		h.Write(tmp[:])
+		h.Write(v)
+	}
+
+	h.Sum(h0[:0])
+
+	return
+}
+
+func argon2InitBlocks(h0 [blake2b.Size + 8]byte, memory uint32, threads uint32) []argon2Block {
+	var block [argon2BlockSize]byte
+
+	B := make([]argon2Block, memory)
+
+	for lane := uint32(0); lane < threads; lane++ {
+		j := lane * (memory / threads)
+		binary.LittleEndian.PutUint32(h0[blake2b.Size+4:], lane)
+
+		for i := uint32(0); i < 2; i++ {
+			binary.LittleEndian.PutUint32(h0[blake2b.Size:], i)
+			argon2Hash(block[:], h0[:])
+
+			for k := range B[j+i] {
+				B[j+i][k] = binary.LittleEndian.Uint64(block[k*8:])
+			}
+		}
+	}
+
+	return B
+}
+
+func argon2Fill(B []argon2Block, mode int, time uint32, memory uint32, threads uint32, check func() error) error {
+	var wg sync.WaitGroup
+
+	lanes := memory / threads
+	segments := lanes / argon2SyncPoints
+
+	processSegment := func(n, slice, lane uint32) {
+		var addresses, in, zero argon2Block
+
+		independent := mode == argon2i || (mode == argon2id && n == 0 && slice < argon2SyncPoints/2)
+
+		if independent {
+			in[0] = uint64(n)
+			in[1] = uint64(lane)
+			in[2] = uint64(slice)
+			in[3] = uint64(memory)
+			in[4] = uint64(time)
+			in[5] = uint64(mode)
+		}
+
+		index := uint32(0)
+
+		if n == 0 && slice == 0 {
+			index = 2
+
+			if independent {
+				in[6]++
+				argon2ProcessBlock(&addresses, &in, &zero)
+				argon2ProcessBlock(&addresses, &addresses, &zero)
+			}
+		}
+
+		offset := lane*lanes + slice*segments + index
+
+		for ; index < segments; index, offset = index+1, offset+1 {
+			prev := offset - 1
+
+			if index == 0 && slice == 0 {
+				prev += lanes
+			}
+
+			var random uint64
+
+			if independent {
+				if index%argon2Words == 0 {
+					in[6]++
+					argon2ProcessBlock(&addresses, &in, &zero)
+					argon2ProcessBlock(&addresses, &addresses, &zero)
+				}
+
+				random = addresses[index%argon2Words]
+			} else {
+				random = B[prev][0]
+			}
+
+			ref := argon2IndexAlpha(random, lanes, segments, threads, n, slice, lane, index)
+
+			if n == 0 {
+				argon2ProcessBlock(&B[offset], &B[prev], &B[ref])
+			} else {
+				argon2ProcessBlockXOR(&B[offset], &B[prev], &B[ref])
+			}
+		}
+	}
+
+	for n := uint32(0); n < time; n++ {
+		for slice := uint32(0); slice < argon2SyncPoints; slice++ {
+			if check != nil {
+				if err := check(); err != nil {
+					return err
+				}
+			}
+
+			for lane := uint32(0); lane < threads; lane++ {
+				wg.Add(1)
+
+				go func(n, slice, lane uint32) {
+					defer wg.Done()
+					processSegment(n, slice, lane)
+				}(n, slice, lane)
+			}
+
+			wg.Wait()
+		}
+	}
+
+	return nil
+}
+
+func argon2IndexAlpha(random uint64, lanes, segments, threads, n, slice, lane, index uint32) uint32 {
+	refLane := uint32(random>>32) % threads
+
+	if n == 0 && slice == 0 {
+		refLane = lane
+	}
+
+	m, s := 3*segments, ((slice+1)%argon2SyncPoints)*segments
+
+	if lane == refLane {
+		m += index
+	}
+
+	if n == 0 {
+		m, s = slice*segments, 0
+
+		if slice == 0 || lane == refLane {
+			m += index
+		}
+	}
+
+	if index == 0 || lane == refLane {
+		m--
+	}
+
+	x := random & 0xffffffff
+	x = (x * x) >> 32
+	x = (uint64(m) * x) >> 32
+
+	return refLane*lanes + (s+m-uint32(x+1))%lanes
+}
+
+func argon2Extract(B []argon2Block, memory uint32, threads uint32, keyLen uint32) []byte {
+	lanes := memory / threads
+
+	for lane := uint32(0); lane < threads-1; lane++ {
+		for i, v := range B[(lane*lanes)+lanes-1] {
+			B[memory-1][i] ^= v
+		}
+	}
+
+	var block [argon2BlockSize]byte
+
+	for i, v := range B[memory-1] {
+		binary.LittleEndian.PutUint64(block[i*8:], v)
+	}
+
+	key := make([]byte, keyLen)
+	argon2Hash(key, block[:])
+
+	return key
+}
+
+// argon2Hash implements the variable length hash function H'.
+func argon2Hash(out []byte, in []byte) {
+	var b [blake2b.Size]byte
+	var length [4]byte
+
+	binary.LittleEndian.PutUint32(length[:], uint32(len(out)))
+
+	if len(out) <= blake2b.Size {
+		h, _ := blake2b.New(len(out), nil)
+		h.Write(length[:])
+		h.Write(in)
+		h.Sum(out[:0])
+		return
+	}
+
+	h, _ := blake2b.New512(nil)
+	h.Write(length[:])
+	h.Write(in)
+	h.Sum(b[:0])
+
+	r := (len(out)+31)/32 - 2
+	copy(out, b[:32])
+
+	for i := 1; i < r; i++ {
+		b = blake2b.Sum512(b[:])
+		copy(out[i*32:], b[:32])
+	}
+
+	h, _ = blake2b.New(len(out)-32*r, nil)
+	h.Write(b[:])
+	h.Sum(out[32*r : 32*r])
+}
+
+func argon2ProcessBlock(out, in1, in2 *argon2Block) {
+	argon2ProcessBlockGeneric(out, in1, in2, false)
+}
+
+func argon2ProcessBlockXOR(out, in1, in2 *argon2Block) {
+	argon2ProcessBlockGeneric(out, in1, in2, true)
+}
+
+// argon2ProcessBlockGeneric implements the compression function G.
+func argon2ProcessBlockGeneric(out, in1, in2 *argon2Block, xor bool) {
+	var t argon2Block
+
+	for i := range t {
+		t[i] = in1[i] ^ in2[i]
+	}
+
+	for i := 0; i < argon2Words; i += 16 {
+		argon2Blamka(
+			&t[i+0], &t[i+1], &t[i+2], &t[i+3],
+			&t[i+4], &t[i+5], &t[i+6], &t[i+7],
+			&t[i+8], &t[i+9], &t[i+10], &t[i+11],
+			&t[i+12], &t[i+13], &t[i+14], &t[i+15],
+		)
+	}
+
+	for i := 0; i < argon2Words/8; i += 2 {
+		argon2Blamka(
+			&t[i], &t[i+1], &t[16+i], &t[16+i+1],
+			&t[32+i], &t[32+i+1], &t[48+i], &t[48+i+1],
+			&t[64+i], &t[64+i+1], &t[80+i], &t[80+i+1],
+			&t[96+i], &t[96+i+1], &t[112+i], &t[112+i+1],
+		)
+	}
+
+	if xor {
+		for i := range t {
+			out[i] ^= in1[i] ^ in2[i] ^ t[i]
+		}
+	} else {
+		for i := range t {
+			out[i] = in1[i] ^ in2[i] ^ t[i]
+		}
+	}
+}
+
+func argon2Blamka(t00, t01, t02, t03, t04, t05, t06, t07, t08, t09, t10, t11, t12, t13, t14, t15 *uint64) {
+	v00, v01, v02, v03 := *t00, *t01, *t02, *t03
+	v04, v05, v06, v07 := *t04, *t05, *t06, *t07
+	v08, v09, v10, v11 := *t08, *t09, *t10, *t11
+	v12, v13, v14, v15 := *t12, *t13, *t14, *t15
+
+	v00, v04, v08, v12 = argon2GB(v00, v04, v08, v12)
+	v01, v05, v09, v13 = argon2GB(v01, v05, v09, v13)
+	v02, v06, v10, v14 = argon2GB(v02, v06, v10, v14)
+	v03, v07, v11, v15 = argon2GB(v03, v07, v11, v15)
+
+	v00, v05, v10, v15 = argon2GB(v00, v05, v10, v15)
+	v01, v06, v11, v12 = argon2GB(v01, v06, v11, v12)
+	v02, v07, v08, v13 = argon2GB(v02, v07, v08, v13)
+	v03, v04, v09, v14 = argon2GB(v03, v04, v09, v14)
+
+	*t00, *t01, *t02, *t03 = v00, v01, v02, v03
+	*t04, *t05, *t06, *t07 = v04, v05, v06, v07
+	*t08, *t09, *t10, *t11 = v08, v09, v10, v11
+	*t12, *t13, *t14, *t15 = v12, v13, v14, v15
+}
+
+func argon2GB(a, b, c, d uint64) (uint64, uint64, uint64, uint64) {
+	a += b + 2*uint64(uint32(a))*uint64(uint32(b))
+	d = bits.RotateLeft64(d^a, -32)
+	c += d + 2*uint64(uint32(c))*uint64(uint32(d))
+	b = bits.RotateLeft64(b^c, -24)
+	a += b + 2*uint64(uint32(a))*uint64(uint32(b))
+	d = bits.RotateLeft64(d^a, -16)
+	c += d + 2*uint64(uint32(c))*uint64(uint32(d))
+	b = bits.RotateLeft64(b^c, -63)
+
+	return a, b, c, d
+}
@@ -0,0 +1,38 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestArgon2(t *testing.T) {
+	password := bytes.Repeat([]byte{0x01}, 32)
+	salt := bytes.Repeat([]byte{0x02}, 16)
+	secret := bytes.Repeat([]byte{0x03}, 8)
+	data := bytes.Repeat([]byte{0x04}, 12)
+
+	// RFC9106 Section 5.1 test vector
+	expected := "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb"
+
+	if tag := argon2Key(argon2d, password, salt, secret, data, 3, 32, 4, 32); hex.EncodeToString(tag) != expected {
+		t.Errorf("Argon2d test vector mismatch (%x)", tag)
+	}
+
+	// cross check against the x/crypto implementation
+	if !bytes.Equal(argon2Key(argon2i, password, salt, nil, nil, 3, 64, 2, 32), argon2.Key(password, salt, 3, 64, 2, 32)) {
+		t.Error("Argon2i mismatch")
+	}
+
+	if !bytes.Equal(argon2Key(argon2id, password, salt, nil, nil, 2, 1024, 3, 64), argon2.IDKey(password, salt, 2, 1024, 3, 64)) {
+		t.Error("Argon2id mismatch")
+	}
+}
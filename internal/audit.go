@@ -0,0 +1,104 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"fmt"
+	"log/syslog"
+	"sort"
+)
+
+type keyFinding struct {
+	Key      key             `json:"key"`
+	Severity syslog.Priority `json:"severity"`
+	Message  string          `json:"msg"`
+}
+
+func severityName(severity syslog.Priority) (name string) {
+	switch {
+	case severity <= syslog.LOG_ERR:
+		name = "error"
+	case severity == syslog.LOG_WARNING:
+		name = "warning"
+	default:
+		name = "info"
+	}
+
+	return
+}
+
+func auditKey(cipher cipherInterface, k key) (findings []keyFinding) {
+	auditor, ok := cipher.New().(auditInterface)
+
+	if !ok {
+		return
+	}
+
+	findings, err := auditor.AuditKey(k)
+
+	if err != nil {
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_ERR,
+			Message:  fmt.Sprintf("unusable key: %v", err),
+		})
+	}
+
+	for i := range findings {
+		findings[i].Key = k
+	}
+
+	return
+}
+
+func auditKeys() (findings []keyFinding) {
+	for _, cipher := range conf.enabledCiphers {
+		if cipher.GetInfo().KeyFormat == "password" {
+			continue
+		}
+
+		for _, private := range []bool{false, true} {
+			keys, err := getKeys(cipher, private, "")
+
+			if err != nil {
+				findings = append(findings, keyFinding{
+					Key:      key{Cipher: cipher.GetInfo().Name, Private: private},
+					Severity: syslog.LOG_ERR,
+					Message:  fmt.Sprintf("could not walk key storage: %v", err),
+				})
+			}
+
+			for _, k := range keys {
+				findings = append(findings, auditKey(cipher, k)...)
+			}
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Severity != findings[j].Severity {
+			return findings[i].Severity < findings[j].Severity
+		}
+
+		return findings[i].Key.Path < findings[j].Key.Path
+	})
+
+	return
+}
+
+func keyAudit() (res jsonObject) {
+	findings := auditKeys()
+
+	if findings == nil {
+		findings = []keyFinding{}
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": findings,
+	}
+
+	return
+}
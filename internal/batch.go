@@ -0,0 +1,169 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type batchResult struct {
+	Path   string `json:"path"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchFunc processes a single file of a batch, returning its output path.
+type batchFunc func(j *job, src string) (output string, err error)
+
+// sourcePaths returns the request source paths and the files they refer to,
+// the "src" attribute can be either a single path or an array of paths.
+// Directories are traversed recursively, the optional filter selects which
+// of the files found in directories are included.
+func sourcePaths(req jsonObject, filter func(string) bool) (src []string, files []string, err error) {
+	switch v := req["src"].(type) {
+	case string:
+		src = []string{v}
+	case []interface{}:
+		for _, p := range v {
+			s, ok := p.(string)
+
+			if !ok {
+				return nil, nil, errors.New("invalid attribute src (s|a)")
+			}
+
+			src = append(src, s)
+		}
+	case nil:
+		return nil, nil, errors.New("missing attribute src")
+	default:
+		return nil, nil, errors.New("invalid attribute src (s|a)")
+	}
+
+	for i := range src {
+		src[i], err = absolutePath(src[i])
+
+		if err != nil {
+			return
+		}
+
+		f, err := treeFiles(src[i], filter)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files = append(files, f...)
+	}
+
+	if len(files) == 0 {
+		err = errors.New("no files to process")
+	}
+
+	return
+}
+
+// treeFiles returns the regular files found, in lexical order, under root,
+// which is returned itself if a regular file. The optional filter selects
+// which of the files found in directories are included.
+func treeFiles(root string, filter func(string) bool) (files []string, err error) {
+	err = filepath.Walk(root, func(osPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if osPath == root {
+			if info.Mode().IsRegular() {
+				files = append(files, osPath)
+			}
+
+			return nil
+		}
+
+		if internalPath(osPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.Mode().IsRegular() && (filter == nil || filter(osPath)) {
+			files = append(files, osPath)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+// transformFile runs fn over the source file and a newly created output
+// file, which is removed on failure.
+func transformFile(src string, dst string, fn func(input *os.File, output *os.File) error) (err error) {
+	input, err := os.Open(src)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+
+	if err != nil {
+		return
+	}
+
+	err = fn(input, output)
+
+	if e := output.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return
+}
+
+// batchJob submits a job which processes each file in turn, the job result
+// reports the outcome for each file.
+func batchJob(op string, src []string, files []string, fn batchFunc) (id string, err error) {
+	return jobs.Submit(op, src[0], pathSize(files), func(j *job) (result interface{}, err error) {
+		var failed int
+
+		results := []batchResult{}
+
+		for _, f := range files {
+			if err = j.Err(); err != nil {
+				return results, err
+			}
+
+			res := batchResult{Path: relativePath(f)}
+			output, e := fn(j, f)
+
+			if e != nil {
+				failed++
+				res.Error = e.Error()
+				status.Error(fmt.Errorf("%s %s: %v", op, relativePath(f), e))
+			} else if output != "" {
+				res.Output = relativePath(output)
+			}
+
+			results = append(results, res)
+		}
+
+		if failed > 0 {
+			err = fmt.Errorf("%s failed for %d of %d file(s)", op, failed, len(files))
+		}
+
+		return results, err
+	})
+}
@@ -161,7 +161,7 @@ func (a *aes256CAAM) SetPassword(password string) (err error) {
 	return
 }
 
-func (a *aes256CAAM) Encrypt(input *os.File, output *os.File, sign bool) (err error) {
+func (a *aes256CAAM) Encrypt(input io.Reader, output io.Writer, sign bool) (err error) {
 	if sign {
 		return errors.New("symmetric cipher does not support signing")
 	}
@@ -169,7 +169,7 @@ func (a *aes256CAAM) Encrypt(input *os.File, output *os.File, sign bool) (err er
 	return CAAMEncrypt(a.password, input, output)
 }
 
-func (a *aes256CAAM) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+func (a *aes256CAAM) Decrypt(input io.Reader, output io.Writer, verify bool) (err error) {
 	if verify {
 		return errors.New("symmetric cipher does not support signature verification")
 	}
@@ -191,11 +191,11 @@ func (a *aes256CAAM) SetKey(k key) error {
 	return errors.New("symmetric cipher does not support key")
 }
 
-func (a *aes256CAAM) Sign(i *os.File, o *os.File) error {
+func (a *aes256CAAM) Sign(i io.Reader, o io.Writer) error {
 	return errors.New("symmetric cipher does not support signing")
 }
 
-func (a *aes256CAAM) Verify(i *os.File, s *os.File) error {
+func (a *aes256CAAM) Verify(i io.Reader, s io.Reader) error {
 	return errors.New("symmetric cipher does not support signature verification")
 }
 
@@ -309,7 +309,7 @@ func CAAMDeriveKey(diversifier []byte, iv []byte) (key []byte, err error) {
 	return
 }
 
-func CAAMEncrypt(password string, input *os.File, output *os.File) (err error) {
+func CAAMEncrypt(password string, input io.Reader, output io.Writer) (err error) {
 	var blob []byte
 
 	// Generate a random AES-256-CTR file encryption key, to be protected
@@ -354,25 +354,31 @@ func CAAMEncrypt(password string, input *os.File, output *os.File) (err error) {
 	return encryptCTR(key, salt, iv, input, output)
 }
 
-func CAAMDecrypt(password string, input *os.File, output *os.File) (err error) {
+func CAAMDecrypt(password string, input io.Reader, output io.Writer) (err error) {
 	var key []byte
 
+	in, err := randomAccess(input)
+
+	if err != nil {
+		return
+	}
+
 	blob := make([]byte, derivedKeySize+BLOB_OVERHEAD)
-	_, err = io.ReadFull(input, blob)
+	_, err = io.ReadFull(in, blob)
 
 	if err != nil {
 		return
 	}
 
 	salt := make([]byte, 8)
-	_, err = io.ReadFull(input, salt)
+	_, err = io.ReadFull(in, salt)
 
 	if err != nil {
 		return
 	}
 
 	iv := make([]byte, aes.BlockSize)
-	_, err = io.ReadFull(input, iv)
+	_, err = io.ReadFull(in, iv)
 
 	if err != nil {
 		return
@@ -393,7 +399,7 @@ func CAAMDecrypt(password string, input *os.File, output *os.File) (err error) {
 		return
 	}
 
-	return decryptCTR(key, salt, iv, input, output)
+	return decryptCTR(key, salt, iv, in, output)
 }
 
 func CAAMOp(mode, arg uintptr) (err error) {
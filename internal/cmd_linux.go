@@ -63,20 +63,6 @@ func setTime(epoch int64) (err error) {
 	return
 }
 
-func cp(src string, dst string) (err error) {
-	args := []string{"-ra", src, dst}
-	_, err = execCommand("/bin/cp", args, false, "")
-
-	return
-}
-
-func mv(src string, dst string) (err error) {
-	args := []string{src, dst}
-	_, err = execCommand("/bin/mv", args, false, "")
-
-	return
-}
-
 func poweroff() {
 	go func() {
 		_, _ = execCommand("/sbin/poweroff", []string{}, true, "")
@@ -37,11 +37,31 @@ type Config struct {
 	VolumeGroup string   `json:"volume_group"`
 	Ciphers     []string `json:"ciphers"`
 
+	KeyStore        bool `json:"key_store"`
+	KeyStoreTimeout int  `json:"key_store_timeout"`
+
+	Jobs       int  `json:"jobs"`
+	SecureWipe bool `json:"secure_wipe"`
+
+	ExtractMaxSize    int64 `json:"extract_max_size"`
+	ExtractMaxRatio   int64 `json:"extract_max_ratio"`
+	ExtractMaxEntries int   `json:"extract_max_entries"`
+	ExtractMaxDepth   int   `json:"extract_max_depth"`
+
+	Versioning     bool `json:"versioning"`
+	VersionsMax    int  `json:"versions_max"`
+	VersionsMaxAge int  `json:"versions_max_age"`
+
+	TextMaxSize int64 `json:"text_max_size"`
+
+	KDBXTimeout int `json:"kdbx_timeout"`
+
 	availableCiphers map[string]cipherInterface
 	enabledCiphers   map[string]cipherInterface
 	availableHSMs    map[string]HSMInterface
 	authHSM          HSMInterface
 	tlsHSM           HSMInterface
+	keysHSM          HSMInterface
 	MountPoint       string
 	TestMode         bool
 	logFile          *os.File
@@ -155,6 +175,8 @@ func (c *Config) EnableHSM() (err error) {
 				c.authHSM = HSM
 			case "tls":
 				c.tlsHSM = HSM
+			case "keys":
+				c.keysHSM = HSM
 			case "cipher":
 				cipher := HSM.Cipher()
 				c.SetAvailableCipher(cipher)
@@ -189,6 +211,19 @@ func (c *Config) SetDefaults() {
 	c.Ciphers = []string{"OpenPGP", "AES-256-CTR", "TOTP"}
 	c.TestMode = false
 	c.VolumeGroup = "lvmvolume"
+	c.KeyStore = false
+	c.KeyStoreTimeout = 300
+	c.Jobs = 2
+	c.SecureWipe = false
+	c.ExtractMaxSize = 4 << 30
+	c.ExtractMaxRatio = 1000
+	c.ExtractMaxEntries = 65536
+	c.ExtractMaxDepth = 64
+	c.Versioning = false
+	c.VersionsMax = 10
+	c.VersionsMaxAge = 30
+	c.TextMaxSize = 1 << 20
+	c.KDBXTimeout = 300
 }
 
 func (c *Config) SetMountPoint() error {
@@ -0,0 +1,252 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// pathError returns a structured error for the operation on the path, the
+// path is reported relative to the encrypted volume.
+func pathError(op string, osPath string, err error) error {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+
+	switch {
+	case errors.As(err, &pathErr):
+		err = pathErr.Err
+	case errors.As(err, &linkErr):
+		err = linkErr.Err
+	}
+
+	return &fs.PathError{Op: op, Path: relativePath(osPath), Err: err}
+}
+
+// opTarget returns the destination path for a copy or move of src to dst,
+// which follows cp/mv semantics: when dst is an existing directory src is
+// placed within it, existing files are never replaced.
+func opTarget(src string, dst string) (target string, err error) {
+	if inKeyPath, private := detectKeyPath(src); inKeyPath && private {
+		return "", errors.New("cannot move or copy private key(s)")
+	}
+
+	if policyFile(src) || policyFile(dst) {
+		return "", errors.New("cannot move or copy key policies")
+	}
+
+	if _, err = os.Lstat(src); err != nil {
+		return "", pathError("stat", src, err)
+	}
+
+	target = dst
+	stat, err := os.Stat(dst)
+
+	switch {
+	case err == nil && !stat.IsDir():
+		return "", fmt.Errorf("path %s exists", relativePath(dst))
+	case err == nil:
+		target = filepath.Join(dst, filepath.Base(src))
+
+		if _, err = os.Lstat(target); err == nil {
+			return "", fmt.Errorf("path %s exists", relativePath(target))
+		}
+	}
+
+	if policyFile(target) {
+		return "", errors.New("cannot move or copy key policies")
+	}
+
+	if target == src || strings.HasPrefix(target, src+"/") {
+		return "", fmt.Errorf("cannot copy or move %s into itself", relativePath(src))
+	}
+
+	return target, nil
+}
+
+// copyFile copies a regular file, preserving its permissions and
+// modification time.
+func copyFile(src string, dst string, info os.FileInfo, j *job) (err error) {
+	input, err := os.Open(src)
+
+	if err != nil {
+		return pathError("open", src, err)
+	}
+	defer input.Close()
+
+	output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+
+	if err != nil {
+		return pathError("create", dst, err)
+	}
+
+	if _, err = io.Copy(j.Writer(output), input); err != nil {
+		err = pathError("copy", src, err)
+	}
+
+	if e := output.Close(); err == nil && e != nil {
+		err = pathError("close", dst, e)
+	}
+
+	if err == nil {
+		err = preserveMetadata(dst, info)
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return
+}
+
+// preserveMetadata applies the permissions, ownership (best-effort) and
+// modification time of the original file.
+func preserveMetadata(dst string, info os.FileInfo) (err error) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+
+	if err = os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return pathError("chmod", dst, err)
+	}
+
+	if err = os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return pathError("chtimes", dst, err)
+	}
+
+	return
+}
+
+// copyPath recursively copies a file or directory to a new destination,
+// preserving symbolic links and metadata. On failure, or cancellation, the
+// partial copy is removed. Private keys are never copied.
+func copyPath(src string, dst string, j *job) (err error) {
+	var dirs []string
+	var infos []os.FileInfo
+	var created bool
+
+	n := status.Notify(syslog.LOG_NOTICE, "copying %s to %s", relativePath(src), relativePath(dst))
+	defer status.Remove(n)
+
+	// only a destination created by this copy is removed, as it might
+	// otherwise belong to a concurrent request
+	defer func() {
+		if err != nil && created {
+			os.RemoveAll(dst)
+		}
+	}()
+
+	err = filepath.Walk(src, func(osPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return pathError("walk", osPath, err)
+		}
+
+		if err = j.Err(); err != nil {
+			return err
+		}
+
+		if inKeyPath, private := detectKeyPath(osPath); inKeyPath && private {
+			return pathError("copy", osPath, errors.New("cannot move or copy private key(s)"))
+		}
+
+		target := filepath.Join(dst, strings.TrimPrefix(osPath, src))
+
+		switch {
+		case info.IsDir():
+			if err = os.Mkdir(target, 0700); err != nil {
+				return pathError("mkdir", target, err)
+			}
+
+			created = true
+
+			// directory metadata is applied once its contents are in place
+			dirs = append(dirs, target)
+			infos = append(infos, info)
+		case info.Mode().IsRegular():
+			if err = copyFile(osPath, target, info, j); err != nil {
+				return err
+			}
+
+			created = true
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(osPath)
+
+			if err != nil {
+				return pathError("readlink", osPath, err)
+			}
+
+			if err = os.Symlink(link, target); err != nil {
+				return pathError("symlink", target, err)
+			}
+
+			created = true
+
+			return preserveMetadata(target, info)
+		default:
+			return pathError("copy", osPath, errors.New("unsupported file type"))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	if len(dirs) == 0 {
+		if err = followKeyPolicy(src, dst, false); err != nil {
+			return pathError("copy", src+policyExt, err)
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = preserveMetadata(dirs[i], infos[i]); err != nil {
+			return
+		}
+	}
+
+	status.Log(syslog.LOG_NOTICE, "copied %s to %s", relativePath(src), relativePath(dst))
+
+	return
+}
+
+// movePath renames a file or directory, falling back to copy and removal
+// when source and destination reside on different filesystems.
+func movePath(src string, dst string, j *job) (err error) {
+	err = os.Rename(src, dst)
+
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyPath(src, dst, j); err != nil {
+			return
+		}
+
+		if err = os.RemoveAll(src); err != nil {
+			return pathError("remove", src, err)
+		}
+	} else if err != nil {
+		return pathError("rename", src, err)
+	}
+
+	if err = followKeyPolicy(src, dst, true); err != nil {
+		return pathError("rename", src+policyExt, err)
+	}
+
+	status.Log(syslog.LOG_NOTICE, "moved %s to %s", relativePath(src), relativePath(dst))
+
+	return
+}
@@ -0,0 +1,101 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyMove(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	src := filepath.Join(conf.MountPoint, "src")
+	mtime := time.Unix(1500000000, 0)
+
+	os.MkdirAll(filepath.Join(src, "sub"), 0750)
+	os.WriteFile(filepath.Join(src, "sub", "file"), []byte("contents"), 0640)
+	os.Chtimes(filepath.Join(src, "sub", "file"), mtime, mtime)
+	os.Symlink("sub/file", filepath.Join(src, "link"))
+
+	dst := filepath.Join(conf.MountPoint, "dst")
+	os.Mkdir(dst, 0700)
+
+	if err := fileOp(src, dst, _copy); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(filepath.Join(dst, "src", "sub", "file"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode().Perm() != 0640 || !stat.ModTime().Equal(mtime) {
+		t.Errorf("metadata not preserved (%v, %v)", stat.Mode(), stat.ModTime())
+	}
+
+	if stat, _ := os.Stat(filepath.Join(dst, "src", "sub")); stat.Mode().Perm() != 0750 {
+		t.Errorf("directory mode not preserved (%v)", stat.Mode())
+	}
+
+	if link, _ := os.Readlink(filepath.Join(dst, "src", "link")); link != "sub/file" {
+		t.Errorf("symbolic link not preserved (%s)", link)
+	}
+
+	if err := fileOp(src, dst, _copy); err == nil {
+		t.Error("existing path replaced")
+	}
+
+	if err := fileOp(src, filepath.Join(src, "sub"), _copy); err == nil {
+		t.Error("copy into itself allowed")
+	}
+
+	// a destination created concurrently is not removed on failure
+	existing := filepath.Join(conf.MountPoint, "existing")
+	os.Mkdir(existing, 0700)
+
+	if err := copyPath(src, existing, nil); err == nil {
+		t.Error("existing path replaced")
+	}
+
+	if _, err := os.Stat(existing); err != nil {
+		t.Error("existing destination removed")
+	}
+
+	// private keys within copied directories
+	conf.KeyPath = "data/keys"
+	defer conf.SetDefaults()
+
+	os.MkdirAll(filepath.Join(conf.MountPoint, conf.KeyPath, "aes"), 0700)
+	os.WriteFile(filepath.Join(conf.MountPoint, conf.KeyPath, "aes", "private.key"), []byte("key"), 0600)
+
+	if err := fileOp(filepath.Join(conf.MountPoint, "data"), dst, _copy); err == nil {
+		t.Error("private key copied")
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "data")); !os.IsNotExist(err) {
+		t.Error("partial copy left behind")
+	}
+
+	moved := filepath.Join(conf.MountPoint, "moved")
+
+	if err := fileOp(src, moved, _move); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("source not moved")
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(moved, "sub", "file")); string(data) != "contents" {
+		t.Error("invalid moved contents")
+	}
+}
@@ -7,6 +7,7 @@
 package interlock
 
 import (
+	"bytes"
 	"crypto/pbkdf2"
 	"crypto/rand"
 	"crypto/sha256"
@@ -60,17 +61,70 @@ type cipherInterface interface {
 	// set encryption, decryption or signing key
 	SetKey(key) error
 	// encryption
-	Encrypt(src *os.File, dst *os.File, sign bool) error
-	// decryption
-	Decrypt(src *os.File, dst *os.File, verify bool) error
+	Encrypt(src io.Reader, dst io.Writer, sign bool) error
+	// decryption, ciphers authenticating the ciphertext before decryption
+	// require random access input (see randomAccess())
+	Decrypt(src io.Reader, dst io.Writer, verify bool) error
 	// signing
-	Sign(src *os.File, dst *os.File) error
+	Sign(src io.Reader, dst io.Writer) error
 	// signature verification
-	Verify(src *os.File, sig *os.File) error
+	Verify(src io.Reader, sig io.Reader) error
 	// One Time Password
 	GenOTP(timestamp int64) (otp string, exp int64, err error)
 }
 
+// sizeReaderAt is implemented by inputs which allow random access (e.g.
+// bytes.Reader, io.SectionReader).
+type sizeReaderAt interface {
+	io.ReaderAt
+	Size() int64
+}
+
+// randomAccess returns a random access view of the input, starting from its
+// current position when the input is a file or a bytes.Reader.
+func randomAccess(input io.Reader) (r *io.SectionReader, err error) {
+	switch in := input.(type) {
+	case *os.File:
+		var stat os.FileInfo
+		var pos int64
+
+		stat, err = in.Stat()
+
+		if err != nil {
+			return
+		}
+
+		pos, err = in.Seek(0, io.SeekCurrent)
+
+		if err != nil {
+			return
+		}
+
+		r = io.NewSectionReader(in, pos, stat.Size()-pos)
+	case *bytes.Reader:
+		pos := in.Size() - int64(in.Len())
+		r = io.NewSectionReader(in, pos, int64(in.Len()))
+	case sizeReaderAt:
+		r = io.NewSectionReader(in, 0, in.Size())
+	default:
+		err = errors.New("cipher requires random access input")
+	}
+
+	return
+}
+
+// optional cipher key auditing
+type auditInterface interface {
+	// audit key material
+	AuditKey(key) ([]keyFinding, error)
+}
+
+// optional cipher key passphrase verification
+type passphraseInterface interface {
+	// verify the key passphrase, reporting whether the key has one
+	VerifyPassphrase(key, string) (bool, error)
+}
+
 type HSMInterface interface {
 	// return a fresh HSM instance
 	New() HSMInterface
@@ -98,6 +152,16 @@ func ciphers() (res jsonObject) {
 func (k *key) Store(cipher cipherInterface, data string) (err error) {
 	var subdir string
 
+	payload := []byte(data)
+
+	if k.Private && conf.KeyStore {
+		payload, err = keyStore.Wrap(payload)
+
+		if err != nil {
+			return
+		}
+	}
+
 	fileName := fmt.Sprintf("%s.%s", k.Identifier, k.KeyFormat)
 
 	if k.Private {
@@ -122,7 +186,7 @@ func (k *key) Store(cipher cipherInterface, data string) (err error) {
 	}
 	defer output.Close()
 
-	written, err := io.Copy(output, strings.NewReader(data))
+	written, err := io.Copy(output, bytes.NewReader(payload))
 
 	if err != nil {
 		return
@@ -257,7 +321,7 @@ func getKeys(cipher cipherInterface, private bool, filter string) (keys []key, e
 			return
 		}
 
-		if fileInfo.IsDir() {
+		if fileInfo.IsDir() || filepath.Ext(path) == policyExt {
 			return
 		}
 
@@ -368,14 +432,13 @@ func genKey(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("could not identify compatible key cipher"), "")
 	}
 
-	go func() {
+	id, err := jobs.Submit("genkey", identifier, 0, func(j *job) (result interface{}, err error) {
 		n := status.Notify(syslog.LOG_INFO, "generating %s keypair %s", cipher.GetInfo().Name, identifier)
 		defer status.Remove(n)
 
 		pub, sec, err := cipher.GenKey(identifier, email)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
@@ -389,7 +452,6 @@ func genKey(r *http.Request) (res jsonObject) {
 		err = pubKey.Store(cipher, pub)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
@@ -403,19 +465,15 @@ func genKey(r *http.Request) (res jsonObject) {
 		err = secKey.Store(cipher, sec)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		status.Log(syslog.LOG_NOTICE, "generated %s keypair %s", cipher.GetInfo().Name, identifier)
-	}()
 
-	res = jsonObject{
-		"status":   "OK",
-		"response": nil,
-	}
+		return
+	})
 
-	return
+	return jobResponse(id, err)
 }
 
 func uploadKey(r *http.Request) (res jsonObject) {
@@ -469,6 +527,175 @@ func uploadKey(r *http.Request) (res jsonObject) {
 	return
 }
 
+func setKey(cipher cipherInterface, keyPath string) (k key, err error) {
+	k, _, err = getKey(filepath.Join(conf.MountPoint, keyPath))
+
+	if err != nil {
+		return
+	}
+
+	err = cipher.SetKey(k)
+
+	return
+}
+
+// encryptionCipher returns a cipher instance set up for encryption and,
+// optionally, signing. The signing key is returned for use accounting of each
+// operation.
+func encryptionCipher(cipherName string, keyPath string, sigKeyPath string, password string, sign bool) (cipher cipherInterface, sigKey key, err error) {
+	cipher, err = conf.GetCipher(cipherName)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Enc {
+		return nil, sigKey, errors.New("encryption requested but not supported by cipher")
+	}
+
+	if cipher.GetInfo().KeyFormat != "password" {
+		if keyPath == "" {
+			return nil, sigKey, errors.New("encryption key not specified")
+		}
+
+		_, err = setKey(cipher, keyPath)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if sign && cipher.GetInfo().Sig {
+		sigKey, err = setKey(cipher, sigKeyPath)
+
+		if err != nil {
+			return
+		}
+	} else if sign && !cipher.GetInfo().Sig {
+		return nil, sigKey, errors.New("signing requested but not supported by cipher")
+	}
+
+	if password != "" {
+		err = cipher.SetPassword(password)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if sign {
+		err = sigKey.Authorize(_sign, password)
+	}
+
+	return
+}
+
+// signingCipher returns a cipher instance set up for signing.
+func signingCipher(cipherName string, keyPath string, password string) (cipher cipherInterface, k key, err error) {
+	cipher, err = conf.GetCipher(cipherName)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Sig {
+		return nil, k, errors.New("signing requested but not supported by cipher")
+	}
+
+	k, err = setKey(cipher, keyPath)
+
+	if err != nil {
+		return
+	}
+
+	if password != "" {
+		err = cipher.SetPassword(password)
+
+		if err != nil {
+			return
+		}
+	}
+
+	err = k.Authorize(_sign, password)
+
+	return
+}
+
+// verificationCipher returns a cipher instance set up for signature
+// verification.
+func verificationCipher(cipherName string, sigKeyPath string) (cipher cipherInterface, err error) {
+	cipher, err = conf.GetCipher(cipherName)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Sig {
+		return nil, errors.New("signature verification requested but not supported by cipher")
+	}
+
+	if cipher.GetInfo().KeyFormat != "password" {
+		key, _, err := getKey(filepath.Join(conf.MountPoint, sigKeyPath))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = cipher.SetKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// decryptionCipher returns a cipher instance set up for decryption and,
+// optionally, signature verification. The decryption key is returned for use
+// accounting of each operation.
+func decryptionCipher(cipherName string, keyPath string, sigKeyPath string, password string, verify bool) (cipher cipherInterface, decKey key, err error) {
+	cipher, err = conf.GetCipher(cipherName)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().Dec {
+		return nil, decKey, errors.New("decryption requested but not supported by cipher")
+	}
+
+	if cipher.GetInfo().KeyFormat != "password" {
+		if keyPath == "" {
+			return nil, decKey, errors.New("decryption key not specified")
+		}
+
+		decKey, err = setKey(cipher, keyPath)
+
+		if err != nil {
+			return
+		}
+	}
+
+	err = cipher.SetPassword(password)
+
+	if err != nil {
+		return
+	}
+
+	err = decKey.Authorize(_decrypt, password)
+
+	if err != nil {
+		return
+	}
+
+	if verify && cipher.GetInfo().Sig {
+		_, err = setKey(cipher, sigKeyPath)
+	} else if verify && !cipher.GetInfo().Sig {
+		err = errors.New("signature verification requested but not supported by cipher")
+	}
+
+	return
+}
+
 func deriveKeyPBKDF2(salt []byte, password string, size int) (randSalt []byte, key []byte, err error) {
 	if len(salt) == 0 {
 		randSalt = make([]byte, 8)
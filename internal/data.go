@@ -0,0 +1,134 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log/syslog"
+	"net/http"
+)
+
+// maximum payload size for message level operations
+const maxDataSize = 1 << 20
+
+func decodeData(req jsonObject) (data []byte, err error) {
+	data, err = base64.StdEncoding.DecodeString(req["data"].(string))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid data encoding: %v", err)
+	}
+
+	if len(data) > maxDataSize {
+		return nil, fmt.Errorf("data exceeds maximum size (%d bytes)", maxDataSize)
+	}
+
+	return
+}
+
+func signData(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"data:s", "cipher:s", "password:s", "key:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	data, err := decodeData(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, k, err := signingCipher(req["cipher"].(string), req["key"].(string), req["password"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	done, err := k.Use(_sign)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	sig := new(bytes.Buffer)
+	err = cipher.Sign(bytes.NewReader(data), sig)
+	done(err)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "signed %d bytes with %s key %s", len(data), k.Cipher, k.Identifier)
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"signature": base64.StdEncoding.EncodeToString(sig.Bytes()),
+		},
+	}
+
+	return
+}
+
+func decryptData(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"data:s", "password:s", "verify:b", "key:s", "sig_key:s", "cipher:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	data, err := decodeData(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	verify := req["verify"].(bool)
+
+	cipher, k, err := decryptionCipher(req["cipher"].(string), req["key"].(string), req["sig_key"].(string), req["password"].(string), verify)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	done, err := k.Use(_decrypt)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	plaintext := new(bytes.Buffer)
+	err = cipher.Decrypt(bytes.NewReader(data), plaintext, verify)
+	done(err)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"data": base64.StdEncoding.EncodeToString(plaintext.Bytes()),
+		},
+	}
+
+	return
+}
@@ -0,0 +1,184 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// maximum number of cached file digests
+const digestCacheSize = 4096
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// digestKey identifies a file version, a file is assumed unchanged as long
+// as its inode, size and modification time are.
+type digestKey struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime int64
+	algo  string
+}
+
+type digestCache struct {
+	sync.Mutex
+	entries map[digestKey]string
+}
+
+var digests = digestCache{
+	entries: make(map[digestKey]string),
+}
+
+func newDigestKey(info os.FileInfo, algo string) (k digestKey, ok bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok {
+		return
+	}
+
+	k = digestKey{
+		dev:   uint64(stat.Dev),
+		ino:   stat.Ino,
+		size:  info.Size(),
+		mtime: info.ModTime().UnixNano(),
+		algo:  algo,
+	}
+
+	return
+}
+
+func (d *digestCache) Get(k digestKey) (digest string, ok bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	digest, ok = d.entries[k]
+
+	return
+}
+
+func (d *digestCache) Add(k digestKey, digest string) {
+	d.Lock()
+	defer d.Unlock()
+
+	// arbitrary entries are evicted once the cache is full
+	for e := range d.entries {
+		if len(d.entries) < digestCacheSize {
+			break
+		}
+
+		delete(d.entries, e)
+	}
+
+	d.entries[k] = digest
+}
+
+// fileDigest returns the hex encoded digest of a regular file, digests are
+// cached until the file changes.
+func fileDigest(osPath string, algo string) (digest string, err error) {
+	newHash, ok := digestAlgorithms[algo]
+
+	if !ok {
+		return "", fmt.Errorf("unsupported digest algorithm %s", algo)
+	}
+
+	input, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	info, err := input.Stat()
+
+	if err != nil {
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", relativePath(osPath))
+	}
+
+	k, cacheable := newDigestKey(info, algo)
+
+	if cacheable {
+		if digest, ok = digests.Get(k); ok {
+			return
+		}
+	}
+
+	h := newHash()
+
+	if _, err = io.Copy(h, input); err != nil {
+		return
+	}
+
+	digest = hex.EncodeToString(h.Sum(nil))
+
+	// the digest is only cached if the file did not change meanwhile
+	if info, err = input.Stat(); err == nil && cacheable {
+		if k2, _ := newDigestKey(info, algo); k2 == k {
+			digests.Add(k, digest)
+		}
+	}
+
+	return digest, nil
+}
+
+// fileDigests computes the digests of the files with a bounded number of
+// concurrent workers, digests of files that cannot be read are left empty.
+func fileDigests(paths []string, algo string) (res []string) {
+	var wg sync.WaitGroup
+
+	res = make([]string, len(paths))
+	queue := make(chan int)
+
+	workers := runtime.NumCPU()
+
+	if workers > len(paths) {
+		workers = len(paths)
+	}
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				res[i], _ = fileDigest(paths[i], algo)
+			}
+		}()
+	}
+
+	for i := range paths {
+		queue <- i
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return
+}
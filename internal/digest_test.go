@@ -0,0 +1,53 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileDigests(t *testing.T) {
+	dir := t.TempDir()
+
+	vectors := map[string]string{
+		"sha256":  "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"sha512":  "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043",
+		"blake2b": "e4cfa39a3d37be31c59609e807970799caa68a19bfaa15135f165085e01d41a65ba1e1b146aeb6bd0092b49eac214c103ccfa3a365954bbbe52f74a2b3620c94",
+	}
+
+	var paths []string
+
+	for i := 0; i < 8; i++ {
+		p := filepath.Join(dir, string(rune('a'+i)))
+		os.WriteFile(p, []byte("hello"), 0600)
+		paths = append(paths, p)
+	}
+
+	for algo, expected := range vectors {
+		for _, digest := range fileDigests(paths, algo) {
+			if digest != expected {
+				t.Errorf("%s: unexpected digest %s", algo, digest)
+			}
+		}
+	}
+
+	if _, err := fileDigest(paths[0], "md5"); err == nil {
+		t.Error("unsupported algorithm accepted")
+	}
+
+	// cached digests are invalidated on modification
+	os.WriteFile(paths[0], []byte("world"), 0600)
+	mtime := time.Now().Add(time.Minute)
+	os.Chtimes(paths[0], mtime, mtime)
+
+	if digest, _ := fileDigest(paths[0], "sha256"); digest == vectors["sha256"] {
+		t.Error("stale cached digest")
+	}
+}
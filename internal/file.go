@@ -8,6 +8,7 @@ package interlock
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -18,18 +19,22 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	_move = iota
 	_copy
 	_mkdir
-	_extract
 	_delete
 )
 
+// prefix for INTERLOCK metadata stored in the encrypted volume root
+const internalPrefix = ".interlock-"
+
 type inode struct {
 	Name    string `json:"name"`
 	Dir     bool   `json:"dir"`
@@ -39,20 +44,61 @@ type inode struct {
 	Private bool   `json:"private"`
 	Key     *key   `json:"key"`
 	SHA256  string `json:"sha256"`
+	Digest  string `json:"digest,omitempty"`
+}
+
+const (
+	// validity of unused download ids
+	downloadTimeout = time.Minute
+	// validity of resumable download ids after their first use
+	downloadWindow = 10 * time.Minute
+)
+
+// downloadEntry holds the download parameters, decryption ciphers are set up
+// only once the download starts to avoid retaining key material.
+type downloadEntry struct {
+	path       string
+	format     string
+	cipherName string
+	keyPath    string
+	password   []byte
+	resumable  bool
+	used       bool
+	expires    time.Time
+}
+
+// wipe clears the decryption password.
+func (e *downloadEntry) wipe() {
+	for i := range e.password {
+		e.password[i] = 0
+	}
 }
 
 type downloadCache struct {
 	sync.Mutex
-	cache map[string]string
+	cache map[string]downloadEntry
 }
 
 var download = downloadCache{
-	cache: make(map[string]string),
+	cache: make(map[string]downloadEntry),
 }
 
 const traversalPattern = "../"
 
-func (d *downloadCache) Add(id string, path string) {
+// countWriter tracks the amount of data streamed to the underlying writer.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+
+	return
+}
+
+func (d *downloadCache) Add(id string, entry downloadEntry) {
 	d.Lock()
 	defer d.Unlock()
 
@@ -60,18 +106,54 @@ func (d *downloadCache) Add(id string, path string) {
 	// given the non persistent nature of the server, this is not
 	// considered to be an issue
 
-	d.cache[id] = path
+	for k, v := range d.cache {
+		if time.Now().After(v.expires) {
+			v.wipe()
+			delete(d.cache, k)
+		}
+	}
+
+	entry.expires = time.Now().Add(downloadTimeout)
+	d.cache[id] = entry
 }
 
-func (d *downloadCache) Remove(id string) (path string, err error) {
+// Clear disposes of all download entries.
+func (d *downloadCache) Clear() {
 	d.Lock()
 	defer d.Unlock()
-	defer delete(d.cache, id)
 
-	if v, ok := d.cache[id]; ok {
-		path = v
-	} else {
-		err = errors.New("download id not found")
+	for _, v := range d.cache {
+		v.wipe()
+	}
+
+	d.cache = make(map[string]downloadEntry)
+}
+
+// Get returns the download entry, streamed downloads are disposed after use
+// while plain file downloads remain valid, for ranged resumption, within a
+// short window from their first use. Unused entries expire after a short
+// timeout.
+func (d *downloadCache) Get(id string) (entry downloadEntry, err error) {
+	d.Lock()
+	defer d.Unlock()
+
+	entry, ok := d.cache[id]
+
+	if !ok {
+		return entry, errors.New("download id not found")
+	}
+
+	switch {
+	case time.Now().After(entry.expires):
+		entry.wipe()
+		delete(d.cache, id)
+		err = errors.New("download id expired")
+	case !entry.resumable:
+		delete(d.cache, id)
+	case !entry.used:
+		entry.used = true
+		entry.expires = time.Now().Add(downloadWindow)
+		d.cache[id] = entry
 	}
 
 	return
@@ -84,9 +166,23 @@ func absolutePath(subPath string) (path string, err error) {
 
 	path = filepath.Join(conf.MountPoint, subPath)
 
+	if err == nil && metadataPath(path) {
+		err = errors.New("access to INTERLOCK metadata is not allowed")
+	}
+
 	return
 }
 
+func fileSize(f *os.File) int64 {
+	stat, err := f.Stat()
+
+	if err != nil {
+		return 0
+	}
+
+	return stat.Size()
+}
+
 func relativePath(p string) (subPath string) {
 	if !strings.HasPrefix(p, conf.MountPoint) {
 		subPath = path.Base(p)
@@ -97,6 +193,23 @@ func relativePath(p string) (subPath string) {
 	return
 }
 
+// regularFile returns the regular file at the path, key storage is excluded.
+func regularFile(osPath string) (info os.FileInfo, err error) {
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		return nil, errors.New("accessing files within key storage is not allowed")
+	}
+
+	if info, err = os.Stat(osPath); err != nil {
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", relativePath(osPath))
+	}
+
+	return
+}
+
 func detectKeyPath(path string) (inKeyPath bool, private bool) {
 	inKeyPath = false
 	absoluteKeyPath := filepath.Join(conf.MountPoint, conf.KeyPath)
@@ -113,6 +226,29 @@ func detectKeyPath(path string) (inKeyPath bool, private bool) {
 	return
 }
 
+// internalPath returns whether the path belongs to key storage or INTERLOCK
+// metadata, such paths are never included in directory traversals.
+func internalPath(osPath string) bool {
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		return true
+	}
+
+	return metadataPath(osPath)
+}
+
+// metadataPath returns whether any path component belongs to INTERLOCK
+// metadata (e.g. key store header, vault, versions, partial uploads and
+// temporary files), which is never accessible through the file API.
+func metadataPath(osPath string) bool {
+	for _, name := range strings.Split(relativePath(osPath), "/") {
+		if strings.HasPrefix(name, internalPrefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func fileMove(r *http.Request) jsonObject {
 	return fileMultiOp(r, _move)
 }
@@ -173,15 +309,7 @@ func fileMkdir(r *http.Request) jsonObject {
 	return fileMultiOp(r, _mkdir)
 }
 
-func fileExtract(r *http.Request) jsonObject {
-	return fileMultiOp(r, _extract)
-}
-
-func fileDelete(r *http.Request) jsonObject {
-	return fileMultiOp(r, _delete)
-}
-
-func fileCompress(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+func fileExtract(r *http.Request) (res jsonObject) {
 	req, err := parseRequest(r)
 
 	if err != nil {
@@ -200,36 +328,261 @@ func fileCompress(w http.ResponseWriter, r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	switch filepath.Ext(dst) {
-	case ".zip", ".ZIP":
-		src := req["src"].([]interface{})
-		s := make([]string, len(src))
+	if inKeyPath, _ := detectKeyPath(dst); inKeyPath {
+		return errorResponse(errors.New("extracting to key storage is not allowed"), "")
+	}
+
+	password, err := optionalString(req, "password", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	entries, err := optionalStrings(req, "entries")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src := req["src"].([]interface{})
+
+	if len(src) == 0 {
+		return errorResponse(errors.New("missing archive path"), "")
+	}
+
+	if len(entries) > 0 && len(src) > 1 {
+		return errorResponse(errors.New("entry selection requires a single archive"), "")
+	}
+
+	archives := make([]string, len(src))
+
+	for i := range src {
+		archives[i], err = absolutePath(src[i].(string))
 
-		for i := range src {
-			s[i], err = absolutePath(src[i].(string))
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if inKeyPath, private := detectKeyPath(archives[i]); inKeyPath && private {
+			return errorResponse(errors.New("cannot move or copy private key(s)"), "")
+		}
+
+		if _, err = archiveFormat(archives[i]); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	id, err := jobs.Submit("extract", archives[0], 0, func(j *job) (result interface{}, err error) {
+		var total int64
+
+		for _, archive := range archives {
+			size, err := archiveSize(archive, entries)
 
 			if err != nil {
-				return errorResponse(err, "")
+				return nil, err
 			}
+
+			total += size
 		}
 
-		err = zipPath(s, dst)
-	default:
-		err = errors.New("unsupported archive format")
+		j.SetTotal(total)
+
+		// output of earlier archives is also discarded on failure when the
+		// destination did not exist
+		if _, err = os.Stat(dst); os.IsNotExist(err) {
+			defer func() {
+				if err != nil {
+					os.RemoveAll(dst)
+				}
+			}()
+		}
+
+		for _, archive := range archives {
+			if err = extractArchive(archive, dst, password, entries, j); err != nil {
+				return
+			}
+		}
+
+		return relativePath(dst), nil
+	})
+
+	return jobResponse(id, err)
+}
+
+func fileArchiveList(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if inKeyPath, private := detectKeyPath(src); inKeyPath && private {
+		return errorResponse(errors.New("cannot list private key(s)"), "")
 	}
 
+	entries, err := listArchive(src)
+
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
 	res = jsonObject{
 		"status":   "OK",
-		"response": nil,
+		"response": entries,
 	}
 
 	return
 }
 
+func fileDelete(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:a"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	secure, err := optionalBool(req, "secure_wipe", conf.SecureWipe)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	var paths []string
+
+	for _, file := range req["path"].([]interface{}) {
+		path, err := absolutePath(file.(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if policyFile(path) {
+			return errorResponse(errors.New("key policies are deleted along with their key"), "")
+		}
+
+		if !secure && versioned(path) {
+			if _, err = os.Lstat(path); err != nil {
+				return errorResponse(err, "")
+			}
+
+			if err = saveVersion(path, false); err != nil {
+				return errorResponse(err, "")
+			}
+
+			status.Log(syslog.LOG_NOTICE, "deleted %s", relativePath(path))
+
+			continue
+		}
+
+		if !secure {
+			err = removePath(path, false, nil)
+
+			if err != nil {
+				return errorResponse(err, "")
+			}
+
+			continue
+		}
+
+		if _, err = os.Lstat(path); err != nil {
+			return errorResponse(err, "")
+		}
+
+		paths = append(paths, path)
+	}
+
+	if !secure {
+		res = jsonObject{
+			"status":   "OK",
+			"response": nil,
+		}
+
+		return
+	}
+
+	if len(paths) == 0 {
+		return errorResponse(errors.New("missing path"), "")
+	}
+
+	id, err := jobs.Submit("wipe", paths[0], pathSize(paths), func(j *job) (result interface{}, err error) {
+		for _, path := range paths {
+			if err = removePath(path, true, j); err != nil {
+				return
+			}
+
+			// earlier versions are wiped as well
+			if _, err = purgeVersions(path, "", true, j); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+
+	return jobResponse(id, err)
+}
+
+func fileCompress(w http.ResponseWriter, r *http.Request) (res jsonObject) {
+	var id string
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"src:a", "dst:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := absolutePath(req["dst"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	src := req["src"].([]interface{})
+	s := make([]string, len(src))
+
+	for i := range src {
+		s[i], err = absolutePath(src[i].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	password, err := optionalString(req, "password", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	id, err = archivePath(s, dst, password)
+
+	return jobResponse(id, err)
+}
+
 func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 	var srcAttr string
 	var dst string
@@ -241,7 +594,7 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 	}
 
 	switch mode {
-	case _move, _copy, _extract:
+	case _move, _copy:
 		err = validateRequest(req, []string{"src:a", "dst:s"})
 		srcAttr = "src"
 
@@ -265,6 +618,10 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
+	if mode == _copy {
+		return fileCopyJob(req["src"].([]interface{}), dst)
+	}
+
 	for _, file := range req[srcAttr].([]interface{}) {
 		path, err := absolutePath(file.(string))
 
@@ -287,61 +644,65 @@ func fileMultiOp(r *http.Request, mode int) (res jsonObject) {
 	return
 }
 
-func fileOp(src string, dst string, mode int) (err error) {
-	switch mode {
-	case _move, _copy, _extract:
-		inKeyPath, private := detectKeyPath(src)
+// fileCopyJob copies one or more paths to the destination within a job,
+// all paths are validated before the job is submitted.
+func fileCopyJob(src []interface{}, dst string) (res jsonObject) {
+	var paths []string
+	var targets []string
 
-		if inKeyPath && private {
-			err = errors.New("cannot move or copy private key(s)")
-			break
+	for _, file := range src {
+		path, err := absolutePath(file.(string))
+
+		if err != nil {
+			return errorResponse(err, "")
 		}
 
-		switch mode {
-		case _copy, _move:
-			var stat os.FileInfo
+		target, err := opTarget(path, dst)
 
-			stat, err = os.Stat(dst)
+		if err != nil {
+			return errorResponse(err, "")
+		}
 
-			if err == nil && !stat.IsDir() {
-				err = fmt.Errorf("path %s exists", relativePath(dst))
-				break
-			}
+		paths = append(paths, path)
+		targets = append(targets, target)
+	}
 
-			if err == nil && stat.IsDir() {
-				d := filepath.Join(dst, path.Base(src))
-				_, err = os.Stat(d)
+	if len(paths) == 0 {
+		return errorResponse(errors.New("missing path"), "")
+	}
 
-				if err == nil {
-					err = fmt.Errorf("path %s exists", relativePath(d))
-					break
-				}
+	id, err := jobs.Submit("copy", paths[0], pathSize(paths), func(j *job) (result interface{}, err error) {
+		for i := range paths {
+			if err = copyPath(paths[i], targets[i], j); err != nil {
+				return
 			}
+		}
 
-			if mode == _copy {
-				err = cp(src, dst)
-			} else {
-				err = mv(src, dst)
-			}
-		case _extract:
-			switch filepath.Ext(src) {
-			case ".zip", ".ZIP":
-				err = unzipFile(src, dst)
-			default:
-				err = errors.New("unsupported archive format")
-			}
+		return
+	})
+
+	return jobResponse(id, err)
+}
+
+func fileOp(src string, dst string, mode int) (err error) {
+	switch mode {
+	case _move, _copy:
+		var target string
+
+		if target, err = opTarget(src, dst); err != nil {
+			break
+		}
+
+		if mode == _copy {
+			err = copyPath(src, target, nil)
+		} else {
+			err = movePath(src, target, nil)
 		}
 	case _mkdir, _delete:
 		if mode == _mkdir {
 			err = os.MkdirAll(src, 0700)
 		} else { // _delete
-			err = os.RemoveAll(src)
-
-			if err != nil {
-				break
-			}
-
-			status.Log(syslog.LOG_NOTICE, "deleted %s", relativePath(src))
+			err = removePath(src, false, nil)
 		}
 	default:
 		err = errors.New("unsupported operation")
@@ -350,6 +711,76 @@ func fileOp(src string, dst string, mode int) (err error) {
 	return
 }
 
+// listOptions holds the optional sorting, filtering and pagination
+// attributes of a directory listing.
+type listOptions struct {
+	sort          string
+	reverse       bool
+	hidden        bool
+	recursiveSize bool
+	offset        int64
+	limit         int64
+}
+
+func parseListOptions(req jsonObject) (opts listOptions, err error) {
+	if opts.sort, err = optionalString(req, "sort", "name"); err != nil {
+		return
+	}
+
+	switch opts.sort {
+	case "name", "size", "mtime":
+	default:
+		return opts, fmt.Errorf("invalid sort attribute %s", opts.sort)
+	}
+
+	if opts.reverse, err = optionalBool(req, "reverse", false); err != nil {
+		return
+	}
+
+	if opts.hidden, err = optionalBool(req, "hidden", true); err != nil {
+		return
+	}
+
+	if opts.recursiveSize, err = optionalBool(req, "recursive_size", false); err != nil {
+		return
+	}
+
+	if opts.offset, err = optionalInt(req, "offset", 0); err != nil {
+		return
+	}
+
+	if opts.limit, err = optionalInt(req, "limit", 0); err != nil {
+		return
+	}
+
+	if opts.offset < 0 || opts.limit < 0 {
+		err = errors.New("invalid list offset or limit")
+	}
+
+	return
+}
+
+// sortInodes orders the inodes by the selected attribute, ties are ordered
+// by name.
+func sortInodes(inodes []inode, by string, reverse bool) {
+	sort.SliceStable(inodes, func(i, k int) bool {
+		a, b := inodes[i], inodes[k]
+
+		if reverse {
+			a, b = b, a
+		}
+
+		switch {
+		case by == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case by == "mtime" && a.Mtime != b.Mtime:
+			return a.Mtime < b.Mtime
+		}
+
+		return a.Name < b.Name
+	})
+}
+
 func fileList(r *http.Request) (res jsonObject) {
 	req, err := parseRequest(r)
 
@@ -369,6 +800,22 @@ func fileList(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
+	algo, err := optionalString(req, "digest", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, ok := digestAlgorithms[algo]; algo != "" && !ok {
+		return errorResponse(fmt.Errorf("unsupported digest algorithm %s", algo), "")
+	}
+
+	opts, err := parseListOptions(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
 	fileInfo, err := os.ReadDir(path)
 
 	if err != nil {
@@ -388,7 +835,15 @@ func fileList(r *http.Request) (res jsonObject) {
 			continue
 		}
 
+		if !opts.hidden && strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
 		filePath := filepath.Join(path, file.Name())
+
+		if metadataPath(filePath) {
+			continue
+		}
 		inKeyPath, private := detectKeyPath(filePath)
 
 		inode := inode{
@@ -403,32 +858,67 @@ func fileList(r *http.Request) (res jsonObject) {
 			inode.Size = info.Size()
 		}
 
-		if !file.IsDir() && inKeyPath {
-			key, _, err := getKey(filePath)
+		if file.IsDir() && opts.recursiveSize && opts.sort == "size" {
+			inode.Size = pathSize([]string{filePath})
+		}
 
-			if err == nil {
-				inode.Key = &key
-			} else {
-				status.Log(syslog.LOG_ERR, "error parsing %s, %s", file.Name(), err.Error())
-				inode.Key = nil
+		inodes = append(inodes, inode)
+	}
+
+	entries := len(inodes)
+	sortInodes(inodes, opts.sort, opts.reverse)
+
+	// further details are only gathered for the requested page
+	if opts.offset >= int64(len(inodes)) {
+		inodes = []inode{}
+	} else {
+		inodes = inodes[opts.offset:]
+	}
+
+	if opts.limit > 0 && int64(len(inodes)) > opts.limit {
+		inodes = inodes[:opts.limit]
+	}
+
+	// inode indices and paths of listed files
+	var files []int
+	var paths []string
+
+	for i := range inodes {
+		filePath := filepath.Join(path, inodes[i].Name)
+
+		if inodes[i].Dir {
+			if opts.recursiveSize && opts.sort != "size" {
+				inodes[i].Size = pathSize([]string{filePath})
 			}
+
+			continue
 		}
 
-		if !file.IsDir() && req["sha256"].(bool) {
-			f, err := os.Open(filePath)
+		if inodes[i].KeyPath && filepath.Ext(filePath) != policyExt {
+			key, _, err := getKey(filePath)
 
 			if err == nil {
-				defer f.Close()
+				inodes[i].Key = &key
+			} else {
+				status.Log(syslog.LOG_ERR, "error parsing %s, %s", inodes[i].Name, err.Error())
+				inodes[i].Key = nil
+			}
+		}
 
-				h := sha256.New()
+		files = append(files, i)
+		paths = append(paths, filePath)
+	}
 
-				if _, err := io.Copy(h, f); err == nil {
-					inode.SHA256 = fmt.Sprintf("%x", h.Sum(nil))
-				}
-			}
+	if req["sha256"].(bool) {
+		for i, digest := range fileDigests(paths, "sha256") {
+			inodes[files[i]].SHA256 = digest
 		}
+	}
 
-		inodes = append(inodes, inode)
+	if algo != "" {
+		for i, digest := range fileDigests(paths, algo) {
+			inodes[files[i]].Digest = digest
+		}
 	}
 
 	res = jsonObject{
@@ -437,18 +927,62 @@ func fileList(r *http.Request) (res jsonObject) {
 			"total_space": total,
 			"free_space":  free,
 			"inodes":      inodes,
+			"entries":     entries,
 		},
 	}
 
 	return
 }
 
+// decryptedPath returns the output path for decryption of src with cipher.
+func decryptedPath(src string, cipher cipherInterface) string {
+	suffix := "." + cipher.GetInfo().Extension
+
+	if strings.HasSuffix(src, suffix) {
+		return strings.TrimSuffix(src, suffix)
+	}
+
+	return src + ".decrypted"
+}
+
+// uploadCipher returns the cipher, if any, requested for encryption of the
+// upload, its parameters are URL encoded like the upload file name.
+func uploadCipher(r *http.Request) (cipher cipherInterface, sigKey key, sign bool, err error) {
+	cipherName := r.Header.Get("X-Encryptcipher")
+
+	if cipherName == "" {
+		return
+	}
+
+	params := make(map[string]string)
+
+	for _, h := range []string{"X-Encryptkey", "X-Encryptsigkey", "X-Encryptpassword"} {
+		params[h], err = url.QueryUnescape(r.Header.Get(h))
+
+		if err != nil {
+			return
+		}
+	}
+
+	sign = r.Header.Get("X-Encryptsign") == "true"
+	cipher, sigKey, err = encryptionCipher(cipherName, params["X-Encryptkey"], params["X-Encryptsigkey"], params["X-Encryptpassword"], sign)
+
+	return
+}
+
 func fileUpload(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	defer func() {
-		if err != nil {
-			log.Print(err)
+		if err == nil {
+			return
+		}
+
+		log.Print(err)
+
+		if errors.Is(err, errUploadOffset) {
+			http.Error(w, err.Error(), http.StatusConflict)
+		} else {
 			http.Error(w, err.Error(), 400)
 		}
 	}()
@@ -463,12 +997,28 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cipher, sigKey, sign, err := uploadCipher(r)
+
+	if err != nil {
+		return
+	}
+
+	if cipher != nil {
+		fileName += "." + cipher.GetInfo().Extension
+	}
+
 	osPath, err := absolutePath(fileName)
 
 	if err != nil {
 		return
 	}
 
+	// keys are uploaded through the key management API
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		err = errors.New("uploading to key storage is not allowed")
+		return
+	}
+
 	osDir := path.Dir(osPath)
 
 	_, err = os.Stat(osPath)
@@ -484,27 +1034,87 @@ func fileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	osFile, err := os.Create(osPath)
-	_ = osFile.Chmod(0600)
+	if offset := r.Header.Get("X-Uploadoffset"); offset != "" {
+		if cipher != nil {
+			err = errors.New("encryption is not supported for chunked uploads")
+			return
+		}
+
+		var res jsonObject
+
+		if res, err = uploadChunk(w, r, osPath, offset, overwrite == "true"); err == nil {
+			sendResponse(w, res)
+		}
+
+		return
+	}
+
+	if cipher == nil {
+		n := status.Notify(syslog.LOG_NOTICE, "uploading %s", relativePath(osPath))
+		defer status.Remove(n)
+	} else {
+		n := status.Notify(syslog.LOG_NOTICE, "uploading and encrypting %s", relativePath(osPath))
+		defer status.Remove(n)
+	}
+
+	// the upload is written to a temporary file, in the destination
+	// directory, which replaces the destination only once complete
+	tmp, err := os.CreateTemp(osDir, internalPrefix+"upload-*")
 
 	if err != nil {
 		return
 	}
-	defer osFile.Close()
+	defer os.Remove(tmp.Name())
 
-	n := status.Notify(syslog.LOG_NOTICE, "uploading %s", relativePath(osPath))
-	defer status.Remove(n)
+	// size and digest refer to the uploaded data, which is the plaintext
+	// when encrypting
+	h := sha256.New()
+	uploaded := &countWriter{w: h}
+	input := io.TeeReader(r.Body, uploaded)
+	output := &countWriter{w: tmp}
+
+	if cipher == nil {
+		_, err = io.Copy(output, input)
+	} else {
+		var done func(error)
+
+		if done, err = sigKey.Use(_sign); err == nil {
+			// the plaintext never reaches the disk
+			err = cipher.Encrypt(input, output, sign)
+			done(err)
+		}
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
 
-	written, err := io.Copy(osFile, r.Body)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
 
 	if err != nil {
 		return
 	}
 
-	status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), written)
+	digest := hex.EncodeToString(h.Sum(nil))
+
+	if expected := r.Header.Get("X-Content-Sha256"); expected != "" && strings.ToLower(expected) != digest {
+		err = fmt.Errorf("SHA256 mismatch for %s upload, discarded", relativePath(osPath))
+		return
+	}
+
+	if err = commitUpload(tmp.Name(), osPath, overwrite == "true"); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), uploaded.n)
+	sendResponse(w, uploadResponse(osPath, uploaded.n, digest))
 }
 
 func fileDownload(r *http.Request) (res jsonObject) {
+	var entry downloadEntry
+
 	req, err := parseRequest(r)
 
 	if err != nil {
@@ -529,19 +1139,65 @@ func fileDownload(r *http.Request) (res jsonObject) {
 		return errorResponse(errors.New("downloading private key(s) is not allowed"), "")
 	}
 
-	_, err = os.Stat(osPath)
+	stat, err := os.Stat(osPath)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
+	entry.format = _zip
+
+	// optional archive format for directories
+	if v, ok := req["format"]; ok {
+		format, ok := v.(string)
+
+		if !ok {
+			return errorResponse(errors.New("invalid attribute format (s)"), "")
+		}
+
+		if entry.format, err = archiveFormat("." + format); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	// optional decryption while streaming
+	if _, ok := req["cipher"]; ok {
+		err = validateRequest(req, []string{"cipher:s", "password:s", "verify:b", "key:s", "sig_key:s"})
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if stat.IsDir() {
+			return errorResponse(errors.New("decryption of directories is not supported"), "")
+		}
+
+		// signature failures would only be detected once the
+		// plaintext has already been sent
+		if req["verify"].(bool) {
+			return errorResponse(errors.New("signature verification is not supported for streamed downloads, use api/file/decrypt"), "")
+		}
+
+		// the request is validated, the cipher is set up again once
+		// the download starts
+		if _, _, err = decryptionCipher(req["cipher"].(string), req["key"].(string), "", req["password"].(string), false); err != nil {
+			return errorResponse(err, "")
+		}
+
+		entry.cipherName = req["cipher"].(string)
+		entry.keyPath = req["key"].(string)
+		entry.password = []byte(req["password"].(string))
+	}
+
 	id, err := randomString(16)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	download.Add(id, osPath)
+	entry.path = osPath
+	entry.resumable = stat.Mode().IsRegular() && entry.cipherName == ""
+	download.Add(id, entry)
 
 	res = jsonObject{
 		"status":   "OK",
@@ -551,7 +1207,20 @@ func fileDownload(r *http.Request) (res jsonObject) {
 	return
 }
 
-func fileDownloadByID(w http.ResponseWriter, id string) {
+// countResponseWriter tracks the amount of data sent to the client.
+type countResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countResponseWriter) Write(p []byte) (n int, err error) {
+	n, err = c.ResponseWriter.Write(p)
+	c.n += int64(n)
+
+	return
+}
+
+func fileDownloadByID(w http.ResponseWriter, r *http.Request, id string) {
 	var err error
 	var written int64
 
@@ -562,12 +1231,13 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 		}
 	}()
 
-	osPath, err := download.Remove(id)
+	entry, err := download.Get(id)
 
 	if err != nil {
 		return
 	}
 
+	osPath := entry.path
 	stat, err := os.Stat(osPath)
 
 	if err != nil {
@@ -579,8 +1249,23 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 	n := status.Notify(syslog.LOG_NOTICE, "downloading %s", relativePath(osPath))
 	defer status.Remove(n)
 
-	if stat.IsDir() {
-		fileName += ".zip"
+	var cipher cipherInterface
+	var k key
+
+	if entry.cipherName != "" {
+		cipher, k, err = decryptionCipher(entry.cipherName, entry.keyPath, "", string(entry.password), false)
+		entry.wipe()
+
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case stat.IsDir():
+		fileName += "." + entry.format
+	case cipher != nil:
+		fileName = path.Base(decryptedPath(osPath, cipher))
 	}
 
 	w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
@@ -588,7 +1273,7 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 	w.Header().Set("Cache-Control", "no-store")
 
 	if stat.IsDir() {
-		written, err = zipWriter([]string{osPath}, w)
+		written, err = archiveWriter([]string{osPath}, w, entry.format, "", nil)
 	} else {
 		var input *os.File
 		input, err = os.Open(osPath)
@@ -598,7 +1283,25 @@ func fileDownloadByID(w http.ResponseWriter, id string) {
 		}
 		defer input.Close()
 
-		written, err = io.Copy(w, input)
+		if cipher != nil {
+			var done func(error)
+
+			if done, err = k.Use(_decrypt); err != nil {
+				return
+			}
+
+			output := &countWriter{w: w}
+			err = cipher.Decrypt(input, output, false)
+			written = output.n
+			done(err)
+		} else {
+			// Range and If-Range requests are served against the
+			// file modification time and size
+			output := &countResponseWriter{ResponseWriter: w}
+			w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", stat.ModTime().UnixNano(), stat.Size()))
+			http.ServeContent(output, r, fileName, stat.ModTime(), input)
+			written = output.n
+		}
 	}
 
 	if err != nil {
@@ -615,13 +1318,13 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "cipher:s", "wipe_src:b", "sign:b", "password:s", "key:s", "sig_key:s"})
+	err = validateRequest(req, []string{"cipher:s", "wipe_src:b", "sign:b", "password:s", "key:s", "sig_key:s"})
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	src, err := absolutePath(req["src"].(string))
+	secure, err := optionalBool(req, "secure_wipe", conf.SecureWipe)
 
 	if err != nil {
 		return errorResponse(err, "")
@@ -629,240 +1332,120 @@ func fileEncrypt(r *http.Request) (res jsonObject) {
 
 	wipe := req["wipe_src"].(bool)
 	sign := req["sign"].(bool)
-	password := req["password"].(string)
-	keyPath := req["key"].(string)
-	sigKeyPath := req["sig_key"].(string)
-	cipherName := req["cipher"].(string)
 
-	cipher, err := conf.GetCipher(cipherName)
+	cipher, sigKey, err := encryptionCipher(req["cipher"].(string), req["key"].(string), req["sig_key"].(string), req["password"].(string), sign)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if !cipher.GetInfo().Enc {
-		return errorResponse(errors.New("encryption requested but not supported by cipher"), "")
-	}
-
-	if cipher.GetInfo().KeyFormat != "password" && keyPath == "" {
-		return errorResponse(errors.New("encryption key not specified"), "")
-	}
-
-	if cipher.GetInfo().KeyFormat != "password" {
-		keyPath = filepath.Join(conf.MountPoint, keyPath)
-		key, _, err := getKey(keyPath)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-
-		err = cipher.SetKey(key)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-	}
-
-	if sign && cipher.GetInfo().Sig {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
-		key, _, err := getKey(sigKeyPath)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-
-		err = cipher.SetKey(key)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-	} else if sign && !cipher.GetInfo().Sig {
-		return errorResponse(errors.New("signing requested but not supported by cipher"), "")
-	}
-
-	if password != "" {
-		err = cipher.SetPassword(password)
+	ext := "." + cipher.GetInfo().Extension
 
-		if err != nil {
-			return errorResponse(err, "")
-		}
-	}
-
-	input, err := os.Open(src)
+	// skip already encrypted files found in directories
+	src, files, err := sourcePaths(req, func(p string) bool {
+		return !strings.HasSuffix(p, ext)
+	})
 
 	if err != nil {
-		input.Close()
 		return errorResponse(err, "")
 	}
 
-	outputPath := src + "." + cipher.GetInfo().Extension
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
+	id, err := batchJob("encrypt", src, files, func(j *job, src string) (outputPath string, err error) {
+		n := status.Notify(syslog.LOG_INFO, "encrypting %s", relativePath(src))
+		defer status.Remove(n)
 
-	if err != nil {
-		input.Close()
-		output.Close()
-		return errorResponse(err, "")
-	}
+		outputPath = src + ext
 
-	go func() {
-		defer input.Close()
-		defer output.Close()
+		done, err := sigKey.Use(_sign)
 
-		n := status.Notify(syslog.LOG_INFO, "encrypting %s", relativePath(src))
-		defer status.Remove(n)
+		if err != nil {
+			return
+		}
 
-		err = cipher.Encrypt(input, output, sign)
+		err = transformFile(src, outputPath, func(input *os.File, output *os.File) error {
+			return cipher.Encrypt(j.Reader(input), output, sign)
+		})
+		done(err)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		if wipe {
-			err = os.Remove(src)
+			err = removePath(src, secure, nil)
 		}
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed encryption of %s", relativePath(src))
-	}()
 
-	res = jsonObject{
-		"status":   "OK",
-		"response": nil,
-	}
+		return
+	})
 
-	return
+	return jobResponse(id, err)
 }
 
 func fileDecrypt(r *http.Request) (res jsonObject) {
-	var outputPath string
-
 	req, err := parseRequest(r)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "password:s", "verify:b", "key:s", "sig_key:s", "cipher:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
-	src, err := absolutePath(req["src"].(string))
+	err = validateRequest(req, []string{"password:s", "verify:b", "key:s", "sig_key:s", "cipher:s"})
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	password := req["password"].(string)
 	verify := req["verify"].(bool)
-	keyPath := req["key"].(string)
-	sigKeyPath := req["sig_key"].(string)
-	cipherName := req["cipher"].(string)
 
-	cipher, err := conf.GetCipher(cipherName)
+	cipher, k, err := decryptionCipher(req["cipher"].(string), req["key"].(string), req["sig_key"].(string), req["password"].(string), verify)
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if !cipher.GetInfo().Dec {
-		return errorResponse(errors.New("decryption requested but not supported by cipher"), "")
-	}
-
-	if cipher.GetInfo().KeyFormat != "password" && keyPath == "" {
-		return errorResponse(errors.New("decryption key not specified"), "")
-	}
-
-	suffix := "." + cipher.GetInfo().Extension
-
-	if strings.HasSuffix(src, suffix) {
-		outputPath = strings.TrimSuffix(src, suffix)
-	} else {
-		outputPath = src + ".decrypted"
-	}
-
-	if cipher.GetInfo().KeyFormat != "password" {
-		keyPath = filepath.Join(conf.MountPoint, keyPath)
-		key, _, err := getKey(keyPath)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-
-		err = cipher.SetKey(key)
+	ext := "." + cipher.GetInfo().Extension
 
-		if err != nil {
-			return errorResponse(err, "")
-		}
-	}
-
-	err = cipher.SetPassword(password)
+	// only files encrypted with the cipher are selected from directories
+	src, files, err := sourcePaths(req, func(p string) bool {
+		return strings.HasSuffix(p, ext)
+	})
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if verify && cipher.GetInfo().Sig {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
-		key, _, err := getKey(sigKeyPath)
+	id, err := batchJob("decrypt", src, files, func(j *job, src string) (outputPath string, err error) {
+		n := status.Notify(syslog.LOG_INFO, "decrypting %s", relativePath(src))
+		defer status.Remove(n)
 
-		if err != nil {
-			return errorResponse(err, "")
-		}
+		outputPath = decryptedPath(src, cipher)
 
-		err = cipher.SetKey(key)
+		done, err := k.Use(_decrypt)
 
 		if err != nil {
-			return errorResponse(err, "")
+			return
 		}
-	} else if verify && !cipher.GetInfo().Sig {
-		return errorResponse(errors.New("signature verification requested but not supported by cipher"), "")
-	}
-
-	input, err := os.Open(src)
-
-	if err != nil {
-		input.Close()
-		return errorResponse(err, "")
-	}
-
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
-
-	if err != nil {
-		input.Close()
-		output.Close()
-		return errorResponse(err, "")
-	}
-
-	go func() {
-		defer input.Close()
-		defer output.Close()
 
-		n := status.Notify(syslog.LOG_INFO, "decrypting %s", relativePath(src))
-		defer status.Remove(n)
-
-		err = cipher.Decrypt(input, output, verify)
+		err = transformFile(src, outputPath, func(input *os.File, output *os.File) error {
+			return cipher.Decrypt(j.Reader(input), output, verify)
+		})
+		done(err)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed decryption of %s", relativePath(src))
-	}()
 
-	res = jsonObject{
-		"status":   "OK",
-		"response": nil,
-	}
+		return
+	})
 
-	return
+	return jobResponse(id, err)
 }
 
 func fileSign(r *http.Request) (res jsonObject) {
@@ -872,92 +1455,56 @@ func fileSign(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	err = validateRequest(req, []string{"src:s", "cipher:s", "password:s", "key:s"})
-
-	if err != nil {
-		return errorResponse(err, "")
-	}
-
-	src, err := absolutePath(req["src"].(string))
+	err = validateRequest(req, []string{"cipher:s", "password:s", "key:s"})
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	password := req["password"].(string)
-	keyPath := req["key"].(string)
-	cipherName := req["cipher"].(string)
-
-	cipher, err := conf.GetCipher(cipherName)
+	cipher, k, err := signingCipher(req["cipher"].(string), req["key"].(string), req["password"].(string))
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if !cipher.GetInfo().Sig {
-		return errorResponse(errors.New("signing requested but not supported by cipher"), "")
-	}
+	ext := "." + cipher.GetInfo().Extension + "-signature"
 
-	keyPath = filepath.Join(conf.MountPoint, keyPath)
-	key, _, err := getKey(keyPath)
+	// skip signatures found in directories
+	src, files, err := sourcePaths(req, func(p string) bool {
+		return !strings.HasSuffix(p, ext)
+	})
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	err = cipher.SetKey(key)
+	id, err := batchJob("sign", src, files, func(j *job, src string) (outputPath string, err error) {
+		n := status.Notify(syslog.LOG_INFO, "signing %s", relativePath(src))
+		defer status.Remove(n)
 
-	if err != nil {
-		return errorResponse(err, "")
-	}
+		outputPath = src + ext
 
-	if password != "" {
-		err = cipher.SetPassword(password)
+		done, err := k.Use(_sign)
 
 		if err != nil {
-			return errorResponse(err, "")
+			return
 		}
-	}
-
-	input, err := os.Open(src)
-
-	if err != nil {
-		input.Close()
-		return errorResponse(err, "")
-	}
-
-	outputPath := src + "." + cipher.GetInfo().Extension + "-signature"
-	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_TRUNC, 0600)
-
-	if err != nil {
-		input.Close()
-		output.Close()
-		return errorResponse(err, "")
-	}
-
-	go func() {
-		defer input.Close()
-		defer output.Close()
-
-		n := status.Notify(syslog.LOG_INFO, "signing %s", relativePath(src))
-		defer status.Remove(n)
 
-		err = cipher.Sign(input, output)
+		err = transformFile(src, outputPath, func(input *os.File, output *os.File) error {
+			return cipher.Sign(j.Reader(input), output)
+		})
+		done(err)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		status.Log(syslog.LOG_NOTICE, "completed signing of %s", relativePath(src))
-	}()
 
-	res = jsonObject{
-		"status":   "OK",
-		"response": nil,
-	}
+		return
+	})
 
-	return
+	return jobResponse(id, err)
 }
 
 func fileVerify(r *http.Request) (res jsonObject) {
@@ -985,34 +1532,12 @@ func fileVerify(r *http.Request) (res jsonObject) {
 		return errorResponse(err, "")
 	}
 
-	sigKeyPath := req["key"].(string)
-	cipherName := req["cipher"].(string)
-
-	cipher, err := conf.GetCipher(cipherName)
+	cipher, err := verificationCipher(req["cipher"].(string), req["key"].(string))
 
 	if err != nil {
 		return errorResponse(err, "")
 	}
 
-	if !cipher.GetInfo().Sig {
-		return errorResponse(errors.New("signature verification requested but not supported by cipher"), "")
-	}
-
-	if cipher.GetInfo().KeyFormat != "password" {
-		sigKeyPath = filepath.Join(conf.MountPoint, sigKeyPath)
-		key, _, err := getKey(sigKeyPath)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-
-		err = cipher.SetKey(key)
-
-		if err != nil {
-			return errorResponse(err, "")
-		}
-	}
-
 	input, err := os.Open(src)
 
 	if err != nil {
@@ -1023,31 +1548,31 @@ func fileVerify(r *http.Request) (res jsonObject) {
 
 	if err != nil {
 		input.Close()
-		sig.Close()
 		return errorResponse(err, "")
 	}
 
-	go func() {
+	id, err := jobs.Submit("verify", src, fileSize(input), func(j *job) (result interface{}, err error) {
 		defer input.Close()
 		defer sig.Close()
 
 		n := status.Notify(syslog.LOG_INFO, "verifying %s", relativePath(src))
 		defer status.Remove(n)
 
-		err = cipher.Verify(input, sig)
+		err = cipher.Verify(j.Reader(input), sig)
 
 		if err != nil {
-			status.Error(err)
 			return
 		}
 
 		status.Log(syslog.LOG_NOTICE, "successful verification of %s", relativePath(src))
-	}()
 
-	res = jsonObject{
-		"status":   "OK",
-		"response": nil,
+		return
+	})
+
+	if err != nil {
+		input.Close()
+		sig.Close()
 	}
 
-	return
+	return jobResponse(id, err)
 }
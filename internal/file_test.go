@@ -0,0 +1,84 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"strings"
+	"testing"
+)
+
+func inodeNames(inodes []inode) string {
+	var names []string
+
+	for _, i := range inodes {
+		names = append(names, i.Name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+func TestSortInodes(t *testing.T) {
+	inodes := []inode{
+		{Name: "c", Size: 10, Mtime: 1},
+		{Name: "a", Size: 20, Mtime: 3},
+		{Name: "d", Size: 10, Mtime: 2},
+		{Name: "b", Size: 30, Mtime: 2},
+	}
+
+	tests := []struct {
+		by      string
+		reverse bool
+		want    string
+	}{
+		{"name", false, "a,b,c,d"},
+		{"name", true, "d,c,b,a"},
+		{"size", false, "c,d,a,b"},
+		{"size", true, "b,a,d,c"},
+		{"mtime", false, "c,b,d,a"},
+	}
+
+	for _, test := range tests {
+		sortInodes(inodes, test.by, test.reverse)
+
+		if got := inodeNames(inodes); got != test.want {
+			t.Errorf("sort by %s (reverse: %v): got %s, want %s", test.by, test.reverse, got, test.want)
+		}
+	}
+}
+
+func TestParseListOptions(t *testing.T) {
+	if _, err := parseListOptions(jsonObject{"sort": "owner"}); err == nil {
+		t.Error("invalid sort attribute accepted")
+	}
+
+	opts, err := parseListOptions(jsonObject{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.sort != "name" || !opts.hidden || opts.limit != 0 {
+		t.Errorf("unexpected defaults %+v", opts)
+	}
+}
+
+func TestAbsolutePath(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	for _, p := range []string{"/.interlock-keystore", "/.interlock-vault/entry", "dir/.interlock-upload-1", "/../etc/passwd"} {
+		if _, err := absolutePath(p); err == nil {
+			t.Errorf("%s accepted", p)
+		}
+	}
+
+	for _, p := range []string{"/", "/dir/file.txt", "/keys/pgp/public/key.asc", "/.interlock"} {
+		if _, err := absolutePath(p); err != nil {
+			t.Errorf("%s rejected (%v)", p, err)
+		}
+	}
+}
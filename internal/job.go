@@ -0,0 +1,463 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/syslog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued   = "queued"
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// number of completed jobs retained for inspection
+const jobHistory = 32
+
+// minimum interval between job progress events
+const jobEventInterval = 500 * time.Millisecond
+
+// jobFunc performs the job operation, long running operations are expected
+// to route their I/O through the job Reader/Writer wrappers for progress
+// tracking and cancellation.
+type jobFunc func(j *job) (result interface{}, err error)
+
+type jobInfo struct {
+	ID        string      `json:"id"`
+	Operation string      `json:"operation"`
+	Path      string      `json:"path"`
+	State     string      `json:"state"`
+	Processed int64       `json:"processed"`
+	Total     int64       `json:"total"`
+	Result    interface{} `json:"result"`
+	Error     string      `json:"error"`
+	Created   int64       `json:"created"`
+	Completed int64       `json:"completed"`
+}
+
+type job struct {
+	sync.Mutex
+	info    jobInfo
+	ctx     context.Context
+	cancel  context.CancelFunc
+	updated time.Time
+}
+
+type jobManager struct {
+	sync.Mutex
+	jobs  map[string]*job
+	slots chan struct{}
+}
+
+var jobs = jobManager{
+	jobs: make(map[string]*job),
+}
+
+// Info returns a snapshot of the job state.
+func (j *job) Info() jobInfo {
+	j.Lock()
+	defer j.Unlock()
+
+	return j.info
+}
+
+// notify publishes the job state to status stream subscribers, progress
+// updates are rate limited.
+func (j *job) notify(progress bool) {
+	j.Lock()
+
+	if progress && time.Since(j.updated) < jobEventInterval {
+		j.Unlock()
+		return
+	}
+
+	j.updated = time.Now()
+	info := j.info
+	j.Unlock()
+
+	status.Event("job", info)
+}
+
+func (j *job) setState(state string) {
+	j.Lock()
+	j.info.State = state
+	j.Unlock()
+
+	j.notify(false)
+}
+
+// SetTotal updates the amount of data expected to be processed.
+func (j *job) SetTotal(total int64) {
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.Total = total
+}
+
+func (j *job) add(n int) {
+	j.Lock()
+	j.info.Processed += int64(n)
+	j.Unlock()
+
+	j.notify(true)
+}
+
+// Err returns the job cancellation status.
+func (j *job) Err() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.ctx.Err()
+}
+
+type progressReader struct {
+	j *job
+	r io.Reader
+}
+
+func (p *progressReader) Read(b []byte) (n int, err error) {
+	if err = p.j.Err(); err != nil {
+		return
+	}
+
+	n, err = p.r.Read(b)
+	p.j.add(n)
+
+	return
+}
+
+// progressReaderAt preserves random access to the underlying input, as
+// ciphers might perform more than one pass over it progress is tracked as
+// the highest offset reached.
+type progressReaderAt struct {
+	j   *job
+	r   *io.SectionReader
+	pos int64
+}
+
+func (p *progressReaderAt) ReadAt(b []byte, off int64) (n int, err error) {
+	if err = p.j.Err(); err != nil {
+		return
+	}
+
+	n, err = p.r.ReadAt(b, off)
+
+	if end := off + int64(n); end > p.pos {
+		p.j.add(int(end - p.pos))
+		p.pos = end
+	}
+
+	return
+}
+
+func (p *progressReaderAt) Size() int64 {
+	return p.r.Size()
+}
+
+type progressWriter struct {
+	j *job
+	w io.Writer
+}
+
+func (p *progressWriter) Write(b []byte) (n int, err error) {
+	if err = p.j.Err(); err != nil {
+		return
+	}
+
+	n, err = p.w.Write(b)
+	p.j.add(n)
+
+	return
+}
+
+// Reader returns a cancelable input which tracks the job progress, random
+// access inputs are returned with their random access capability preserved.
+func (j *job) Reader(r io.Reader) io.Reader {
+	if j == nil {
+		return r
+	}
+
+	if s, err := randomAccess(r); err == nil {
+		p := io.NewSectionReader(&progressReaderAt{j: j, r: s}, 0, s.Size())
+
+		if f, ok := r.(interface{ Name() string }); ok {
+			return &progressSection{p, f.Name()}
+		}
+
+		return p
+	}
+
+	return &progressReader{j, r}
+}
+
+// progressSection is a progress tracking random access input, the name of
+// the original input is retained for ciphers that record it.
+type progressSection struct {
+	*io.SectionReader
+	name string
+}
+
+func (p *progressSection) Name() string {
+	return p.name
+}
+
+// Writer returns a cancelable output which tracks the job progress.
+func (j *job) Writer(w io.Writer) io.Writer {
+	if j == nil {
+		return w
+	}
+
+	return &progressWriter{j, w}
+}
+
+func (m *jobManager) acquire(j *job) (err error) {
+	m.Lock()
+
+	if m.slots == nil {
+		n := conf.Jobs
+
+		if n <= 0 {
+			n = 1
+		}
+
+		m.slots = make(chan struct{}, n)
+	}
+
+	slots := m.slots
+	m.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+	case <-j.ctx.Done():
+		err = j.ctx.Err()
+	}
+
+	return
+}
+
+func (m *jobManager) release() {
+	<-m.slots
+}
+
+// prune disposes of the oldest completed jobs exceeding the history size.
+func (m *jobManager) prune() {
+	var completed []jobInfo
+
+	m.Lock()
+	defer m.Unlock()
+
+	for _, j := range m.jobs {
+		if info := j.Info(); info.Completed != 0 {
+			completed = append(completed, info)
+		}
+	}
+
+	if len(completed) <= jobHistory {
+		return
+	}
+
+	sort.Slice(completed, func(i, k int) bool {
+		return completed[i].Completed < completed[k].Completed
+	})
+
+	for _, info := range completed[:len(completed)-jobHistory] {
+		delete(m.jobs, info.ID)
+	}
+}
+
+// Submit queues a job for asynchronous execution, the number of concurrently
+// running jobs is bounded by the "jobs" configuration option.
+func (m *jobManager) Submit(op string, osPath string, total int64, fn jobFunc) (id string, err error) {
+	id, err = randomString(16)
+
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	j := &job{
+		info: jobInfo{
+			ID:        id,
+			Operation: op,
+			Path:      relativePath(osPath),
+			State:     jobQueued,
+			Total:     total,
+			Created:   time.Now().Unix(),
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	m.Lock()
+	m.jobs[id] = j
+	m.Unlock()
+
+	j.notify(false)
+
+	go m.run(j, fn)
+
+	return
+}
+
+func (m *jobManager) run(j *job, fn jobFunc) {
+	var result interface{}
+
+	defer m.prune()
+	defer j.notify(false)
+	defer j.cancel()
+
+	err := m.acquire(j)
+
+	if err == nil {
+		j.setState(jobRunning)
+		result, err = fn(j)
+		m.release()
+	}
+
+	j.Lock()
+	defer j.Unlock()
+
+	j.info.Completed = time.Now().Unix()
+	j.info.Result = result
+
+	switch {
+	case j.ctx.Err() != nil:
+		j.info.State = jobCanceled
+		j.info.Error = j.ctx.Err().Error()
+		status.Log(syslog.LOG_NOTICE, "canceled %s of %s", j.info.Operation, j.info.Path)
+	case err != nil:
+		j.info.State = jobFailed
+		j.info.Error = err.Error()
+		status.Error(err)
+	default:
+		j.info.State = jobDone
+	}
+}
+
+func (m *jobManager) Get(id string) (j *job, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	j, ok := m.jobs[id]
+
+	if !ok {
+		err = errors.New("job id not found")
+	}
+
+	return
+}
+
+func (m *jobManager) List() (list []jobInfo) {
+	m.Lock()
+	defer m.Unlock()
+
+	list = []jobInfo{}
+
+	for _, j := range m.jobs {
+		list = append(list, j.Info())
+	}
+
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Created < list[k].Created
+	})
+
+	return
+}
+
+func jobResponse(id string, err error) (res jsonObject) {
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": id,
+	}
+
+	return
+}
+
+func jobList() (res jsonObject) {
+	res = jsonObject{
+		"status":   "OK",
+		"response": jobs.List(),
+	}
+
+	return
+}
+
+func jobGet(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	j, err := jobs.Get(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": j.Info(),
+	}
+
+	return
+}
+
+func jobCancel(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	j, err := jobs.Get(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if info := j.Info(); info.Completed != 0 {
+		return errorResponse(errors.New("job already completed"), "")
+	}
+
+	j.cancel()
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -41,6 +41,88 @@ func parseRequest(r *http.Request) (j jsonObject, err error) {
 	return
 }
 
+// optionalBool returns the value of an optional boolean attribute, or the
+// default when not present.
+func optionalBool(req jsonObject, key string, def bool) (val bool, err error) {
+	v, ok := req[key]
+
+	if !ok {
+		return def, nil
+	}
+
+	if val, ok = v.(bool); !ok {
+		err = fmt.Errorf("invalid attribute %s (b)", key)
+	}
+
+	return
+}
+
+// optionalString returns the value of an optional string attribute, or the
+// default when not present.
+func optionalString(req jsonObject, key string, def string) (val string, err error) {
+	v, ok := req[key]
+
+	if !ok {
+		return def, nil
+	}
+
+	if val, ok = v.(string); !ok {
+		err = fmt.Errorf("invalid attribute %s (s)", key)
+	}
+
+	return
+}
+
+// optionalInt returns the value of an optional integer attribute, or the
+// default when not present.
+func optionalInt(req jsonObject, key string, def int64) (val int64, err error) {
+	v, ok := req[key]
+
+	if !ok {
+		return def, nil
+	}
+
+	n, ok := v.(json.Number)
+
+	if !ok {
+		return 0, fmt.Errorf("invalid attribute %s (n)", key)
+	}
+
+	if val, err = n.Int64(); err != nil {
+		err = fmt.Errorf("invalid attribute %s (n)", key)
+	}
+
+	return
+}
+
+// optionalStrings returns the value of an optional string array attribute,
+// or nil when not present.
+func optionalStrings(req jsonObject, key string) (val []string, err error) {
+	v, ok := req[key]
+
+	if !ok {
+		return
+	}
+
+	a, ok := v.([]interface{})
+
+	if !ok {
+		return nil, fmt.Errorf("invalid attribute %s (a)", key)
+	}
+
+	for _, e := range a {
+		s, ok := e.(string)
+
+		if !ok {
+			return nil, fmt.Errorf("invalid attribute %s (a)", key)
+		}
+
+		val = append(val, s)
+	}
+
+	return
+}
+
 func (j jsonObject) String() (s string) {
 	b, err := json.Marshal(j)
 
@@ -80,6 +162,8 @@ func validateRequest(req jsonObject, reqAttrs []string) error {
 			_, ok = req[key].(json.Number)
 		case "a":
 			_, ok = req[key].([]interface{})
+		case "o":
+			_, ok = req[key].(map[string]interface{})
 		case "i":
 			_, ok = req[key]
 		default:
@@ -0,0 +1,1285 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/salsa20/salsa"
+	"golang.org/x/crypto/twofish"
+)
+
+// KeePass database (KDBX 3.1 and 4.x) support.
+//
+// The database XML document is kept as a generic element tree, protected
+// values are stored in plaintext within the tree once the database is opened.
+// Modified databases are always written in KDBX 4 format, re-using the
+// original cipher, compression and key derivation parameters.
+
+const (
+	kdbxSignature1 = 0x9aa2d903
+	kdbxSignature2 = 0xb54bfb67
+
+	// maximum size of database files and of their decompressed contents
+	kdbxMaxSize = 64 << 20
+	// maximum AES-KDF rounds
+	kdbxMaxRounds = 1 << 27
+	// maximum Argon2 memory and time costs
+	kdbxMaxMemory     = 64 << 20
+	kdbxMaxIterations = 1 << 7
+	// size of KDBX 4 HMAC authenticated blocks
+	kdbxBlockSize = 1 << 20
+	// seconds between 0001-01-01 and the Unix epoch
+	kdbxEpoch = 62135596800
+)
+
+// header field identifiers
+const (
+	kdbxEndOfHeader        = 0
+	kdbxCipherID           = 2
+	kdbxCompressionFlags   = 3
+	kdbxMasterSeed         = 4
+	kdbxTransformSeed      = 5
+	kdbxTransformRounds    = 6
+	kdbxEncryptionIV       = 7
+	kdbxProtectedStreamKey = 8
+	kdbxStreamStartBytes   = 9
+	kdbxInnerRandomStream  = 10
+	kdbxKdfParameters      = 11
+	kdbxPublicCustomData   = 12
+)
+
+// inner header field identifiers (KDBX 4)
+const (
+	kdbxInnerEndOfHeader = 0
+	kdbxInnerStreamID    = 1
+	kdbxInnerStreamKey   = 2
+	kdbxInnerBinary      = 3
+)
+
+// inner random stream identifiers
+const (
+	kdbxStreamSalsa20  = 2
+	kdbxStreamChaCha20 = 3
+)
+
+var (
+	kdbxCipherAES256   = mustUUID("31c1f2e6bf714350be5805216afc5aff")
+	kdbxCipherChaCha20 = mustUUID("d6038a2b8b6f4cb5a524339a31dbb59a")
+	kdbxCipherTwofish  = mustUUID("ad68f29f576f4bb9a36ad47af965346c")
+
+	kdbxKdfAES      = mustUUID("c9d9f39a628a4460bf740d08c18a4fea")
+	kdbxKdfAES3     = mustUUID("7c02bb8279a74ac0927d114a00648238")
+	kdbxKdfArgon2d  = mustUUID("ef636ddf8c29444b91f7a9a403e30a0c")
+	kdbxKdfArgon2id = mustUUID("9e298b1956db4773b23dfc3ec6f0a1e6")
+
+	kdbxSalsa20Nonce = []byte{0xe8, 0x30, 0x09, 0x4b, 0x97, 0x20, 0x5d, 0x2a}
+
+	errKDBXCredentials = errors.New("invalid KDBX credentials or corrupted database")
+)
+
+func mustUUID(s string) []byte {
+	b, err := hex.DecodeString(s)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return b
+}
+
+// kdbxNode represents an element of the database XML document.
+type kdbxNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Content string     `xml:",chardata"`
+	Nodes   []kdbxNode `xml:",any"`
+}
+
+type kdbxDatabase struct {
+	major uint16
+	minor uint16
+
+	cipherID    []byte
+	compression uint32
+	masterSeed  []byte
+	iv          []byte
+	kdf         map[string]interface{}
+
+	// raw KDBX 4 header fields, preserved on write
+	kdfParameters []byte
+	customData    []byte
+
+	// key derived from the database credentials
+	transformedKey []byte
+
+	// KDBX 3.1 key derivation and inner stream parameters
+	transformSeed   []byte
+	transformRounds uint64
+	streamStart     []byte
+
+	streamID  uint32
+	streamKey []byte
+	// KDBX 4 binaries, the first byte holds the binary flags
+	binaries [][]byte
+
+	root kdbxNode
+}
+
+type kdbxGroup struct {
+	UUID    string
+	Name    string
+	Path    string
+	Entries int
+}
+
+type kdbxEntry struct {
+	UUID      string
+	Group     string
+	GroupUUID string
+	Fields    map[string]string
+	Protected map[string]bool
+}
+
+// attr returns the value of an element attribute.
+func (n *kdbxNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// child returns the first child element with the specified name.
+func (n *kdbxNode) child(name string) *kdbxNode {
+	for i := range n.Nodes {
+		if n.Nodes[i].XMLName.Local == name {
+			return &n.Nodes[i]
+		}
+	}
+
+	return nil
+}
+
+// text returns the contents of a child element.
+func (n *kdbxNode) text(name string) string {
+	if c := n.child(name); c != nil {
+		return c.Content
+	}
+
+	return ""
+}
+
+// readVariantDictionary parses KDBX 4 KDF parameters.
+func readVariantDictionary(data []byte) (dict map[string]interface{}, err error) {
+	r := bytes.NewReader(data)
+	dict = make(map[string]interface{})
+
+	var version uint16
+
+	if err = binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return
+	}
+
+	if version>>8 != 1 {
+		return nil, fmt.Errorf("unsupported KDBX variant dictionary version %x", version)
+	}
+
+	for {
+		var kind uint8
+		var size uint32
+
+		if err = binary.Read(r, binary.LittleEndian, &kind); err != nil {
+			return
+		}
+
+		if kind == 0 {
+			return
+		}
+
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return
+		}
+
+		if int64(size) > int64(r.Len()) {
+			return nil, errors.New("invalid KDBX variant dictionary")
+		}
+
+		name := make([]byte, size)
+
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return
+		}
+
+		if int64(size) > int64(r.Len()) {
+			return nil, errors.New("invalid KDBX variant dictionary")
+		}
+
+		value := make([]byte, size)
+
+		if _, err = io.ReadFull(r, value); err != nil {
+			return
+		}
+
+		switch {
+		case kind == 0x04 && size == 4:
+			dict[string(name)] = uint64(binary.LittleEndian.Uint32(value))
+		case kind == 0x05 && size == 8:
+			dict[string(name)] = binary.LittleEndian.Uint64(value)
+		case kind == 0x08 && size == 1:
+			dict[string(name)] = value[0] != 0
+		case kind == 0x0c && size == 4:
+			dict[string(name)] = int64(int32(binary.LittleEndian.Uint32(value)))
+		case kind == 0x0d && size == 8:
+			dict[string(name)] = int64(binary.LittleEndian.Uint64(value))
+		case kind == 0x18:
+			dict[string(name)] = string(value)
+		case kind == 0x42:
+			dict[string(name)] = value
+		default:
+			return nil, fmt.Errorf("invalid KDBX variant dictionary entry %s", name)
+		}
+	}
+}
+
+// readHeader parses the outer header, returning its raw contents.
+func (db *kdbxDatabase) readHeader(r *bytes.Reader) (header []byte, err error) {
+	var sig [3]uint32
+
+	start := r.Len()
+
+	if err = binary.Read(r, binary.LittleEndian, &sig); err != nil {
+		return nil, errors.New("invalid KDBX file")
+	}
+
+	if sig[0] != kdbxSignature1 || sig[1] != kdbxSignature2 {
+		return nil, errors.New("invalid KDBX file signature")
+	}
+
+	db.minor = uint16(sig[2])
+	db.major = uint16(sig[2] >> 16)
+
+	if db.major != 3 && db.major != 4 {
+		return nil, fmt.Errorf("unsupported KDBX version %d.%d", db.major, db.minor)
+	}
+
+	for {
+		var id uint8
+		var size uint32
+
+		if err = binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return
+		}
+
+		if db.major == 3 {
+			var size16 uint16
+			err = binary.Read(r, binary.LittleEndian, &size16)
+			size = uint32(size16)
+		} else {
+			err = binary.Read(r, binary.LittleEndian, &size)
+		}
+
+		if err != nil {
+			return
+		}
+
+		if int64(size) > int64(r.Len()) {
+			return nil, errors.New("invalid KDBX header")
+		}
+
+		data := make([]byte, size)
+
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+
+		switch id {
+		case kdbxEndOfHeader:
+			header = make([]byte, start-r.Len())
+			_, err = r.ReadAt(header, 0)
+			return
+		case kdbxCipherID:
+			db.cipherID = data
+		case kdbxCompressionFlags:
+			if size != 4 {
+				return nil, errors.New("invalid KDBX compression flags")
+			}
+
+			db.compression = binary.LittleEndian.Uint32(data)
+		case kdbxMasterSeed:
+			db.masterSeed = data
+		case kdbxTransformSeed:
+			db.transformSeed = data
+		case kdbxTransformRounds:
+			if size != 8 {
+				return nil, errors.New("invalid KDBX transform rounds")
+			}
+
+			db.transformRounds = binary.LittleEndian.Uint64(data)
+		case kdbxEncryptionIV:
+			db.iv = data
+		case kdbxProtectedStreamKey:
+			db.streamKey = data
+		case kdbxStreamStartBytes:
+			db.streamStart = data
+		case kdbxInnerRandomStream:
+			if size != 4 {
+				return nil, errors.New("invalid KDBX inner random stream")
+			}
+
+			db.streamID = binary.LittleEndian.Uint32(data)
+		case kdbxKdfParameters:
+			if db.kdf, err = readVariantDictionary(data); err != nil {
+				return
+			}
+
+			db.kdfParameters = data
+		case kdbxPublicCustomData:
+			db.customData = data
+		}
+	}
+}
+
+// kdbxCompositeKey combines the master password and key file contents.
+func kdbxCompositeKey(password string, keyFile []byte) (key []byte, err error) {
+	h := sha256.New()
+
+	if password != "" || keyFile == nil {
+		p := sha256.Sum256([]byte(password))
+		h.Write(p[:])
+	}
+
+	if keyFile != nil {
+		k, err := kdbxKeyFileHash(keyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		h.Write(k)
+	}
+
+	return h.Sum(nil), nil
+}
+
+// kdbxKeyFileHash returns the key derived from a key file, in XML (version
+// 1.0 or 2.0), raw (32 bytes), hex (64 characters) or arbitrary format.
+func kdbxKeyFileHash(data []byte) (key []byte, err error) {
+	var keyFile struct {
+		Meta struct {
+			Version string `xml:"Version"`
+		} `xml:"Meta"`
+		Key struct {
+			Data struct {
+				Hash  string `xml:"Hash,attr"`
+				Value string `xml:",chardata"`
+			} `xml:"Data"`
+		} `xml:"Key"`
+	}
+
+	if xml.Unmarshal(data, &keyFile) == nil && keyFile.Key.Data.Value != "" {
+		value := strings.Join(strings.Fields(keyFile.Key.Data.Value), "")
+
+		if strings.HasPrefix(keyFile.Meta.Version, "2.") {
+			if key, err = hex.DecodeString(value); err != nil || len(key) != 32 {
+				return nil, errors.New("invalid KDBX key file")
+			}
+
+			if hash, _ := hex.DecodeString(keyFile.Key.Data.Hash); len(hash) > 0 {
+				sum := sha256.Sum256(key)
+
+				if !bytes.Equal(hash, sum[:len(hash)]) {
+					return nil, errors.New("invalid KDBX key file checksum")
+				}
+			}
+
+			return
+		}
+
+		if key, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, errors.New("invalid KDBX key file")
+		}
+
+		return
+	}
+
+	switch {
+	case len(data) == 32:
+		return data, nil
+	case len(data) == 64:
+		if key, err = hex.DecodeString(string(data)); err == nil {
+			return
+		}
+	}
+
+	sum := sha256.Sum256(data)
+
+	return sum[:], nil
+}
+
+// transformKey applies the database key derivation function to the
+// composite key, AES-KDF rounds are interrupted on job cancellation.
+func (db *kdbxDatabase) transformKey(compositeKey []byte, j *job) (key []byte, err error) {
+	kdfID := kdbxKdfAES
+	seed := db.transformSeed
+	rounds := db.transformRounds
+
+	if db.major >= 4 {
+		id, _ := db.kdf["$UUID"].([]byte)
+		kdfID = id
+		seed, _ = db.kdf["S"].([]byte)
+		rounds, _ = db.kdf["R"].(uint64)
+	}
+
+	switch {
+	case bytes.Equal(kdfID, kdbxKdfAES), bytes.Equal(kdfID, kdbxKdfAES3):
+		if len(seed) != 32 {
+			return nil, errors.New("invalid KDBX AES-KDF seed")
+		}
+
+		if rounds > kdbxMaxRounds {
+			return nil, fmt.Errorf("KDBX AES-KDF rounds exceed limit (%d)", kdbxMaxRounds)
+		}
+
+		block, err := aes.NewCipher(seed)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key = append([]byte{}, compositeKey...)
+
+		for i := uint64(0); i < rounds; i++ {
+			if i%(1<<16) == 0 {
+				if err = j.Err(); err != nil {
+					return nil, err
+				}
+			}
+
+			block.Encrypt(key[0:16], key[0:16])
+			block.Encrypt(key[16:32], key[16:32])
+		}
+
+		sum := sha256.Sum256(key)
+
+		return sum[:], nil
+	case bytes.Equal(kdfID, kdbxKdfArgon2d), bytes.Equal(kdfID, kdbxKdfArgon2id):
+		mode := argon2d
+
+		if bytes.Equal(kdfID, kdbxKdfArgon2id) {
+			mode = argon2id
+		}
+
+		version, _ := db.kdf["V"].(uint64)
+		iterations, _ := db.kdf["I"].(uint64)
+		memory, _ := db.kdf["M"].(uint64)
+		parallelism, _ := db.kdf["P"].(uint64)
+		secret, _ := db.kdf["K"].([]byte)
+		data, _ := db.kdf["A"].([]byte)
+
+		if version != argon2Version {
+			return nil, fmt.Errorf("unsupported Argon2 version %x", version)
+		}
+
+		if len(seed) == 0 || iterations < 1 || parallelism < 1 || parallelism > 255 {
+			return nil, errors.New("invalid KDBX Argon2 parameters")
+		}
+
+		if memory > kdbxMaxMemory {
+			return nil, fmt.Errorf("KDBX Argon2 memory cost exceeds limit (%d bytes)", kdbxMaxMemory)
+		}
+
+		if iterations > kdbxMaxIterations {
+			return nil, fmt.Errorf("KDBX Argon2 iterations exceed limit (%d)", kdbxMaxIterations)
+		}
+
+		return argon2KeyCheck(mode, compositeKey, seed, secret, data, uint32(iterations), uint32(memory/1024), uint8(parallelism), 32, j.Err)
+	}
+
+	return nil, errors.New("unsupported KDBX key derivation function")
+}
+
+// decryptPayload decrypts the database payload with the outer cipher.
+func (db *kdbxDatabase) decryptPayload(key []byte, data []byte) (plaintext []byte, err error) {
+	var block cipher.Block
+
+	switch {
+	case bytes.Equal(db.cipherID, kdbxCipherChaCha20):
+		c, err := chacha20.NewUnauthenticatedCipher(key, db.iv)
+
+		if err != nil {
+			return nil, err
+		}
+
+		plaintext = make([]byte, len(data))
+		c.XORKeyStream(plaintext, data)
+
+		return plaintext, nil
+	case bytes.Equal(db.cipherID, kdbxCipherAES256):
+		block, err = aes.NewCipher(key)
+	case bytes.Equal(db.cipherID, kdbxCipherTwofish):
+		block, err = twofish.NewCipher(key)
+	default:
+		return nil, errors.New("unsupported KDBX cipher")
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(db.iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errKDBXCredentials
+	}
+
+	plaintext = make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, db.iv).CryptBlocks(plaintext, data)
+
+	padding := int(plaintext[len(plaintext)-1])
+
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errKDBXCredentials
+	}
+
+	for _, b := range plaintext[len(plaintext)-padding:] {
+		if int(b) != padding {
+			return nil, errKDBXCredentials
+		}
+	}
+
+	return plaintext[:len(plaintext)-padding], nil
+}
+
+// readHMACBlocks reads the KDBX 4 HMAC authenticated block stream.
+func readHMACBlocks(r *bytes.Reader, hmacKey []byte) (data []byte, err error) {
+	for index := uint64(0); ; index++ {
+		var mac [sha256.Size]byte
+		var size uint32
+
+		if _, err = io.ReadFull(r, mac[:]); err != nil {
+			return nil, errKDBXCredentials
+		}
+
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil || int64(size) > int64(r.Len()) {
+			return nil, errKDBXCredentials
+		}
+
+		block := make([]byte, size)
+
+		if _, err = io.ReadFull(r, block); err != nil {
+			return
+		}
+
+		if !hmac.Equal(mac[:], kdbxBlockHMAC(hmacKey, index, block)) {
+			return nil, errKDBXCredentials
+		}
+
+		if size == 0 {
+			return
+		}
+
+		data = append(data, block...)
+	}
+}
+
+// kdbxBlockHMAC computes the HMAC of a KDBX 4 payload block.
+func kdbxBlockHMAC(hmacKey []byte, index uint64, block []byte) []byte {
+	mac := hmac.New(sha256.New, kdbxBlockKey(hmacKey, index))
+	binary.Write(mac, binary.LittleEndian, index)
+	binary.Write(mac, binary.LittleEndian, uint32(len(block)))
+	mac.Write(block)
+
+	return mac.Sum(nil)
+}
+
+// kdbxHeaderHMAC computes the KDBX 4 header HMAC, unlike payload blocks the
+// header contents are authenticated without index and length.
+func kdbxHeaderHMAC(hmacKey []byte, header []byte) []byte {
+	mac := hmac.New(sha256.New, kdbxBlockKey(hmacKey, ^uint64(0)))
+	mac.Write(header)
+
+	return mac.Sum(nil)
+}
+
+// kdbxBlockKey derives the HMAC key of a KDBX 4 block.
+func kdbxBlockKey(hmacKey []byte, index uint64) []byte {
+	k := sha512.Sum512(append(binary.LittleEndian.AppendUint64(nil, index), hmacKey...))
+	return k[:]
+}
+
+// readHashedBlocks reads the KDBX 3.1 hashed block stream.
+func readHashedBlocks(r *bytes.Reader) (data []byte, err error) {
+	for {
+		var index, size uint32
+		var hash [sha256.Size]byte
+
+		if err = binary.Read(r, binary.LittleEndian, &index); err != nil {
+			return
+		}
+
+		if _, err = io.ReadFull(r, hash[:]); err != nil {
+			return
+		}
+
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil || int64(size) > int64(r.Len()) {
+			return nil, errors.New("invalid KDBX block stream")
+		}
+
+		if size == 0 {
+			return
+		}
+
+		block := make([]byte, size)
+
+		if _, err = io.ReadFull(r, block); err != nil {
+			return
+		}
+
+		if sha256.Sum256(block) != hash {
+			return nil, errors.New("KDBX block hash mismatch")
+		}
+
+		data = append(data, block...)
+	}
+}
+
+// readInnerHeader parses the KDBX 4 inner header, returning the remaining
+// XML document.
+func (db *kdbxDatabase) readInnerHeader(data []byte) (doc []byte, err error) {
+	r := bytes.NewReader(data)
+
+	for {
+		var id uint8
+		var size uint32
+
+		if err = binary.Read(r, binary.LittleEndian, &id); err != nil {
+			return
+		}
+
+		if err = binary.Read(r, binary.LittleEndian, &size); err != nil || int64(size) > int64(r.Len()) {
+			return nil, errors.New("invalid KDBX inner header")
+		}
+
+		field := make([]byte, size)
+
+		if _, err = io.ReadFull(r, field); err != nil {
+			return
+		}
+
+		switch id {
+		case kdbxInnerEndOfHeader:
+			return data[len(data)-r.Len():], nil
+		case kdbxInnerStreamID:
+			if size != 4 {
+				return nil, errors.New("invalid KDBX inner random stream")
+			}
+
+			db.streamID = binary.LittleEndian.Uint32(field)
+		case kdbxInnerStreamKey:
+			db.streamKey = field
+		case kdbxInnerBinary:
+			if size < 1 {
+				return nil, errors.New("invalid KDBX binary")
+			}
+
+			db.binaries = append(db.binaries, field)
+		}
+	}
+}
+
+// salsa20Stream implements a cipher.Stream for the KDBX 3.1 inner random
+// stream.
+type salsa20Stream struct {
+	key     [32]byte
+	counter [16]byte
+	block   [64]byte
+	used    int
+}
+
+func (s *salsa20Stream) XORKeyStream(dst, src []byte) {
+	var zero [64]byte
+
+	for i := range src {
+		if s.used == len(s.block) {
+			salsa.XORKeyStream(s.block[:], zero[:], &s.counter, &s.key)
+			binary.LittleEndian.PutUint64(s.counter[8:], binary.LittleEndian.Uint64(s.counter[8:])+1)
+			s.used = 0
+		}
+
+		dst[i] = src[i] ^ s.block[s.used]
+		s.used++
+	}
+}
+
+// innerStream returns the stream cipher protecting values within the XML
+// document.
+func (db *kdbxDatabase) innerStream() (stream cipher.Stream, err error) {
+	switch db.streamID {
+	case kdbxStreamSalsa20:
+		s := &salsa20Stream{key: sha256.Sum256(db.streamKey)}
+		s.used = len(s.block)
+		copy(s.counter[:], kdbxSalsa20Nonce)
+
+		return s, nil
+	case kdbxStreamChaCha20:
+		h := sha512.Sum512(db.streamKey)
+		return chacha20.NewUnauthenticatedCipher(h[:32], h[32:44])
+	}
+
+	return nil, fmt.Errorf("unsupported KDBX inner random stream %d", db.streamID)
+}
+
+// unprotect decrypts, in document order, all protected values.
+func (n *kdbxNode) unprotect(stream cipher.Stream) (err error) {
+	if n.XMLName.Local == "Value" && strings.EqualFold(n.attr("Protected"), "true") {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(n.Content))
+
+		if err != nil {
+			return errors.New("invalid KDBX protected value")
+		}
+
+		stream.XORKeyStream(data, data)
+		n.Content = string(data)
+	}
+
+	for i := range n.Nodes {
+		if err = n.Nodes[i].unprotect(stream); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// openKDBX decrypts a KeePass database with its master password and,
+// optionally, key file contents. The job, if any, allows cancellation of the
+// key derivation.
+func openKDBX(data []byte, password string, keyFile []byte, j *job) (db *kdbxDatabase, err error) {
+	if len(data) > kdbxMaxSize {
+		return nil, fmt.Errorf("KDBX file exceeds maximum size (%d bytes)", kdbxMaxSize)
+	}
+
+	db = &kdbxDatabase{}
+	r := bytes.NewReader(data)
+
+	header, err := db.readHeader(r)
+
+	if err != nil {
+		return
+	}
+
+	if len(db.masterSeed) != 32 {
+		return nil, errors.New("invalid KDBX master seed")
+	}
+
+	compositeKey, err := kdbxCompositeKey(password, keyFile)
+
+	if err != nil {
+		return
+	}
+
+	transformedKey, err := db.transformKey(compositeKey, j)
+
+	if err != nil {
+		return
+	}
+
+	db.transformedKey = transformedKey
+	key := sha256.Sum256(append(append([]byte{}, db.masterSeed...), transformedKey...))
+
+	var payload []byte
+
+	if db.major >= 4 {
+		var hash, mac [sha256.Size]byte
+
+		io.ReadFull(r, hash[:])
+
+		if _, err = io.ReadFull(r, mac[:]); err != nil {
+			return nil, errors.New("invalid KDBX header")
+		}
+
+		if sha256.Sum256(header) != hash {
+			return nil, errors.New("KDBX header checksum mismatch")
+		}
+
+		hmacKey := sha512.Sum512(append(append(append([]byte{}, db.masterSeed...), transformedKey...), 0x01))
+
+		if !hmac.Equal(mac[:], kdbxHeaderHMAC(hmacKey[:], header)) {
+			return nil, errKDBXCredentials
+		}
+
+		if payload, err = readHMACBlocks(r, hmacKey[:]); err != nil {
+			return
+		}
+
+		if payload, err = db.decryptPayload(key[:], payload); err != nil {
+			return
+		}
+	} else {
+		rest := make([]byte, r.Len())
+		r.Read(rest)
+
+		if payload, err = db.decryptPayload(key[:], rest); err != nil {
+			return
+		}
+
+		if len(payload) < len(db.streamStart) || len(db.streamStart) == 0 || !bytes.Equal(payload[:len(db.streamStart)], db.streamStart) {
+			return nil, errKDBXCredentials
+		}
+
+		if payload, err = readHashedBlocks(bytes.NewReader(payload[len(db.streamStart):])); err != nil {
+			return
+		}
+	}
+
+	if db.compression == 1 {
+		gz, err := gzip.NewReader(bytes.NewReader(payload))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if payload, err = io.ReadAll(io.LimitReader(gz, kdbxMaxSize+1)); err != nil {
+			return nil, err
+		}
+
+		if len(payload) > kdbxMaxSize {
+			return nil, fmt.Errorf("KDBX contents exceed maximum size (%d bytes)", kdbxMaxSize)
+		}
+	}
+
+	if db.major >= 4 {
+		if payload, err = db.readInnerHeader(payload); err != nil {
+			return
+		}
+	}
+
+	if err = xml.Unmarshal(payload, &db.root); err != nil {
+		return nil, fmt.Errorf("invalid KDBX document, %v", err)
+	}
+
+	if db.root.XMLName.Local != "KeePassFile" {
+		return nil, errors.New("invalid KDBX document")
+	}
+
+	stream, err := db.innerStream()
+
+	if err != nil {
+		return
+	}
+
+	if err = db.root.unprotect(stream); err != nil {
+		return
+	}
+
+	return
+}
+
+// walk visits all database groups, excluding the recycle bin, with their
+// path.
+func (db *kdbxDatabase) walk(fn func(group *kdbxNode, path string)) {
+	var walk func(group *kdbxNode, path string)
+
+	recycleBin := ""
+
+	if meta := db.root.child("Meta"); meta != nil && strings.EqualFold(meta.text("RecycleBinEnabled"), "true") {
+		recycleBin = meta.text("RecycleBinUUID")
+	}
+
+	walk = func(group *kdbxNode, path string) {
+		if recycleBin != "" && group.text("UUID") == recycleBin {
+			return
+		}
+
+		if path == "" {
+			path = group.text("Name")
+		} else {
+			path += "/" + group.text("Name")
+		}
+
+		fn(group, path)
+
+		for i := range group.Nodes {
+			if group.Nodes[i].XMLName.Local == "Group" {
+				walk(&group.Nodes[i], path)
+			}
+		}
+	}
+
+	if root := db.root.child("Root"); root != nil {
+		if group := root.child("Group"); group != nil {
+			walk(group, "")
+		}
+	}
+}
+
+// groups returns all database groups, excluding the recycle bin.
+func (db *kdbxDatabase) groups() (groups []kdbxGroup) {
+	db.walk(func(group *kdbxNode, path string) {
+		g := kdbxGroup{
+			UUID: kdbxUUID(group.text("UUID")),
+			Name: group.text("Name"),
+			Path: path,
+		}
+
+		for _, n := range group.Nodes {
+			if n.XMLName.Local == "Entry" {
+				g.Entries++
+			}
+		}
+
+		groups = append(groups, g)
+	})
+
+	return
+}
+
+// entries returns all database entries, excluding history and recycled
+// entries, with their group path.
+func (db *kdbxDatabase) entries() (entries []kdbxEntry) {
+	db.walk(func(group *kdbxNode, path string) {
+		for i := range group.Nodes {
+			if group.Nodes[i].XMLName.Local == "Entry" {
+				entries = append(entries, newKDBXEntry(&group.Nodes[i], group, path))
+			}
+		}
+	})
+
+	return
+}
+
+// entry returns the entry, excluding history and recycled entries, matching
+// the UUID in hex format.
+func (db *kdbxDatabase) entry(uuid string) (e *kdbxNode, group *kdbxNode, path string) {
+	db.walk(func(g *kdbxNode, p string) {
+		for i := range g.Nodes {
+			if n := &g.Nodes[i]; e == nil && n.XMLName.Local == "Entry" && kdbxUUID(n.text("UUID")) == strings.ToLower(uuid) {
+				e, group, path = n, g, p
+			}
+		}
+	})
+
+	return
+}
+
+func newKDBXEntry(n *kdbxNode, group *kdbxNode, path string) (e kdbxEntry) {
+	e = kdbxEntry{
+		UUID:      kdbxUUID(n.text("UUID")),
+		Group:     path,
+		GroupUUID: kdbxUUID(group.text("UUID")),
+		Fields:    make(map[string]string),
+		Protected: make(map[string]bool),
+	}
+
+	for _, s := range n.Nodes {
+		if s.XMLName.Local != "String" {
+			continue
+		}
+
+		if v := s.child("Value"); v != nil {
+			e.Fields[s.text("Key")] = v.Content
+			e.Protected[s.text("Key")] = strings.EqualFold(v.attr("Protected"), "true")
+		}
+	}
+
+	return
+}
+
+// kdbxUUID converts a base64 encoded UUID to hex format.
+func kdbxUUID(s string) string {
+	uuid, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+
+	if err != nil {
+		return s
+	}
+
+	return hex.EncodeToString(uuid)
+}
+
+// kdbxTime returns the KDBX 4 representation of a timestamp.
+func kdbxTime(t time.Time) string {
+	return base64.StdEncoding.EncodeToString(binary.LittleEndian.AppendUint64(nil, uint64(t.Unix()+kdbxEpoch)))
+}
+
+// clone returns a deep copy of the element.
+func (n *kdbxNode) clone() (c kdbxNode) {
+	c = *n
+	c.Attrs = append([]xml.Attr{}, n.Attrs...)
+	c.Nodes = make([]kdbxNode, len(n.Nodes))
+
+	for i := range n.Nodes {
+		c.Nodes[i] = n.Nodes[i].clone()
+	}
+
+	return
+}
+
+// setField sets, or adds, an entry string field. The previous entry state is
+// preserved in its history, as done by KeePass.
+func (db *kdbxDatabase) setField(e *kdbxNode, name string, value string, protected bool) {
+	backup := e.clone()
+	backup.Nodes = nil
+
+	for _, n := range e.Nodes {
+		if n.XMLName.Local != "History" {
+			backup.Nodes = append(backup.Nodes, n.clone())
+		}
+	}
+
+	history := e.child("History")
+
+	if history == nil {
+		e.Nodes = append(e.Nodes, kdbxNode{XMLName: xml.Name{Local: "History"}})
+		history = &e.Nodes[len(e.Nodes)-1]
+	}
+
+	history.Nodes = append(history.Nodes, backup)
+
+	var field *kdbxNode
+
+	for i := range e.Nodes {
+		if e.Nodes[i].XMLName.Local == "String" && e.Nodes[i].text("Key") == name {
+			field = &e.Nodes[i]
+		}
+	}
+
+	if field == nil {
+		e.Nodes = append(e.Nodes, kdbxNode{
+			XMLName: xml.Name{Local: "String"},
+			Nodes: []kdbxNode{
+				{XMLName: xml.Name{Local: "Key"}, Content: name},
+				{XMLName: xml.Name{Local: "Value"}},
+			},
+		})
+
+		field = &e.Nodes[len(e.Nodes)-1]
+	}
+
+	v := field.child("Value")
+
+	if v == nil {
+		field.Nodes = append(field.Nodes, kdbxNode{XMLName: xml.Name{Local: "Value"}})
+		v = &field.Nodes[len(field.Nodes)-1]
+	}
+
+	v.Content = value
+	v.Attrs = nil
+
+	if protected {
+		v.Attrs = []xml.Attr{{Name: xml.Name{Local: "Protected"}, Value: "True"}}
+	}
+
+	if times := e.child("Times"); times != nil {
+		now := kdbxTime(time.Now())
+
+		for i := range times.Nodes {
+			switch times.Nodes[i].XMLName.Local {
+			case "LastModificationTime", "LastAccessTime":
+				times.Nodes[i].Content = now
+			}
+		}
+	}
+}
+
+// protect returns a copy of the element where, in document order, all
+// protected values are encrypted.
+func (n *kdbxNode) protect(stream cipher.Stream) (c kdbxNode) {
+	c = *n
+	c.Nodes = make([]kdbxNode, len(n.Nodes))
+
+	if len(n.Nodes) > 0 && strings.TrimSpace(n.Content) == "" {
+		c.Content = ""
+	}
+
+	if n.XMLName.Local == "Value" && strings.EqualFold(n.attr("Protected"), "true") {
+		data := []byte(n.Content)
+		stream.XORKeyStream(data, data)
+		c.Content = base64.StdEncoding.EncodeToString(data)
+	}
+
+	for i := range n.Nodes {
+		c.Nodes[i] = n.Nodes[i].protect(stream)
+	}
+
+	return
+}
+
+// encryptPayload encrypts the database payload with the outer cipher.
+func encryptPayload(cipherID []byte, key []byte, iv []byte, data []byte) (ciphertext []byte, err error) {
+	var block cipher.Block
+
+	switch {
+	case bytes.Equal(cipherID, kdbxCipherChaCha20):
+		c, err := chacha20.NewUnauthenticatedCipher(key, iv)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ciphertext = make([]byte, len(data))
+		c.XORKeyStream(ciphertext, data)
+
+		return ciphertext, nil
+	case bytes.Equal(cipherID, kdbxCipherAES256):
+		block, err = aes.NewCipher(key)
+	case bytes.Equal(cipherID, kdbxCipherTwofish):
+		block, err = twofish.NewCipher(key)
+	default:
+		return nil, errors.New("unsupported KDBX cipher")
+	}
+
+	if err != nil {
+		return
+	}
+
+	padding := block.BlockSize() - len(data)%block.BlockSize()
+	plaintext := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	ciphertext = make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, plaintext)
+
+	return
+}
+
+// write serializes the database in KDBX 4 format, fresh master seed,
+// encryption IV and inner stream key are generated on each write.
+func (db *kdbxDatabase) write() (data []byte, err error) {
+	if db.major < 4 || db.kdfParameters == nil {
+		return nil, errors.New("writing is only supported for KDBX 4 databases")
+	}
+
+	ivSize := aes.BlockSize
+
+	if bytes.Equal(db.cipherID, kdbxCipherChaCha20) {
+		ivSize = chacha20.NonceSize
+	}
+
+	masterSeed := make([]byte, 32)
+	iv := make([]byte, ivSize)
+	streamKey := make([]byte, 64)
+
+	for _, b := range [][]byte{masterSeed, iv, streamKey} {
+		if _, err = rand.Read(b); err != nil {
+			return
+		}
+	}
+
+	field := func(w *bytes.Buffer, id uint8, data []byte) {
+		w.WriteByte(id)
+		binary.Write(w, binary.LittleEndian, uint32(len(data)))
+		w.Write(data)
+	}
+
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.LittleEndian, []uint32{kdbxSignature1, kdbxSignature2, uint32(db.major)<<16 | uint32(db.minor)})
+
+	field(header, kdbxCipherID, db.cipherID)
+	field(header, kdbxCompressionFlags, binary.LittleEndian.AppendUint32(nil, db.compression))
+	field(header, kdbxMasterSeed, masterSeed)
+	field(header, kdbxEncryptionIV, iv)
+	field(header, kdbxKdfParameters, db.kdfParameters)
+
+	if db.customData != nil {
+		field(header, kdbxPublicCustomData, db.customData)
+	}
+
+	field(header, kdbxEndOfHeader, []byte("\r\n\r\n"))
+
+	inner := new(bytes.Buffer)
+	field(inner, kdbxInnerStreamID, binary.LittleEndian.AppendUint32(nil, kdbxStreamChaCha20))
+	field(inner, kdbxInnerStreamKey, streamKey)
+
+	for _, b := range db.binaries {
+		field(inner, kdbxInnerBinary, b)
+	}
+
+	field(inner, kdbxInnerEndOfHeader, nil)
+
+	h := sha512.Sum512(streamKey)
+	stream, err := chacha20.NewUnauthenticatedCipher(h[:32], h[32:44])
+
+	if err != nil {
+		return
+	}
+
+	doc, err := xml.Marshal(db.root.protect(stream))
+
+	if err != nil {
+		return
+	}
+
+	inner.WriteString(xml.Header)
+	inner.Write(doc)
+
+	payload := inner.Bytes()
+
+	if db.compression == 1 {
+		buf := new(bytes.Buffer)
+		gz := gzip.NewWriter(buf)
+
+		if _, err = gz.Write(payload); err == nil {
+			err = gz.Close()
+		}
+
+		if err != nil {
+			return
+		}
+
+		payload = buf.Bytes()
+	}
+
+	seedKey := append(append([]byte{}, masterSeed...), db.transformedKey...)
+	key := sha256.Sum256(seedKey)
+	hmacKey := sha512.Sum512(append(seedKey, 0x01))
+
+	if payload, err = encryptPayload(db.cipherID, key[:], iv, payload); err != nil {
+		return
+	}
+
+	out := bytes.NewBuffer(append([]byte{}, header.Bytes()...))
+	hash := sha256.Sum256(header.Bytes())
+
+	out.Write(hash[:])
+	out.Write(kdbxHeaderHMAC(hmacKey[:], header.Bytes()))
+
+	for index := uint64(0); ; index++ {
+		block := payload[:min(len(payload), kdbxBlockSize)]
+		payload = payload[len(block):]
+
+		out.Write(kdbxBlockHMAC(hmacKey[:], index, block))
+		binary.Write(out, binary.LittleEndian, uint32(len(block)))
+		out.Write(block)
+
+		if len(block) == 0 {
+			break
+		}
+	}
+
+	return out.Bytes(), nil
+}
@@ -0,0 +1,423 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testKDBXDocument = `<?xml version="1.0" encoding="utf-8" standalone="yes"?>
+<KeePassFile>
+	<Meta>
+		<RecycleBinEnabled>True</RecycleBinEnabled>
+		<RecycleBinUUID>cmVjeWNsZWQ=</RecycleBinUUID>
+	</Meta>
+	<Root>
+		<Group>
+			<UUID>cm9vdA==</UUID>
+			<Name>Root</Name>
+			<Entry>
+				<UUID>ZW50cnkx</UUID>
+				<String><Key>Title</Key><Value>Mail</Value></String>
+				<String><Key>UserName</Key><Value>alice</Value></String>
+				<String><Key>Password</Key><Value Protected="True">%s</Value></String>
+				<History>
+					<Entry>
+						<UUID>ZW50cnkx</UUID>
+						<String><Key>Password</Key><Value Protected="True">%s</Value></String>
+					</Entry>
+				</History>
+			</Entry>
+			<Group>
+				<UUID>d2Vi</UUID>
+				<Name>Web</Name>
+				<Entry>
+					<UUID>ZW50cnky</UUID>
+					<String><Key>Title</Key><Value>Forum</Value></String>
+					<String><Key>Password</Key><Value Protected="True">%s</Value></String>
+					<String><Key>otp</Key><Value Protected="True">%s</Value></String>
+				</Entry>
+			</Group>
+			<Group>
+				<UUID>cmVjeWNsZWQ=</UUID>
+				<Name>Recycle Bin</Name>
+				<Entry>
+					<UUID>ZW50cnkz</UUID>
+					<String><Key>Title</Key><Value>Deleted</Value></String>
+				</Entry>
+			</Group>
+		</Group>
+	</Root>
+</KeePassFile>`
+
+var testKDBXSecrets = []string{"s3cret", "old", "pässwörd", "otpauth://totp/forum?secret=JBSWY3DPEHPK3PXP"}
+
+func testVariantDictionary(entries map[string]interface{}) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, uint16(0x0100))
+
+	for name, value := range entries {
+		var kind uint8
+		var data []byte
+
+		switch v := value.(type) {
+		case uint32:
+			kind, data = 0x04, binary.LittleEndian.AppendUint32(nil, v)
+		case uint64:
+			kind, data = 0x05, binary.LittleEndian.AppendUint64(nil, v)
+		case []byte:
+			kind, data = 0x42, v
+		}
+
+		buf.WriteByte(kind)
+		binary.Write(buf, binary.LittleEndian, uint32(len(name)))
+		buf.WriteString(name)
+		binary.Write(buf, binary.LittleEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+
+	buf.WriteByte(0)
+
+	return buf.Bytes()
+}
+
+// testKDBX builds an AES-256 encrypted, gzip compressed, database.
+func testKDBX(t *testing.T, major uint16, kdf map[string]interface{}, password string) []byte {
+	db := &kdbxDatabase{
+		major:       major,
+		masterSeed:  bytes.Repeat([]byte{1}, 32),
+		iv:          bytes.Repeat([]byte{2}, 16),
+		streamKey:   bytes.Repeat([]byte{3}, 32),
+		streamStart: bytes.Repeat([]byte{4}, 32),
+	}
+
+	header := new(bytes.Buffer)
+	binary.Write(header, binary.LittleEndian, []uint32{kdbxSignature1, kdbxSignature2, uint32(major) << 16})
+
+	field := func(w *bytes.Buffer, id uint8, data []byte) {
+		w.WriteByte(id)
+
+		if w == header && major == 3 {
+			binary.Write(w, binary.LittleEndian, uint16(len(data)))
+		} else {
+			binary.Write(w, binary.LittleEndian, uint32(len(data)))
+		}
+
+		w.Write(data)
+	}
+
+	field(header, kdbxCipherID, kdbxCipherAES256)
+	field(header, kdbxCompressionFlags, []byte{1, 0, 0, 0})
+	field(header, kdbxMasterSeed, db.masterSeed)
+	field(header, kdbxEncryptionIV, db.iv)
+
+	if major == 3 {
+		db.transformSeed = kdf["S"].([]byte)
+		db.transformRounds = kdf["R"].(uint64)
+		db.streamID = kdbxStreamSalsa20
+
+		field(header, kdbxTransformSeed, db.transformSeed)
+		field(header, kdbxTransformRounds, binary.LittleEndian.AppendUint64(nil, db.transformRounds))
+		field(header, kdbxProtectedStreamKey, db.streamKey)
+		field(header, kdbxStreamStartBytes, db.streamStart)
+		field(header, kdbxInnerRandomStream, []byte{kdbxStreamSalsa20, 0, 0, 0})
+	} else {
+		db.streamID = kdbxStreamChaCha20
+		db.kdf, _ = readVariantDictionary(testVariantDictionary(kdf))
+		field(header, kdbxKdfParameters, testVariantDictionary(kdf))
+	}
+
+	field(header, kdbxEndOfHeader, nil)
+
+	compositeKey, _ := kdbxCompositeKey(password, nil)
+	transformedKey, err := db.transformKey(compositeKey, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, _ := db.innerStream()
+	var values []interface{}
+
+	for _, s := range testKDBXSecrets {
+		data := []byte(s)
+		stream.XORKeyStream(data, data)
+		values = append(values, base64.StdEncoding.EncodeToString(data))
+	}
+
+	inner := new(bytes.Buffer)
+
+	if major >= 4 {
+		field(inner, kdbxInnerStreamID, []byte{kdbxStreamChaCha20, 0, 0, 0})
+		field(inner, kdbxInnerStreamKey, db.streamKey)
+		field(inner, kdbxInnerEndOfHeader, nil)
+	}
+
+	fmt.Fprintf(inner, testKDBXDocument, values...)
+
+	payload := new(bytes.Buffer)
+	gz := gzip.NewWriter(payload)
+	gz.Write(inner.Bytes())
+	gz.Close()
+
+	plaintext := payload.Bytes()
+
+	if major == 3 {
+		blocks := new(bytes.Buffer)
+		hash := sha256.Sum256(plaintext)
+
+		blocks.Write(db.streamStart)
+		binary.Write(blocks, binary.LittleEndian, uint32(0))
+		blocks.Write(hash[:])
+		binary.Write(blocks, binary.LittleEndian, uint32(len(plaintext)))
+		blocks.Write(plaintext)
+		blocks.Write(make([]byte, 4+32+4))
+		plaintext = blocks.Bytes()
+	}
+
+	key := sha256.Sum256(append(append([]byte{}, db.masterSeed...), transformedKey...))
+	block, _ := aes.NewCipher(key[:])
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	plaintext = append(plaintext, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewCBCEncrypter(block, db.iv).CryptBlocks(ciphertext, plaintext)
+
+	out := bytes.NewBuffer(append([]byte{}, header.Bytes()...))
+
+	if major == 3 {
+		out.Write(ciphertext)
+		return out.Bytes()
+	}
+
+	hmacKey := sha512.Sum512(append(append(append([]byte{}, db.masterSeed...), transformedKey...), 0x01))
+	hash := sha256.Sum256(header.Bytes())
+
+	out.Write(hash[:])
+	out.Write(kdbxHeaderHMAC(hmacKey[:], header.Bytes()))
+
+	out.Write(kdbxBlockHMAC(hmacKey[:], 0, ciphertext))
+	binary.Write(out, binary.LittleEndian, uint32(len(ciphertext)))
+	out.Write(ciphertext)
+	out.Write(kdbxBlockHMAC(hmacKey[:], 1, nil))
+	binary.Write(out, binary.LittleEndian, uint32(0))
+
+	return out.Bytes()
+}
+
+func TestKDBX(t *testing.T) {
+	seed := bytes.Repeat([]byte{5}, 32)
+
+	databases := map[string][]byte{
+		"KDBX 3.1 AES-KDF": testKDBX(t, 3, map[string]interface{}{"S": seed, "R": uint64(100)}, "password"),
+		"KDBX 4 AES-KDF":   testKDBX(t, 4, map[string]interface{}{"$UUID": kdbxKdfAES, "S": seed, "R": uint64(100)}, "password"),
+		"KDBX 4 Argon2d": testKDBX(t, 4, map[string]interface{}{
+			"$UUID": kdbxKdfArgon2d, "S": seed, "V": uint32(0x13), "I": uint64(2), "M": uint64(64 * 1024), "P": uint32(2),
+		}, "password"),
+	}
+
+	for name, data := range databases {
+		if _, err := openKDBX(data, "wrong", nil, nil); err == nil {
+			t.Errorf("%s: wrong password accepted", name)
+		}
+
+		db, err := openKDBX(data, "password", nil, nil)
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		entries := db.entries()
+
+		if len(entries) != 2 {
+			t.Fatalf("%s: unexpected number of entries (%d)", name, len(entries))
+		}
+
+		if e := entries[0]; e.Group != "Root" || e.Fields["Title"] != "Mail" || e.Fields["Password"] != "s3cret" || !e.Protected["Password"] {
+			t.Errorf("%s: unexpected entry %+v", name, e)
+		}
+
+		if e := entries[1]; e.Group != "Root/Web" || e.Fields["Password"] != "pässwörd" || e.Fields["otp"] != testKDBXSecrets[3] {
+			t.Errorf("%s: unexpected entry %+v", name, e)
+		}
+	}
+}
+
+// TestKDBXFixtures opens databases generated by an independent
+// implementation (see testdata/kdbx/README).
+func TestKDBXFixtures(t *testing.T) {
+	fixtures := []string{
+		"kdbx31-aeskdf.kdbx",
+		"kdbx4-aeskdf-aes.kdbx",
+		"kdbx4-argon2d-aes.kdbx",
+		"kdbx4-argon2id-chacha20.kdbx",
+	}
+
+	check := func(name string, db *kdbxDatabase) {
+		entries := db.entries()
+
+		if len(entries) != 2 {
+			t.Fatalf("%s: unexpected number of entries (%d)", name, len(entries))
+		}
+
+		mail := entries[0]
+
+		if mail.UUID != "b83a886a5c437ccd9ac15473fd6f1788" || mail.Group != "Root" || mail.Fields["Title"] != "Mail" ||
+			mail.Fields["UserName"] != "alice" || mail.Fields["Password"] != "s3cret" || !mail.Protected["Password"] ||
+			mail.Fields["Notes"] != "line 1\nline 2" || mail.Fields["URL"] != "https://mail.example" {
+			t.Errorf("%s: unexpected entry %+v", name, mail)
+		}
+
+		forum := entries[1]
+
+		if forum.UUID != "bbdbe444288550204c968fe7002a97a9" || forum.Group != "Root/Web" || forum.Fields["Password"] != "pässwörd" ||
+			forum.Fields["otp"] != "otpauth://totp/forum?secret=JBSWY3DPEHPK3PXP&period=30&digits=6" || !forum.Protected["otp"] {
+			t.Errorf("%s: unexpected entry %+v", name, forum)
+		}
+
+		n, _, _ := db.entry(mail.UUID)
+
+		if history := n.child("History"); history == nil || len(history.Nodes) != 1 || newKDBXEntry(&history.Nodes[0], n, "").Fields["Password"] != "old secret" {
+			t.Errorf("%s: unexpected entry history", name)
+		}
+	}
+
+	for _, name := range fixtures {
+		data, err := os.ReadFile(filepath.Join("testdata", "kdbx", name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = openKDBX(data, "wrong", nil, nil); err == nil {
+			t.Errorf("%s: wrong password accepted", name)
+		}
+
+		db, err := openKDBX(data, "password", nil, nil)
+
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		check(name, db)
+
+		if db.major < 4 {
+			continue
+		}
+
+		// written databases must re-open with unchanged contents
+		if data, err = db.write(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if db, err = openKDBX(data, "password", nil, nil); err != nil {
+			t.Fatalf("%s: written database, %v", name, err)
+		}
+
+		check(name+" (written)", db)
+	}
+}
+
+func TestKDBXLimits(t *testing.T) {
+	seed := bytes.Repeat([]byte{5}, 32)
+	compositeKey := make([]byte, 32)
+
+	db := &kdbxDatabase{major: 3, transformSeed: seed, transformRounds: kdbxMaxRounds + 1}
+
+	if _, err := db.transformKey(compositeKey, nil); err == nil {
+		t.Error("excessive AES-KDF rounds accepted")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	db.transformRounds = 1 << 20
+
+	if _, err := db.transformKey(compositeKey, &job{ctx: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("AES-KDF not interrupted on cancellation (%v)", err)
+	}
+
+	db = &kdbxDatabase{major: 4}
+	db.kdf, _ = readVariantDictionary(testVariantDictionary(map[string]interface{}{"$UUID": kdbxKdfArgon2d, "S": seed, "V": uint32(0x13), "I": uint64(2), "M": uint64(1 << 20), "P": uint32(1)}))
+
+	if _, err := db.transformKey(compositeKey, &job{ctx: ctx}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Argon2 not interrupted on cancellation (%v)", err)
+	}
+
+	for _, kdf := range []map[string]interface{}{
+		{"$UUID": kdbxKdfArgon2id, "S": seed, "V": uint32(0x13), "I": uint64(2), "M": uint64(kdbxMaxMemory * 2), "P": uint32(2)},
+		{"$UUID": kdbxKdfArgon2id, "S": seed, "V": uint32(0x13), "I": uint64(kdbxMaxIterations + 1), "M": uint64(1024), "P": uint32(1)},
+	} {
+		db = &kdbxDatabase{major: 4}
+		db.kdf, _ = readVariantDictionary(testVariantDictionary(kdf))
+
+		if _, err := db.transformKey(compositeKey, nil); err == nil {
+			t.Errorf("excessive Argon2 parameters accepted %v", kdf)
+		}
+	}
+}
+
+func TestKDBXVariantDictionary(t *testing.T) {
+	malformed := [][]byte{
+		// name length exceeding the dictionary
+		{0x00, 0x01, 0x04, 0xf0, 0xff, 0xff, 0x7f},
+		// value length exceeding the dictionary
+		{0x00, 0x01, 0x04, 0x01, 0x00, 0x00, 0x00, 0x41, 0xff, 0xff, 0xff, 0x7f},
+		// truncated entry
+		{0x00, 0x01, 0x04, 0x01, 0x00},
+	}
+
+	for _, data := range malformed {
+		if _, err := readVariantDictionary(data); err == nil {
+			t.Errorf("malformed variant dictionary accepted %x", data)
+		}
+	}
+}
+
+func TestKDBXKeyFile(t *testing.T) {
+	key := bytes.Repeat([]byte{0xaa}, 32)
+
+	sum := sha256.Sum256(key)
+	v2 := fmt.Sprintf(`<KeyFile><Meta><Version>2.0</Version></Meta><Key><Data Hash="%X">
+		AAAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA AAAAAAAA
+	</Data></Key></KeyFile>`, sum[:4])
+
+	v1 := []byte(`<KeyFile><Meta><Version>1.00</Version></Meta><Key><Data>` + base64.StdEncoding.EncodeToString(key) + `</Data></Key></KeyFile>`)
+
+	if k, err := kdbxKeyFileHash(v1); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("unexpected XML v1 key file hash %x (%v)", k, err)
+	}
+
+	if k, err := kdbxKeyFileHash([]byte(v2)); err != nil || !bytes.Equal(k, key) {
+		t.Errorf("unexpected XML v2 key file hash %x (%v)", k, err)
+	}
+
+	if _, err := kdbxKeyFileHash(bytes.Replace([]byte(v2), []byte("AAAA "), []byte("AAAB "), 1)); err == nil {
+		t.Error("XML v2 key file checksum mismatch not detected")
+	}
+
+	if k, _ := kdbxKeyFileHash(key); !bytes.Equal(k, key) {
+		t.Errorf("unexpected raw key file hash %x", k)
+	}
+
+	if k, _ := kdbxKeyFileHash([]byte("arbitrary")); len(k) != 32 {
+		t.Errorf("unexpected arbitrary key file hash %x", k)
+	}
+}
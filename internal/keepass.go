@@ -0,0 +1,840 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeePass databases stored on the encrypted volume are opened server-side,
+// their key files are kept in key storage under the KDBX cipher. Opened
+// databases are held in memory, until closed or expired, to avoid repeating
+// the (memory-hard) key derivation on each request.
+
+type keePass struct {
+	info    cipherInfo
+	keyFile []byte
+}
+
+// kdbxSession represents a database opened server-side.
+type kdbxSession struct {
+	sync.Mutex
+
+	db       *kdbxDatabase
+	osPath   string
+	sum      [sha256.Size]byte
+	modified bool
+	expires  time.Time
+}
+
+var kdbxSessions = struct {
+	sync.Mutex
+	open map[string]*kdbxSession
+}{
+	open: make(map[string]*kdbxSession),
+}
+
+// fields holding TOTP seeds, as used by KeePass and KeePassXC
+var kdbxTOTPFields = []string{"otp", "TimeOtp-Secret-Base32", "TOTP Seed"}
+
+func init() {
+	conf.SetAvailableCipher(new(keePass).Init())
+}
+
+func (k *keePass) Init() cipherInterface {
+	k.info = cipherInfo{
+		Name:        "KDBX",
+		Description: "KeePass database (KDBX 3.1/4.x) key file",
+		KeyFormat:   "keyx",
+		Enc:         false,
+		Dec:         false,
+		Sig:         false,
+		OTP:         false,
+		Msg:         false,
+		Extension:   "kdbx",
+	}
+
+	return k
+}
+
+func (k *keePass) New() cipherInterface {
+	return new(keePass).Init()
+}
+
+func (k *keePass) GetInfo() cipherInfo {
+	return k.info
+}
+
+func (k *keePass) GetKeyInfo(key key) (info string, err error) {
+	if err = k.SetKey(key); err != nil {
+		return
+	}
+
+	format := "hashed file"
+
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(k.keyFile), []byte("<")):
+		format = "XML"
+	case len(k.keyFile) == 32:
+		format = "raw 256-bit key"
+	case len(k.keyFile) == 64:
+		format = "hex encoded 256-bit key"
+	}
+
+	info = fmt.Sprintf("KeePass key file (%s, %d bytes)\n", format, len(k.keyFile))
+
+	return
+}
+
+func (k *keePass) SetKey(key key) (err error) {
+	data, err := readKey(key)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = kdbxKeyFileHash(data); err != nil {
+		return
+	}
+
+	k.keyFile = data
+
+	return
+}
+
+func (k *keePass) GenKey(i string, e string) (p string, s string, err error) {
+	err = errors.New("cipher does not support key generation")
+	return
+}
+
+func (k *keePass) SetPassword(password string) error {
+	return errors.New("cipher does not support passwords")
+}
+
+func (k *keePass) Encrypt(input io.Reader, output io.Writer, _ bool) error {
+	return errors.New("cipher does not support encryption")
+}
+
+func (k *keePass) Decrypt(input io.Reader, output io.Writer, verify bool) error {
+	return errors.New("cipher does not support decryption")
+}
+
+func (k *keePass) Sign(input io.Reader, output io.Writer) error {
+	return errors.New("cipher does not support signing")
+}
+
+func (k *keePass) Verify(input io.Reader, signature io.Reader) error {
+	return errors.New("cipher does not support signature verification")
+}
+
+func (k *keePass) GenOTP(timestamp int64) (otp string, exp int64, err error) {
+	err = errors.New("cipher does not support OTP generation")
+	return
+}
+
+// kdbxKeyFile returns the contents of a KeePass key file within key storage.
+func kdbxKeyFile(ref string) (data []byte, err error) {
+	osPath, err := absolutePath(ref)
+
+	if err != nil {
+		return
+	}
+
+	if inKeyPath, private := detectKeyPath(osPath); !inKeyPath || !private {
+		return nil, fmt.Errorf("%s is not a private key within key storage", ref)
+	}
+
+	k, cipher, err := getKey(osPath)
+
+	if err != nil {
+		return
+	}
+
+	if _, ok := cipher.(*keePass); !ok {
+		return nil, fmt.Errorf("%s is not a KDBX key", ref)
+	}
+
+	cipher = cipher.New()
+
+	if err = cipher.SetKey(k); err != nil {
+		return
+	}
+
+	return cipher.(*keePass).keyFile, nil
+}
+
+// readKDBXFile reads a database file, which is never read past the maximum
+// database size.
+func readKDBXFile(osPath string) (data []byte, err error) {
+	f, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	if data, err = io.ReadAll(io.LimitReader(f, kdbxMaxSize+1)); err != nil {
+		return
+	}
+
+	if len(data) > kdbxMaxSize {
+		return nil, fmt.Errorf("KDBX file exceeds maximum size (%d bytes)", kdbxMaxSize)
+	}
+
+	return
+}
+
+// openKDBXSession opens a database, returning its session identifier. The
+// job, if any, allows cancellation of the key derivation.
+func openKDBXSession(osPath string, password string, keyFile []byte, j *job) (id string, s *kdbxSession, err error) {
+	data, err := readKDBXFile(osPath)
+
+	if err != nil {
+		return
+	}
+
+	db, err := openKDBX(data, password, keyFile, j)
+
+	if err != nil {
+		return
+	}
+
+	if id, err = newVaultID(); err != nil {
+		return
+	}
+
+	s = &kdbxSession{
+		db:     db,
+		osPath: osPath,
+		sum:    sha256.Sum256(data),
+	}
+
+	s.touch()
+
+	kdbxSessions.Lock()
+
+	for expiredID, expired := range kdbxSessions.open {
+		expired.Lock()
+
+		if expired.expired() {
+			delete(kdbxSessions.open, expiredID)
+			expired.clear()
+		}
+
+		expired.Unlock()
+	}
+
+	kdbxSessions.open[id] = s
+	kdbxSessions.Unlock()
+
+	status.Log(syslog.LOG_NOTICE, "opened KeePass database %s", relativePath(osPath))
+
+	return
+}
+
+// touch extends the session expiration.
+func (s *kdbxSession) touch() {
+	if conf.KDBXTimeout > 0 {
+		s.expires = time.Now().Add(time.Duration(conf.KDBXTimeout) * time.Second)
+	}
+}
+
+func (s *kdbxSession) expired() bool {
+	return !s.expires.IsZero() && time.Now().After(s.expires)
+}
+
+// clear disposes of the session database.
+func (s *kdbxSession) clear() {
+	if s.modified {
+		status.Log(syslog.LOG_WARNING, "discarding unsaved changes to KeePass database %s", relativePath(s.osPath))
+	}
+
+	for i := range s.db.transformedKey {
+		s.db.transformedKey[i] = 0
+	}
+
+	s.db = nil
+
+	status.Log(syslog.LOG_NOTICE, "closed KeePass database %s", relativePath(s.osPath))
+}
+
+// getKDBXSession returns a locked, unexpired, session.
+func getKDBXSession(id string) (s *kdbxSession, err error) {
+	kdbxSessions.Lock()
+	defer kdbxSessions.Unlock()
+
+	s, ok := kdbxSessions.open[id]
+
+	if !ok {
+		return nil, errors.New("invalid or expired KeePass database session")
+	}
+
+	s.Lock()
+
+	if s.expired() {
+		delete(kdbxSessions.open, id)
+		s.clear()
+		s.Unlock()
+
+		return nil, errors.New("invalid or expired KeePass database session")
+	}
+
+	s.touch()
+
+	return
+}
+
+// closeKDBXSession closes an opened database.
+func closeKDBXSession(id string) (err error) {
+	kdbxSessions.Lock()
+	s, ok := kdbxSessions.open[id]
+	delete(kdbxSessions.open, id)
+	kdbxSessions.Unlock()
+
+	if !ok {
+		return errors.New("invalid or expired KeePass database session")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.clear()
+
+	return
+}
+
+// closeKDBXSessions closes all opened databases.
+func closeKDBXSessions() {
+	kdbxSessions.Lock()
+	defer kdbxSessions.Unlock()
+
+	for id, s := range kdbxSessions.open {
+		s.Lock()
+		s.clear()
+		s.Unlock()
+
+		delete(kdbxSessions.open, id)
+	}
+}
+
+// save writes the database back to its file, which must not have been
+// modified since the database was opened.
+func (s *kdbxSession) save() (err error) {
+	info, err := regularFile(s.osPath)
+
+	if err != nil {
+		return
+	}
+
+	current, err := readKDBXFile(s.osPath)
+
+	if err != nil {
+		return
+	}
+
+	if sha256.Sum256(current) != s.sum {
+		return fmt.Errorf("%s has been modified since it was opened", relativePath(s.osPath))
+	}
+
+	data, err := s.db.write()
+
+	if err != nil {
+		return
+	}
+
+	if err = writeText(s.osPath, data, info); err != nil {
+		return
+	}
+
+	s.sum = sha256.Sum256(data)
+	s.modified = false
+
+	status.Log(syslog.LOG_NOTICE, "saved KeePass database %s", relativePath(s.osPath))
+
+	return
+}
+
+// totpSeed returns the entry TOTP secret, if any.
+func (e *kdbxEntry) totpSeed() string {
+	for _, f := range kdbxTOTPFields {
+		if s := e.Fields[f]; s != "" {
+			return s
+		}
+	}
+
+	return ""
+}
+
+// otp returns the current code for the entry TOTP secret.
+func (e *kdbxEntry) otp() (otp string, exp int64, err error) {
+	s := e.totpSeed()
+
+	if s == "" {
+		return "", 0, errors.New("entry has no TOTP secret")
+	}
+
+	seed, err := parseTOTPSeed(s)
+
+	if err != nil {
+		return
+	}
+
+	totp := new(tOTP)
+	totp.Init()
+
+	if totp.secKey, err = base32.StdEncoding.DecodeString(seed); err != nil {
+		return
+	}
+
+	return totp.GenOTP(time.Now().Unix())
+}
+
+// summary returns the entry without field values, except for non-protected
+// standard fields.
+func (e *kdbxEntry) summary() map[string]interface{} {
+	fields := []string{}
+	protected := []string{}
+
+	for name := range e.Fields {
+		fields = append(fields, name)
+
+		if e.Protected[name] {
+			protected = append(protected, name)
+		}
+	}
+
+	sort.Strings(fields)
+	sort.Strings(protected)
+
+	summary := map[string]interface{}{
+		"uuid":       e.UUID,
+		"group":      e.Group,
+		"group_uuid": e.GroupUUID,
+		"fields":     fields,
+		"protected":  protected,
+		"totp":       e.totpSeed() != "",
+	}
+
+	for key, name := range map[string]string{"title": "Title", "username": "UserName", "url": "URL"} {
+		if e.Protected[name] {
+			summary[key] = ""
+		} else {
+			summary[key] = e.Fields[name]
+		}
+	}
+
+	return summary
+}
+
+// sessionEntry returns the entry, with the specified UUID, of an opened
+// database.
+func (s *kdbxSession) entry(uuid string) (e kdbxEntry, err error) {
+	n, group, path := s.db.entry(uuid)
+
+	if n == nil {
+		return e, fmt.Errorf("KeePass entry %s not found", uuid)
+	}
+
+	return newKDBXEntry(n, group, path), nil
+}
+
+func kdbxOpen(r *http.Request) (res jsonObject) {
+	var keyFile []byte
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s", "password:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, err = regularFile(osPath); err != nil {
+		return errorResponse(err, "")
+	}
+
+	keyRef, err := optionalString(req, "key", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if keyRef != "" {
+		if keyFile, err = kdbxKeyFile(keyRef); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	n := status.Notify(syslog.LOG_INFO, "opening KeePass database %s", relativePath(osPath))
+	defer status.Remove(n)
+
+	// the key derivation is interrupted if the client disconnects
+	id, s, err := openKDBXSession(osPath, req["password"].(string), keyFile, &job{ctx: r.Context()})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"id":       id,
+			"path":     relativePath(osPath),
+			"version":  fmt.Sprintf("%d.%d", s.db.major, s.db.minor),
+			"writable": s.db.major >= 4,
+			"groups":   len(s.db.groups()),
+			"entries":  len(s.db.entries()),
+			"expires":  s.expires.Unix(),
+		},
+	}
+
+	return
+}
+
+func kdbxClose(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if err = closeKDBXSession(req["id"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func kdbxGroups(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	groups := []map[string]interface{}{}
+
+	for _, g := range s.db.groups() {
+		groups = append(groups, map[string]interface{}{
+			"uuid":    g.UUID,
+			"name":    g.Name,
+			"path":    g.Path,
+			"entries": g.Entries,
+		})
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": groups,
+	}
+
+	return
+}
+
+func kdbxEntries(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	group, err := optionalString(req, "group", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	query, err := optionalString(req, "query", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	entries := []map[string]interface{}{}
+	query = strings.ToLower(query)
+
+	for _, e := range s.db.entries() {
+		if group != "" && e.GroupUUID != strings.ToLower(group) {
+			continue
+		}
+
+		summary := e.summary()
+
+		if query != "" {
+			match := false
+
+			for _, key := range []string{"title", "username", "url", "group"} {
+				if strings.Contains(strings.ToLower(summary[key].(string)), query) {
+					match = true
+				}
+			}
+
+			if !match {
+				continue
+			}
+		}
+
+		entries = append(entries, summary)
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": entries,
+	}
+
+	return
+}
+
+func kdbxReveal(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s", "entry:s", "field:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	e, err := s.entry(req["entry"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	field := req["field"].(string)
+	value, ok := e.Fields[field]
+
+	if !ok {
+		return errorResponse(fmt.Errorf("KeePass entry %s has no field %s", e.UUID, field), "")
+	}
+
+	if e.Protected[field] {
+		status.Log(syslog.LOG_NOTICE, "revealed protected field %s of KeePass entry %s", field, e.UUID)
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"entry":     e.UUID,
+			"field":     field,
+			"value":     value,
+			"protected": e.Protected[field],
+		},
+	}
+
+	return
+}
+
+func kdbxOTP(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s", "entry:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	e, err := s.entry(req["entry"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	otp, exp, err := e.otp()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"otp":     otp,
+			"otp_exp": exp,
+		},
+	}
+
+	return
+}
+
+func kdbxSet(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s", "entry:s", "field:s", "value:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	field := req["field"].(string)
+
+	if field == "" {
+		return errorResponse(errors.New("missing field name"), "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	if s.db.major < 4 {
+		return errorResponse(errors.New("editing is only supported for KDBX 4 databases"), "")
+	}
+
+	n, group, path := s.db.entry(req["entry"].(string))
+
+	if n == nil {
+		return errorResponse(fmt.Errorf("KeePass entry %s not found", req["entry"].(string)), "")
+	}
+
+	e := newKDBXEntry(n, group, path)
+	_, exists := e.Fields[field]
+
+	protected, err := optionalBool(req, "protected", e.Protected[field] || (!exists && field == "Password"))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s.db.setField(n, field, req["value"].(string), protected)
+	s.modified = true
+
+	status.Log(syslog.LOG_NOTICE, "updated field %s of KeePass entry %s", field, e.UUID)
+
+	e = newKDBXEntry(n, group, path)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": e.summary(),
+	}
+
+	return
+}
+
+func kdbxSave(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	s, err := getKDBXSession(req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer s.Unlock()
+
+	if err = s.save(); err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"path":   relativePath(s.osPath),
+			"sha256": fmt.Sprintf("%x", s.sum),
+		},
+	}
+
+	return
+}
@@ -0,0 +1,145 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKDBXSession(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	kdf := map[string]interface{}{"$UUID": kdbxKdfAES, "S": bytes.Repeat([]byte{5}, 32), "R": uint64(10)}
+	osPath := filepath.Join(conf.MountPoint, "test.kdbx")
+
+	if err := os.WriteFile(osPath, testKDBX(t, 4, kdf, "password"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := openKDBXSession(osPath, "wrong", nil, nil); err == nil {
+		t.Fatal("wrong password accepted")
+	}
+
+	// oversized files are rejected without being loaded
+	large := filepath.Join(conf.MountPoint, "large.kdbx")
+	os.WriteFile(large, nil, 0600)
+	os.Truncate(large, kdbxMaxSize+1)
+
+	if _, err := readKDBXFile(large); err == nil {
+		t.Error("oversized database accepted")
+	}
+
+	id, s, err := openKDBXSession(osPath, "password", nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := s.db.groups(); len(groups) != 2 || groups[1].Path != "Root/Web" || groups[1].Entries != 1 {
+		t.Errorf("unexpected groups %+v", groups)
+	}
+
+	s, err = getKDBXSession(id)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forum, err := s.entry("656e74727932")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if summary := forum.summary(); summary["title"] != "Forum" || summary["totp"] != true {
+		t.Errorf("unexpected entry summary %+v", summary)
+	}
+
+	if otp, _, err := forum.otp(); err != nil || len(otp) != 6 {
+		t.Errorf("unexpected TOTP code %s (%v)", otp, err)
+	}
+
+	n, _, _ := s.db.entry(forum.UUID)
+	s.db.setField(n, "Password", "n€w", true)
+	s.db.setField(n, "Comment", "added", false)
+
+	if err = s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Unlock()
+
+	if err = closeKDBXSession(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = getKDBXSession(id); err == nil {
+		t.Error("closed session still available")
+	}
+
+	data, _ := os.ReadFile(osPath)
+	db, err := openKDBX(data, "password", nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := db.entries()
+
+	if e := entries[1]; e.Fields["Password"] != "n€w" || !e.Protected["Password"] || e.Fields["Comment"] != "added" || e.Fields["otp"] != testKDBXSecrets[3] {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	if e := entries[0]; e.Fields["Password"] != "s3cret" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	n, _, _ = db.entry(forum.UUID)
+
+	if history := n.child("History"); history == nil || len(history.Nodes) != 2 || newKDBXEntry(&history.Nodes[0], n, "").Fields["Password"] != testKDBXSecrets[2] {
+		t.Error("entry history not preserved")
+	}
+
+	if _, err = (&kdbxDatabase{major: 3}).write(); err == nil {
+		t.Error("KDBX 3.1 write accepted")
+	}
+}
+
+func TestKDBXKeyStorage(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+	conf.Ciphers = append(conf.Ciphers, "KDBX")
+
+	if err := conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := conf.GetCipher("KDBX")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := bytes.Repeat([]byte("ab"), 32)
+	k := key{Identifier: "test", KeyFormat: "keyx", Cipher: "KDBX", Private: true}
+
+	if err = k.Store(cipher, string(keyFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := kdbxKeyFile("/" + k.Path); err != nil || !bytes.Equal(data, keyFile) {
+		t.Errorf("unexpected key file %q (%v)", data, err)
+	}
+
+	if _, err = kdbxKeyFile("/test.kdbx"); err == nil {
+		t.Error("key file outside key storage accepted")
+	}
+}
@@ -0,0 +1,524 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Optional private key encryption at rest: private keys written to key
+// storage are encrypted with AES-256-CTR and authenticated with HMAC-SHA256.
+// A master key is derived from a dedicated key store passphrase using
+// Argon2id and, when the "keys" HSM option is enabled, made device specific
+// through HSM key derivation. Distinct encryption, authentication and
+// verifier keys are expanded from the master key with HKDF-SHA256. The
+// initialization vector is prepended to the encrypted key, the HMAC is
+// appended:
+//
+// magic (8 bytes) || iv (16 bytes) || ciphertext || hmac (32 bytes)
+//
+// The key store key derivation parameters, salt, HSM diversifier
+// initialization vector and passphrase verifier are kept in the encrypted
+// volume root:
+//
+// magic (8 bytes) || time (4 bytes) || memory KiB (4 bytes) || threads (1 byte) ||
+// salt (16 bytes) || iv (16 bytes) || verifier (32 bytes)
+
+const keyStoreMagic = "ILKSTOR1"
+const keyStorePath = internalPrefix + "keystore"
+
+const (
+	keyStoreHeaderMagic = "ILKSHDR1"
+	keyStoreHeaderSize  = 8 + 4 + 4 + 1 + keyStoreSaltSize + aes.BlockSize + sha256.Size
+	keyStoreSaltSize    = 16
+
+	// Argon2id parameters for new key stores
+	keyStoreTime    = 3
+	keyStoreMemory  = 64 * 1024
+	keyStoreThreads = 2
+
+	// limits for parameters read from existing key stores
+	keyStoreMaxTime   = 64
+	keyStoreMaxMemory = 256 * 1024
+)
+
+type keyStoreData struct {
+	sync.Mutex
+	key     []byte
+	expires time.Time
+}
+
+type keyStoreParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	iv      []byte
+}
+
+var keyStore keyStoreData
+
+// keyStoreSubkey expands a purpose specific key from the key store master
+// key.
+func keyStoreSubkey(key []byte, purpose string) []byte {
+	subkey, err := hkdf.Key(sha256.New, key, nil, "interlock key store "+purpose, derivedKeySize)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return subkey
+}
+
+func keyStoreVerifier(key []byte) []byte {
+	mac := hmac.New(sha256.New, keyStoreSubkey(key, "verifier"))
+	mac.Write([]byte(keyStoreMagic))
+
+	return mac.Sum(nil)
+}
+
+func deriveKeyStoreKey(password string, p keyStoreParams) (key []byte, err error) {
+	key = argon2Key(argon2id, []byte(password), p.salt, nil, nil, p.time, p.memory, p.threads, derivedKeySize)
+
+	if conf.keysHSM == nil {
+		return
+	}
+
+	return conf.keysHSM.DeriveKey(key, p.iv)
+}
+
+func (p *keyStoreParams) marshal(verifier []byte) (header []byte) {
+	header = append([]byte(keyStoreHeaderMagic), binary.BigEndian.AppendUint32(nil, p.time)...)
+	header = binary.BigEndian.AppendUint32(header, p.memory)
+	header = append(header, p.threads)
+	header = append(header, p.salt...)
+	header = append(header, p.iv...)
+
+	return append(header, verifier...)
+}
+
+// parseKeyStoreHeader returns the key derivation parameters and passphrase
+// verifier of an existing key store.
+func parseKeyStoreHeader(header []byte) (p keyStoreParams, verifier []byte, err error) {
+	if len(header) != keyStoreHeaderSize || !bytes.HasPrefix(header, []byte(keyStoreHeaderMagic)) {
+		err = errors.New("invalid key store header")
+		return
+	}
+
+	header = header[len(keyStoreHeaderMagic):]
+
+	p.time = binary.BigEndian.Uint32(header[0:4])
+	p.memory = binary.BigEndian.Uint32(header[4:8])
+	p.threads = header[8]
+	p.salt = header[9 : 9+keyStoreSaltSize]
+	p.iv = header[9+keyStoreSaltSize : 9+keyStoreSaltSize+aes.BlockSize]
+	verifier = header[9+keyStoreSaltSize+aes.BlockSize:]
+
+	if p.time < 1 || p.time > keyStoreMaxTime || p.memory > keyStoreMaxMemory || p.threads < 1 {
+		err = errors.New("invalid key store parameters")
+	}
+
+	return
+}
+
+// openKeyStoreHeader derives the key store key, verifying the passphrase
+// against the key store header.
+func openKeyStoreHeader(header []byte, password string) (key []byte, err error) {
+	p, verifier, err := parseKeyStoreHeader(header)
+
+	if err != nil {
+		return
+	}
+
+	key, err = deriveKeyStoreKey(password, p)
+
+	if err == nil && !hmac.Equal(keyStoreVerifier(key), verifier) {
+		err = errors.New("invalid key store passphrase")
+	}
+
+	return
+}
+
+func (ks *keyStoreData) init(password string) (key []byte, err error) {
+	p := keyStoreParams{
+		time:    keyStoreTime,
+		memory:  keyStoreMemory,
+		threads: keyStoreThreads,
+		salt:    make([]byte, keyStoreSaltSize),
+		iv:      make([]byte, aes.BlockSize),
+	}
+
+	for _, b := range [][]byte{p.salt, p.iv} {
+		if _, err = io.ReadFull(rand.Reader, b); err != nil {
+			return
+		}
+	}
+
+	key, err = deriveKeyStoreKey(password, p)
+
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(filepath.Join(conf.MountPoint, keyStorePath), p.marshal(keyStoreVerifier(key)), 0600)
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "initialized key store")
+
+	return
+}
+
+// Open unlocks the key store, initializing it on first use, and encrypts any
+// plaintext private key found in key storage.
+func (ks *keyStoreData) Open(password string) (expires time.Time, err error) {
+	var key []byte
+
+	if !conf.KeyStore {
+		err = errors.New("key store is disabled")
+		return
+	}
+
+	if len(password) < 8 {
+		err = errors.New("password < 8 characters")
+		return
+	}
+
+	header, err := os.ReadFile(filepath.Join(conf.MountPoint, keyStorePath))
+
+	switch {
+	case os.IsNotExist(err):
+		key, err = ks.init(password)
+	case err != nil:
+		return
+	default:
+		key, err = openKeyStoreHeader(header, password)
+	}
+
+	if err != nil {
+		return
+	}
+
+	ks.Lock()
+	ks.clear()
+	ks.key = key
+	ks.expires = time.Now().Add(time.Duration(conf.KeyStoreTimeout) * time.Second)
+	expires = ks.expires
+	ks.Unlock()
+
+	status.Log(syslog.LOG_NOTICE, "unlocked key store")
+
+	err = ks.wrapKeys()
+
+	return
+}
+
+// Verify checks the key store passphrase, without unlocking the key store.
+func (ks *keyStoreData) Verify(password string) (err error) {
+	if !conf.KeyStore {
+		return errors.New("key store is disabled")
+	}
+
+	header, err := os.ReadFile(filepath.Join(conf.MountPoint, keyStorePath))
+
+	if os.IsNotExist(err) {
+		return errors.New("key store is not initialized")
+	}
+
+	if err != nil {
+		return
+	}
+
+	key, err := openKeyStoreHeader(header, password)
+
+	for i := range key {
+		key[i] = 0
+	}
+
+	return
+}
+
+func (ks *keyStoreData) clear() {
+	if ks.key == nil {
+		return
+	}
+
+	for i := range ks.key {
+		ks.key[i] = 0
+	}
+
+	ks.key = nil
+
+	status.Log(syslog.LOG_NOTICE, "locked key store")
+}
+
+// Close locks the key store, disposing of its key.
+func (ks *keyStoreData) Close() {
+	ks.Lock()
+	defer ks.Unlock()
+
+	ks.clear()
+}
+
+// Unlocked returns whether the key store is unlocked and not expired.
+func (ks *keyStoreData) Unlocked() bool {
+	ks.Lock()
+	defer ks.Unlock()
+
+	if ks.key != nil && time.Now().After(ks.expires) {
+		ks.clear()
+	}
+
+	return ks.key != nil
+}
+
+// Key returns the key store key, if unlocked and not expired.
+func (ks *keyStoreData) Key() (key []byte, err error) {
+	ks.Lock()
+	defer ks.Unlock()
+
+	if ks.key != nil && time.Now().After(ks.expires) {
+		ks.clear()
+	}
+
+	if ks.key == nil {
+		return nil, errors.New("key store is locked")
+	}
+
+	return append([]byte{}, ks.key...), nil
+}
+
+func (ks *keyStoreData) Wrap(data []byte) (wrapped []byte, err error) {
+	key, err := ks.Key()
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(keyStoreSubkey(key, "encryption"))
+
+	if err != nil {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	_, err = io.ReadFull(rand.Reader, iv)
+
+	if err != nil {
+		return
+	}
+
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext, data)
+
+	mac := hmac.New(sha256.New, keyStoreSubkey(key, "authentication"))
+	mac.Write(iv)
+	mac.Write(ciphertext)
+
+	wrapped = append([]byte(keyStoreMagic), iv...)
+	wrapped = append(wrapped, ciphertext...)
+	wrapped = append(wrapped, mac.Sum(nil)...)
+
+	return
+}
+
+func (ks *keyStoreData) Unwrap(wrapped []byte) (data []byte, err error) {
+	if !bytes.HasPrefix(wrapped, []byte(keyStoreMagic)) {
+		return nil, errors.New("private key not protected by key store")
+	}
+
+	wrapped = wrapped[len(keyStoreMagic):]
+
+	if len(wrapped) < aes.BlockSize+sha256.Size {
+		return nil, errors.New("invalid key store entry")
+	}
+
+	key, err := ks.Key()
+
+	if err != nil {
+		return
+	}
+
+	iv := wrapped[0:aes.BlockSize]
+	ciphertext := wrapped[aes.BlockSize : len(wrapped)-sha256.Size]
+
+	mac := hmac.New(sha256.New, keyStoreSubkey(key, "authentication"))
+	mac.Write(iv)
+	mac.Write(ciphertext)
+
+	if !hmac.Equal(wrapped[len(wrapped)-sha256.Size:], mac.Sum(nil)) {
+		return nil, errors.New("invalid HMAC")
+	}
+
+	block, err := aes.NewCipher(keyStoreSubkey(key, "encryption"))
+
+	if err != nil {
+		return
+	}
+
+	data = make([]byte, len(ciphertext))
+	cipher.NewCTR(block, iv).XORKeyStream(data, ciphertext)
+
+	return
+}
+
+func (ks *keyStoreData) wrapKeys() (err error) {
+	for _, cipher := range conf.enabledCiphers {
+		if cipher.GetInfo().KeyFormat == "password" {
+			continue
+		}
+
+		keys, err := getKeys(cipher, true, "")
+
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			keyPath := filepath.Join(conf.MountPoint, k.Path)
+			data, err := os.ReadFile(keyPath)
+
+			if err != nil {
+				return err
+			}
+
+			if bytes.HasPrefix(data, []byte(keyStoreMagic)) {
+				continue
+			}
+
+			wrapped, err := ks.Wrap(data)
+
+			if err != nil {
+				return err
+			}
+
+			output, err := os.CreateTemp(filepath.Dir(keyPath), ".keystore-")
+
+			if err != nil {
+				return err
+			}
+
+			_, err = output.Write(wrapped)
+
+			if err == nil {
+				err = output.Sync()
+			}
+
+			output.Close()
+
+			if err == nil {
+				err = os.Rename(output.Name(), keyPath)
+			}
+
+			if err != nil {
+				os.Remove(output.Name())
+				return err
+			}
+
+			status.Log(syslog.LOG_NOTICE, "encrypted %s private key %s in key store", k.Cipher, k.Identifier)
+		}
+	}
+
+	return
+}
+
+// readKey returns key file contents, private keys are decrypted through the
+// key store when enabled.
+func readKey(k key) (data []byte, err error) {
+	data, err = os.ReadFile(filepath.Join(conf.MountPoint, k.Path))
+
+	if err != nil || !conf.KeyStore || !k.Private {
+		return
+	}
+
+	return keyStore.Unwrap(data)
+}
+
+func keyStoreInfo() (res jsonObject) {
+	var expires int64
+
+	_, err := os.Stat(filepath.Join(conf.MountPoint, keyStorePath))
+	initialized := err == nil
+
+	key, err := keyStore.Key()
+	locked := err != nil
+
+	if key != nil {
+		keyStore.Lock()
+		expires = keyStore.expires.Unix()
+		keyStore.Unlock()
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"enabled":     conf.KeyStore,
+			"initialized": initialized,
+			"locked":      locked,
+			"expires":     expires,
+		},
+	}
+
+	return
+}
+
+func unlockKeyStore(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"password:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	expires, err := keyStore.Open(req["password"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"expires": expires.Unix(),
+		},
+	}
+
+	return
+}
+
+func lockKeyStore() (res jsonObject) {
+	keyStore.Close()
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
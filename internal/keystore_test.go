@@ -0,0 +1,111 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	conf.MountPoint = t.TempDir()
+	conf.KeyPath = "keys"
+	conf.KeyStore = true
+	conf.KeyStoreTimeout = 60
+	defer func() { conf.KeyStore = false }()
+
+	password := "interlocktest"
+	totp := new(tOTP).Init()
+
+	secKey := key{
+		Identifier: "keystore_test",
+		KeyFormat:  "base32",
+		Cipher:     "TOTP",
+		Private:    true,
+	}
+
+	if err := secKey.Store(totp, "JBSWY3DPEHPK3PXP"); err == nil {
+		t.Fatal("key stored with locked key store")
+	}
+
+	if _, err := keyStore.Open(password); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := secKey.Store(totp, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(conf.MountPoint, secKey.Path))
+
+	if bytes.Contains(data, []byte("JBSWY3DPEHPK3PXP")) {
+		t.Error("private key stored in plaintext")
+	}
+
+	if err := totp.SetKey(secKey); err != nil {
+		t.Error(err)
+	}
+
+	keyStore.Close()
+
+	if err := totp.SetKey(secKey); err == nil {
+		t.Error("private key used with locked key store")
+	}
+
+	if _, err := keyStore.Open("invalidpassword"); err == nil {
+		t.Error("key store unlocked with invalid passphrase")
+	}
+
+	if _, err := keyStore.Open(password); err != nil {
+		t.Error(err)
+	}
+
+	if err := totp.SetKey(secKey); err != nil {
+		t.Error(err)
+	}
+
+	keyStore.Close()
+}
+
+func TestKeyStoreHeader(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+	conf.KeyStore = true
+	defer func() { conf.KeyStore = false }()
+
+	if _, err := keyStore.Open("interlocktest"); err != nil {
+		t.Fatal(err)
+	}
+
+	keyStore.Close()
+
+	header, _ := os.ReadFile(filepath.Join(conf.MountPoint, keyStorePath))
+	p, _, err := parseKeyStoreHeader(header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p.time != keyStoreTime || p.memory != keyStoreMemory || p.threads != keyStoreThreads || len(p.salt) != keyStoreSaltSize {
+		t.Errorf("unexpected key store parameters %+v", p)
+	}
+
+	key, _ := deriveKeyStoreKey("interlocktest", p)
+
+	if bytes.Equal(keyStoreSubkey(key, "encryption"), keyStoreSubkey(key, "authentication")) {
+		t.Error("key store subkeys are not distinct")
+	}
+
+	// excessive memory cost
+	header[12] = 0xff
+
+	if _, _, err = parseKeyStoreHeader(header); err == nil {
+		t.Error("invalid key store parameters accepted")
+	}
+}
@@ -0,0 +1,874 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// LZMA compression, as used within LZMA2 chunks, with a greedy hash chain
+// match finder for encoding.
+//
+// Neither the Go standard nor supplementary libraries provide LZMA, it is
+// therefore implemented here to support the tar.xz archive format.
+
+const (
+	lzmaStates      = 12
+	lzmaPosStates   = 1 << 4
+	lzmaLenStates   = 4
+	lzmaMatchMinLen = 2
+	lzmaMatchMaxLen = 273
+
+	lzmaDistSlots     = 64
+	lzmaDistModelEnd  = 14
+	lzmaFullDistances = 1 << (lzmaDistModelEnd / 2)
+	lzmaAlignBits     = 4
+
+	lzmaProbBits = 11
+	lzmaProbInit = 1 << (lzmaProbBits - 1)
+	lzmaMoveBits = 5
+	lzmaTopValue = 1 << 24
+
+	// lc=3, lp=0, pb=2 (xz defaults)
+	lzmaLC    = 3
+	lzmaLP    = 0
+	lzmaPB    = 2
+	lzmaProps = (lzmaPB*5+lzmaLP)*9 + lzmaLC
+
+	// hash chain match finder parameters
+	lzmaHashBits = 20
+	lzmaChainLen = 32
+	lzmaNiceLen  = 64
+	// consecutive literals after which match searches are sampled
+	lzmaSkipLen   = 256
+	lzmaLiterals  = 0x300
+	lzmaEndMarker = 0xffffffff
+)
+
+type lzmaProb uint16
+
+type lzmaLenCoder struct {
+	choice  lzmaProb
+	choice2 lzmaProb
+	low     [lzmaPosStates][1 << 3]lzmaProb
+	mid     [lzmaPosStates][1 << 3]lzmaProb
+	high    [1 << 8]lzmaProb
+}
+
+// lzmaState holds the probability model and match history shared by the
+// encoder and decoder.
+type lzmaState struct {
+	lc, lp, pb int
+
+	state int
+	reps  [4]uint32
+
+	literal    []lzmaProb
+	isMatch    [lzmaStates][lzmaPosStates]lzmaProb
+	isRep      [lzmaStates]lzmaProb
+	isRep0     [lzmaStates]lzmaProb
+	isRep1     [lzmaStates]lzmaProb
+	isRep2     [lzmaStates]lzmaProb
+	isRep0Long [lzmaStates][lzmaPosStates]lzmaProb
+	distSlot   [lzmaLenStates][lzmaDistSlots]lzmaProb
+	// indexed from distance slot base - slot, the first element is unused
+	distSpec  [1 + lzmaFullDistances - lzmaDistModelEnd]lzmaProb
+	distAlign [1 << lzmaAlignBits]lzmaProb
+	matchLen  lzmaLenCoder
+	repLen    lzmaLenCoder
+}
+
+// lzmaProperties decodes the lc, lp and pb properties byte.
+func lzmaProperties(b byte) (lc int, lp int, pb int, err error) {
+	if b >= 9*5*5 {
+		return 0, 0, 0, errors.New("invalid LZMA properties")
+	}
+
+	lc = int(b % 9)
+	b /= 9
+	lp = int(b % 5)
+	pb = int(b / 5)
+
+	// LZMA2 restriction
+	if lc+lp > 4 {
+		return 0, 0, 0, errors.New("invalid LZMA properties")
+	}
+
+	return
+}
+
+func initProbs(probs []lzmaProb) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+func (l *lzmaLenCoder) reset() {
+	l.choice = lzmaProbInit
+	l.choice2 = lzmaProbInit
+
+	for i := range l.low {
+		initProbs(l.low[i][:])
+		initProbs(l.mid[i][:])
+	}
+
+	initProbs(l.high[:])
+}
+
+func (s *lzmaState) reset() {
+	s.state = 0
+	s.reps = [4]uint32{}
+
+	if n := lzmaLiterals << (s.lc + s.lp); len(s.literal) != n {
+		s.literal = make([]lzmaProb, n)
+	}
+
+	initProbs(s.literal)
+
+	for i := 0; i < lzmaStates; i++ {
+		initProbs(s.isMatch[i][:])
+		initProbs(s.isRep0Long[i][:])
+	}
+
+	initProbs(s.isRep[:])
+	initProbs(s.isRep0[:])
+	initProbs(s.isRep1[:])
+	initProbs(s.isRep2[:])
+
+	for i := range s.distSlot {
+		initProbs(s.distSlot[i][:])
+	}
+
+	initProbs(s.distSpec[:])
+	initProbs(s.distAlign[:])
+
+	s.matchLen.reset()
+	s.repLen.reset()
+}
+
+func (s *lzmaState) literalProbs(pos uint64, prev byte) []lzmaProb {
+	i := ((int(pos)&(1<<s.lp-1))<<s.lc + int(prev)>>(8-s.lc)) * lzmaLiterals
+	return s.literal[i : i+lzmaLiterals]
+}
+
+func (s *lzmaState) updateLiteral() {
+	switch {
+	case s.state < 4:
+		s.state = 0
+	case s.state < 10:
+		s.state -= 3
+	default:
+		s.state -= 6
+	}
+}
+
+func (s *lzmaState) updateMatch() {
+	if s.state < 7 {
+		s.state = 7
+	} else {
+		s.state = 10
+	}
+}
+
+func (s *lzmaState) updateRep() {
+	if s.state < 7 {
+		s.state = 8
+	} else {
+		s.state = 11
+	}
+}
+
+func (s *lzmaState) updateShortRep() {
+	if s.state < 7 {
+		s.state = 9
+	} else {
+		s.state = 11
+	}
+}
+
+func lzmaLenState(length int) int {
+	return min(length-lzmaMatchMinLen, lzmaLenStates-1)
+}
+
+// lzmaDict is the sliding window shared by the decoder and the encoder,
+// positions are relative to the last dictionary reset.
+type lzmaDict struct {
+	buf  []byte
+	pos  uint64
+	full uint64
+}
+
+func (d *lzmaDict) reset() {
+	d.pos = 0
+	d.full = 0
+}
+
+func (d *lzmaDict) put(b byte) {
+	d.buf[d.pos%uint64(len(d.buf))] = b
+	d.pos++
+	d.full = min(d.full+1, uint64(len(d.buf)))
+}
+
+// get returns the byte at distance dist+1 from the current position.
+func (d *lzmaDict) get(dist uint32) byte {
+	if d.full == 0 {
+		return 0
+	}
+
+	return d.buf[(d.pos-uint64(dist)-1)%uint64(len(d.buf))]
+}
+
+type lzmaRangeDecoder struct {
+	buf  []byte
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rc *lzmaRangeDecoder) init(buf []byte) (err error) {
+	if len(buf) < 5 || buf[0] != 0 {
+		return errors.New("invalid LZMA data")
+	}
+
+	rc.rng = 0xffffffff
+	rc.code = uint32(buf[1])<<24 | uint32(buf[2])<<16 | uint32(buf[3])<<8 | uint32(buf[4])
+	rc.buf = buf[5:]
+	rc.err = nil
+
+	return
+}
+
+func (rc *lzmaRangeDecoder) normalize() {
+	if rc.rng >= lzmaTopValue {
+		return
+	}
+
+	if len(rc.buf) == 0 {
+		rc.err = errors.New("truncated LZMA data")
+		return
+	}
+
+	rc.rng <<= 8
+	rc.code = rc.code<<8 | uint32(rc.buf[0])
+	rc.buf = rc.buf[1:]
+}
+
+func (rc *lzmaRangeDecoder) bit(p *lzmaProb) (bit uint32) {
+	rc.normalize()
+	bound := (rc.rng >> lzmaProbBits) * uint32(*p)
+
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<lzmaProbBits - *p) >> lzmaMoveBits
+		return 0
+	}
+
+	rc.rng -= bound
+	rc.code -= bound
+	*p -= *p >> lzmaMoveBits
+
+	return 1
+}
+
+func (rc *lzmaRangeDecoder) direct(n int) (v uint32) {
+	for ; n > 0; n-- {
+		rc.normalize()
+		rc.rng >>= 1
+		v <<= 1
+
+		if rc.code >= rc.rng {
+			rc.code -= rc.rng
+			v |= 1
+		}
+	}
+
+	return
+}
+
+func (rc *lzmaRangeDecoder) tree(probs []lzmaProb, n int) uint32 {
+	symbol := uint32(1)
+
+	for i := 0; i < n; i++ {
+		symbol = symbol<<1 | rc.bit(&probs[symbol])
+	}
+
+	return symbol - 1<<n
+}
+
+func (rc *lzmaRangeDecoder) reverseTree(probs []lzmaProb, n int) (v uint32) {
+	symbol := uint32(1)
+
+	for i := 0; i < n; i++ {
+		bit := rc.bit(&probs[symbol])
+		symbol = symbol<<1 | bit
+		v |= bit << i
+	}
+
+	return
+}
+
+func (rc *lzmaRangeDecoder) length(l *lzmaLenCoder, posState int) int {
+	switch {
+	case rc.bit(&l.choice) == 0:
+		return lzmaMatchMinLen + int(rc.tree(l.low[posState][:], 3))
+	case rc.bit(&l.choice2) == 0:
+		return lzmaMatchMinLen + 8 + int(rc.tree(l.mid[posState][:], 3))
+	default:
+		return lzmaMatchMinLen + 16 + int(rc.tree(l.high[:], 8))
+	}
+}
+
+func (rc *lzmaRangeDecoder) distance(s *lzmaState, length int) uint32 {
+	slot := rc.tree(s.distSlot[lzmaLenState(length)][:], 6)
+
+	if slot < 4 {
+		return slot
+	}
+
+	n := int(slot>>1) - 1
+	dist := (2 | slot&1) << n
+
+	if slot < lzmaDistModelEnd {
+		return dist + rc.reverseTree(s.distSpec[dist-slot:], n)
+	}
+
+	dist += rc.direct(n-lzmaAlignBits) << lzmaAlignBits
+	return dist + rc.reverseTree(s.distAlign[:], lzmaAlignBits)
+}
+
+// lzmaDecode decodes a single LZMA chunk of the argument uncompressed size,
+// appending its output to the dictionary and to out.
+func lzmaDecode(s *lzmaState, d *lzmaDict, data []byte, size int, out []byte) ([]byte, error) {
+	rc := &lzmaRangeDecoder{}
+
+	if err := rc.init(data); err != nil {
+		return out, err
+	}
+
+	pbMask := uint64(1)<<s.pb - 1
+
+	for n := 0; n < size && rc.err == nil; {
+		posState := int(d.pos & pbMask)
+
+		if rc.bit(&s.isMatch[s.state][posState]) == 0 {
+			probs := s.literalProbs(d.pos, d.get(0))
+			symbol := uint32(1)
+
+			if s.state < 7 {
+				for symbol < 0x100 {
+					symbol = symbol<<1 | rc.bit(&probs[symbol])
+				}
+			} else {
+				match := uint32(d.get(s.reps[0])) << 1
+				offset := uint32(0x100)
+
+				for symbol < 0x100 {
+					matchBit := match & offset
+					match <<= 1
+
+					if rc.bit(&probs[offset+matchBit+symbol]) == 1 {
+						symbol = symbol<<1 | 1
+						offset = matchBit
+					} else {
+						symbol <<= 1
+						offset &= ^matchBit
+					}
+				}
+			}
+
+			b := byte(symbol)
+			d.put(b)
+			out = append(out, b)
+			s.updateLiteral()
+			n++
+
+			continue
+		}
+
+		var length int
+
+		if rc.bit(&s.isRep[s.state]) == 0 {
+			length = rc.length(&s.matchLen, posState)
+			dist := rc.distance(s, length)
+
+			if dist == lzmaEndMarker {
+				return out, errors.New("unexpected LZMA end marker")
+			}
+
+			s.reps = [4]uint32{dist, s.reps[0], s.reps[1], s.reps[2]}
+			s.updateMatch()
+		} else {
+			if d.full == 0 {
+				return out, errors.New("invalid LZMA distance")
+			}
+
+			if rc.bit(&s.isRep0[s.state]) == 0 {
+				if rc.bit(&s.isRep0Long[s.state][posState]) == 0 {
+					b := d.get(s.reps[0])
+					d.put(b)
+					out = append(out, b)
+					s.updateShortRep()
+					n++
+
+					continue
+				}
+			} else {
+				var dist uint32
+
+				if rc.bit(&s.isRep1[s.state]) == 0 {
+					dist = s.reps[1]
+				} else {
+					if rc.bit(&s.isRep2[s.state]) == 0 {
+						dist = s.reps[2]
+					} else {
+						dist = s.reps[3]
+						s.reps[3] = s.reps[2]
+					}
+
+					s.reps[2] = s.reps[1]
+				}
+
+				s.reps[1] = s.reps[0]
+				s.reps[0] = dist
+			}
+
+			length = rc.length(&s.repLen, posState)
+			s.updateRep()
+		}
+
+		if uint64(s.reps[0]) >= d.full {
+			return out, errors.New("invalid LZMA distance")
+		}
+
+		if length > size-n {
+			return out, errors.New("invalid LZMA match length")
+		}
+
+		for i := 0; i < length; i++ {
+			b := d.get(s.reps[0])
+			d.put(b)
+			out = append(out, b)
+		}
+
+		n += length
+	}
+
+	rc.normalize()
+
+	if rc.err != nil {
+		return out, rc.err
+	}
+
+	if len(rc.buf) != 0 || rc.code != 0 {
+		return out, errors.New("invalid LZMA chunk size")
+	}
+
+	return out, nil
+}
+
+type lzmaRangeEncoder struct {
+	out       []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+func (rc *lzmaRangeEncoder) reset() {
+	rc.out = rc.out[:0]
+	rc.low = 0
+	rc.rng = 0xffffffff
+	rc.cache = 0
+	rc.cacheSize = 1
+}
+
+// pending returns the number of bytes the encoder would output if flushed.
+func (rc *lzmaRangeEncoder) pending() int {
+	return len(rc.out) + rc.cacheSize + 4
+}
+
+func (rc *lzmaRangeEncoder) shiftLow() {
+	if uint32(rc.low) < 0xff000000 || rc.low>>32 != 0 {
+		carry := byte(rc.low >> 32)
+		b := rc.cache
+
+		for ; rc.cacheSize > 0; rc.cacheSize-- {
+			rc.out = append(rc.out, b+carry)
+			b = 0xff
+		}
+
+		rc.cache = byte(rc.low >> 24)
+	}
+
+	rc.cacheSize++
+	rc.low = (rc.low & 0x00ffffff) << 8
+}
+
+func (rc *lzmaRangeEncoder) flush() []byte {
+	for i := 0; i < 5; i++ {
+		rc.shiftLow()
+	}
+
+	return rc.out
+}
+
+func (rc *lzmaRangeEncoder) bit(p *lzmaProb, bit uint32) {
+	bound := (rc.rng >> lzmaProbBits) * uint32(*p)
+
+	if bit == 0 {
+		rc.rng = bound
+		*p += (1<<lzmaProbBits - *p) >> lzmaMoveBits
+	} else {
+		rc.low += uint64(bound)
+		rc.rng -= bound
+		*p -= *p >> lzmaMoveBits
+	}
+
+	for rc.rng < lzmaTopValue {
+		rc.rng <<= 8
+		rc.shiftLow()
+	}
+}
+
+func (rc *lzmaRangeEncoder) direct(v uint32, n int) {
+	for n--; n >= 0; n-- {
+		rc.rng >>= 1
+
+		if (v>>n)&1 == 1 {
+			rc.low += uint64(rc.rng)
+		}
+
+		for rc.rng < lzmaTopValue {
+			rc.rng <<= 8
+			rc.shiftLow()
+		}
+	}
+}
+
+func (rc *lzmaRangeEncoder) tree(probs []lzmaProb, v uint32, n int) {
+	symbol := uint32(1)
+
+	for n--; n >= 0; n-- {
+		bit := (v >> n) & 1
+		rc.bit(&probs[symbol], bit)
+		symbol = symbol<<1 | bit
+	}
+}
+
+func (rc *lzmaRangeEncoder) reverseTree(probs []lzmaProb, v uint32, n int) {
+	symbol := uint32(1)
+
+	for i := 0; i < n; i++ {
+		bit := v & 1
+		v >>= 1
+		rc.bit(&probs[symbol], bit)
+		symbol = symbol<<1 | bit
+	}
+}
+
+func (rc *lzmaRangeEncoder) length(l *lzmaLenCoder, length int, posState int) {
+	v := uint32(length - lzmaMatchMinLen)
+
+	switch {
+	case v < 8:
+		rc.bit(&l.choice, 0)
+		rc.tree(l.low[posState][:], v, 3)
+	case v < 16:
+		rc.bit(&l.choice, 1)
+		rc.bit(&l.choice2, 0)
+		rc.tree(l.mid[posState][:], v-8, 3)
+	default:
+		rc.bit(&l.choice, 1)
+		rc.bit(&l.choice2, 1)
+		rc.tree(l.high[:], v-16, 8)
+	}
+}
+
+func (rc *lzmaRangeEncoder) distance(s *lzmaState, dist uint32, length int) {
+	slot := dist
+
+	if dist >= 4 {
+		n := uint32(bits.Len32(dist))
+		slot = 2*(n-1) | (dist>>(n-2))&1
+	}
+
+	rc.tree(s.distSlot[lzmaLenState(length)][:], slot, 6)
+
+	if slot < 4 {
+		return
+	}
+
+	n := int(slot>>1) - 1
+	base := (2 | slot&1) << n
+	v := dist - base
+
+	if slot < lzmaDistModelEnd {
+		rc.reverseTree(s.distSpec[base-slot:], v, n)
+		return
+	}
+
+	rc.direct(v>>lzmaAlignBits, n-lzmaAlignBits)
+	rc.reverseTree(s.distAlign[:], v&(1<<lzmaAlignBits-1), lzmaAlignBits)
+}
+
+// lzmaEncoder compresses data held in a window of which the dictSize bytes,
+// a power of two, preceding the current position can be referenced by
+// matches.
+type lzmaEncoder struct {
+	lzmaState
+	rc lzmaRangeEncoder
+
+	// consecutive literals, for incompressible data detection
+	literals int
+
+	dictSize int
+	// window data, base is the position of its first byte relative to the
+	// last dictionary reset
+	buf  []byte
+	base uint64
+
+	// hash chains, holding positions + 1 (zero for none) modulo 2^32,
+	// candidates are always verified against the window data
+	head []uint32
+	prev []uint32
+}
+
+func newLZMAEncoder(dictSize int) (e *lzmaEncoder) {
+	e = &lzmaEncoder{
+		dictSize: dictSize,
+		head:     make([]uint32, 1<<lzmaHashBits),
+		prev:     make([]uint32, dictSize),
+	}
+
+	e.lc = lzmaLC
+	e.lp = lzmaLP
+	e.pb = lzmaPB
+
+	e.reset()
+
+	return
+}
+
+func lzmaHash(b []byte) int {
+	return int(binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - lzmaHashBits))
+}
+
+// insert adds the window position i to the hash chains.
+func (e *lzmaEncoder) insert(i int) {
+	if i+4 > len(e.buf) {
+		return
+	}
+
+	pos := e.base + uint64(i)
+	h := lzmaHash(e.buf[i:])
+
+	e.prev[pos&uint64(e.dictSize-1)] = e.head[h]
+	e.head[h] = uint32(pos + 1)
+}
+
+// matchLength returns the length of the match at window position i against the
+// argument distance, up to limit bytes.
+func (e *lzmaEncoder) matchLength(i int, dist uint32, limit int) (n int) {
+	j := i - int(dist) - 1
+
+	if j < 0 || uint64(dist) >= e.base+uint64(i) {
+		return 0
+	}
+
+	for n < limit && e.buf[i+n] == e.buf[j+n] {
+		n++
+	}
+
+	return
+}
+
+// findMatch returns the longest match, searched along the hash chain, at
+// window position i.
+func (e *lzmaEncoder) findMatch(i int, limit int) (length int, dist uint32) {
+	if limit < 4 {
+		return
+	}
+
+	next := uint32(e.base + uint64(i) + 1)
+	cand := e.head[lzmaHash(e.buf[i:])]
+
+	for chain := lzmaChainLen; chain > 0 && cand != 0; chain-- {
+		if next-cand == 0 || next-cand > uint32(min(e.dictSize, i)) {
+			break
+		}
+
+		d := int(next - cand)
+
+		// candidates not extending the current match are skipped
+		if e.buf[i-d+length] == e.buf[i+length] {
+			if n := e.matchLength(i, uint32(d-1), limit); n > length {
+				length = n
+				dist = uint32(d - 1)
+
+				if n >= lzmaNiceLen || n == limit {
+					break
+				}
+			}
+		}
+
+		cand = e.prev[(cand-1)&uint32(e.dictSize-1)]
+	}
+
+	return
+}
+
+func (e *lzmaEncoder) encodeLiteral(i int) {
+	pos := e.base + uint64(i)
+	posState := int(pos & (1<<e.pb - 1))
+
+	var prev byte
+
+	if pos > 0 {
+		prev = e.buf[i-1]
+	}
+
+	b := uint32(e.buf[i])
+	probs := e.literalProbs(pos, prev)
+
+	e.rc.bit(&e.isMatch[e.state][posState], 0)
+
+	if e.state < 7 {
+		e.rc.tree(probs, b, 8)
+	} else {
+		match := uint32(e.buf[i-int(e.reps[0])-1]) << 1
+		offset := uint32(0x100)
+		symbol := uint32(1)
+
+		for n := 7; n >= 0; n-- {
+			bit := (b >> n) & 1
+			matchBit := match & offset
+			match <<= 1
+
+			e.rc.bit(&probs[offset+matchBit+symbol], bit)
+			symbol = symbol<<1 | bit
+
+			if bit == 1 {
+				offset = matchBit
+			} else {
+				offset &= ^matchBit
+			}
+		}
+	}
+
+	e.updateLiteral()
+}
+
+func (e *lzmaEncoder) encodeMatch(posState int, dist uint32, length int) {
+	e.rc.bit(&e.isMatch[e.state][posState], 1)
+	e.rc.bit(&e.isRep[e.state], 0)
+	e.rc.length(&e.matchLen, length, posState)
+	e.rc.distance(&e.lzmaState, dist, length)
+
+	e.reps = [4]uint32{dist, e.reps[0], e.reps[1], e.reps[2]}
+	e.updateMatch()
+}
+
+func (e *lzmaEncoder) encodeRep(posState int, rep int, length int) {
+	e.rc.bit(&e.isMatch[e.state][posState], 1)
+	e.rc.bit(&e.isRep[e.state], 1)
+
+	if rep == 0 {
+		e.rc.bit(&e.isRep0[e.state], 0)
+
+		if length == 1 {
+			e.rc.bit(&e.isRep0Long[e.state][posState], 0)
+			e.updateShortRep()
+			return
+		}
+
+		e.rc.bit(&e.isRep0Long[e.state][posState], 1)
+	} else {
+		dist := e.reps[rep]
+
+		e.rc.bit(&e.isRep0[e.state], 1)
+
+		if rep == 1 {
+			e.rc.bit(&e.isRep1[e.state], 0)
+		} else {
+			e.rc.bit(&e.isRep1[e.state], 1)
+			e.rc.bit(&e.isRep2[e.state], uint32(rep-2))
+
+			if rep == 3 {
+				e.reps[3] = e.reps[2]
+			}
+
+			e.reps[2] = e.reps[1]
+		}
+
+		e.reps[1] = e.reps[0]
+		e.reps[0] = dist
+	}
+
+	e.rc.length(&e.repLen, length, posState)
+	e.updateRep()
+}
+
+// encode compresses window data starting at position i, up to end, until the
+// compressed output approaches maxSize, returning the position reached.
+func (e *lzmaEncoder) encode(i int, end int, maxSize int) int {
+	e.rc.reset()
+
+	for i < end && e.rc.pending() < maxSize {
+		pos := e.base + uint64(i)
+		posState := int(pos & (1<<e.pb - 1))
+		limit := min(end-i, lzmaMatchMaxLen)
+
+		repLen := 0
+		rep := 0
+
+		if pos > 0 {
+			for r, dist := range e.reps {
+				if n := e.matchLength(i, dist, limit); n > repLen {
+					repLen = n
+					rep = r
+				}
+			}
+		}
+
+		var length int
+		var dist uint32
+
+		if e.literals < lzmaSkipLen || e.literals%8 == 0 {
+			length, dist = e.findMatch(i, limit)
+		}
+
+		switch {
+		case repLen >= lzmaMatchMinLen && repLen+1 >= length:
+			e.encodeRep(posState, rep, repLen)
+			length = repLen
+		case length >= 3:
+			e.encodeMatch(posState, dist, length)
+		case pos > 0 && e.matchLength(i, e.reps[0], 1) == 1:
+			e.encodeRep(posState, 0, 1)
+			length = 1
+		default:
+			e.encodeLiteral(i)
+			length = 1
+		}
+
+		if length > 1 {
+			e.literals = 0
+		} else {
+			e.literals++
+		}
+
+		for j := 0; j < length; j++ {
+			e.insert(i + j)
+		}
+
+		i += length
+	}
+
+	return i
+}
@@ -0,0 +1,518 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// default manifest file name, in the format of the sha256sum utility
+const manifestName = "SHA256SUMS"
+
+type manifestResult struct {
+	Files      int      `json:"files"`
+	Valid      bool     `json:"valid"`
+	Signature  bool     `json:"signature"`
+	Mismatched []string `json:"mismatched"`
+	Missing    []string `json:"missing"`
+	Unlisted   []string `json:"unlisted"`
+}
+
+type duplicateGroup struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Paths  []string `json:"paths"`
+}
+
+// sha256File returns the hex encoded SHA256 digest of the file, tracking
+// progress on the job.
+func sha256File(osPath string, j *job) (digest string, err error) {
+	input, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	h := sha256.New()
+
+	if _, err = io.Copy(h, j.Reader(input)); err != nil {
+		return
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifestLine formats a manifest entry, names containing newlines or
+// backslashes are escaped as done by sha256sum.
+func manifestLine(digest string, name string) string {
+	if strings.ContainsAny(name, "\\\n") {
+		name = strings.ReplaceAll(name, "\\", "\\\\")
+		name = strings.ReplaceAll(name, "\n", "\\n")
+		return fmt.Sprintf("\\%s  %s\n", digest, name)
+	}
+
+	return fmt.Sprintf("%s  %s\n", digest, name)
+}
+
+// parseManifest returns the digests listed in a manifest, indexed by name.
+func parseManifest(osPath string) (digests map[string]string, names []string, err error) {
+	input, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	digests = make(map[string]string)
+	scanner := bufio.NewScanner(input)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+
+		if line == "" {
+			continue
+		}
+
+		escaped := strings.HasPrefix(line, "\\")
+		line = strings.TrimPrefix(line, "\\")
+
+		// binary mode entries are marked with an asterisk
+		if len(line) < 2*sha256.Size+2 || (line[2*sha256.Size:2*sha256.Size+2] != "  " && line[2*sha256.Size:2*sha256.Size+2] != " *") {
+			return nil, nil, fmt.Errorf("invalid manifest line %d", n)
+		}
+
+		digest := strings.ToLower(line[0 : 2*sha256.Size])
+		name := line[2*sha256.Size+2:]
+
+		if _, err = hex.DecodeString(digest); err != nil {
+			return nil, nil, fmt.Errorf("invalid manifest line %d", n)
+		}
+
+		if escaped {
+			name = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(name)
+		}
+
+		name = filepath.Clean(strings.TrimPrefix(name, "./"))
+
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, nil, fmt.Errorf("invalid path in manifest line %d", n)
+		}
+
+		if _, ok := digests[name]; !ok {
+			names = append(names, name)
+		}
+
+		digests[name] = digest
+	}
+
+	err = scanner.Err()
+
+	return
+}
+
+func fileManifest(r *http.Request) (res jsonObject) {
+	var cipher cipherInterface
+	var sigKey key
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	root, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	dst, err := optionalString(req, "dst", filepath.Join(req["path"].(string), manifestName))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if dst, err = absolutePath(dst); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if inKeyPath, _ := detectKeyPath(dst); inKeyPath {
+		return errorResponse(errors.New("writing to key storage is not allowed"), "")
+	}
+
+	sigPath := ""
+
+	// optional signature
+	if _, ok := req["cipher"]; ok {
+		err = validateRequest(req, []string{"cipher:s", "password:s", "key:s"})
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		cipher, sigKey, err = signingCipher(req["cipher"].(string), req["key"].(string), req["password"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		sigPath = dst + "." + cipher.GetInfo().Extension + "-signature"
+	}
+
+	if stat, err := os.Stat(root); err != nil || !stat.IsDir() {
+		return errorResponse(fmt.Errorf("%s is not a directory", relativePath(root)), "")
+	}
+
+	files, err := treeFiles(root, func(p string) bool {
+		return p != dst && p != sigPath
+	})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	id, err := jobs.Submit("manifest", root, pathSize(files), func(j *job) (result interface{}, err error) {
+		n := status.Notify(syslog.LOG_INFO, "generating manifest for %s", relativePath(root))
+		defer status.Remove(n)
+
+		output, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+		if err != nil {
+			return
+		}
+
+		for _, f := range files {
+			var digest string
+
+			if digest, err = sha256File(f, j); err != nil {
+				break
+			}
+
+			rel, _ := filepath.Rel(root, f)
+
+			if _, err = io.WriteString(output, manifestLine(digest, filepath.ToSlash(rel))); err != nil {
+				break
+			}
+		}
+
+		if err == nil {
+			err = output.Sync()
+		}
+
+		if e := output.Close(); err == nil {
+			err = e
+		}
+
+		if err == nil && cipher != nil {
+			var done func(error)
+
+			if done, err = sigKey.Use(_sign); err == nil {
+				err = transformFile(dst, sigPath, func(input *os.File, output *os.File) error {
+					return cipher.Sign(input, output)
+				})
+				done(err)
+			}
+		}
+
+		if err != nil {
+			os.Remove(dst)
+			return
+		}
+
+		status.Log(syslog.LOG_NOTICE, "generated manifest %s (%d files)", relativePath(dst), len(files))
+
+		return relativePath(dst), nil
+	})
+
+	return jobResponse(id, err)
+}
+
+func fileManifestVerify(r *http.Request) (res jsonObject) {
+	var cipher cipherInterface
+	var sigPath string
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	manifest, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	root, err := optionalString(req, "root", filepath.Dir(req["path"].(string)))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if root, err = absolutePath(root); err != nil {
+		return errorResponse(err, "")
+	}
+
+	// optional signature verification
+	if _, ok := req["cipher"]; ok {
+		err = validateRequest(req, []string{"cipher:s", "key:s"})
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		cipher, err = verificationCipher(req["cipher"].(string), req["key"].(string))
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		sigPath, err = optionalString(req, "sig", req["path"].(string)+"."+cipher.GetInfo().Extension+"-signature")
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if sigPath, err = absolutePath(sigPath); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	digests, names, err := parseManifest(manifest)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	var total int64
+
+	for _, name := range names {
+		// key storage and metadata are never traversed, nor verified
+		if internalPath(filepath.Join(root, name)) {
+			return errorResponse(fmt.Errorf("invalid path in manifest: %s", name), "")
+		}
+
+		if stat, err := os.Stat(filepath.Join(root, name)); err == nil {
+			total += stat.Size()
+		}
+	}
+
+	id, err := jobs.Submit("manifest_verify", manifest, total, func(j *job) (result interface{}, err error) {
+		n := status.Notify(syslog.LOG_INFO, "verifying manifest %s", relativePath(manifest))
+		defer status.Remove(n)
+
+		res := &manifestResult{
+			Files:      len(names),
+			Mismatched: []string{},
+			Missing:    []string{},
+			Unlisted:   []string{},
+		}
+
+		if cipher != nil {
+			err = verifyFile(cipher, manifest, sigPath)
+
+			if err != nil {
+				return res, fmt.Errorf("manifest signature verification failed, %v", err)
+			}
+
+			res.Signature = true
+		}
+
+		for _, name := range names {
+			if err = j.Err(); err != nil {
+				return
+			}
+
+			digest, err := sha256File(filepath.Join(root, name), j)
+
+			switch {
+			case os.IsNotExist(err):
+				res.Missing = append(res.Missing, name)
+			case err != nil:
+				return res, err
+			case digest != digests[name]:
+				res.Mismatched = append(res.Mismatched, name)
+			}
+		}
+
+		files, err := treeFiles(root, func(p string) bool {
+			return p != manifest && p != sigPath
+		})
+
+		if err != nil {
+			return res, err
+		}
+
+		for _, f := range files {
+			rel, _ := filepath.Rel(root, f)
+
+			if _, ok := digests[rel]; !ok {
+				res.Unlisted = append(res.Unlisted, filepath.ToSlash(rel))
+			}
+		}
+
+		res.Valid = len(res.Mismatched) == 0 && len(res.Missing) == 0
+
+		if !res.Valid {
+			return res, fmt.Errorf("manifest verification failed, %d mismatched and %d missing file(s)", len(res.Mismatched), len(res.Missing))
+		}
+
+		status.Log(syslog.LOG_NOTICE, "successful verification of manifest %s", relativePath(manifest))
+
+		return res, nil
+	})
+
+	return jobResponse(id, err)
+}
+
+// verifyFile verifies the detached signature of a file.
+func verifyFile(cipher cipherInterface, osPath string, sigPath string) (err error) {
+	input, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	sig, err := os.Open(sigPath)
+
+	if err != nil {
+		return
+	}
+	defer sig.Close()
+
+	return cipher.Verify(input, sig)
+}
+
+// findDuplicates groups the files by digest, only files sharing their size
+// with other ones are hashed.
+func findDuplicates(files []string, j *job) (groups []duplicateGroup, err error) {
+	sizes := make(map[int64][]string)
+
+	for _, f := range files {
+		stat, err := os.Stat(f)
+
+		// empty files are not considered duplicates
+		if err != nil || stat.Size() == 0 {
+			continue
+		}
+
+		sizes[stat.Size()] = append(sizes[stat.Size()], f)
+	}
+
+	var total int64
+
+	for size, paths := range sizes {
+		if len(paths) > 1 {
+			total += size * int64(len(paths))
+		}
+	}
+
+	if j != nil {
+		j.SetTotal(total)
+	}
+
+	groups = []duplicateGroup{}
+
+	for size, paths := range sizes {
+		if len(paths) < 2 {
+			continue
+		}
+
+		digests := make(map[string][]string)
+
+		for _, p := range paths {
+			digest, err := sha256File(p, j)
+
+			if err != nil {
+				return nil, err
+			}
+
+			digests[digest] = append(digests[digest], relativePath(p))
+		}
+
+		for digest, dup := range digests {
+			if len(dup) > 1 {
+				sort.Strings(dup)
+				groups = append(groups, duplicateGroup{SHA256: digest, Size: size, Paths: dup})
+			}
+		}
+	}
+
+	sort.Slice(groups, func(i, k int) bool {
+		if groups[i].Size != groups[k].Size {
+			return groups[i].Size > groups[k].Size
+		}
+
+		return groups[i].Paths[0] < groups[k].Paths[0]
+	})
+
+	return
+}
+
+func fileDuplicates(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	root, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	files, err := treeFiles(root, nil)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if len(files) == 0 {
+		return errorResponse(errors.New("no files to process"), "")
+	}
+
+	id, err := jobs.Submit("duplicates", root, 0, func(j *job) (result interface{}, err error) {
+		n := status.Notify(syslog.LOG_INFO, "searching duplicates in %s", relativePath(root))
+		defer status.Remove(n)
+
+		return findDuplicates(files, j)
+	})
+
+	return jobResponse(id, err)
+}
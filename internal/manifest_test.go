@@ -0,0 +1,96 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	files := map[string]string{
+		"a":           "duplicate",
+		"dir/b":       "duplicate",
+		"dir/c":       "unique",
+		"dir/new\nd":  "newline",
+		"dir/back\\e": "backslash",
+	}
+
+	var manifest strings.Builder
+
+	for name, contents := range files {
+		osPath := filepath.Join(conf.MountPoint, name)
+		os.MkdirAll(filepath.Dir(osPath), 0700)
+		os.WriteFile(osPath, []byte(contents), 0600)
+
+		digest, err := sha256File(osPath, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		manifest.WriteString(manifestLine(digest, name))
+	}
+
+	manifestPath := filepath.Join(conf.MountPoint, manifestName)
+	os.WriteFile(manifestPath, []byte(manifest.String()), 0600)
+
+	digests, names, err := parseManifest(manifestPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(names) != len(files) {
+		t.Fatalf("unexpected number of manifest entries (%d)", len(names))
+	}
+
+	for _, name := range names {
+		digest, _ := sha256File(filepath.Join(conf.MountPoint, name), nil)
+
+		if digests[name] != digest {
+			t.Errorf("digest mismatch for %q", name)
+		}
+	}
+
+	os.WriteFile(manifestPath, []byte(strings.Repeat("0", 64)+"  ../escape\n"), 0600)
+
+	if _, _, err = parseManifest(manifestPath); err == nil {
+		t.Error("path traversal accepted")
+	}
+
+	// key storage is neither written nor verified
+	keyFile := filepath.Join(conf.KeyPath, "pgp", "private", "key.asc")
+	os.MkdirAll(filepath.Join(conf.MountPoint, filepath.Dir(keyFile)), 0700)
+	os.WriteFile(filepath.Join(conf.MountPoint, keyFile), []byte("secret"), 0600)
+
+	if textRequest(fileManifest, jsonObject{"path": "/dir", "dst": "/" + keyFile + ".sha256"}) != nil {
+		t.Error("manifest written to key storage")
+	}
+
+	os.WriteFile(manifestPath, []byte(manifestLine(strings.Repeat("0", 64), keyFile)), 0600)
+
+	if textRequest(fileManifestVerify, jsonObject{"path": "/" + manifestName}) != nil {
+		t.Error("key storage path verified")
+	}
+
+	paths, _ := treeFiles(conf.MountPoint, nil)
+	groups, err := findDuplicates(paths, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 || len(groups[0].Paths) != 2 || groups[0].Paths[0] != "/a" || groups[0].Paths[1] != "/dir/b" {
+		t.Errorf("unexpected duplicates %+v", groups)
+	}
+}
@@ -13,13 +13,16 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log/syslog"
+	"os"
+	"path/filepath"
 	"regexp"
 	"syscall"
 
 	"golang.org/x/term"
 )
 
-var opPattern = regexp.MustCompile("^(lock|unlock|derive)(:.+)?$")
+var opPattern = regexp.MustCompile("^(lock|unlock|derive|keyaudit)(:.+)?$")
 
 func Op(op string) (err error) {
 	var cmd string
@@ -85,6 +88,46 @@ func Op(op string) (err error) {
 		}
 
 		fmt.Println(derivedKey)
+	case "keyaudit":
+		err = printKeyAudit()
+	}
+
+	return
+}
+
+func printKeyAudit() (err error) {
+	var attention int
+
+	_, err = os.Stat(filepath.Join(conf.MountPoint, conf.KeyPath))
+
+	if err != nil {
+		return fmt.Errorf("key storage not available, is the encrypted volume mounted? (%v)", err)
+	}
+
+	if conf.KeyStore {
+		fmt.Print("Key store ")
+		password, err := promptPassword(false)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = keyStore.Open(string(password)); err != nil {
+			return err
+		}
+		defer keyStore.Close()
+	}
+
+	for _, f := range auditKeys() {
+		fmt.Printf("%-7s %s: %s\n", severityName(f.Severity), f.Key.Path, f.Message)
+
+		if f.Severity <= syslog.LOG_WARNING {
+			attention++
+		}
+	}
+
+	if attention > 0 {
+		err = fmt.Errorf("%d key audit finding(s) require attention", attention)
 	}
 
 	return
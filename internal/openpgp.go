@@ -11,7 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"os"
+	"log/syslog"
 	"path/filepath"
 	"time"
 
@@ -20,6 +20,13 @@ import (
 	"golang.org/x/crypto/openpgp/packet"
 )
 
+const (
+	// minimum acceptable RSA key size
+	minRSABits = 2048
+	// advance warning period for key expiration
+	expiryWarning = 30 * 24 * time.Hour
+)
+
 type openPGP struct {
 	info   cipherInfo
 	pubKey *openpgp.Entity
@@ -134,6 +141,36 @@ func (o *openPGP) SetPassword(password string) (err error) {
 	return
 }
 
+func (o *openPGP) VerifyPassphrase(k key, password string) (protected bool, err error) {
+	if err = o.SetKey(k); err != nil {
+		return
+	}
+
+	if o.secKey == nil {
+		return false, errors.New("passphrase verification requires a private key")
+	}
+
+	keys := []*packet.PrivateKey{o.secKey.PrivateKey}
+
+	for _, subKey := range o.secKey.Subkeys {
+		keys = append(keys, subKey.PrivateKey)
+	}
+
+	for _, pk := range keys {
+		if pk == nil || !pk.Encrypted {
+			continue
+		}
+
+		protected = true
+
+		if pk.Decrypt([]byte(password)) != nil {
+			return protected, errors.New("invalid key passphrase")
+		}
+	}
+
+	return
+}
+
 // workaround for https://github.com/golang/go/issues/15353
 func readEntityWithoutExpiredSubkeys(packets *packet.Reader) (entity *openpgp.Entity, err error) {
 	var p packet.Packet
@@ -166,15 +203,13 @@ func readEntityWithoutExpiredSubkeys(packets *packet.Reader) (entity *openpgp.En
 }
 
 func (o *openPGP) SetKey(k key) (err error) {
-	keyPath := filepath.Join(conf.MountPoint, k.Path)
-	keyFile, err := os.Open(keyPath)
+	data, err := readKey(k)
 
 	if err != nil {
 		return
 	}
-	defer keyFile.Close()
 
-	keyBlock, err := armor.Decode(keyFile)
+	keyBlock, err := armor.Decode(bytes.NewReader(data))
 
 	if err != nil {
 		return
@@ -207,13 +242,16 @@ func (o *openPGP) SetKey(k key) (err error) {
 	return
 }
 
-func (o *openPGP) Encrypt(input *os.File, output *os.File, _ bool) (err error) {
+func (o *openPGP) Encrypt(input io.Reader, output io.Writer, _ bool) (err error) {
 	hints := &openpgp.FileHints{
 		IsBinary: true,
-		FileName: input.Name(),
 		ModTime:  time.Now(),
 	}
 
+	if f, ok := input.(interface{ Name() string }); ok {
+		hints.FileName = filepath.Base(f.Name())
+	}
+
 	// signing is automatically detected if SetKey(secKey) is performed on
 	// the *openPGP instance
 
@@ -229,7 +267,7 @@ func (o *openPGP) Encrypt(input *os.File, output *os.File, _ bool) (err error) {
 	return
 }
 
-func (o *openPGP) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+func (o *openPGP) Decrypt(input io.Reader, output io.Writer, verify bool) (err error) {
 	keyRing := openpgp.EntityList{}
 	keyRing = append(keyRing, o.secKey)
 
@@ -256,11 +294,11 @@ func (o *openPGP) Decrypt(input *os.File, output *os.File, verify bool) (err err
 	return
 }
 
-func (o *openPGP) Sign(input *os.File, output *os.File) error {
+func (o *openPGP) Sign(input io.Reader, output io.Writer) error {
 	return openpgp.ArmoredDetachSign(output, o.secKey, input, nil)
 }
 
-func (o *openPGP) Verify(input *os.File, signature *os.File) (err error) {
+func (o *openPGP) Verify(input io.Reader, signature io.Reader) (err error) {
 	keyRing := openpgp.EntityList{}
 	keyRing = append(keyRing, o.pubKey)
 
@@ -269,6 +307,122 @@ func (o *openPGP) Verify(input *os.File, signature *os.File) (err error) {
 	return
 }
 
+func auditPublicKey(pub *packet.PublicKey, desc string) (findings []keyFinding) {
+	bitLength, _ := pub.BitLength()
+
+	switch pub.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		if bitLength < minRSABits {
+			findings = append(findings, keyFinding{
+				Severity: syslog.LOG_ERR,
+				Message:  fmt.Sprintf("weak %s: %v/%v", desc, algoName(pub.PubKeyAlgo), bitLength),
+			})
+		}
+	case packet.PubKeyAlgoDSA, packet.PubKeyAlgoElGamal:
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  fmt.Sprintf("deprecated %s algorithm: %v/%v", desc, algoName(pub.PubKeyAlgo), bitLength),
+		})
+	}
+
+	return
+}
+
+func auditExpiry(sig *packet.Signature, desc string) (findings []keyFinding) {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return
+	}
+
+	expiry := sig.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+
+	switch {
+	case time.Now().After(expiry):
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_ERR,
+			Message:  fmt.Sprintf("%s expired on %v", desc, expiry),
+		})
+	case time.Now().Add(expiryWarning).After(expiry):
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  fmt.Sprintf("%s expires on %v", desc, expiry),
+		})
+	}
+
+	return
+}
+
+func (o *openPGP) AuditKey(k key) (findings []keyFinding, err error) {
+	err = o.SetKey(k)
+
+	if err != nil {
+		return
+	}
+
+	entity := o.pubKey
+
+	if k.Private {
+		entity = o.secKey
+	}
+
+	findings = append(findings, auditPublicKey(entity.PrimaryKey, "primary key")...)
+
+	for _, ident := range entity.Identities {
+		findings = append(findings, auditExpiry(ident.SelfSignature, "primary key")...)
+		break
+	}
+
+	for _, rev := range entity.Revocations {
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_ERR,
+			Message:  fmt.Sprintf("key revoked on %v", rev.CreationTime),
+		})
+	}
+
+	if len(entity.Subkeys) == 0 {
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  "no valid subkeys",
+		})
+	}
+
+	for _, sub := range entity.Subkeys {
+		findings = append(findings, auditPublicKey(sub.PublicKey, "subkey")...)
+		findings = append(findings, auditExpiry(sub.Sig, "subkey "+sub.PublicKey.KeyIdShortString())...)
+	}
+
+	if !k.Private {
+		return
+	}
+
+	if entity.PrivateKey != nil && !entity.PrivateKey.Encrypted {
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  "private key not protected by passphrase",
+		})
+	}
+
+	pubKeys, _ := getKeys(o, false, "")
+
+	for _, pubKey := range pubKeys {
+		pub := new(openPGP)
+
+		if pub.SetKey(pubKey) != nil {
+			continue
+		}
+
+		if bytes.Equal(pub.pubKey.PrimaryKey.Fingerprint[:], entity.PrimaryKey.Fingerprint[:]) {
+			return
+		}
+	}
+
+	findings = append(findings, keyFinding{
+		Severity: syslog.LOG_WARNING,
+		Message:  "no matching public key",
+	})
+
+	return
+}
+
 func algoName(algo packet.PublicKeyAlgorithm) (name string) {
 	switch algo {
 	case packet.PubKeyAlgoRSA:
@@ -0,0 +1,412 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// policy files are stored alongside private keys
+const policyExt = ".policy"
+
+const (
+	_sign    = "sign"
+	_decrypt = "decrypt"
+)
+
+type keyPolicy struct {
+	Operations []string `json:"operations"`
+	MaxUses    int      `json:"max_uses"`
+	Confirm    bool     `json:"confirm"`
+}
+
+type keyUsage struct {
+	sync.Mutex
+	// completed uses
+	count map[string]int
+	// uses reserved by operations in progress
+	pending map[string]int
+}
+
+var usage = keyUsage{
+	count:   make(map[string]int),
+	pending: make(map[string]int),
+}
+
+var defaultPolicy = keyPolicy{
+	Operations: []string{_sign, _decrypt},
+	MaxUses:    0,
+	Confirm:    false,
+}
+
+func (p *keyPolicy) Allows(op string) bool {
+	for _, o := range p.Operations {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *keyPolicy) Validate() error {
+	for _, o := range p.Operations {
+		if o != _sign && o != _decrypt {
+			return fmt.Errorf("invalid key policy operation %s", o)
+		}
+	}
+
+	if p.MaxUses < 0 {
+		return errors.New("invalid key policy maximum uses")
+	}
+
+	return nil
+}
+
+func (k *key) policyPath() string {
+	return filepath.Join(conf.MountPoint, k.Path+policyExt)
+}
+
+// policyFile returns whether the path is a key policy file, which can only be
+// managed through the key policy API.
+func policyFile(osPath string) bool {
+	inKeyPath, _ := detectKeyPath(osPath)
+	return inKeyPath && filepath.Ext(osPath) == policyExt
+}
+
+// followKeyPolicy moves, or copies, the policy file of a key along with it.
+func followKeyPolicy(src string, dst string, move bool) (err error) {
+	if inKeyPath, _ := detectKeyPath(src); !inKeyPath {
+		return
+	}
+
+	src += policyExt
+	dst += policyExt
+
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	if inKeyPath, _ := detectKeyPath(dst); !inKeyPath {
+		return errors.New("key policies cannot be moved or copied outside key storage")
+	}
+
+	if move {
+		return os.Rename(src, dst)
+	}
+
+	data, err := os.ReadFile(src)
+
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(dst, data, 0600)
+}
+
+// Policy returns the private key usage policy, keys without a stored policy
+// are subject to the default unrestricted one.
+func (k *key) Policy() (p keyPolicy, err error) {
+	data, err := os.ReadFile(k.policyPath())
+
+	if os.IsNotExist(err) {
+		return defaultPolicy, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(data, &p)
+
+	return
+}
+
+func (p keyPolicy) String() string {
+	return fmt.Sprintf("operations: %v, max uses: %d, confirm: %v", p.Operations, p.MaxUses, p.Confirm)
+}
+
+func (k *key) SetPolicy(p keyPolicy) (err error) {
+	if err = p.Validate(); err != nil {
+		return
+	}
+
+	prev, err := k.Policy()
+
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(p)
+
+	if err != nil {
+		return
+	}
+
+	err = os.WriteFile(k.policyPath(), data, 0600)
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "updated %s key %s policy from (%v) to (%v)", k.Cipher, k.Identifier, prev, p)
+
+	return
+}
+
+// confirmKey verifies the password confirming the use of a private key
+// against its passphrase or, for keys without one, the key store passphrase.
+func confirmKey(k key, password string) (err error) {
+	if password == "" {
+		return errors.New("password not specified")
+	}
+
+	cipher, err := conf.GetCipher(k.Cipher)
+
+	if err != nil {
+		return
+	}
+
+	if v, ok := cipher.New().(passphraseInterface); ok {
+		protected, err := v.VerifyPassphrase(k, password)
+
+		if protected || err != nil {
+			return err
+		}
+	}
+
+	if !conf.KeyStore {
+		return fmt.Errorf("key %s has no passphrase and the key store is disabled", k.Identifier)
+	}
+
+	return keyStore.Verify(password)
+}
+
+// Authorize verifies that the key policy allows the requested operation,
+// confirming the password when required.
+func (k *key) Authorize(op string, password string) (err error) {
+	if !k.Private {
+		return
+	}
+
+	p, err := k.Policy()
+
+	if err != nil {
+		return
+	}
+
+	if !p.Allows(op) {
+		err = fmt.Errorf("key policy does not allow %s operations with %s", op, k.Identifier)
+		status.Log(syslog.LOG_WARNING, "denied %s operation with %s key %s", op, k.Cipher, k.Identifier)
+		return
+	}
+
+	if !p.Confirm {
+		return
+	}
+
+	if err = confirmKey(*k, password); err != nil {
+		status.Log(syslog.LOG_WARNING, "denied %s operation with %s key %s, confirmation failed", op, k.Cipher, k.Identifier)
+		return fmt.Errorf("key policy requires password confirmation for %s, %v", k.Identifier, err)
+	}
+
+	return
+}
+
+// Use reserves one use of the key, for the requested operation, within the
+// current session. The returned function must be called with the operation
+// outcome, only successful operations are counted.
+func (k *key) Use(op string) (done func(error), err error) {
+	done = func(error) {}
+
+	if !k.Private {
+		return
+	}
+
+	p, err := k.Policy()
+
+	if err != nil {
+		return
+	}
+
+	if !p.Allows(op) {
+		err = fmt.Errorf("key policy does not allow %s operations with %s", op, k.Identifier)
+		status.Log(syslog.LOG_WARNING, "denied %s operation with %s key %s", op, k.Cipher, k.Identifier)
+		return
+	}
+
+	usage.Lock()
+	defer usage.Unlock()
+
+	if p.MaxUses > 0 && usage.count[k.Path]+usage.pending[k.Path] >= p.MaxUses {
+		err = fmt.Errorf("key %s exceeded maximum uses per session (%d)", k.Identifier, p.MaxUses)
+		status.Log(syslog.LOG_WARNING, "denied %s operation with %s key %s, maximum uses exceeded", op, k.Cipher, k.Identifier)
+		return
+	}
+
+	usage.pending[k.Path]++
+
+	var once sync.Once
+
+	done = func(err error) {
+		once.Do(func() { usage.complete(*k, op, err) })
+	}
+
+	return
+}
+
+func (u *keyUsage) complete(k key, op string, err error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.pending[k.Path]--; u.pending[k.Path] <= 0 {
+		delete(u.pending, k.Path)
+	}
+
+	if err != nil {
+		return
+	}
+
+	u.count[k.Path]++
+
+	status.Log(syslog.LOG_NOTICE, "%s key %s used for %s (session uses: %d)", k.Cipher, k.Identifier, op, u.count[k.Path])
+}
+
+func (u *keyUsage) Uses(k key) int {
+	u.Lock()
+	defer u.Unlock()
+
+	return u.count[k.Path]
+}
+
+func (u *keyUsage) Reset() {
+	u.Lock()
+	defer u.Unlock()
+
+	u.count = make(map[string]int)
+}
+
+func privateKey(p string) (k key, err error) {
+	path, err := absolutePath(p)
+
+	if err != nil {
+		return
+	}
+
+	k, _, err = getKey(path)
+
+	if err != nil {
+		return
+	}
+
+	if !k.Private {
+		err = errors.New("key policies apply only to private keys")
+	}
+
+	return
+}
+
+func keyPolicyInfo(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	k, err := privateKey(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	p, err := k.Policy()
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"policy": p,
+			"uses":   usage.Uses(k),
+		},
+	}
+
+	return
+}
+
+func setKeyPolicy(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s", "policy:i"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	k, err := privateKey(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	password, err := optionalString(req, "password", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	// policy changes are reserved to the key owner
+	if !keyStore.Unlocked() {
+		if err = confirmKey(k, password); err != nil {
+			status.Log(syslog.LOG_WARNING, "denied %s key %s policy change, %v", k.Cipher, k.Identifier, err)
+			return errorResponse(fmt.Errorf("key policy changes require the key password or an unlocked key store, %v", err), "")
+		}
+	}
+
+	p := keyPolicy{}
+
+	// we re-marshal and unmarshal to avoid having to assign struct
+	// elements individually
+	s, _ := json.Marshal(req["policy"])
+	err = json.Unmarshal(s, &p)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = k.SetPolicy(p)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,94 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestKeyPolicy(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	if err := conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(usage.Reset)
+
+	cipher, err := conf.GetCipher("TOTP")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := key{Identifier: "policy_test", KeyFormat: "base32", Cipher: "TOTP", Private: true}
+
+	if err = k.Store(cipher, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.SetPolicy(keyPolicy{Operations: []string{_sign}, MaxUses: 1, Confirm: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.Authorize(_decrypt, ""); err == nil {
+		t.Error("operation not allowed by policy accepted")
+	}
+
+	if err = k.Authorize(_sign, "any password"); err == nil {
+		t.Error("confirmation accepted without key passphrase or key store")
+	}
+
+	conf.KeyStore = true
+	conf.KeyStoreTimeout = 60
+
+	if _, err = keyStore.Open("interlocktest"); err != nil {
+		t.Fatal(err)
+	}
+
+	keyStore.Close()
+
+	if err = k.Authorize(_sign, "wrong password"); err == nil {
+		t.Error("invalid confirmation password accepted")
+	}
+
+	if err = k.Authorize(_sign, "interlocktest"); err != nil {
+		t.Error(err)
+	}
+
+	done, err := k.Use(_sign)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = k.Use(_sign); err == nil {
+		t.Error("reserved use not accounted")
+	}
+
+	done(errors.New("failed operation"))
+
+	if usage.Uses(k) != 0 {
+		t.Error("failed operation counted as use")
+	}
+
+	if done, err = k.Use(_sign); err != nil {
+		t.Fatal(err)
+	}
+
+	done(nil)
+
+	if usage.Uses(k) != 1 {
+		t.Errorf("unexpected uses %d", usage.Uses(k))
+	}
+
+	if _, err = k.Use(_sign); err == nil {
+		t.Error("maximum uses exceeded")
+	}
+}
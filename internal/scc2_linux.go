@@ -117,7 +117,7 @@ func (a *aes256SCC) SetPassword(password string) (err error) {
 	return
 }
 
-func (a *aes256SCC) Encrypt(input *os.File, output *os.File, sign bool) (err error) {
+func (a *aes256SCC) Encrypt(input io.Reader, output io.Writer, sign bool) (err error) {
 	if sign {
 		return errors.New("symmetric cipher does not support signing")
 	}
@@ -146,20 +146,26 @@ func (a *aes256SCC) Encrypt(input *os.File, output *os.File, sign bool) (err err
 	return
 }
 
-func (a *aes256SCC) Decrypt(input *os.File, output *os.File, verify bool) (err error) {
+func (a *aes256SCC) Decrypt(input io.Reader, output io.Writer, verify bool) (err error) {
 	if verify {
 		return errors.New("symmetric cipher does not support signature verification")
 	}
 
+	in, err := randomAccess(input)
+
+	if err != nil {
+		return
+	}
+
 	salt := make([]byte, 8)
-	_, err = io.ReadFull(input, salt)
+	_, err = io.ReadFull(in, salt)
 
 	if err != nil {
 		return
 	}
 
 	iv := make([]byte, aes.BlockSize)
-	_, err = io.ReadFull(input, iv)
+	_, err = io.ReadFull(in, iv)
 
 	if err != nil {
 		return
@@ -177,7 +183,7 @@ func (a *aes256SCC) Decrypt(input *os.File, output *os.File, verify bool) (err e
 		return
 	}
 
-	err = decryptCTR(deviceKey, salt, iv, input, output)
+	err = decryptCTR(deviceKey, salt, iv, in, output)
 
 	return
 }
@@ -196,11 +202,11 @@ func (a *aes256SCC) SetKey(k key) error {
 	return errors.New("symmetric cipher does not support key")
 }
 
-func (a *aes256SCC) Sign(i *os.File, o *os.File) error {
+func (a *aes256SCC) Sign(i io.Reader, o io.Writer) error {
 	return errors.New("symmetric cipher does not support signing")
 }
 
-func (a *aes256SCC) Verify(i *os.File, s *os.File) error {
+func (a *aes256SCC) Verify(i io.Reader, s io.Reader) error {
 	return errors.New("symmetric cipher does not support signature verification")
 }
 
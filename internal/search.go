@@ -0,0 +1,295 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// default and maximum number of search results per request
+	searchLimit    = 100
+	searchMaxLimit = 1000
+	// files larger than this are not searched for contents
+	searchMaxContentSize = 64 << 20
+	// leading data inspected to detect binary files
+	searchSniffSize = 8000
+)
+
+type searchQuery struct {
+	name        string
+	minSize     int64
+	maxSize     int64
+	mtimeAfter  int64
+	mtimeBefore int64
+	contents    []byte
+	offset      int64
+	limit       int64
+}
+
+func parseSearchQuery(req jsonObject) (q *searchQuery, err error) {
+	q = &searchQuery{}
+
+	if q.name, err = optionalString(req, "name", ""); err != nil {
+		return
+	}
+
+	q.name = strings.ToLower(q.name)
+
+	if _, err = filepath.Match(q.name, ""); err != nil {
+		return nil, errors.New("invalid attribute name (glob)")
+	}
+
+	contents, err := optionalString(req, "contents", "")
+
+	if err != nil {
+		return
+	}
+
+	q.contents = []byte(contents)
+
+	for _, a := range []struct {
+		key string
+		val *int64
+		def int64
+	}{
+		{"min_size", &q.minSize, 0},
+		{"max_size", &q.maxSize, 0},
+		{"mtime_after", &q.mtimeAfter, 0},
+		{"mtime_before", &q.mtimeBefore, 0},
+		{"offset", &q.offset, 0},
+		{"limit", &q.limit, searchLimit},
+	} {
+		if *a.val, err = optionalInt(req, a.key, a.def); err != nil {
+			return
+		}
+	}
+
+	if q.offset < 0 || q.limit <= 0 || q.limit > searchMaxLimit {
+		return nil, errors.New("invalid search offset or limit")
+	}
+
+	return
+}
+
+// textContains returns whether the file is a text file containing the
+// pattern, binary files are detected by the presence of NUL bytes.
+func textContains(osPath string, pattern []byte) bool {
+	f, err := os.Open(osPath)
+
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, searchSniffSize)
+	n, _ := io.ReadFull(f, head)
+
+	if bytes.IndexByte(head[:n], 0) >= 0 {
+		return false
+	}
+
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+
+	buf := make([]byte, 32*1024+len(pattern))
+	tail := 0
+
+	for {
+		n, err := f.Read(buf[tail:])
+		data := buf[:tail+n]
+
+		if bytes.Contains(data, pattern) {
+			return true
+		}
+
+		if err != nil {
+			return false
+		}
+
+		// retain the data needed to match across reads
+		keep := len(pattern) - 1
+
+		if keep > len(data) {
+			keep = len(data)
+		}
+
+		tail = copy(buf, data[len(data)-keep:])
+	}
+}
+
+// match returns whether the file matches the query, contents are only searched
+// for regular files outside key storage.
+func (q *searchQuery) match(osPath string, info fs.FileInfo, inKeyPath bool) bool {
+	if q.name != "" {
+		if ok, _ := filepath.Match(q.name, strings.ToLower(info.Name())); !ok {
+			return false
+		}
+	}
+
+	mtime := info.ModTime().Unix()
+
+	switch {
+	case q.mtimeAfter > 0 && mtime < q.mtimeAfter:
+		return false
+	case q.mtimeBefore > 0 && mtime > q.mtimeBefore:
+		return false
+	}
+
+	// size and contents criteria only apply to files
+	if info.IsDir() {
+		return q.minSize == 0 && q.maxSize == 0 && len(q.contents) == 0
+	}
+
+	switch {
+	case info.Size() < q.minSize:
+		return false
+	case q.maxSize > 0 && info.Size() > q.maxSize:
+		return false
+	}
+
+	if len(q.contents) > 0 {
+		if inKeyPath || !info.Mode().IsRegular() || info.Size() > searchMaxContentSize {
+			return false
+		}
+
+		return textContains(osPath, q.contents)
+	}
+
+	return true
+}
+
+// search walks the volume from root, in lexical order, returning the page of
+// matching inodes selected by the query offset and limit.
+func search(root string, q *searchQuery) (inodes []inode, more bool, err error) {
+	var matches int64
+
+	inodes = []inode{}
+	errDone := errors.New("done")
+
+	err = filepath.WalkDir(root, func(osPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable paths are skipped
+			if d != nil && d.IsDir() && osPath != root {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if osPath == root {
+			return nil
+		}
+
+		if d.Name() == "lost+found" || metadataPath(osPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return nil
+		}
+
+		inKeyPath, private := detectKeyPath(osPath)
+
+		if !q.match(osPath, info, inKeyPath) {
+			return nil
+		}
+
+		matches++
+
+		if matches <= q.offset {
+			return nil
+		}
+
+		if int64(len(inodes)) == q.limit {
+			more = true
+			return errDone
+		}
+
+		inode := inode{
+			Name:    relativePath(osPath),
+			Dir:     d.IsDir(),
+			Size:    info.Size(),
+			Mtime:   info.ModTime().Unix(),
+			KeyPath: inKeyPath,
+			Private: private,
+		}
+
+		if !d.IsDir() && inKeyPath && filepath.Ext(osPath) != policyExt {
+			if key, _, err := getKey(osPath); err == nil {
+				inode.Key = &key
+			}
+		}
+
+		inodes = append(inodes, inode)
+
+		return nil
+	})
+
+	if err == errDone {
+		err = nil
+	}
+
+	return
+}
+
+func fileSearch(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	root, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	q, err := parseSearchQuery(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	inodes, more, err := search(root, q)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"inodes": inodes,
+			"offset": q.offset,
+			"more":   more,
+		},
+	}
+
+	return
+}
@@ -0,0 +1,46 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	for _, p := range []string{
+		"dir/file.txt",
+		"dir/.interlock-upload-1",
+		"dir/.interlock-vault/entry.txt",
+		".interlock-vault/entry.txt",
+	} {
+		osPath := filepath.Join(conf.MountPoint, p)
+		os.MkdirAll(filepath.Dir(osPath), 0700)
+		os.WriteFile(osPath, []byte("interlock"), 0600)
+	}
+
+	inodes, more, err := search(conf.MountPoint, &searchQuery{limit: searchLimit})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata is excluded at any depth
+	if len(inodes) != 2 || more || inodes[0].Name != "/dir" || inodes[1].Name != "/dir/file.txt" {
+		t.Errorf("unexpected search results %+v", inodes)
+	}
+
+	inodes, _, _ = search(conf.MountPoint, &searchQuery{contents: []byte("interlock"), limit: searchLimit})
+
+	if len(inodes) != 1 || inodes[0].Name != "/dir/file.txt" {
+		t.Errorf("unexpected search results %+v", inodes)
+	}
+}
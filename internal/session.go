@@ -21,6 +21,7 @@ type sessionData struct {
 	SessionID string // only a single session can be active at any time
 	XSRFToken string
 	createdAt *time.Time
+	done      chan struct{}
 }
 
 var session sessionData
@@ -55,6 +56,41 @@ func (s *sessionData) Validate(r *http.Request) (validSessionID bool, validXSRFT
 	return
 }
 
+// ValidXSRFToken validates an XSRF token supplied outside the request
+// headers.
+func (s *sessionData) ValidXSRFToken(XSRFToken string) bool {
+	session.Lock()
+	defer session.Unlock()
+
+	return session.XSRFToken != "" && subtle.ConstantTimeCompare([]byte(session.XSRFToken), []byte(XSRFToken)) == 1
+}
+
+// Done returns a channel which is closed when the session, identified by
+// sessionID, is invalidated.
+func (s *sessionData) Done(sessionID string) (done <-chan struct{}, active bool) {
+	session.Lock()
+	defer session.Unlock()
+
+	if session.SessionID == "" || subtle.ConstantTimeCompare([]byte(session.SessionID), []byte(sessionID)) != 1 {
+		return
+	}
+
+	if session.done == nil {
+		session.done = make(chan struct{})
+	}
+
+	return session.done, true
+}
+
+// invalidate notifies the session invalidation, it must be called with the
+// session lock held.
+func (s *sessionData) invalidate() {
+	if session.done != nil {
+		close(session.done)
+		session.done = nil
+	}
+}
+
 func (s *sessionData) Set(volume string, sessionID string, XSRFToken string) {
 	session.Lock()
 	defer session.Unlock()
@@ -70,6 +106,12 @@ func (s *sessionData) Set(volume string, sessionID string, XSRFToken string) {
 	session.SessionID = sessionID
 	session.XSRFToken = XSRFToken
 	session.createdAt = &now
+	session.invalidate()
+
+	keyStore.Close()
+	closeKDBXSessions()
+	download.Clear()
+	usage.Reset()
 }
 
 func (s *sessionData) Clear() {
@@ -79,4 +121,10 @@ func (s *sessionData) Clear() {
 	session.Volume = ""
 	session.SessionID = ""
 	session.XSRFToken = ""
+	session.invalidate()
+
+	keyStore.Close()
+	closeKDBXSessions()
+	download.Clear()
+	usage.Reset()
 }
@@ -49,6 +49,8 @@ Interlock.Backend = new function() {
 
                'config':     { 'time': 'config/time' },
 
+               'jobs':       { 'get': 'jobs/get' },
+
                'status':     { 'version': 'status/version',
                                'running': 'status/running' },
 
@@ -1808,7 +1808,8 @@ Interlock.FileManager.mkdir = function(path) {
 Interlock.FileManager.fileCopyCallback = function(backendData, args) {
   try {
     if (backendData.status === 'OK') {
-      Interlock.FileManager.fileList('mainView');
+      /* the copy is executed as a job, its identifier is returned */
+      Interlock.FileManager.fileCopyJob(backendData.response);
     } else {
       Interlock.Session.createEvent({'kind': backendData.status,
         'msg': '[Interlock.FileManager.fileCopy] ' + backendData.response});
@@ -1821,6 +1822,66 @@ Interlock.FileManager.fileCopyCallback = function(backendData, args) {
   }
 };
 
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Poll the copy job state
+ *
+ * @param {string} id copy job identifier
+ * @returns {}
+ */
+Interlock.FileManager.fileCopyJob = function(id) {
+  try {
+    Interlock.Backend.APIRequest(Interlock.Backend.API.jobs.get, 'POST',
+      JSON.stringify({id: id}), 'FileManager.fileCopyJobCallback');
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.FileManager.fileCopyJob] ' + e});
+  }
+};
+
+/**
+ * @function
+ * @public
+ *
+ * @description
+ * Callback function, refresh the file listed in the mainView according with
+ * the current pwd once the copy job has completed
+ *
+ * @param {Object} backendData
+ * @returns {}
+ */
+Interlock.FileManager.fileCopyJobCallback = function(backendData) {
+  try {
+    if (backendData.status !== 'OK') {
+      Interlock.Session.createEvent({'kind': backendData.status,
+        'msg': '[Interlock.FileManager.fileCopy] ' + backendData.response});
+      return;
+    }
+
+    var job = backendData.response;
+
+    switch (job.state) {
+      case 'queued':
+      case 'running':
+        setTimeout(function() { Interlock.FileManager.fileCopyJob(job.id) }, 1000);
+        break;
+      case 'done':
+        Interlock.FileManager.fileList('mainView');
+        break;
+      default:
+        Interlock.Session.createEvent({'kind': 'critical',
+          'msg': '[Interlock.FileManager.fileCopy] ' + job.error});
+        Interlock.FileManager.fileList('mainView');
+    }
+  } catch (e) {
+    Interlock.Session.createEvent({'kind': 'critical',
+      'msg': '[Interlock.FileManager.fileCopy] ' + e});
+  }
+};
+
 /**
  * @function
  * @public
@@ -8,9 +8,11 @@ package interlock
 
 import (
 	"container/ring"
+	"encoding/json"
 	"fmt"
 	"log"
 	"log/syslog"
+	"net/http"
 	"sort"
 	"sync"
 	"time"
@@ -18,6 +20,13 @@ import (
 
 const bufferSize = 20
 
+// pending events for each stream subscriber, events are dropped for
+// subscribers which fall behind
+const eventBufferSize = 64
+
+// interval for stream keep-alive messages and session validity checks
+const streamKeepAlive = 15 * time.Second
+
 // build information, initialized at compile time (see Makefile)
 var Build string
 var Revision string
@@ -27,6 +36,7 @@ type statusBuffer struct {
 	LogBuf       *ring.Ring
 	Notification map[int]statusEntry
 	n            int
+	subscribers  map[chan statusEvent]bool
 }
 
 type statusEntry struct {
@@ -35,10 +45,57 @@ type statusEntry struct {
 	Message string          `json:"msg"`
 }
 
+type notificationEntry struct {
+	ID int `json:"id"`
+	statusEntry
+}
+
+type statusEvent struct {
+	Name string
+	Data interface{}
+}
+
 var status = statusBuffer{
 	LogBuf:       ring.New(bufferSize),
 	Notification: make(map[int]statusEntry),
 	n:            0,
+	subscribers:  make(map[chan statusEvent]bool),
+}
+
+// publish delivers an event to stream subscribers, it must be called with
+// the status buffer locked.
+func (s *statusBuffer) publish(name string, data interface{}) {
+	for ch := range s.subscribers {
+		select {
+		case ch <- statusEvent{name, data}:
+		default:
+		}
+	}
+}
+
+// Event delivers an event to stream subscribers.
+func (s *statusBuffer) Event(name string, data interface{}) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.publish(name, data)
+}
+
+func (s *statusBuffer) Subscribe() chan statusEvent {
+	s.Lock()
+	defer s.Unlock()
+
+	ch := make(chan statusEvent, eventBufferSize)
+	s.subscribers[ch] = true
+
+	return ch
+}
+
+func (s *statusBuffer) Unsubscribe(ch chan statusEvent) {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.subscribers, ch)
 }
 
 func (s *statusBuffer) Log(code syslog.Priority, format string, a ...interface{}) {
@@ -47,8 +104,11 @@ func (s *statusBuffer) Log(code syslog.Priority, format string, a ...interface{}
 
 	log.Printf(format, a...)
 
+	entry := statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+
 	s.LogBuf = s.LogBuf.Prev()
-	s.LogBuf.Value = statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+	s.LogBuf.Value = entry
+	s.publish("log", entry)
 }
 
 func (s *statusBuffer) Error(err error) {
@@ -57,8 +117,11 @@ func (s *statusBuffer) Error(err error) {
 
 	log.Print(err.Error())
 
+	entry := statusEntry{Epoch: time.Now().Unix(), Code: syslog.LOG_ERR, Message: err.Error()}
+
 	s.LogBuf = s.LogBuf.Prev()
-	s.LogBuf.Value = statusEntry{Epoch: time.Now().Unix(), Code: syslog.LOG_ERR, Message: err.Error()}
+	s.LogBuf.Value = entry
+	s.publish("log", entry)
 }
 
 func (s *statusBuffer) Notify(code syslog.Priority, format string, a ...interface{}) int {
@@ -67,6 +130,7 @@ func (s *statusBuffer) Notify(code syslog.Priority, format string, a ...interfac
 
 	s.n++
 	s.Notification[s.n] = statusEntry{Epoch: time.Now().Unix(), Code: code, Message: fmt.Sprintf(format, a...)}
+	s.publish("notification", notificationEntry{s.n, s.Notification[s.n]})
 
 	return s.n
 }
@@ -76,6 +140,7 @@ func (s *statusBuffer) Remove(n int) {
 	defer s.Unlock()
 
 	delete(s.Notification, n)
+	s.publish("notification_remove", map[string]int{"id": n})
 }
 
 func (s *statusBuffer) Notifications() (notifications []statusEntry) {
@@ -112,3 +177,61 @@ func versionStatus() (res jsonObject) {
 
 	return
 }
+
+// statusStream pushes log, notification and job events to the client using
+// Server-Sent Events until the client disconnects or the session ends.
+func statusStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sessionID, err := r.Cookie(sessionCookie)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// the stream ends as soon as the session is invalidated
+	done, active := session.Done(sessionID.Value)
+
+	if !active {
+		http.Error(w, "invalid session", http.StatusUnauthorized)
+		return
+	}
+
+	ch := status.Subscribe()
+	defer status.Unsubscribe(ch)
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case e := <-ch:
+			data, err := json.Marshal(e.Data)
+
+			if err != nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,717 @@
+#!/usr/bin/env python3
+#
+# INTERLOCK | https://github.com/usbarmory/interlock
+# Copyright (c) The INTERLOCK authors. All Rights Reserved.
+#
+# Use of this source code is governed by the license
+# that can be found in the LICENSE file.
+#
+# Independent KeePass (KDBX 3.1 and 4) implementation, written against the
+# KeePass file format documentation and sharing no code with the Go parser,
+# used to generate the test databases in this directory and to read back
+# databases written by INTERLOCK.
+#
+# Requires Python 3 with the "cryptography" package, Argon2 is implemented
+# here (RFC 9106) as not all OpenSSL builds provide it.
+#
+#   kdbx.py generate              # (re)generate the test databases
+#   kdbx.py dump <file> <password>  # print the entries of a database
+
+import base64
+import gzip
+import hashlib
+import hmac
+import os
+import struct
+import sys
+import xml.etree.ElementTree as ET
+
+from cryptography.hazmat.primitives import padding
+from cryptography.hazmat.primitives.ciphers import Cipher, algorithms, modes
+
+SIG1 = 0x9AA2D903
+SIG2 = 0xB54BFB67
+
+CIPHER_AES256 = bytes.fromhex("31c1f2e6bf714350be5805216afc5aff")
+CIPHER_CHACHA20 = bytes.fromhex("d6038a2b8b6f4cb5a524339a31dbb59a")
+KDF_AES = bytes.fromhex("c9d9f39a628a4460bf740d08c18a4fea")
+KDF_ARGON2D = bytes.fromhex("ef636ddf8c29444b91f7a9a403e30a0c")
+KDF_ARGON2ID = bytes.fromhex("9e298b1956db4773b23dfc3ec6f0a1e6")
+
+SALSA20_NONCE = bytes.fromhex("e830094b97205d2a")
+
+# seconds between 0001-01-01 and the Unix epoch
+EPOCH = 62135596800
+# fixed timestamp (2024-01-01T00:00:00Z) for reproducible output
+TIMESTAMP = 1704067200
+
+
+M64 = (1 << 64) - 1
+
+
+def blake2b(data, n=64):
+    return hashlib.blake2b(data, digest_size=n).digest()
+
+
+def hprime(data, n):
+    """Variable length hash function H' (RFC 9106, section 3.3)."""
+    data = struct.pack("<I", n) + data
+
+    if n <= 64:
+        return blake2b(data, n)
+
+    r = (n + 31) // 32 - 2
+    v = blake2b(data)
+    out = v[:32]
+
+    for _ in range(r - 1):
+        v = blake2b(v)
+        out += v[:32]
+
+    return out + blake2b(v, n - 32 * r)
+
+
+def gb(v, a, b, c, d):
+    va, vb, vc, vd = v[a], v[b], v[c], v[d]
+    va = (va + vb + 2 * (va & 0xFFFFFFFF) * (vb & 0xFFFFFFFF)) & M64
+    vd ^= va
+    vd = ((vd >> 32) | (vd << 32)) & M64
+    vc = (vc + vd + 2 * (vc & 0xFFFFFFFF) * (vd & 0xFFFFFFFF)) & M64
+    vb ^= vc
+    vb = ((vb >> 24) | (vb << 40)) & M64
+    va = (va + vb + 2 * (va & 0xFFFFFFFF) * (vb & 0xFFFFFFFF)) & M64
+    vd ^= va
+    vd = ((vd >> 16) | (vd << 48)) & M64
+    vc = (vc + vd + 2 * (vc & 0xFFFFFFFF) * (vd & 0xFFFFFFFF)) & M64
+    vb ^= vc
+    vb = ((vb >> 63) | (vb << 1)) & M64
+    v[a], v[b], v[c], v[d] = va, vb, vc, vd
+
+
+def permute(v, idx):
+    gb(v, idx[0], idx[4], idx[8], idx[12])
+    gb(v, idx[1], idx[5], idx[9], idx[13])
+    gb(v, idx[2], idx[6], idx[10], idx[14])
+    gb(v, idx[3], idx[7], idx[11], idx[15])
+    gb(v, idx[0], idx[5], idx[10], idx[15])
+    gb(v, idx[1], idx[6], idx[11], idx[12])
+    gb(v, idx[2], idx[7], idx[8], idx[13])
+    gb(v, idx[3], idx[4], idx[9], idx[14])
+
+
+ROWS = [[16 * i + k for k in range(16)] for i in range(8)]
+COLUMNS = [[16 * r + 2 * j + k for r in range(8) for k in range(2)] for j in range(8)]
+
+
+def compress(x, y, prev=None):
+    """Compression function G, XORed with the previous block contents if any."""
+    r = [a ^ b for a, b in zip(x, y)]
+    q = list(r)
+
+    for idx in ROWS:
+        permute(q, idx)
+
+    for idx in COLUMNS:
+        permute(q, idx)
+
+    out = [a ^ b for a, b in zip(q, r)]
+
+    if prev is not None:
+        out = [a ^ b for a, b in zip(out, prev)]
+
+    return out
+
+
+def to_block(data):
+    return list(struct.unpack("<128Q", data))
+
+
+def argon2(mode, password, salt, secret, data, time, memory, lanes, n):
+    """Argon2 version 0x13, mode 0 (d), 1 (i) or 2 (id), memory in KiB."""
+    h0 = blake2b(struct.pack("<6I", lanes, n, memory, time, 0x13, mode) +
+                 struct.pack("<I", len(password)) + password +
+                 struct.pack("<I", len(salt)) + salt +
+                 struct.pack("<I", len(secret)) + secret +
+                 struct.pack("<I", len(data)) + data)
+
+    blocks = 4 * lanes * (memory // (4 * lanes))
+    q = blocks // lanes
+    segment = q // 4
+
+    B = [[None] * q for _ in range(lanes)]
+
+    for l in range(lanes):
+        B[l][0] = to_block(hprime(h0 + struct.pack("<II", 0, l), 1024))
+        B[l][1] = to_block(hprime(h0 + struct.pack("<II", 1, l), 1024))
+
+    zero = [0] * 128
+
+    for r in range(time):
+        for s in range(4):
+            for l in range(lanes):
+                independent = mode == 1 or (mode == 2 and r == 0 and s < 2)
+                counter = 0
+                addresses = None
+
+                def next_addresses():
+                    nonlocal counter, addresses
+                    counter += 1
+                    z = [r, l, s, blocks, time, mode, counter] + [0] * 121
+                    addresses = compress(zero, compress(zero, z))
+
+                start = 0
+
+                if r == 0 and s == 0:
+                    start = 2
+
+                    if independent:
+                        next_addresses()
+
+                for i in range(start, segment):
+                    j = s * segment + i
+                    prev = B[l][j - 1] if j > 0 else B[l][q - 1]
+
+                    if independent:
+                        if i % 128 == 0:
+                            next_addresses()
+
+                        rand = addresses[i % 128]
+                    else:
+                        rand = prev[0]
+
+                    ref_lane = (rand >> 32) % lanes
+
+                    if r == 0 and s == 0:
+                        ref_lane = l
+
+                    same = ref_lane == l
+
+                    if r == 0:
+                        if s == 0:
+                            area = i - 1
+                        elif same:
+                            area = s * segment + i - 1
+                        else:
+                            area = s * segment - (1 if i == 0 else 0)
+                    else:
+                        if same:
+                            area = q - segment + i - 1
+                        else:
+                            area = q - segment - (1 if i == 0 else 0)
+
+                    x = rand & 0xFFFFFFFF
+                    x = (x * x) >> 32
+                    rel = area - 1 - ((area * x) >> 32)
+                    first = 0 if r == 0 or s == 3 else (s + 1) * segment
+                    ref = B[ref_lane][(first + rel) % q]
+
+                    B[l][j] = compress(prev, ref, B[l][j] if r > 0 else None)
+
+    c = B[0][q - 1]
+
+    for l in range(1, lanes):
+        c = [a ^ b for a, b in zip(c, B[l][q - 1])]
+
+    return hprime(struct.pack("<128Q", *c), n)
+
+
+def rotl(v, n):
+    return ((v << n) | (v >> (32 - n))) & 0xFFFFFFFF
+
+
+class Salsa20:
+    """Salsa20/20 keystream, as used for KDBX 3.1 protected values."""
+
+    def __init__(self, key, nonce):
+        c = struct.unpack("<4I", b"expand 32-byte k")
+        k = struct.unpack("<8I", key)
+        n = struct.unpack("<2I", nonce)
+        self.state = [c[0], k[0], k[1], k[2], k[3], c[1], n[0], n[1],
+                      0, 0, c[2], k[4], k[5], k[6], k[7], c[3]]
+        self.buf = b""
+
+    def block(self):
+        x = list(self.state)
+
+        def qr(a, b, c, d):
+            x[b] ^= rotl((x[a] + x[d]) & 0xFFFFFFFF, 7)
+            x[c] ^= rotl((x[b] + x[a]) & 0xFFFFFFFF, 9)
+            x[d] ^= rotl((x[c] + x[b]) & 0xFFFFFFFF, 13)
+            x[a] ^= rotl((x[d] + x[c]) & 0xFFFFFFFF, 18)
+
+        for _ in range(10):
+            qr(0, 4, 8, 12)
+            qr(5, 9, 13, 1)
+            qr(10, 14, 2, 6)
+            qr(15, 3, 7, 11)
+            qr(0, 1, 2, 3)
+            qr(5, 6, 7, 4)
+            qr(10, 11, 8, 9)
+            qr(15, 12, 13, 14)
+
+        out = struct.pack("<16I", *[(x[i] + self.state[i]) & 0xFFFFFFFF for i in range(16)])
+
+        self.state[8] = (self.state[8] + 1) & 0xFFFFFFFF
+
+        if self.state[8] == 0:
+            self.state[9] = (self.state[9] + 1) & 0xFFFFFFFF
+
+        return out
+
+    def xor(self, data):
+        while len(self.buf) < len(data):
+            self.buf += self.block()
+
+        ks, self.buf = self.buf[:len(data)], self.buf[len(data):]
+
+        return bytes(a ^ b for a, b in zip(data, ks))
+
+
+class ChaCha20Stream:
+    """ChaCha20 keystream, as used for KDBX 4 protected values."""
+
+    def __init__(self, key):
+        h = hashlib.sha512(key).digest()
+        self.enc = Cipher(algorithms.ChaCha20(h[:32], b"\x00" * 4 + h[32:44]), None).encryptor()
+
+    def xor(self, data):
+        return self.enc.update(data)
+
+
+def variant_dictionary(items):
+    out = struct.pack("<H", 0x0100)
+
+    for name, (kind, value) in items:
+        if kind == 0x04:
+            value = struct.pack("<I", value)
+        elif kind == 0x05:
+            value = struct.pack("<Q", value)
+
+        out += struct.pack("<B", kind) + struct.pack("<I", len(name)) + name.encode()
+        out += struct.pack("<I", len(value)) + value
+
+    return out + b"\x00"
+
+
+def parse_variant_dictionary(data):
+    items = {}
+    pos = 2
+
+    while data[pos] != 0:
+        kind = data[pos]
+        n = struct.unpack_from("<I", data, pos + 1)[0]
+        name = data[pos + 5:pos + 5 + n].decode()
+        pos += 5 + n
+        n = struct.unpack_from("<I", data, pos)[0]
+        value = data[pos + 4:pos + 4 + n]
+        pos += 4 + n
+
+        if kind == 0x04:
+            value = struct.unpack("<I", value)[0]
+        elif kind == 0x05:
+            value = struct.unpack("<Q", value)[0]
+
+        items[name] = value
+
+    return items
+
+
+def composite_key(password):
+    return hashlib.sha256(hashlib.sha256(password.encode()).digest()).digest()
+
+
+def transform_key(key, kdf):
+    uuid = kdf["$UUID"]
+
+    if uuid == KDF_AES:
+        enc = Cipher(algorithms.AES(kdf["S"]), modes.ECB()).encryptor()
+
+        for _ in range(kdf["R"]):
+            key = enc.update(key)
+
+        return hashlib.sha256(key).digest()
+
+    if uuid in (KDF_ARGON2D, KDF_ARGON2ID):
+        mode = 0 if uuid == KDF_ARGON2D else 2
+        return argon2(mode, key, kdf["S"], b"", b"", kdf["I"], kdf["M"] // 1024, kdf["P"], 32)
+
+    raise ValueError("unsupported key derivation function")
+
+
+def outer_cipher(cipher_id, key, iv, encrypt):
+    if cipher_id == CIPHER_AES256:
+        c = Cipher(algorithms.AES(key), modes.CBC(iv))
+    elif cipher_id == CIPHER_CHACHA20:
+        c = Cipher(algorithms.ChaCha20(key, b"\x00" * 4 + iv), None)
+    else:
+        raise ValueError("unsupported cipher")
+
+    return c.encryptor() if encrypt else c.decryptor()
+
+
+def encrypt_payload(cipher_id, key, iv, data):
+    if cipher_id == CIPHER_AES256:
+        p = padding.PKCS7(128).padder()
+        data = p.update(data) + p.finalize()
+
+    e = outer_cipher(cipher_id, key, iv, True)
+
+    return e.update(data) + e.finalize()
+
+
+def decrypt_payload(cipher_id, key, iv, data):
+    d = outer_cipher(cipher_id, key, iv, False)
+    data = d.update(data) + d.finalize()
+
+    if cipher_id == CIPHER_AES256:
+        u = padding.PKCS7(128).unpadder()
+        data = u.update(data) + u.finalize()
+
+    return data
+
+
+def block_key(hmac_key, index):
+    return hashlib.sha512(struct.pack("<Q", index) + hmac_key).digest()
+
+
+def block_hmac(hmac_key, index, data):
+    msg = struct.pack("<Q", index) + struct.pack("<I", len(data)) + data
+    return hmac.new(block_key(hmac_key, index), msg, hashlib.sha256).digest()
+
+
+def kdbx_time(major):
+    if major >= 4:
+        return base64.b64encode(struct.pack("<q", TIMESTAMP + EPOCH)).decode()
+
+    return "2024-01-01T00:00:00Z"
+
+
+def uuid(name):
+    return base64.b64encode(hashlib.md5(name.encode()).digest()).decode()
+
+
+def document(major, stream, header_hash):
+    """KeePassXC style XML document, protected values are XORed in order."""
+
+    def protect(value):
+        return base64.b64encode(stream.xor(value.encode())).decode()
+
+    t = kdbx_time(major)
+    times = ("<Times><CreationTime>%s</CreationTime><LastModificationTime>%s</LastModificationTime>"
+             "<LastAccessTime>%s</LastAccessTime><ExpiryTime>%s</ExpiryTime><Expires>False</Expires>"
+             "<UsageCount>0</UsageCount><LocationChanged>%s</LocationChanged></Times>") % (t, t, t, t, t)
+
+    def entry(name, fields, history=None):
+        out = "<Entry><UUID>%s</UUID><IconID>0</IconID>" % uuid(name)
+        out += "<ForegroundColor/><BackgroundColor/><OverrideURL/><Tags/>" + times
+
+        for key, value, protected in fields:
+            if protected:
+                out += "<String><Key>%s</Key><Value Protected=\"True\">%s</Value></String>" % (key, protect(value))
+            else:
+                out += "<String><Key>%s</Key><Value>%s</Value></String>" % (key, value)
+
+        out += "<AutoType><Enabled>True</Enabled><DataTransferObfuscation>0</DataTransferObfuscation></AutoType>"
+
+        if history is None:
+            return out + "</Entry>"
+
+        return out + "<History>%s</History></Entry>" % entry(name, history)
+
+    meta = "<Meta><Generator>KeePassXC</Generator>"
+
+    if header_hash is not None:
+        meta += "<HeaderHash>%s</HeaderHash>" % base64.b64encode(header_hash).decode()
+
+    meta += ("<DatabaseName>INTERLOCK</DatabaseName><DatabaseNameChanged>%s</DatabaseNameChanged>"
+             "<MemoryProtection><ProtectTitle>False</ProtectTitle><ProtectUserName>False</ProtectUserName>"
+             "<ProtectPassword>True</ProtectPassword><ProtectURL>False</ProtectURL><ProtectNotes>False</ProtectNotes>"
+             "</MemoryProtection><RecycleBinEnabled>True</RecycleBinEnabled><RecycleBinUUID>%s</RecycleBinUUID>"
+             "<CustomData/></Meta>") % (t, uuid("recycle bin"))
+
+    # entries are serialized in document order, as protected values must be
+    mail = entry("mail", [("Notes", "line 1\nline 2", False), ("Password", "s3cret", True),
+                          ("Title", "Mail", False), ("URL", "https://mail.example", False),
+                          ("UserName", "alice", False)],
+                 [("Password", "old secret", True), ("Title", "Mail", False)])
+    forum = entry("forum", [("Notes", "", False), ("Password", "pässwörd", True),
+                            ("Title", "Forum", False), ("URL", "", False), ("UserName", "bob", False),
+                            ("otp", "otpauth://totp/forum?secret=JBSWY3DPEHPK3PXP&period=30&digits=6", True)])
+    deleted = entry("deleted", [("Password", "deleted", True), ("Title", "Deleted", False)])
+
+    root = ("<Root><Group><UUID>%s</UUID><Name>Root</Name><Notes/><IconID>48</IconID>%s"
+            "<IsExpanded>True</IsExpanded>%s"
+            "<Group><UUID>%s</UUID><Name>Web</Name><Notes/><IconID>1</IconID>%s<IsExpanded>True</IsExpanded>%s</Group>"
+            "<Group><UUID>%s</UUID><Name>Recycle Bin</Name><Notes/><IconID>43</IconID>%s<IsExpanded>False</IsExpanded>%s</Group>"
+            "</Group><DeletedObjects/></Root>") % (
+        uuid("root"), times, mail, uuid("web"), times, forum, uuid("recycle bin"), times, deleted)
+
+    return ("<?xml version=\"1.0\" encoding=\"utf-8\" standalone=\"yes\"?>\n<KeePassFile>%s%s</KeePassFile>"
+            % (meta, root)).encode()
+
+
+def field3(kind, data):
+    return struct.pack("<BH", kind, len(data)) + data
+
+
+def field4(kind, data):
+    return struct.pack("<BI", kind, len(data)) + data
+
+
+def write_kdbx3(password, rounds, seed):
+    rnd = lambda n, label: hashlib.sha256((seed + label).encode()).digest()[:n]
+
+    master_seed = rnd(32, "master")
+    transform_seed = rnd(32, "transform")
+    iv = rnd(16, "iv")
+    stream_key = rnd(32, "stream")
+    start_bytes = rnd(32, "start")
+
+    header = struct.pack("<IIHH", SIG1, SIG2, 1, 3)
+    header += field3(2, CIPHER_AES256)
+    header += field3(3, struct.pack("<I", 1))
+    header += field3(4, master_seed)
+    header += field3(5, transform_seed)
+    header += field3(6, struct.pack("<Q", rounds))
+    header += field3(7, iv)
+    header += field3(8, stream_key)
+    header += field3(9, start_bytes)
+    header += field3(10, struct.pack("<I", 2))
+    header += field3(0, b"\r\n\r\n")
+
+    stream = Salsa20(hashlib.sha256(stream_key).digest(), SALSA20_NONCE)
+    xml = gzip.compress(document(3, stream, hashlib.sha256(header).digest()), mtime=0)
+
+    blocks = struct.pack("<I", 0) + hashlib.sha256(xml).digest() + struct.pack("<I", len(xml)) + xml
+    blocks += struct.pack("<I", 1) + b"\x00" * 32 + struct.pack("<I", 0)
+
+    transformed = transform_key(composite_key(password), {"$UUID": KDF_AES, "S": transform_seed, "R": rounds})
+    key = hashlib.sha256(master_seed + transformed).digest()
+
+    return header + encrypt_payload(CIPHER_AES256, key, iv, start_bytes + blocks)
+
+
+def write_kdbx4(password, cipher_id, kdf, seed):
+    rnd = lambda n, label: hashlib.sha256((seed + label).encode()).digest()[:n]
+
+    master_seed = rnd(32, "master")
+    iv = rnd(16 if cipher_id == CIPHER_AES256 else 12, "iv")
+    stream_key = hashlib.sha512((seed + "stream").encode()).digest()
+
+    kdf_items = [("$UUID", (0x42, kdf["$UUID"]))]
+
+    if kdf["$UUID"] == KDF_AES:
+        kdf_items += [("R", (0x05, kdf["R"])), ("S", (0x42, kdf["S"]))]
+    else:
+        kdf_items += [("I", (0x05, kdf["I"])), ("M", (0x05, kdf["M"])), ("P", (0x04, kdf["P"])),
+                      ("S", (0x42, kdf["S"])), ("V", (0x04, 0x13))]
+
+    header = struct.pack("<IIHH", SIG1, SIG2, 0, 4)
+    header += field4(2, cipher_id)
+    header += field4(3, struct.pack("<I", 1))
+    header += field4(4, master_seed)
+    header += field4(7, iv)
+    header += field4(11, variant_dictionary(kdf_items))
+    header += field4(0, b"\r\n\r\n")
+
+    inner = field4(1, struct.pack("<I", 3)) + field4(2, stream_key) + field4(0, b"")
+    xml = gzip.compress(inner + document(4, ChaCha20Stream(stream_key), None), mtime=0)
+
+    transformed = transform_key(composite_key(password), kdf)
+    key = hashlib.sha256(master_seed + transformed).digest()
+    hmac_key = hashlib.sha512(master_seed + transformed + b"\x01").digest()
+
+    ciphertext = encrypt_payload(cipher_id, key, iv, xml)
+
+    out = header + hashlib.sha256(header).digest()
+    out += hmac.new(block_key(hmac_key, 0xFFFFFFFFFFFFFFFF), header, hashlib.sha256).digest()
+    out += block_hmac(hmac_key, 0, ciphertext) + struct.pack("<I", len(ciphertext)) + ciphertext
+    out += block_hmac(hmac_key, 1, b"") + struct.pack("<I", 0)
+
+    return out
+
+
+def read_kdbx(data, password):
+    sig1, sig2, minor, major = struct.unpack_from("<IIHH", data)
+
+    if sig1 != SIG1 or sig2 != SIG2:
+        raise ValueError("invalid signature")
+
+    fields = {}
+    pos = 12
+
+    while True:
+        if major >= 4:
+            kind, n = struct.unpack_from("<BI", data, pos)
+            pos += 5
+        else:
+            kind, n = struct.unpack_from("<BH", data, pos)
+            pos += 3
+
+        fields[kind] = data[pos:pos + n]
+        pos += n
+
+        if kind == 0:
+            break
+
+    header = data[:pos]
+
+    if major >= 4:
+        kdf = parse_variant_dictionary(fields[11])
+    else:
+        kdf = {"$UUID": KDF_AES, "S": fields[5], "R": struct.unpack("<Q", fields[6])[0]}
+
+    transformed = transform_key(composite_key(password), kdf)
+    key = hashlib.sha256(fields[4] + transformed).digest()
+
+    if major >= 4:
+        hmac_key = hashlib.sha512(fields[4] + transformed + b"\x01").digest()
+
+        if hashlib.sha256(header).digest() != data[pos:pos + 32]:
+            raise ValueError("header hash mismatch")
+
+        mac = hmac.new(block_key(hmac_key, 0xFFFFFFFFFFFFFFFF), header, hashlib.sha256).digest()
+
+        if mac != data[pos + 32:pos + 64]:
+            raise ValueError("invalid credentials")
+
+        pos += 64
+        ciphertext = b""
+        index = 0
+
+        while True:
+            mac = data[pos:pos + 32]
+            n = struct.unpack_from("<I", data, pos + 32)[0]
+            block = data[pos + 36:pos + 36 + n]
+            pos += 36 + n
+
+            if block_hmac(hmac_key, index, block) != mac:
+                raise ValueError("block %d authentication failure" % index)
+
+            if n == 0:
+                break
+
+            ciphertext += block
+            index += 1
+
+        payload = decrypt_payload(fields[2], key, fields[7], ciphertext)
+
+        if fields[3] == struct.pack("<I", 1):
+            payload = gzip.decompress(payload)
+
+        inner = {}
+        pos = 0
+
+        while True:
+            kind, n = struct.unpack_from("<BI", payload, pos)
+            inner.setdefault(kind, payload[pos + 5:pos + 5 + n])
+            pos += 5 + n
+
+            if kind == 0:
+                break
+
+        if struct.unpack("<I", inner[1])[0] != 3:
+            raise ValueError("unsupported inner stream")
+
+        stream = ChaCha20Stream(inner[2])
+        xml = payload[pos:]
+    else:
+        payload = decrypt_payload(fields[2], key, fields[7], data[pos:])
+
+        if payload[:32] != fields[9]:
+            raise ValueError("invalid credentials")
+
+        pos = 32
+        xml = b""
+
+        while True:
+            _, digest, n = struct.unpack_from("<I32sI", payload, pos)
+            block = payload[pos + 40:pos + 40 + n]
+            pos += 40 + n
+
+            if n == 0:
+                break
+
+            if hashlib.sha256(block).digest() != digest:
+                raise ValueError("block hash mismatch")
+
+            xml += block
+
+        if fields[3] == struct.pack("<I", 1):
+            xml = gzip.decompress(xml)
+
+        stream = Salsa20(hashlib.sha256(fields[8]).digest(), SALSA20_NONCE)
+
+    root = ET.fromstring(xml)
+
+    # protected values are decrypted in document order
+    for value in root.iter("Value"):
+        if value.get("Protected") == "True" and value.text:
+            value.text = stream.xor(base64.b64decode(value.text)).decode()
+
+    return root
+
+
+def dump(root):
+    def walk(group, path):
+        name = group.findtext("Name")
+        path = path + "/" + name if path else name
+
+        for e in group.findall("Entry"):
+            fields = {s.findtext("Key"): s.findtext("Value") or "" for s in e.findall("String")}
+            history = len(e.findall("History/Entry"))
+            print("%s\t%s\t%s\t%d" % (path, base64.b64decode(e.findtext("UUID")).hex(),
+                                      sorted(fields.items()), history))
+
+        for g in group.findall("Group"):
+            walk(g, path)
+
+    walk(root.find("Root/Group"), "")
+
+
+def generate():
+    outdir = os.path.dirname(os.path.abspath(__file__))
+    salt = hashlib.sha256(b"argon2 salt").digest()
+    databases = {
+        "kdbx31-aeskdf.kdbx": write_kdbx3("password", 6000, "kdbx31"),
+        "kdbx4-aeskdf-aes.kdbx": write_kdbx4("password", CIPHER_AES256,
+                                             {"$UUID": KDF_AES, "S": hashlib.sha256(b"aes-kdf seed").digest(), "R": 6000},
+                                             "kdbx4-aes"),
+        "kdbx4-argon2d-aes.kdbx": write_kdbx4("password", CIPHER_AES256,
+                                              {"$UUID": KDF_ARGON2D, "S": salt, "I": 2, "M": 1 << 20, "P": 2},
+                                              "kdbx4-argon2d"),
+        "kdbx4-argon2id-chacha20.kdbx": write_kdbx4("password", CIPHER_CHACHA20,
+                                                    {"$UUID": KDF_ARGON2ID, "S": salt, "I": 2, "M": 1 << 20, "P": 2},
+                                                    "kdbx4-chacha20"),
+    }
+
+    for name, data in databases.items():
+        with open(os.path.join(outdir, name), "wb") as f:
+            f.write(data)
+
+        # self-check
+        read_kdbx(data, "password")
+
+
+def selftest():
+    # RFC 9106 test vectors
+    args = (b"\x01" * 32, b"\x02" * 16, b"\x03" * 8, b"\x04" * 12, 3, 32, 4, 32)
+
+    assert argon2(0, *args).hex() == "512b391b6f1162975371d30919734294f868e3be3984f3c1a13a4db9fabe4acb"
+    assert argon2(1, *args).hex() == "c814d9d1dc7f37aa13f0d77f2494bda1c8de6b016dd388d29952a4c4672b6ce8"
+    assert argon2(2, *args).hex() == "0d640df58d78766c08c037a34a8b53c9d01ef0452d75b65eb52520e96b01e659"
+
+    # ECRYPT Salsa20 256-bit key, set 1, vector 0
+    assert Salsa20(b"\x80" + b"\x00" * 31, b"\x00" * 8).xor(b"\x00" * 16).hex() == "e3be8fdd8beca2e3ea8ef9475b29a6e7"
+
+
+if __name__ == "__main__":
+    selftest()
+
+    if len(sys.argv) == 2 and sys.argv[1] == "generate":
+        generate()
+    elif len(sys.argv) == 4 and sys.argv[1] == "dump":
+        with open(sys.argv[2], "rb") as f:
+            dump(read_kdbx(f.read(), sys.argv[3]))
+    else:
+        sys.exit("usage: kdbx.py generate | dump <file> <password>")
@@ -0,0 +1,30 @@
+#!/bin/sh
+#
+# INTERLOCK | https://github.com/usbarmory/interlock
+# Copyright (c) The INTERLOCK authors. All Rights Reserved.
+#
+# Use of this source code is governed by the license
+# that can be found in the LICENSE file.
+#
+# Generates the xz test files in this directory with the xz utility.
+
+set -e
+
+python3 - <<'PY'
+import random
+r = random.Random(1)
+text = b"".join(b"line %04d of the INTERLOCK xz test file\n" % i for i in range(256))
+binary = bytes(r.getrandbits(8) for _ in range(2048))
+open("input", "wb").write(text + binary + text)
+PY
+
+xz -ck -6 input > crc64.xz
+xz -ck -0 --check=crc32 input > crc32.xz
+xz -ck -9e --check=sha256 input > sha256.xz
+xz -ck --check=none --lzma2=lc=0,lp=4,pb=0 input > none-lp4.xz
+xz -ck -T1 --block-size=4096 input > blocks.xz
+
+head -c 5000 input | xz -c > a.xz
+tail -c +5001 input | xz -c --check=crc32 > b.xz
+(cat a.xz; head -c 8 /dev/zero; cat b.xz; head -c 4 /dev/zero) > streams.xz
+rm a.xz b.xz
@@ -0,0 +1,261 @@
+#!/usr/bin/env python3
+#
+# INTERLOCK | https://github.com/usbarmory/interlock
+# Copyright (c) The INTERLOCK authors. All Rights Reserved.
+#
+# Use of this source code is governed by the license
+# that can be found in the LICENSE file.
+#
+# Independent WinZip AES (AE-1/AE-2) writer and reader, following the WinZip
+# "AES Encryption Information" specification, used to generate the test
+# archives in this directory and to decode archives written by INTERLOCK.
+#
+# usage:
+#   winzip_aes.py generate
+#   winzip_aes.py dump <file> <password>
+
+import hashlib
+import hmac
+import os
+import struct
+import sys
+import zlib
+
+from cryptography.hazmat.primitives.ciphers import Cipher, algorithms, modes
+
+PASSWORD = b"password"
+
+METHOD_STORE = 0
+METHOD_DEFLATE = 8
+METHOD_AES = 99
+EXTRA_AES = 0x9901
+FLAG_ENCRYPTED = 0x0001
+
+ROUNDS = 1000
+PVV_SIZE = 2
+MAC_SIZE = 10
+
+# strength: (key size, salt size)
+STRENGTHS = {1: (16, 8), 2: (24, 12), 3: (32, 16)}
+
+# 2015-01-30 22:23:00 in MS-DOS format
+DOS_TIME = (22 << 11) | (23 << 5)
+DOS_DATE = ((2015 - 1980) << 9) | (1 << 5) | 30
+
+
+def ctr_le(key, data):
+    # WinZip AES uses a little-endian block counter starting at 1
+    ecb = Cipher(algorithms.AES(key), modes.ECB()).encryptor()
+    out = bytearray()
+
+    for i in range(0, len(data), 16):
+        counter = (i // 16 + 1).to_bytes(16, "little")
+        stream = ecb.update(counter)
+        chunk = data[i:i + 16]
+        out += bytes(a ^ b for a, b in zip(chunk, stream))
+
+    return bytes(out)
+
+
+def derive(password, salt, key_size):
+    keys = hashlib.pbkdf2_hmac("sha1", password, salt, ROUNDS, 2 * key_size + PVV_SIZE)
+    return keys[0:key_size], keys[key_size:2 * key_size], keys[2 * key_size:]
+
+
+def aes_extra(version, strength, method):
+    return struct.pack("<HHH2sBH", EXTRA_AES, 7, version, b"AE", strength, method)
+
+
+def compress(method, data):
+    if method == METHOD_STORE:
+        return data
+
+    c = zlib.compressobj(9, zlib.DEFLATED, -15)
+    return c.compress(data) + c.flush()
+
+
+def decompress(method, data):
+    if method == METHOD_STORE:
+        return data
+
+    if method == METHOD_DEFLATE:
+        return zlib.decompress(data, -15)
+
+    raise ValueError("unsupported compression method %d" % method)
+
+
+class Writer:
+    def __init__(self):
+        self.data = bytearray()
+        self.central = bytearray()
+        self.count = 0
+
+    def add(self, name, contents, mode, method=METHOD_DEFLATE, aes=None, salt=None):
+        name = name.encode()
+        crc = zlib.crc32(contents) if not name.endswith(b"/") else 0
+        payload = compress(method, contents)
+        flags = 0
+        extra = b""
+        entry_method = method
+
+        if aes is not None:
+            version, strength = aes
+            key_size, salt_size = STRENGTHS[strength]
+            assert len(salt) == salt_size
+
+            enc_key, mac_key, pvv = derive(PASSWORD, salt, key_size)
+            ciphertext = ctr_le(enc_key, payload)
+            mac = hmac.new(mac_key, ciphertext, hashlib.sha1).digest()[0:MAC_SIZE]
+            payload = salt + pvv + ciphertext + mac
+
+            flags |= FLAG_ENCRYPTED
+            extra = aes_extra(version, strength, method)
+            entry_method = METHOD_AES
+
+            # AE-2 omits the CRC, relying on the authentication code
+            if version == 2:
+                crc = 0
+
+        offset = len(self.data)
+        version_needed = 51 if aes is not None else 20
+
+        self.data += struct.pack("<IHHHHHIIIHH", 0x04034b50, version_needed, flags,
+                                 entry_method, DOS_TIME, DOS_DATE, crc, len(payload),
+                                 len(contents), len(name), len(extra))
+        self.data += name + extra + payload
+
+        # version made by: UNIX, specification 6.3
+        self.central += struct.pack("<IHHHHHHIIIHHHHHII", 0x02014b50, (3 << 8) | 63,
+                                    version_needed, flags, entry_method, DOS_TIME,
+                                    DOS_DATE, crc, len(payload), len(contents),
+                                    len(name), len(extra), 0, 0, 0, mode << 16, offset)
+        self.central += name + extra
+        self.count += 1
+
+    def bytes(self):
+        offset = len(self.data)
+        end = struct.pack("<IHHHHIIH", 0x06054b50, 0, 0, self.count, self.count,
+                          len(self.central), offset, 0)
+
+        return bytes(self.data + self.central + end)
+
+
+def read(data, password):
+    entries = []
+    end = data.rindex(b"PK\x05\x06")
+    _, _, _, _, count, size, offset, _ = struct.unpack("<IHHHHIIH", data[end:end + 22])
+    p = offset
+
+    for _ in range(count):
+        (sig, _, _, flags, method, _, _, crc, csize, usize, nlen, elen, clen,
+         _, _, _, local) = struct.unpack("<IHHHHHHIIIHHHHHII", data[p:p + 46])
+        assert sig == 0x02014b50
+        name = data[p + 46:p + 46 + nlen].decode()
+        extra = data[p + 46 + nlen:p + 46 + nlen + elen]
+        p += 46 + nlen + elen + clen
+
+        lnlen, lelen = struct.unpack("<HH", data[local + 26:local + 30])
+        start = local + 30 + lnlen + lelen
+        payload = data[start:start + csize]
+        version = None
+
+        if flags & FLAG_ENCRYPTED:
+            if method != METHOD_AES:
+                raise ValueError("%s: unsupported encryption" % name)
+
+            while extra:
+                eid, esize = struct.unpack("<HH", extra[0:4])
+
+                if eid == EXTRA_AES:
+                    version, vendor, strength, method = struct.unpack("<H2sBH", extra[4:11])
+                    assert vendor == b"AE"
+
+                extra = extra[4 + esize:]
+
+            key_size, salt_size = STRENGTHS[strength]
+            salt = payload[0:salt_size]
+            enc_key, mac_key, pvv = derive(password, salt, key_size)
+
+            if payload[salt_size:salt_size + PVV_SIZE] != pvv:
+                raise ValueError("%s: invalid password" % name)
+
+            ciphertext = payload[salt_size + PVV_SIZE:-MAC_SIZE]
+            mac = hmac.new(mac_key, ciphertext, hashlib.sha1).digest()[0:MAC_SIZE]
+
+            if not hmac.compare_digest(mac, payload[-MAC_SIZE:]):
+                raise ValueError("%s: authentication failure" % name)
+
+            payload = ctr_le(enc_key, ciphertext)
+
+        contents = decompress(method, payload)
+
+        if len(contents) != usize:
+            raise ValueError("%s: size mismatch" % name)
+
+        if version != 2 and zlib.crc32(contents) != crc:
+            raise ValueError("%s: checksum mismatch" % name)
+
+        entries.append((name, version, contents))
+
+    return entries
+
+
+def generate():
+    text = b"".join(b"line %04d of the INTERLOCK WinZip AES test file\n" % i for i in range(256))
+    binary = bytes((i * 7 + 3) & 0xff for i in range(4099))
+
+    archives = {
+        # AE-1, AES-128, stored
+        "ae1-aes128-stored.zip": [
+            ("file.txt", text, 0o100644, METHOD_STORE, (1, 1), bytes(range(8))),
+        ],
+        # AE-2, AES-192, deflate
+        "ae2-aes192-deflate.zip": [
+            ("file.txt", text, 0o100644, METHOD_DEFLATE, (2, 2), bytes(range(12))),
+        ],
+        # AE-2, AES-256, deflate, mixed with unencrypted entries
+        "ae2-aes256-mixed.zip": [
+            ("dir/", b"", 0o40755, METHOD_STORE, None, None),
+            ("dir/file.txt", text, 0o100644, METHOD_DEFLATE, (2, 3), bytes(range(16))),
+            ("dir/binary.bin", binary, 0o100600, METHOD_STORE, (2, 3), bytes(range(16, 32))),
+            ("plain.txt", b"unencrypted entry\n", 0o100644, METHOD_DEFLATE, None, None),
+        ],
+    }
+
+    directory = os.path.dirname(os.path.abspath(__file__))
+
+    for name, entries in archives.items():
+        w = Writer()
+
+        for (entry, contents, mode, method, aes, salt) in entries:
+            w.add(entry, contents, mode, method, aes, salt)
+
+        data = w.bytes()
+
+        # round trip with the reader
+        decoded = read(data, PASSWORD)
+        assert [(e[0], e[2]) for e in decoded] == [(e[0], e[1]) for e in entries]
+
+        with open(os.path.join(directory, name), "wb") as f:
+            f.write(data)
+
+        print("%s: %d entries" % (name, len(entries)))
+
+
+def dump(path, password):
+    with open(path, "rb") as f:
+        data = f.read()
+
+    for name, version, contents in read(data, password.encode()):
+        aes = "AE-%d" % version if version else "plain"
+        print("%s %s %d %s" % (name, aes, len(contents), hashlib.sha256(contents).hexdigest()))
+
+
+if __name__ == "__main__":
+    if len(sys.argv) == 2 and sys.argv[1] == "generate":
+        generate()
+    elif len(sys.argv) == 4 and sys.argv[1] == "dump":
+        dump(sys.argv[2], sys.argv[3])
+    else:
+        print(__doc__ or "usage: winzip_aes.py generate | dump <file> <password>")
+        sys.exit(1)
@@ -0,0 +1,436 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings supported by the viewer and editor, contents which cannot be
+// represented as text are exchanged as base64 encoded binary data.
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF16LE = "utf-16le"
+	encodingUTF16BE = "utf-16be"
+	encodingLatin1  = "iso-8859-1"
+	encodingBinary  = "binary"
+)
+
+var byteOrderMarks = map[string][]byte{
+	encodingUTF8:    {0xef, 0xbb, 0xbf},
+	encodingUTF16LE: {0xff, 0xfe},
+	encodingUTF16BE: {0xfe, 0xff},
+}
+
+// serializes precondition checks and replacement of edited files
+var textWrites sync.Mutex
+
+// detectBOM returns the encoding identified by the byte order mark at the
+// beginning of the data, if any.
+func detectBOM(data []byte) (encoding string, bom []byte) {
+	for _, encoding := range []string{encodingUTF8, encodingUTF16LE, encodingUTF16BE} {
+		if bom = byteOrderMarks[encoding]; bytes.HasPrefix(data, bom) {
+			return encoding, bom
+		}
+	}
+
+	return "", nil
+}
+
+// detectEncoding returns the encoding of data without byte order mark,
+// binary data is detected by the presence of NUL bytes.
+func detectEncoding(data []byte) string {
+	switch {
+	case bytes.IndexByte(data, 0) >= 0:
+		return encodingBinary
+	case utf8.Valid(data):
+		return encodingUTF8
+	default:
+		return encodingLatin1
+	}
+}
+
+// trimPartialRune removes an incomplete UTF-8 sequence, split by a byte
+// range, from the end of the data.
+func trimPartialRune(data []byte) []byte {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				return data[:i]
+			}
+
+			break
+		}
+	}
+
+	return data
+}
+
+// decodeText converts data in the specified encoding to a string.
+func decodeText(data []byte, encoding string) (contents string, err error) {
+	switch encoding {
+	case encodingUTF8:
+		if !utf8.Valid(data) {
+			return "", errors.New("invalid UTF-8 contents")
+		}
+
+		return string(data), nil
+	case encodingUTF16LE, encodingUTF16BE:
+		if len(data)%2 != 0 {
+			return "", errors.New("invalid UTF-16 contents")
+		}
+
+		u := make([]uint16, len(data)/2)
+
+		for i := range u {
+			if encoding == encodingUTF16LE {
+				u[i] = uint16(data[2*i]) | uint16(data[2*i+1])<<8
+			} else {
+				u[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+			}
+		}
+
+		return string(utf16.Decode(u)), nil
+	case encodingLatin1:
+		r := make([]rune, len(data))
+
+		for i, b := range data {
+			r[i] = rune(b)
+		}
+
+		return string(r), nil
+	case encodingBinary:
+		return base64.StdEncoding.EncodeToString(data), nil
+	}
+
+	return "", fmt.Errorf("unsupported encoding %s", encoding)
+}
+
+// encodeText converts a string to the specified encoding, binary contents
+// are expected to be base64 encoded.
+func encodeText(contents string, encoding string) (data []byte, err error) {
+	switch encoding {
+	case encodingUTF8:
+		return []byte(contents), nil
+	case encodingUTF16LE, encodingUTF16BE:
+		u := utf16.Encode([]rune(contents))
+		data = make([]byte, 2*len(u))
+
+		for i, c := range u {
+			if encoding == encodingUTF16LE {
+				data[2*i], data[2*i+1] = byte(c), byte(c>>8)
+			} else {
+				data[2*i], data[2*i+1] = byte(c>>8), byte(c)
+			}
+		}
+
+		return
+	case encodingLatin1:
+		for _, r := range contents {
+			if r > 0xff {
+				return nil, fmt.Errorf("character %q cannot be encoded in %s", r, encoding)
+			}
+
+			data = append(data, byte(r))
+		}
+
+		return
+	case encodingBinary:
+		return base64.StdEncoding.DecodeString(contents)
+	}
+
+	return nil, fmt.Errorf("unsupported encoding %s", encoding)
+}
+
+func fileRead(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	offset, err := optionalInt(req, "offset", 0)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	length, err := optionalInt(req, "length", 0)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if offset < 0 || length < 0 {
+		return errorResponse(errors.New("invalid read offset or length"), "")
+	}
+
+	info, err := regularFile(osPath)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if length == 0 || length > info.Size() {
+		length = info.Size()
+	}
+
+	if conf.TextMaxSize > 0 && length > conf.TextMaxSize {
+		length = conf.TextMaxSize
+	}
+
+	digest, err := fileDigest(osPath, "sha256")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	input, err := os.Open(osPath)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer input.Close()
+
+	// the encoding is identified by the byte order mark, if present,
+	// regardless of the requested range
+	head := make([]byte, 3)
+	n, _ := io.ReadFull(input, head)
+	encoding, bom := detectBOM(head[:n])
+
+	if offset < int64(len(bom)) {
+		offset = int64(len(bom))
+	}
+
+	if (encoding == encodingUTF16LE || encoding == encodingUTF16BE) && offset%2 != 0 {
+		return errorResponse(errors.New("UTF-16 contents require an even offset"), "")
+	}
+
+	data := make([]byte, length)
+	n, err = input.ReadAt(data, offset)
+
+	if err != nil && err != io.EOF {
+		return errorResponse(err, "")
+	}
+
+	data = data[:n]
+	truncated := offset+int64(n) < info.Size()
+
+	if truncated {
+		switch encoding {
+		case encodingUTF16LE, encodingUTF16BE:
+			data = data[:len(data)&^1]
+		case "", encodingUTF8:
+			data = trimPartialRune(data)
+		}
+	}
+
+	if encoding == "" {
+		encoding = detectEncoding(data)
+	}
+
+	contents, err := decodeText(data, encoding)
+
+	if err != nil {
+		return errorResponse(fmt.Errorf("cannot read %s, %v", relativePath(osPath), err), "")
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"path":      relativePath(osPath),
+			"size":      info.Size(),
+			"mtime":     info.ModTime().Unix(),
+			"sha256":    digest,
+			"encoding":  encoding,
+			"bom":       len(bom) > 0,
+			"offset":    offset,
+			"length":    len(data),
+			"truncated": truncated,
+			"contents":  contents,
+		},
+	}
+
+	return
+}
+
+func fileWrite(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s", "contents:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	encoding, err := optionalString(req, "encoding", encodingUTF8)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	bom, err := optionalBool(req, "bom", false)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	ifSHA256, err := optionalString(req, "if_sha256", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	ifMtime, err := optionalInt(req, "if_mtime", -1)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	data, err := encodeText(req["contents"].(string), encoding)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if bom {
+		mark, ok := byteOrderMarks[encoding]
+
+		if !ok {
+			return errorResponse(fmt.Errorf("byte order mark not supported for %s", encoding), "")
+		}
+
+		data = append(append([]byte{}, mark...), data...)
+	}
+
+	if conf.TextMaxSize > 0 && int64(len(data)) > conf.TextMaxSize {
+		return errorResponse(fmt.Errorf("contents exceed maximum size (%d bytes)", conf.TextMaxSize), "")
+	}
+
+	textWrites.Lock()
+	defer textWrites.Unlock()
+
+	info, err := regularFile(osPath)
+	exists := err == nil
+
+	switch {
+	case os.IsNotExist(err) && (ifSHA256 != "" || ifMtime >= 0):
+		return errorResponse(fmt.Errorf("precondition failed, %s does not exist", relativePath(osPath)), "")
+	case err != nil && !os.IsNotExist(err):
+		return errorResponse(err, "")
+	}
+
+	if exists && ifMtime >= 0 && info.ModTime().Unix() != ifMtime {
+		return errorResponse(fmt.Errorf("precondition failed, %s has been modified", relativePath(osPath)), "")
+	}
+
+	if exists && ifSHA256 != "" {
+		digest, err := fileDigest(osPath, "sha256")
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if digest != strings.ToLower(ifSHA256) {
+			return errorResponse(fmt.Errorf("precondition failed, %s has been modified", relativePath(osPath)), "")
+		}
+	}
+
+	if err = writeText(osPath, data, info); err != nil {
+		return errorResponse(err, "")
+	}
+
+	if info, err = os.Stat(osPath); err != nil {
+		return errorResponse(err, "")
+	}
+
+	sum := sha256.Sum256(data)
+	status.Log(syslog.LOG_NOTICE, "saved file %s (%d bytes)", relativePath(osPath), len(data))
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"path":   relativePath(osPath),
+			"size":   info.Size(),
+			"mtime":  info.ModTime().Unix(),
+			"sha256": hex.EncodeToString(sum[:]),
+		},
+	}
+
+	return
+}
+
+// writeText atomically replaces, or creates, the file with the data, the
+// permissions of an existing file are retained.
+func writeText(osPath string, data []byte, info os.FileInfo) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(osPath), internalPrefix+"write-*")
+
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	perm := os.FileMode(0644)
+
+	if info != nil {
+		perm = info.Mode().Perm()
+	}
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	return commitUpload(tmp.Name(), osPath, info != nil)
+}
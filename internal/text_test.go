@@ -0,0 +1,116 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func textRequest(handler func(*http.Request) jsonObject, req jsonObject) map[string]interface{} {
+	body, _ := json.Marshal(req)
+	res := handler(httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+
+	if res["status"] != "OK" {
+		return nil
+	}
+
+	return res["response"].(map[string]interface{})
+}
+
+func TestTextEncodings(t *testing.T) {
+	contents := "naïve café ☕"
+
+	for _, encoding := range []string{encodingUTF8, encodingUTF16LE, encodingUTF16BE} {
+		data, err := encodeText(contents, encoding)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s, err := decodeText(data, encoding); err != nil || s != contents {
+			t.Errorf("%s round trip mismatch (%q, %v)", encoding, s, err)
+		}
+	}
+
+	if s, _ := decodeText([]byte{0, 1, 2}, encodingBinary); s != "AAEC" {
+		t.Errorf("unexpected binary encoding %s", s)
+	}
+
+	if data, err := encodeText("AAEC", encodingBinary); err != nil || !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Errorf("unexpected binary decoding %v (%v)", data, err)
+	}
+
+	if _, err := encodeText(contents, encodingLatin1); err == nil {
+		t.Error("unencodable character accepted")
+	}
+
+	if data, _ := encodeText("café", encodingLatin1); detectEncoding(data) != encodingLatin1 {
+		t.Error("ISO-8859-1 contents not detected")
+	}
+
+	if data := trimPartialRune([]byte("caf\xc3")); string(data) != "caf" {
+		t.Errorf("partial rune not trimmed (%q)", data)
+	}
+}
+
+func TestTextReadWrite(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+	conf.TextMaxSize = 8
+
+	osPath := filepath.Join(conf.MountPoint, "notes.txt")
+	os.WriteFile(osPath, []byte("\xef\xbb\xbfcafé latte"), 0640)
+
+	res := textRequest(fileRead, jsonObject{"path": "/notes.txt"})
+
+	if res == nil {
+		t.Fatal("read failed")
+	}
+
+	if res["contents"] != "café la" || res["encoding"] != encodingUTF8 || res["bom"] != true || res["truncated"] != true {
+		t.Errorf("unexpected read response %v", res)
+	}
+
+	conf.TextMaxSize = 1 << 20
+	res = textRequest(fileRead, jsonObject{"path": "/notes.txt"})
+
+	if res["contents"] != "café latte" || res["truncated"] != false {
+		t.Errorf("unexpected read response %v", res)
+	}
+
+	digest := res["sha256"]
+
+	if textRequest(fileWrite, jsonObject{"path": "/notes.txt", "contents": "tea", "if_sha256": "00"}) != nil {
+		t.Error("write with stale precondition succeeded")
+	}
+
+	if textRequest(fileWrite, jsonObject{"path": "/notes.txt", "contents": "tea", "bom": true, "if_sha256": digest}) == nil {
+		t.Fatal("write failed")
+	}
+
+	if data, _ := os.ReadFile(osPath); string(data) != "\xef\xbb\xbftea" {
+		t.Errorf("unexpected contents %q", data)
+	}
+
+	if info, _ := os.Stat(osPath); info.Mode().Perm() != 0640 {
+		t.Errorf("permissions not retained (%v)", info.Mode())
+	}
+
+	if textRequest(fileWrite, jsonObject{"path": "/notes.txt", "contents": "tea", "if_sha256": digest}) != nil {
+		t.Error("write with stale precondition succeeded")
+	}
+
+	if textRequest(fileWrite, jsonObject{"path": "/" + conf.KeyPath + "/key", "contents": "tea"}) != nil {
+		t.Error("write within key storage succeeded")
+	}
+}
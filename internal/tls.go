@@ -7,6 +7,7 @@
 package interlock
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -247,28 +248,16 @@ func decryptKey(cipher cipherInterface, keyPath string) (key []byte, err error)
 	if err != nil {
 		return
 	}
+	defer input.Close()
 
-	stat, err := input.Stat()
-
-	if err != nil {
-		return
-	}
-
-	r, output, err := os.Pipe()
-
-	if err != nil {
-		return
-	}
-
+	output := new(bytes.Buffer)
 	err = cipher.Decrypt(input, output, false)
 
 	if err != nil {
 		return
 	}
 
-	// salt (8 bytes) + iv (16 bytes) + hmac (32 bytes) == 56 bytes
-	key = make([]byte, stat.Size()-56)
-	_, err = r.Read(key)
+	key = output.Bytes()
 
 	return
 }
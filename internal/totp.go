@@ -14,12 +14,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"io"
+	"log/syslog"
 	"strings"
 	"time"
 )
 
+// RFC4226 minimum shared secret length
+const minSeedSize = 16
+
 type tOTP struct {
 	info   cipherInfo
 	secKey []byte
@@ -72,8 +75,7 @@ func (t *tOTP) GetKeyInfo(k key) (info string, err error) {
 }
 
 func (t *tOTP) SetKey(k key) (err error) {
-	keyPath := filepath.Join(conf.MountPoint, k.Path)
-	s, err := os.ReadFile(keyPath)
+	s, err := readKey(k)
 
 	if err != nil {
 		return
@@ -92,6 +94,64 @@ func (t *tOTP) SetKey(k key) (err error) {
 	return
 }
 
+func (t *tOTP) AuditKey(k key) (findings []keyFinding, err error) {
+	err = t.SetKey(k)
+
+	if err != nil {
+		return
+	}
+
+	if len(t.secKey) < minSeedSize {
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  fmt.Sprintf("weak seed: %d bits", len(t.secKey)*8),
+		})
+	}
+
+	// A seed in the public key slot is its exportable half (e.g. for
+	// authenticator provisioning) and must match the private one.
+	matched := false
+	counterparts, _ := getKeys(t, !k.Private, "")
+
+	for _, c := range counterparts {
+		if c.Identifier != k.Identifier {
+			continue
+		}
+
+		other := new(tOTP)
+
+		if other.SetKey(c) != nil {
+			continue
+		}
+
+		if !hmac.Equal(other.secKey, t.secKey) {
+			findings = append(findings, keyFinding{
+				Severity: syslog.LOG_ERR,
+				Message:  "public and private seeds differ",
+			})
+
+			return
+		}
+
+		matched = true
+	}
+
+	switch {
+	case !k.Private && !matched:
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_WARNING,
+			Message:  "seed stored in public key slot without matching private key",
+		})
+	case k.Private && !matched:
+		findings = append(findings, keyFinding{
+			Severity: syslog.LOG_INFO,
+			Message:  "no matching public key",
+		})
+	}
+
+	return
+}
+
 func (t *tOTP) GenOTP(timestamp int64) (code string, exp int64, err error) {
 	interval := int64(30)
 	message := timestamp / interval
@@ -135,18 +195,18 @@ func (t *tOTP) SetPassword(password string) error {
 	return errors.New("cipher does not support passwords")
 }
 
-func (t *tOTP) Encrypt(input *os.File, output *os.File, _ bool) error {
+func (t *tOTP) Encrypt(input io.Reader, output io.Writer, _ bool) error {
 	return errors.New("cipher does not support encryption")
 }
 
-func (t *tOTP) Decrypt(input *os.File, output *os.File, verify bool) error {
+func (t *tOTP) Decrypt(input io.Reader, output io.Writer, verify bool) error {
 	return errors.New("cipher does not support decryption")
 }
 
-func (t *tOTP) Sign(input *os.File, output *os.File) error {
+func (t *tOTP) Sign(input io.Reader, output io.Writer) error {
 	return errors.New("cipher does not support signin")
 }
 
-func (t *tOTP) Verify(input *os.File, signature *os.File) error {
+func (t *tOTP) Verify(input io.Reader, signature io.Reader) error {
 	return errors.New("cipher does not support signature verification")
 }
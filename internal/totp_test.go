@@ -7,6 +7,8 @@
 package interlock
 
 import (
+	"encoding/base32"
+	"log/syslog"
 	"os"
 	"path"
 	"testing"
@@ -51,3 +53,61 @@ func TestTOTP(t *testing.T) {
 	secKeyFile.Close()
 	os.Remove(secKeyFile.Name())
 }
+
+func TestTOTPAudit(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	if err := conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	cipher, err := conf.GetCipher("TOTP")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seed := base32.StdEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+	store := func(identifier string, private bool, seed string) key {
+		k := key{Identifier: identifier, KeyFormat: "base32", Cipher: "TOTP", Private: private}
+
+		if err := k.Store(cipher, seed); err != nil {
+			t.Fatal(err)
+		}
+
+		return k
+	}
+
+	messages := func(k key) (m []string) {
+		for _, f := range auditKey(cipher, k) {
+			m = append(m, severityName(f.Severity)+": "+f.Message)
+		}
+
+		return
+	}
+
+	short := store("short", true, "JBSWY3DPEHPK3PXP")
+
+	if m := messages(short); len(m) != 2 || m[0] != "warning: weak seed: 80 bits" || m[1] != "info: no matching public key" {
+		t.Errorf("unexpected findings %v", m)
+	}
+
+	pair := store("pair", true, seed)
+	store("pair", false, seed)
+
+	if m := messages(pair); len(m) != 0 {
+		t.Errorf("unexpected findings %v", m)
+	}
+
+	if m := messages(store("orphan", false, seed)); len(m) != 1 || m[0] != "warning: seed stored in public key slot without matching private key" {
+		t.Errorf("unexpected findings %v", m)
+	}
+
+	store("mismatch", true, seed)
+
+	if f := auditKey(cipher, store("mismatch", false, "ORUGS4ZANFZSAYJAKRHVIUBAORSXG5BANM======")); len(f) != 1 || f[0].Severity != syslog.LOG_ERR {
+		t.Errorf("unexpected findings %+v", f)
+	}
+}
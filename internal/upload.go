@@ -0,0 +1,281 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directory, within the encrypted volume root, holding partial uploads
+const uploadsPath = internalPrefix + "uploads"
+
+// partial uploads not resumed within this interval are discarded
+const uploadExpiry = 24 * time.Hour
+
+var errUploadOffset = errors.New("invalid upload offset")
+
+type chunkUploads struct {
+	sync.Mutex
+	active map[string]bool
+}
+
+var uploads = chunkUploads{
+	active: make(map[string]bool),
+}
+
+func (u *chunkUploads) acquire(osPath string) (err error) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.active[osPath] {
+		return fmt.Errorf("%w, upload of %s already in progress", errUploadOffset, relativePath(osPath))
+	}
+
+	u.active[osPath] = true
+
+	return
+}
+
+func (u *chunkUploads) release(osPath string) {
+	u.Lock()
+	defer u.Unlock()
+
+	delete(u.active, osPath)
+}
+
+// partialPath returns the path holding the partial upload for the
+// destination path.
+func partialPath(osPath string) string {
+	sum := sha256.Sum256([]byte(osPath))
+	return filepath.Join(conf.MountPoint, uploadsPath, hex.EncodeToString(sum[:]))
+}
+
+// prunePartials removes stale partial uploads.
+func prunePartials() {
+	dir := filepath.Join(conf.MountPoint, uploadsPath)
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > uploadExpiry {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// syncDir commits directory entries changes to storage.
+func syncDir(osPath string) (err error) {
+	dir, err := os.Open(osPath)
+
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// commitUpload atomically moves a completed upload to its destination, an
+// existing destination is replaced only when overwriting is requested and
+// preserved when versioning is enabled.
+func commitUpload(src string, osPath string, overwrite bool) (err error) {
+	if stat, e := os.Lstat(osPath); e == nil && overwrite && stat.Mode().IsRegular() && versioned(osPath) {
+		if err = saveVersion(osPath, true); err != nil {
+			return
+		}
+	}
+
+	if overwrite {
+		err = os.Rename(src, osPath)
+	} else if err = os.Link(src, osPath); err == nil {
+		err = os.Remove(src)
+	} else if os.IsExist(err) {
+		err = fmt.Errorf("path %s exists, not overwriting", osPath)
+	}
+
+	if err != nil {
+		return
+	}
+
+	return syncDir(filepath.Dir(osPath))
+}
+
+func uploadResponse(osPath string, size int64, digest string) jsonObject {
+	return jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"path":   relativePath(osPath),
+			"size":   size,
+			"sha256": digest,
+		},
+	}
+}
+
+// uploadChunk appends the request body to the partial upload of the
+// destination path, the chunk offset must match the amount of data already
+// received. The upload is moved to its destination, after verification of
+// its SHA256 digest, on the chunk flagged as complete.
+func uploadChunk(w http.ResponseWriter, r *http.Request, osPath string, offsetHeader string, overwrite bool) (res jsonObject, err error) {
+	offset, err := strconv.ParseInt(offsetHeader, 10, 64)
+
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("%w %s", errUploadOffset, offsetHeader)
+	}
+
+	complete := r.Header.Get("X-Uploadcomplete") == "true"
+	digest := strings.ToLower(r.Header.Get("X-Content-Sha256"))
+
+	if complete && digest == "" {
+		return nil, errors.New("missing X-Content-SHA256 header for chunked upload completion")
+	}
+
+	if err = uploads.acquire(osPath); err != nil {
+		return
+	}
+	defer uploads.release(osPath)
+
+	partial := partialPath(osPath)
+	flag := os.O_WRONLY
+
+	if offset == 0 {
+		prunePartials()
+
+		if err = os.MkdirAll(filepath.Dir(partial), 0700); err != nil {
+			return
+		}
+
+		flag |= os.O_CREATE | os.O_TRUNC
+	}
+
+	output, err := os.OpenFile(partial, flag, 0600)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%w %d, no upload in progress", errUploadOffset, offset)
+		}
+
+		return
+	}
+
+	stat, err := output.Stat()
+
+	if err != nil {
+		output.Close()
+		return
+	}
+
+	if stat.Size() != offset {
+		output.Close()
+		w.Header().Set("X-Uploadoffset", strconv.FormatInt(stat.Size(), 10))
+		return nil, fmt.Errorf("%w %d, expected %d", errUploadOffset, offset, stat.Size())
+	}
+
+	if _, err = output.Seek(offset, io.SeekStart); err == nil {
+		_, err = io.Copy(output, r.Body)
+	}
+
+	if err == nil && complete {
+		err = output.Sync()
+	}
+
+	if e := output.Close(); err == nil {
+		err = e
+	}
+
+	// data received before the error is retained for resumption
+	stat, e := os.Stat(partial)
+
+	if e != nil {
+		return nil, e
+	}
+
+	w.Header().Set("X-Uploadoffset", strconv.FormatInt(stat.Size(), 10))
+
+	if err != nil {
+		return
+	}
+
+	if !complete {
+		res = jsonObject{
+			"status": "OK",
+			"response": map[string]interface{}{
+				"offset": stat.Size(),
+			},
+		}
+
+		return
+	}
+
+	sum, err := sha256File(partial, nil)
+
+	if err != nil {
+		return
+	}
+
+	if sum != digest {
+		os.Remove(partial)
+		return nil, fmt.Errorf("SHA256 mismatch for %s upload, discarded", relativePath(osPath))
+	}
+
+	if err = commitUpload(partial, osPath, overwrite); err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_INFO, "uploaded %s (%v bytes)", relativePath(osPath), stat.Size())
+
+	return uploadResponse(osPath, stat.Size(), sum), nil
+}
+
+func fileUploadStatus(r *http.Request) (res jsonObject) {
+	var offset int64
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if stat, err := os.Stat(partialPath(osPath)); err == nil {
+		offset = stat.Size()
+	}
+
+	res = jsonObject{
+		"status": "OK",
+		"response": map[string]interface{}{
+			"offset": offset,
+		},
+	}
+
+	return
+}
@@ -0,0 +1,1136 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Vault entries are individually encrypted, with any cipher supporting both
+// encryption and decryption, and stored within the encrypted volume root
+// under .interlock-vault/<id>.<cipher extension>.
+
+const vaultPath = internalPrefix + "vault"
+
+const (
+	passwordLowercase = "abcdefghijklmnopqrstuvwxyz"
+	passwordUppercase = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordDigits    = "0123456789"
+	passwordSymbols   = "!#$%&()*+,-./:;<=>?@[]^_{|}~"
+
+	passwordMinLength     = 4
+	passwordMaxLength     = 256
+	passwordDefaultLength = 20
+)
+
+type vaultEntry struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	URL      string `json:"url"`
+	Notes    string `json:"notes,omitempty"`
+	TOTP     string `json:"totp"`
+	Group    string `json:"group"`
+	Created  int64  `json:"created"`
+	Modified int64  `json:"modified"`
+}
+
+// vaultImport holds an entry to import along with its TOTP seed, if any.
+type vaultImport struct {
+	entry vaultEntry
+	seed  string
+}
+
+func vaultDir() string {
+	return filepath.Join(conf.MountPoint, vaultPath)
+}
+
+func vaultEntryPath(cipher cipherInterface, id string) string {
+	return filepath.Join(vaultDir(), id+"."+cipher.GetInfo().Extension)
+}
+
+func newVaultID() (id string, err error) {
+	buf := make([]byte, 16)
+
+	if _, err = io.ReadFull(rand.Reader, buf); err != nil {
+		return
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func validVaultID(id string) bool {
+	buf, err := hex.DecodeString(id)
+	return err == nil && len(buf) == 16 && id == strings.ToLower(id)
+}
+
+// vaultCipher returns the cipher instance, set up for encryption or
+// decryption, specified in the request. The returned function must be called
+// with the request outcome, to account for private key use.
+func vaultCipher(req jsonObject, encrypt bool) (cipher cipherInterface, done func(error), err error) {
+	var k key
+
+	done = func(error) {}
+	err = validateRequest(req, []string{"cipher:s", "password:s", "key:s"})
+
+	if err != nil {
+		return
+	}
+
+	cipherName := req["cipher"].(string)
+	keyPath := req["key"].(string)
+	password := req["password"].(string)
+
+	if encrypt {
+		cipher, _, err = encryptionCipher(cipherName, keyPath, "", password, false)
+	} else {
+		cipher, k, err = decryptionCipher(cipherName, keyPath, "", password, false)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if info := cipher.GetInfo(); !info.Enc || !info.Dec {
+		return nil, done, fmt.Errorf("cipher %s does not support vault entries", info.Name)
+	}
+
+	done, err = k.Use(_decrypt)
+
+	return
+}
+
+// storeVaultEntry encrypts and atomically stores the entry, existing entries
+// are replaced only when not creating a new one.
+func storeVaultEntry(cipher cipherInterface, entry *vaultEntry, create bool) (err error) {
+	data, err := json.Marshal(entry)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(vaultDir(), 0700); err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(vaultDir(), internalPrefix+"entry-*")
+
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	err = cipher.Encrypt(bytes.NewReader(data), tmp, false)
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return
+	}
+
+	return commitUpload(tmp.Name(), vaultEntryPath(cipher, entry.ID), !create)
+}
+
+// loadVaultEntry decrypts the entry matching the id.
+func loadVaultEntry(cipher cipherInterface, id string) (e vaultEntry, err error) {
+	if !validVaultID(id) {
+		return e, errors.New("invalid vault entry id")
+	}
+
+	data, err := os.ReadFile(vaultEntryPath(cipher, id))
+
+	if os.IsNotExist(err) {
+		return e, fmt.Errorf("vault entry %s not found", id)
+	}
+
+	if err != nil {
+		return
+	}
+
+	plaintext := new(bytes.Buffer)
+
+	if err = cipher.Decrypt(bytes.NewReader(data), plaintext, false); err != nil {
+		return e, fmt.Errorf("cannot decrypt vault entry %s, %v", id, err)
+	}
+
+	if err = json.Unmarshal(plaintext.Bytes(), &e); err != nil {
+		return
+	}
+
+	// prevent substitution of entries
+	if e.ID != id {
+		return e, fmt.Errorf("vault entry %s id mismatch", id)
+	}
+
+	return
+}
+
+// vaultDecryptionRequest returns the credentials for decryption of stored
+// entries, asymmetric ciphers take them from the optional "dec_key" and
+// "dec_password" attributes.
+func vaultDecryptionRequest(req jsonObject) jsonObject {
+	dec := jsonObject{
+		"cipher":   req["cipher"],
+		"key":      req["key"],
+		"password": req["password"],
+	}
+
+	for _, attr := range []string{"key", "password"} {
+		if v, ok := req["dec_"+attr]; ok {
+			dec[attr] = v
+		}
+	}
+
+	return dec
+}
+
+// vaultStoredEntry decrypts the entry matching the id with the request
+// credentials, failing on a mismatch.
+func vaultStoredEntry(req jsonObject, id string) (e vaultEntry, err error) {
+	cipher, done, err := vaultCipher(req, false)
+
+	if err != nil {
+		return
+	}
+	defer func() { done(err) }()
+
+	if !validVaultID(id) {
+		return e, errors.New("invalid vault entry id")
+	}
+
+	if _, err = os.Stat(vaultEntryPath(cipher, id)); os.IsNotExist(err) {
+		matches, _ := filepath.Glob(filepath.Join(vaultDir(), id+".*"))
+
+		if len(matches) > 0 {
+			return e, fmt.Errorf("vault entry %s is not encrypted with %s", id, cipher.GetInfo().Name)
+		}
+	}
+
+	return loadVaultEntry(cipher, id)
+}
+
+// removeVaultTOTP removes the TOTP seed imported along with the entry, if
+// any, from key storage.
+func removeVaultTOTP(e vaultEntry) {
+	if e.TOTP == "" {
+		return
+	}
+
+	k, _, err := vaultTOTPKey(e.TOTP)
+
+	if err != nil || k.Identifier != "vault-"+e.ID {
+		return
+	}
+
+	if err = removePath(filepath.Join(conf.MountPoint, k.Path), conf.SecureWipe, nil); err != nil {
+		status.Log(syslog.LOG_WARNING, "cannot remove TOTP seed of vault entry %s, %v", e.ID, err)
+	}
+}
+
+// vaultEntries returns all entries, decryptable with the cipher, which match
+// the query. Secrets are omitted from returned entries.
+func vaultEntries(cipher cipherInterface, query string) (entries []vaultEntry, err error) {
+	entries = []vaultEntry{}
+	ext := "." + cipher.GetInfo().Extension
+
+	files, err := os.ReadDir(vaultDir())
+
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	query = strings.ToLower(query)
+	decrypted, failed := 0, 0
+
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ext)
+
+		if !strings.HasSuffix(f.Name(), ext) || !validVaultID(id) {
+			continue
+		}
+
+		e, err := loadVaultEntry(cipher, id)
+
+		if err != nil {
+			failed++
+			continue
+		}
+
+		decrypted++
+
+		if query != "" && !e.match(query) {
+			continue
+		}
+
+		e.Password = ""
+		e.Notes = ""
+
+		entries = append(entries, e)
+	}
+
+	if failed > 0 && decrypted == 0 {
+		return nil, errors.New("cannot decrypt vault entries, invalid credentials")
+	}
+
+	sort.Slice(entries, func(i, k int) bool {
+		if entries[i].Group != entries[k].Group {
+			return strings.ToLower(entries[i].Group) < strings.ToLower(entries[k].Group)
+		}
+
+		return strings.ToLower(entries[i].Title) < strings.ToLower(entries[k].Title)
+	})
+
+	return
+}
+
+// match returns whether the lowercase query is found in the entry title,
+// username, URL, group or notes.
+func (e *vaultEntry) match(query string) bool {
+	for _, s := range []string{e.Title, e.Username, e.URL, e.Group, e.Notes} {
+		if strings.Contains(strings.ToLower(s), query) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validate checks the entry attributes, a TOTP reference must point to a
+// key within the TOTP key store.
+func (e *vaultEntry) validate() (err error) {
+	if e.Title == "" {
+		return errors.New("missing vault entry title")
+	}
+
+	if e.TOTP == "" {
+		return
+	}
+
+	_, cipher, err := vaultTOTPKey(e.TOTP)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().OTP {
+		return fmt.Errorf("%s is not a TOTP key", e.TOTP)
+	}
+
+	return
+}
+
+func vaultTOTPKey(ref string) (k key, cipher cipherInterface, err error) {
+	osPath, err := absolutePath(ref)
+
+	if err != nil {
+		return
+	}
+
+	if inKeyPath, _ := detectKeyPath(osPath); !inKeyPath {
+		return k, nil, fmt.Errorf("%s is not within key storage", ref)
+	}
+
+	return getKey(osPath)
+}
+
+// vaultOTP returns the current code for the entry TOTP key reference.
+func vaultOTP(ref string) (otp string, exp int64, err error) {
+	k, cipher, err := vaultTOTPKey(ref)
+
+	if err != nil {
+		return
+	}
+
+	if !cipher.GetInfo().OTP {
+		return "", 0, fmt.Errorf("%s is not a TOTP key", ref)
+	}
+
+	cipher = cipher.New()
+
+	if err = cipher.SetKey(k); err != nil {
+		return
+	}
+
+	return cipher.GenOTP(time.Now().Unix())
+}
+
+// generatePassword returns a random password of the requested length, which
+// includes at least one character of each selected class.
+func generatePassword(length int, classes []string) (password string, err error) {
+	charset := strings.Join(classes, "")
+
+	if charset == "" {
+		return "", errors.New("no character classes selected")
+	}
+
+	if length < passwordMinLength || length > passwordMaxLength || length < len(classes) {
+		return "", fmt.Errorf("invalid password length, must be between %d and %d", passwordMinLength, passwordMaxLength)
+	}
+
+	max := big.NewInt(int64(len(charset)))
+	buf := make([]byte, length)
+
+	for {
+		for i := range buf {
+			n, err := rand.Int(rand.Reader, max)
+
+			if err != nil {
+				return "", err
+			}
+
+			buf[i] = charset[n.Int64()]
+		}
+
+		complete := true
+
+		for _, class := range classes {
+			if !bytes.ContainsAny(buf, class) {
+				complete = false
+				break
+			}
+		}
+
+		if complete {
+			return string(buf), nil
+		}
+	}
+}
+
+// parseTOTPSeed returns the base32 seed of a TOTP secret, either in plain
+// base32 format or as otpauth URI. Only the parameters supported by the TOTP
+// cipher (SHA1, 6 digits, 30 seconds period) are allowed.
+func parseTOTPSeed(s string) (seed string, err error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(strings.ToLower(s), "otpauth://") {
+		u, err := url.Parse(s)
+
+		if err != nil || u.Host != "totp" {
+			return "", errors.New("invalid TOTP URI")
+		}
+
+		q := u.Query()
+
+		if a := q.Get("algorithm"); a != "" && !strings.EqualFold(a, "SHA1") {
+			return "", fmt.Errorf("unsupported TOTP algorithm %s", a)
+		}
+
+		if d := q.Get("digits"); d != "" && d != "6" {
+			return "", fmt.Errorf("unsupported TOTP digits %s", d)
+		}
+
+		if p := q.Get("period"); p != "" && p != "30" {
+			return "", fmt.Errorf("unsupported TOTP period %s", p)
+		}
+
+		s = q.Get("secret")
+	}
+
+	seed = strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(s))
+
+	if seed == "" {
+		return "", errors.New("missing TOTP secret")
+	}
+
+	// the TOTP cipher expects padded seeds
+	seed = strings.TrimRight(seed, "=")
+	seed += strings.Repeat("=", (8-len(seed)%8)%8)
+
+	if _, err = base32.StdEncoding.DecodeString(seed); err != nil {
+		return "", errors.New("invalid TOTP secret")
+	}
+
+	return
+}
+
+// storeTOTPSeed stores an imported TOTP seed in the TOTP key store,
+// returning the key path.
+func storeTOTPSeed(seed string, identifier string) (ref string, err error) {
+	cipher, err := conf.GetCipher("TOTP")
+
+	if err != nil {
+		return "", errors.New("TOTP cipher is not enabled")
+	}
+
+	k := key{
+		Identifier: identifier,
+		KeyFormat:  "base32",
+		Cipher:     cipher.GetInfo().Name,
+		Private:    true,
+	}
+
+	if err = k.Store(cipher, seed); err != nil {
+		return
+	}
+
+	return "/" + k.Path, nil
+}
+
+// csvColumns maps CSV export headers of common password managers to entry
+// attributes.
+var csvColumns = map[string]string{
+	"title":             "title",
+	"name":              "title",
+	"username":          "username",
+	"user name":         "username",
+	"login":             "username",
+	"login_username":    "username",
+	"password":          "password",
+	"login_password":    "password",
+	"url":               "url",
+	"website":           "url",
+	"web site":          "url",
+	"login_uri":         "url",
+	"notes":             "notes",
+	"note":              "notes",
+	"extra":             "notes",
+	"group":             "group",
+	"folder":            "group",
+	"grouping":          "group",
+	"totp":              "totp",
+	"otp":               "totp",
+	"login_totp":        "totp",
+	"one-time password": "totp",
+}
+
+// parseVaultCSV parses a CSV file, with a header line identifying its
+// columns, as exported by common password managers.
+func parseVaultCSV(input io.Reader) (imports []vaultImport, err error) {
+	r := csv.NewReader(input)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	header, err := r.Read()
+
+	if err != nil {
+		return nil, errors.New("invalid CSV file")
+	}
+
+	columns := make(map[string]int)
+
+	for i, h := range header {
+		if attr, ok := csvColumns[strings.ToLower(strings.TrimSpace(h))]; ok {
+			if _, dup := columns[attr]; !dup {
+				columns[attr] = i
+			}
+		}
+	}
+
+	if _, ok := columns["password"]; !ok {
+		return nil, errors.New("unrecognized CSV header, missing password column")
+	}
+
+	for {
+		record, err := r.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(attr string) string {
+			if i, ok := columns[attr]; ok && i < len(record) {
+				return record[i]
+			}
+
+			return ""
+		}
+
+		imp := vaultImport{
+			entry: vaultEntry{
+				Title:    field("title"),
+				Username: field("username"),
+				Password: field("password"),
+				URL:      field("url"),
+				Notes:    field("notes"),
+				Group:    field("group"),
+			},
+			seed: field("totp"),
+		}
+
+		if imp.entry.Title == "" && imp.entry.Username == "" && imp.entry.Password == "" {
+			continue
+		}
+
+		imports = append(imports, imp)
+	}
+
+	return
+}
+
+// parseVaultKDBX reads the entries of a KeePass database, custom fields are
+// preserved in the entry notes.
+func parseVaultKDBX(data []byte, password string, keyFile []byte, j *job) (imports []vaultImport, err error) {
+	db, err := openKDBX(data, password, keyFile, j)
+
+	if err != nil {
+		return
+	}
+
+	standard := map[string]bool{
+		"Title": true, "UserName": true, "Password": true, "URL": true, "Notes": true,
+		"otp": true, "TimeOtp-Secret-Base32": true, "TOTP Seed": true, "TOTP Settings": true,
+	}
+
+	for _, e := range db.entries() {
+		imp := vaultImport{
+			entry: vaultEntry{
+				Title:    e.Fields["Title"],
+				Username: e.Fields["UserName"],
+				Password: e.Fields["Password"],
+				URL:      e.Fields["URL"],
+				Notes:    e.Fields["Notes"],
+				Group:    e.Group,
+			},
+		}
+
+		imp.seed = e.totpSeed()
+
+		var custom []string
+
+		for name, value := range e.Fields {
+			if !standard[name] && value != "" {
+				custom = append(custom, name+": "+value)
+			}
+		}
+
+		sort.Strings(custom)
+
+		if len(custom) > 0 {
+			imp.entry.Notes = strings.TrimSpace(imp.entry.Notes + "\n\n" + strings.Join(custom, "\n"))
+		}
+
+		imports = append(imports, imp)
+	}
+
+	return
+}
+
+// importVaultEntries stores imported entries, TOTP seeds are moved to the
+// TOTP key store or, when this is not possible, preserved in the notes.
+func importVaultEntries(cipher cipherInterface, imports []vaultImport, j *job) (imported int, err error) {
+	now := time.Now().Unix()
+
+	for _, imp := range imports {
+		if err = j.Err(); err != nil {
+			return
+		}
+
+		e := imp.entry
+
+		if e.ID, err = newVaultID(); err != nil {
+			return
+		}
+
+		if e.Title == "" {
+			e.Title = e.URL
+		}
+
+		if e.Title == "" {
+			e.Title = e.Username
+		}
+
+		e.Created = now
+		e.Modified = now
+
+		if imp.seed != "" {
+			seed, err := parseTOTPSeed(imp.seed)
+
+			if err == nil {
+				e.TOTP, err = storeTOTPSeed(seed, "vault-"+e.ID)
+			}
+
+			if err != nil {
+				status.Log(syslog.LOG_WARNING, "TOTP seed of vault entry %s kept in notes, %v", e.Title, err)
+				e.Notes = strings.TrimSpace(e.Notes + "\n\nTOTP: " + imp.seed)
+			}
+		}
+
+		if err = storeVaultEntry(cipher, &e, true); err != nil {
+			return
+		}
+
+		imported++
+	}
+
+	return
+}
+
+// vaultEntryRequest returns the entry attributes specified in the request.
+func vaultEntryRequest(req jsonObject) (e vaultEntry, err error) {
+	err = validateRequest(req, []string{"entry:o"})
+
+	if err != nil {
+		return
+	}
+
+	data, err := json.Marshal(req["entry"])
+
+	if err != nil {
+		return
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	if err = d.Decode(&e); err != nil {
+		return e, fmt.Errorf("invalid vault entry, %v", err)
+	}
+
+	return e, e.validate()
+}
+
+func vaultList(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, done, err := vaultCipher(req, false)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	entries, err := vaultEntries(cipher, "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": entries,
+	}
+
+	return
+}
+
+func vaultSearch(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"query:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, done, err := vaultCipher(req, false)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	entries, err := vaultEntries(cipher, req["query"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": entries,
+	}
+
+	return
+}
+
+func vaultGet(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, done, err := vaultCipher(req, false)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	e, err := loadVaultEntry(cipher, req["id"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	entry := map[string]interface{}{
+		"entry": e,
+	}
+
+	if e.TOTP != "" {
+		if otp, exp, err := vaultOTP(e.TOTP); err == nil {
+			entry["otp"] = otp
+			entry["otp_exp"] = exp
+		} else {
+			status.Log(syslog.LOG_WARNING, "cannot generate TOTP code for vault entry %s, %v", e.ID, err)
+		}
+	}
+
+	status.Log(syslog.LOG_NOTICE, "revealed vault entry %s", e.ID)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": entry,
+	}
+
+	return
+}
+
+func vaultAdd(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	e, err := vaultEntryRequest(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, done, err := vaultCipher(req, true)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	if e.ID, err = newVaultID(); err != nil {
+		return errorResponse(err, "")
+	}
+
+	e.Created = time.Now().Unix()
+	e.Modified = e.Created
+
+	if err = storeVaultEntry(cipher, &e, true); err != nil {
+		return errorResponse(err, "")
+	}
+
+	status.Log(syslog.LOG_NOTICE, "added vault entry %s", e.ID)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": e.ID,
+	}
+
+	return
+}
+
+func vaultUpdate(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	e, err := vaultEntryRequest(req)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	cipher, done, err := vaultCipher(req, true)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	e.ID = req["id"].(string)
+
+	// the stored entry must be decryptable with the request credentials
+	prev, err := vaultStoredEntry(vaultDecryptionRequest(req), e.ID)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	matches, err := filepath.Glob(filepath.Join(vaultDir(), e.ID+".*"))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	e.Created = prev.Created
+	e.Modified = time.Now().Unix()
+
+	if err = storeVaultEntry(cipher, &e, false); err != nil {
+		return errorResponse(err, "")
+	}
+
+	// remove the entry copy encrypted with a different cipher, if any
+	for _, m := range matches {
+		if m != vaultEntryPath(cipher, e.ID) {
+			removePath(m, conf.SecureWipe, nil)
+		}
+	}
+
+	if prev.TOTP != e.TOTP {
+		removeVaultTOTP(prev)
+	}
+
+	status.Log(syslog.LOG_NOTICE, "updated vault entry %s", e.ID)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func vaultDelete(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	id := req["id"].(string)
+
+	// the entry must be decryptable with the request credentials
+	e, err := vaultStoredEntry(req, id)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	matches, err := filepath.Glob(filepath.Join(vaultDir(), id+".*"))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	for _, m := range matches {
+		if err = removePath(m, conf.SecureWipe, nil); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	removeVaultTOTP(e)
+
+	status.Log(syslog.LOG_NOTICE, "deleted vault entry %s", id)
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func vaultGenerate(r *http.Request) (res jsonObject) {
+	var classes []string
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	length, err := optionalInt(req, "length", passwordDefaultLength)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	for _, c := range []struct {
+		name    string
+		charset string
+	}{
+		{"lowercase", passwordLowercase},
+		{"uppercase", passwordUppercase},
+		{"digits", passwordDigits},
+		{"symbols", passwordSymbols},
+	} {
+		enabled, err := optionalBool(req, c.name, true)
+
+		if err != nil {
+			return errorResponse(err, "")
+		}
+
+		if enabled {
+			classes = append(classes, c.charset)
+		}
+	}
+
+	password, err := generatePassword(int(length), classes)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": password,
+	}
+
+	return
+}
+
+func vaultImportFile(r *http.Request) (res jsonObject) {
+	var keyFile []byte
+
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if _, err = regularFile(osPath); err != nil {
+		return errorResponse(err, "")
+	}
+
+	format, err := optionalString(req, "format", strings.TrimPrefix(strings.ToLower(filepath.Ext(osPath)), "."))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if format != "csv" && format != "kdbx" {
+		return errorResponse(fmt.Errorf("unsupported import format %s", format), "")
+	}
+
+	kdbxPassword, err := optionalString(req, "kdbx_password", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	kdbxKey, err := optionalString(req, "kdbx_key", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if kdbxKey != "" {
+		if keyFile, err = kdbxKeyFile(kdbxKey); err != nil {
+			return errorResponse(err, "")
+		}
+	}
+
+	cipher, done, err := vaultCipher(req, true)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+	defer func() { done(err) }()
+
+	id, err := jobs.Submit("vault_import", osPath, 0, func(j *job) (result interface{}, err error) {
+		var imports []vaultImport
+
+		n := status.Notify(syslog.LOG_INFO, "importing %s into vault", relativePath(osPath))
+		defer status.Remove(n)
+
+		switch format {
+		case "csv":
+			var f *os.File
+
+			if f, err = os.Open(osPath); err != nil {
+				return
+			}
+
+			imports, err = parseVaultCSV(f)
+			f.Close()
+		case "kdbx":
+			var data []byte
+
+			if data, err = readKDBXFile(osPath); err != nil {
+				return
+			}
+
+			imports, err = parseVaultKDBX(data, kdbxPassword, keyFile, j)
+		}
+
+		if err != nil {
+			return
+		}
+
+		imported, err := importVaultEntries(cipher, imports, j)
+
+		if err != nil {
+			return imported, err
+		}
+
+		status.Log(syslog.LOG_NOTICE, "imported %d vault entries from %s", imported, relativePath(osPath))
+
+		return imported, nil
+	})
+
+	return jobResponse(id, err)
+}
@@ -0,0 +1,154 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVault(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	if err := conf.EnableCiphers(); err != nil {
+		t.Fatal(err)
+	}
+
+	credentials := jsonObject{"cipher": "AES-256-CTR", "password": "vault password", "key": ""}
+	cipher, _, err := vaultCipher(credentials, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csv := "Group,Title,Username,Password,URL,Notes,TOTP\n" +
+		"Root/Web,Forum,alice,s3cret,https://forum.example,,otpauth://totp/forum?secret=JBSWY3DPEHPK3PXP\n" +
+		"Root,Mail,bob,\"pa,ss\",,\"line 1\nline 2\",\n"
+
+	imports, err := parseVaultCSV(strings.NewReader(csv))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := importVaultEntries(cipher, imports, nil); err != nil || n != 2 {
+		t.Fatalf("unexpected import result %d (%v)", n, err)
+	}
+
+	entries, err := vaultEntries(cipher, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Title != "Mail" || entries[1].Title != "Forum" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	if entries[0].Password != "" || entries[0].Notes != "" {
+		t.Error("entry secrets included in listing")
+	}
+
+	e, err := loadVaultEntry(cipher, entries[0].ID)
+
+	if err != nil || e.Password != "pa,ss" || e.Notes != "line 1\nline 2" {
+		t.Errorf("unexpected entry %+v (%v)", e, err)
+	}
+
+	forum, _ := loadVaultEntry(cipher, entries[1].ID)
+
+	if otp, _, err := vaultOTP(forum.TOTP); err != nil || len(otp) != 6 {
+		t.Errorf("unexpected TOTP code %s (%v)", otp, err)
+	}
+
+	if results, _ := vaultEntries(cipher, "FORUM.EXAMPLE"); len(results) != 1 || results[0].ID != forum.ID {
+		t.Errorf("unexpected search results %+v", results)
+	}
+
+	wrong, _, _ := vaultCipher(jsonObject{"cipher": "AES-256-CTR", "password": "wrong password", "key": ""}, false)
+
+	if _, err = vaultEntries(wrong, ""); err == nil {
+		t.Error("wrong vault password accepted")
+	}
+
+	if _, err = vaultStoredEntry(jsonObject{"cipher": "AES-256-CTR", "password": "wrong password", "key": ""}, forum.ID); err == nil {
+		t.Error("wrong vault password accepted for stored entry")
+	}
+
+	if e, err = vaultStoredEntry(credentials, forum.ID); err != nil || e.Created != forum.Created {
+		t.Errorf("unexpected stored entry %+v (%v)", e, err)
+	}
+
+	removeVaultTOTP(forum)
+
+	if _, _, err = vaultTOTPKey(forum.TOTP); err == nil {
+		t.Error("imported TOTP seed not removed")
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	classes := []string{passwordLowercase, passwordDigits}
+
+	for i := 0; i < 16; i++ {
+		password, err := generatePassword(4, classes)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(password) != 4 || !strings.ContainsAny(password, passwordLowercase) || !strings.ContainsAny(password, passwordDigits) {
+			t.Errorf("unexpected password %s", password)
+		}
+
+		if strings.ContainsAny(password, passwordUppercase+passwordSymbols) {
+			t.Errorf("unexpected character class in password %s", password)
+		}
+	}
+
+	if _, err := generatePassword(1000, classes); err == nil {
+		t.Error("invalid password length accepted")
+	}
+}
+
+func TestParseTOTPSeed(t *testing.T) {
+	seeds := map[string]string{
+		"jbsw y3dp ehpk 3pxp":                                "JBSWY3DPEHPK3PXP",
+		"otpauth://totp/a?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY": "GEZDGNBVGY3TQOJQGEZDGNBVGY======",
+	}
+
+	for s, expected := range seeds {
+		if seed, err := parseTOTPSeed(s); err != nil || seed != expected {
+			t.Errorf("unexpected seed %s for %s (%v)", seed, s, err)
+		}
+	}
+
+	if _, err := parseTOTPSeed("otpauth://totp/a?secret=JBSWY3DPEHPK3PXP&digits=8"); err == nil {
+		t.Error("unsupported TOTP parameters accepted")
+	}
+}
+
+func TestParseVaultKDBX(t *testing.T) {
+	kdf := map[string]interface{}{"$UUID": kdbxKdfAES, "S": make([]byte, 32), "R": uint64(10)}
+	imports, err := parseVaultKDBX(testKDBX(t, 4, kdf, "password"), "password", nil, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(imports) != 2 {
+		t.Fatalf("unexpected number of entries (%d)", len(imports))
+	}
+
+	if e := imports[0].entry; e.Title != "Mail" || e.Username != "alice" || e.Password != "s3cret" || e.Group != "Root" {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	if imp := imports[1]; imp.entry.Group != "Root/Web" || imp.seed != testKDBXSecrets[3] {
+		t.Errorf("unexpected entry %+v", imp)
+	}
+}
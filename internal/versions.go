@@ -0,0 +1,324 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Versions of a file are stored, within the encrypted volume root, under
+// .interlock-versions/<path>@<id> where the id is the UTC time at which the
+// version has been replaced or deleted.
+
+const (
+	versionsPath      = internalPrefix + "versions"
+	versionSeparator  = "@"
+	versionTimeFormat = "20060102T150405.000000000Z"
+)
+
+type versionInfo struct {
+	ID      string `json:"id"`
+	Dir     bool   `json:"dir"`
+	Size    int64  `json:"size"`
+	Created int64  `json:"created"`
+
+	created time.Time
+}
+
+// versioned returns whether replaced or deleted contents of the path are
+// preserved, key storage and INTERLOCK metadata are never versioned.
+func versioned(osPath string) bool {
+	return conf.Versioning && !internalPath(osPath)
+}
+
+func versionPath(osPath string, id string) string {
+	return filepath.Join(conf.MountPoint, versionsPath, relativePath(osPath)) + versionSeparator + id
+}
+
+// saveVersion preserves the current contents of the path, the path is either
+// moved or, when link is set, hard linked to the versions tree.
+func saveVersion(osPath string, link bool) (err error) {
+	id := time.Now().UTC().Format(versionTimeFormat)
+	dst := versionPath(osPath, id)
+
+	if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return
+	}
+
+	if link {
+		err = os.Link(osPath, dst)
+	} else {
+		err = os.Rename(osPath, dst)
+	}
+
+	if err != nil {
+		return
+	}
+
+	status.Log(syslog.LOG_INFO, "saved version %s of %s", id, relativePath(osPath))
+
+	return pruneVersions(osPath)
+}
+
+// listVersions returns the versions of the path, newest first.
+func listVersions(osPath string) (versions []versionInfo, err error) {
+	versions = []versionInfo{}
+	prefix := filepath.Base(versionPath(osPath, ""))
+	dir := filepath.Dir(versionPath(osPath, ""))
+
+	entries, err := os.ReadDir(dir)
+
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+
+		id := strings.TrimPrefix(e.Name(), prefix)
+		created, err := time.Parse(versionTimeFormat, id)
+
+		if err != nil {
+			continue
+		}
+
+		v := versionInfo{
+			ID:      id,
+			Dir:     e.IsDir(),
+			Created: created.Unix(),
+			created: created,
+		}
+
+		if info, err := e.Info(); err == nil && !e.IsDir() {
+			v.Size = info.Size()
+		}
+
+		versions = append(versions, v)
+	}
+
+	sort.Slice(versions, func(i, k int) bool {
+		return versions[i].created.After(versions[k].created)
+	})
+
+	return
+}
+
+// pruneVersions applies the configured retention policy to the versions of
+// the path.
+func pruneVersions(osPath string) (err error) {
+	versions, err := listVersions(osPath)
+
+	if err != nil {
+		return
+	}
+
+	maxAge := time.Duration(conf.VersionsMaxAge) * 24 * time.Hour
+
+	for i, v := range versions {
+		if (conf.VersionsMax > 0 && i >= conf.VersionsMax) || (maxAge > 0 && time.Since(v.created) > maxAge) {
+			if err = os.RemoveAll(versionPath(osPath, v.ID)); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// purgeVersions removes all versions of the path, or only the one matching
+// the id when specified.
+func purgeVersions(osPath string, id string, secure bool, j *job) (purged int, err error) {
+	versions, err := listVersions(osPath)
+
+	if err != nil {
+		return
+	}
+
+	for _, v := range versions {
+		if id != "" && v.ID != id {
+			continue
+		}
+
+		if err = removePath(versionPath(osPath, v.ID), secure, j); err != nil {
+			return
+		}
+
+		purged++
+	}
+
+	return
+}
+
+// restoreVersion replaces the path with the specified version, current
+// contents are preserved as a new version.
+func restoreVersion(osPath string, id string) (err error) {
+	src := versionPath(osPath, id)
+
+	if _, err = time.Parse(versionTimeFormat, id); err != nil {
+		return errors.New("invalid version id")
+	}
+
+	if _, err = os.Lstat(src); err != nil {
+		return fmt.Errorf("version %s of %s not found", id, relativePath(osPath))
+	}
+
+	// the version is set aside first as saving the current contents
+	// might prune it
+	tmp, err := randomName(filepath.Join(conf.MountPoint, versionsPath))
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(src, tmp); err != nil {
+		return
+	}
+
+	if _, err = os.Lstat(osPath); err == nil {
+		err = saveVersion(osPath, false)
+	} else if os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(osPath), 0700)
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, osPath)
+	}
+
+	if err != nil {
+		os.Rename(tmp, src)
+		return
+	}
+
+	status.Log(syslog.LOG_NOTICE, "restored version %s of %s", id, relativePath(osPath))
+
+	return
+}
+
+func fileVersions(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	versions, err := listVersions(osPath)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": versions,
+	}
+
+	return
+}
+
+func fileRestore(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s", "id:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if internalPath(osPath) {
+		return errorResponse(errors.New("versioning is not available for internal paths"), "")
+	}
+
+	if err = restoreVersion(osPath, req["id"].(string)); err != nil {
+		return errorResponse(err, "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
+
+func filePurgeVersions(r *http.Request) (res jsonObject) {
+	req, err := parseRequest(r)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	err = validateRequest(req, []string{"path:s"})
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	osPath, err := absolutePath(req["path"].(string))
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	id, err := optionalString(req, "id", "")
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	purged, err := purgeVersions(osPath, id, conf.SecureWipe, nil)
+
+	if err != nil {
+		return errorResponse(err, "")
+	}
+
+	if id != "" && purged == 0 {
+		return errorResponse(fmt.Errorf("version %s of %s not found", id, relativePath(osPath)), "")
+	}
+
+	res = jsonObject{
+		"status":   "OK",
+		"response": nil,
+	}
+
+	return
+}
@@ -0,0 +1,74 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+	conf.Versioning = true
+	conf.VersionsMax = 2
+
+	osPath := filepath.Join(conf.MountPoint, "dir", "file@1")
+	os.MkdirAll(filepath.Dir(osPath), 0700)
+
+	for _, contents := range []string{"v1", "v2", "v3", "v4"} {
+		if _, err := os.Stat(osPath); err == nil {
+			if err = saveVersion(osPath, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		os.WriteFile(osPath, []byte(contents), 0600)
+	}
+
+	versions, err := listVersions(osPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("unexpected number of versions (%d)", len(versions))
+	}
+
+	if data, _ := os.ReadFile(versionPath(osPath, versions[0].ID)); string(data) != "v3" {
+		t.Errorf("unexpected latest version contents %s", data)
+	}
+
+	if err = restoreVersion(osPath, versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(osPath); string(data) != "v2" {
+		t.Errorf("unexpected restored contents %s", data)
+	}
+
+	// the replaced contents are preserved, the oldest version is pruned
+	versions, _ = listVersions(osPath)
+
+	if len(versions) != 2 {
+		t.Fatalf("unexpected number of versions (%d)", len(versions))
+	}
+
+	if data, _ := os.ReadFile(versionPath(osPath, versions[0].ID)); string(data) != "v4" {
+		t.Errorf("unexpected latest version contents %s", data)
+	}
+
+	if versioned(filepath.Join(conf.MountPoint, versionsPath, "dir")) {
+		t.Error("versions tree is versioned")
+	}
+
+	if n, err := purgeVersions(osPath, "", false, nil); err != nil || n != 2 {
+		t.Errorf("unexpected purge result (%d, %v)", n, err)
+	}
+}
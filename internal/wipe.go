@@ -0,0 +1,177 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Best-effort secure deletion: file contents are overwritten with random
+// data and synced, the file is truncated, renamed to a random name and
+// finally unlinked, its blocks are then discarded when supported. Files with
+// multiple hard links are only unlinked, as their contents remain reachable.
+//
+// Flash translation layers, journaling and copy-on-write filesystems might
+// retain earlier copies of the data, therefore secure wipe complements, and
+// does not replace, the encrypted volume protection.
+
+func randomName(dir string) (osPath string, err error) {
+	name := make([]byte, 16)
+
+	if _, err = io.ReadFull(rand.Reader, name); err != nil {
+		return
+	}
+
+	return filepath.Join(dir, hex.EncodeToString(name)), nil
+}
+
+// wipeFile securely removes a single file.
+func wipeFile(osPath string, j *job) (err error) {
+	f, err := os.OpenFile(osPath, os.O_WRONLY, 0)
+
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		return
+	}
+
+	size := stat.Size()
+
+	// overwriting would affect the remaining links
+	if st, ok := stat.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		f.Close()
+		status.Log(syslog.LOG_WARNING, "%s has multiple hard links, unlinked without wiping", relativePath(osPath))
+		return os.Remove(osPath)
+	}
+
+	n := status.Notify(syslog.LOG_INFO, "wiping %s", relativePath(osPath))
+	defer status.Remove(n)
+
+	if _, err = io.CopyN(j.Writer(f), rand.Reader, size); err != nil {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	if err = discardFile(f, size); err != nil && conf.Debug {
+		log.Printf("could not discard %s: %v", relativePath(osPath), err)
+	}
+
+	if err = f.Truncate(0); err != nil {
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		return
+	}
+
+	f.Close()
+
+	tmp, err := randomName(filepath.Dir(osPath))
+
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(osPath, tmp); err != nil {
+		return
+	}
+
+	return os.Remove(tmp)
+}
+
+// wipePath securely removes a file or, recursively, a directory.
+func wipePath(osPath string, j *job) (err error) {
+	var files []string
+	var dirs []string
+
+	err = filepath.Walk(osPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, p)
+		case info.Mode().IsRegular():
+			files = append(files, p)
+		default:
+			// links and special files carry no data
+			dirs = append(dirs, p)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		if err = j.Err(); err != nil {
+			return
+		}
+
+		if err = wipeFile(f, j); err != nil {
+			return
+		}
+	}
+
+	// remove deepest entries first
+	sort.Slice(dirs, func(i, k int) bool {
+		return strings.Count(dirs[i], string(os.PathSeparator)) > strings.Count(dirs[k], string(os.PathSeparator))
+	})
+
+	for _, d := range dirs {
+		if err = os.Remove(d); err != nil {
+			return
+		}
+	}
+
+	return nil
+}
+
+// removePath deletes a file or directory, securely if requested.
+func removePath(osPath string, secure bool, j *job) (err error) {
+	if secure {
+		err = wipePath(osPath, j)
+	} else {
+		err = os.RemoveAll(osPath)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if inKeyPath, _ := detectKeyPath(osPath); inKeyPath {
+		_ = os.Remove(osPath + policyExt)
+	}
+
+	if secure {
+		status.Log(syslog.LOG_NOTICE, "securely wiped %s", relativePath(osPath))
+	} else {
+		status.Log(syslog.LOG_NOTICE, "deleted %s", relativePath(osPath))
+	}
+
+	return
+}
@@ -0,0 +1,26 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package interlock
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// discardFile releases the file blocks to the underlying device, which
+// results in a discard request when supported by the filesystem and device
+// mapper configuration.
+func discardFile(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
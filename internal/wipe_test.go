@@ -0,0 +1,50 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWipePath(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	dir := filepath.Join(conf.MountPoint, "dir")
+	file := filepath.Join(dir, "file")
+	link := filepath.Join(conf.MountPoint, "link")
+
+	os.Mkdir(dir, 0700)
+	os.WriteFile(file, []byte("contents"), 0600)
+
+	if err := os.Link(file, link); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wipePath(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("path not removed")
+	}
+
+	// contents reachable through other hard links are preserved
+	if data, _ := os.ReadFile(link); string(data) != "contents" {
+		t.Errorf("hard linked contents overwritten (%q)", data)
+	}
+
+	if err := wipePath(link, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(link); !os.IsNotExist(err) {
+		t.Error("file not wiped")
+	}
+}
@@ -0,0 +1,826 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// xz container format (https://tukaani.org/xz/xz-file-format.txt), limited
+// to the LZMA2 filter.
+
+const (
+	// maximum LZMA2 dictionary size (as used by xz -9)
+	xzMaxDict = 64 << 20
+	// LZMA2 dictionary size used for compression (as used by xz -1)
+	xzDict = 1 << 20
+
+	xzHeaderSize      = 12
+	xzFooterSize      = 12
+	xzBlockHeaderSize = 12
+	xzFilterLZMA      = 0x21
+
+	xzCheckNone   = 0x00
+	xzCheckCRC32  = 0x01
+	xzCheckCRC64  = 0x04
+	xzCheckSHA256 = 0x0a
+
+	// LZMA2 chunk limits
+	xzChunkMax        = 1 << 21
+	xzChunkCompressed = 1 << 16
+	xzChunkMargin     = 1 << 10
+)
+
+var (
+	xzHeaderMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+
+	xzCRC64 = crc64.MakeTable(crc64.ECMA)
+)
+
+// xzVarint decodes an xz multibyte integer.
+func xzVarint(r io.ByteReader) (v uint64, err error) {
+	for n := 0; n < 9; n++ {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if b == 0 && n > 0 {
+			break
+		}
+
+		v |= uint64(b&0x7f) << (7 * n)
+
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+
+	return 0, errors.New("invalid xz integer")
+}
+
+func xzPutVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(buf, byte(v))
+}
+
+// xzDictSize returns the LZMA2 dictionary size encoded in its filter
+// properties.
+func xzDictSize(b byte) (size uint64, err error) {
+	switch {
+	case b > 40:
+		return 0, errors.New("invalid xz dictionary size")
+	case b == 40:
+		return 0xffffffff, nil
+	default:
+		return uint64(2|(b&1)) << (b/2 + 11), nil
+	}
+}
+
+func xzCheckHash(check byte) (h hash.Hash, size int, err error) {
+	switch check {
+	case xzCheckNone:
+		return nil, 0, nil
+	case xzCheckCRC32:
+		return crc32.NewIEEE(), 4, nil
+	case xzCheckCRC64:
+		return crc64.New(xzCRC64), 8, nil
+	case xzCheckSHA256:
+		return sha256.New(), sha256.Size, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported xz check type %#x", check)
+	}
+}
+
+// xzSum returns the check value in xz encoding (CRC values are stored in
+// little-endian order).
+func xzSum(h hash.Hash) []byte {
+	switch h := h.(type) {
+	case hash.Hash32:
+		return binary.LittleEndian.AppendUint32(nil, h.Sum32())
+	case hash.Hash64:
+		return binary.LittleEndian.AppendUint64(nil, h.Sum64())
+	default:
+		return h.Sum(nil)
+	}
+}
+
+type xzRecord struct {
+	unpadded     uint64
+	uncompressed uint64
+}
+
+// xzInput counts, and optionally hashes, the compressed data being read.
+type xzInput struct {
+	r   *bufio.Reader
+	n   int64
+	crc hash.Hash32
+}
+
+func (in *xzInput) Read(p []byte) (n int, err error) {
+	n, err = in.r.Read(p)
+	in.n += int64(n)
+
+	if in.crc != nil {
+		in.crc.Write(p[:n])
+	}
+
+	return
+}
+
+func (in *xzInput) ReadByte() (b byte, err error) {
+	if b, err = in.r.ReadByte(); err != nil {
+		return
+	}
+
+	in.n++
+
+	if in.crc != nil {
+		in.crc.Write([]byte{b})
+	}
+
+	return
+}
+
+func (in *xzInput) read(n int) (buf []byte, err error) {
+	buf = make([]byte, n)
+
+	if _, err = io.ReadFull(in, buf); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return
+}
+
+type xzReader struct {
+	in  *xzInput
+	buf []byte
+	out []byte
+	err error
+
+	// stream state
+	stream  bool
+	flags   []byte
+	check   byte
+	records []xzRecord
+
+	// block state
+	block        bool
+	start        int64
+	headerSize   int64
+	compressed   int64
+	uncompressed int64
+	size         uint64
+	hash         hash.Hash
+
+	// LZMA2 state
+	lzma          lzmaState
+	dict          lzmaDict
+	needDictReset bool
+	needProps     bool
+}
+
+func (x *xzReader) Read(p []byte) (n int, err error) {
+	for len(x.out) == 0 && x.err == nil {
+		x.err = x.next()
+	}
+
+	if len(x.out) > 0 {
+		n = copy(p, x.out)
+		x.out = x.out[n:]
+		return
+	}
+
+	return 0, x.err
+}
+
+func (x *xzReader) Close() (err error) {
+	// the tar reader stops at the end of archive marker, the remaining
+	// data is consumed to verify the stream integrity
+	for x.err == nil {
+		x.out = x.out[:0]
+		x.err = x.next()
+	}
+
+	if x.err != io.EOF {
+		return fmt.Errorf("xz error: %v", x.err)
+	}
+
+	return
+}
+
+// next decodes the following element of the xz file, filling the output
+// buffer with any decompressed data.
+func (x *xzReader) next() (err error) {
+	defer func() {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated xz stream")
+		}
+	}()
+
+	switch {
+	case x.block:
+		return x.readChunk()
+	case x.stream:
+		b, err := x.in.ReadByte()
+
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+
+		if b == 0 {
+			return x.readIndex()
+		}
+
+		return x.readBlockHeader(b)
+	default:
+		return x.readStreamHeader()
+	}
+}
+
+func (x *xzReader) readStreamHeader() (err error) {
+	first := x.records == nil
+
+	// stream padding, in multiples of four null bytes, separates
+	// concatenated streams
+	buf := make([]byte, 4)
+
+	for {
+		if _, err = io.ReadFull(x.in, buf); err == io.EOF && first {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return
+		}
+
+		if !bytes.Equal(buf, make([]byte, 4)) || first {
+			break
+		}
+	}
+
+	rest, err := x.in.read(xzHeaderSize - 4)
+
+	if err != nil {
+		return
+	}
+
+	header := append(buf, rest...)
+
+	if !bytes.Equal(header[0:6], xzHeaderMagic) {
+		return errors.New("invalid xz stream header")
+	}
+
+	if crc32.ChecksumIEEE(header[6:8]) != binary.LittleEndian.Uint32(header[8:12]) {
+		return errors.New("invalid xz stream header checksum")
+	}
+
+	if header[6] != 0 || header[7]&0xf0 != 0 {
+		return errors.New("unsupported xz stream flags")
+	}
+
+	if _, _, err = xzCheckHash(header[7]); err != nil {
+		return
+	}
+
+	x.stream = true
+	x.flags = header[6:8]
+	x.check = header[7]
+	x.records = []xzRecord{}
+
+	return
+}
+
+func (x *xzReader) readBlockHeader(size byte) (err error) {
+	headerSize := (int(size) + 1) * 4
+	buf, err := x.in.read(headerSize - 1)
+
+	if err != nil {
+		return
+	}
+
+	header := append([]byte{size}, buf...)
+
+	if crc32.ChecksumIEEE(header[:headerSize-4]) != binary.LittleEndian.Uint32(header[headerSize-4:]) {
+		return errors.New("invalid xz block header checksum")
+	}
+
+	flags := header[1]
+
+	if flags&0x3c != 0 {
+		return errors.New("unsupported xz block flags")
+	}
+
+	if flags&0x03 != 0 {
+		return errors.New("unsupported xz filter chain")
+	}
+
+	r := bytes.NewReader(header[2 : headerSize-4])
+
+	x.compressed = -1
+	x.uncompressed = -1
+
+	if flags&0x40 != 0 {
+		v, err := xzVarint(r)
+
+		if err != nil || v == 0 || v > 1<<62 {
+			return errors.New("invalid xz block header")
+		}
+
+		x.compressed = int64(v)
+	}
+
+	if flags&0x80 != 0 {
+		v, err := xzVarint(r)
+
+		if err != nil || v > 1<<62 {
+			return errors.New("invalid xz block header")
+		}
+
+		x.uncompressed = int64(v)
+	}
+
+	id, err := xzVarint(r)
+
+	if err != nil {
+		return
+	}
+
+	if id != xzFilterLZMA {
+		return fmt.Errorf("unsupported xz filter %#x", id)
+	}
+
+	if propsSize, err := xzVarint(r); err != nil || propsSize != 1 {
+		return errors.New("invalid xz LZMA2 properties")
+	}
+
+	props, err := r.ReadByte()
+
+	if err != nil {
+		return
+	}
+
+	dictSize, err := xzDictSize(props)
+
+	if err != nil {
+		return
+	}
+
+	// the dictionary is allocated upfront, its size is therefore bound to
+	// the device capabilities
+	if dictSize > xzMaxDict {
+		return fmt.Errorf("xz dictionary size exceeds limit (%d bytes)", xzMaxDict)
+	}
+
+	for r.Len() > 0 {
+		if b, _ := r.ReadByte(); b != 0 {
+			return errors.New("invalid xz block header padding")
+		}
+	}
+
+	dictSize = max(dictSize, 4096)
+
+	if uint64(len(x.dict.buf)) != dictSize {
+		x.dict.buf = make([]byte, dictSize)
+	}
+
+	x.hash, _, _ = xzCheckHash(x.check)
+	x.block = true
+	x.start = x.in.n
+	x.headerSize = int64(headerSize)
+	x.size = 0
+	x.needDictReset = true
+	x.needProps = true
+
+	return
+}
+
+func (x *xzReader) readChunk() (err error) {
+	control, err := x.in.ReadByte()
+
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return
+	}
+
+	if control == 0x00 {
+		return x.endBlock()
+	}
+
+	if control >= 0xe0 || control == 0x01 {
+		x.needProps = true
+		x.needDictReset = false
+		x.dict.reset()
+	} else if x.needDictReset {
+		return errors.New("invalid LZMA2 chunk")
+	}
+
+	if control < 0x80 {
+		if control > 0x02 {
+			return errors.New("invalid LZMA2 chunk")
+		}
+
+		buf, err := x.in.read(2)
+
+		if err != nil {
+			return err
+		}
+
+		data, err := x.in.read(int(binary.BigEndian.Uint16(buf)) + 1)
+
+		if err != nil {
+			return err
+		}
+
+		for _, b := range data {
+			x.dict.put(b)
+		}
+
+		return x.output(data)
+	}
+
+	buf, err := x.in.read(4)
+
+	if err != nil {
+		return
+	}
+
+	size := int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(buf[0:2])) + 1
+	compressed := int(binary.BigEndian.Uint16(buf[2:4])) + 1
+
+	switch {
+	case control >= 0xc0:
+		props, err := x.in.ReadByte()
+
+		if err != nil {
+			return err
+		}
+
+		if x.lzma.lc, x.lzma.lp, x.lzma.pb, err = lzmaProperties(props); err != nil {
+			return err
+		}
+
+		x.needProps = false
+		x.lzma.reset()
+	case x.needProps:
+		return errors.New("invalid LZMA2 chunk")
+	case control >= 0xa0:
+		x.lzma.reset()
+	}
+
+	data, err := x.in.read(compressed)
+
+	if err != nil {
+		return
+	}
+
+	if x.buf, err = lzmaDecode(&x.lzma, &x.dict, data, size, x.buf[:0]); err != nil {
+		return
+	}
+
+	return x.output(x.buf)
+}
+
+func (x *xzReader) output(data []byte) (err error) {
+	x.size += uint64(len(data))
+
+	if x.uncompressed >= 0 && x.size > uint64(x.uncompressed) {
+		return errors.New("invalid xz block size")
+	}
+
+	if x.hash != nil {
+		x.hash.Write(data)
+	}
+
+	x.out = data
+
+	return
+}
+
+func (x *xzReader) endBlock() (err error) {
+	compressed := x.in.n - x.start
+
+	if x.compressed >= 0 && compressed != x.compressed {
+		return errors.New("invalid xz block compressed size")
+	}
+
+	if x.uncompressed >= 0 && x.size != uint64(x.uncompressed) {
+		return errors.New("invalid xz block uncompressed size")
+	}
+
+	if padding, err := x.in.read(int(-compressed & 3)); err != nil {
+		return err
+	} else if !bytes.Equal(padding, make([]byte, len(padding))) {
+		return errors.New("invalid xz block padding")
+	}
+
+	unpadded := x.headerSize + compressed
+
+	if x.hash != nil {
+		sum := xzSum(x.hash)
+		check, err := x.in.read(len(sum))
+
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(check, sum) {
+			return errors.New("xz check mismatch")
+		}
+
+		unpadded += int64(len(sum))
+	}
+
+	x.records = append(x.records, xzRecord{uint64(unpadded), x.size})
+	x.block = false
+
+	return
+}
+
+func (x *xzReader) readIndex() (err error) {
+	x.in.crc = crc32.NewIEEE()
+	x.in.crc.Write([]byte{0x00})
+	start := x.in.n - 1
+
+	count, err := xzVarint(x.in)
+
+	if err != nil {
+		return
+	}
+
+	if count != uint64(len(x.records)) {
+		return errors.New("invalid xz index")
+	}
+
+	for _, record := range x.records {
+		unpadded, err := xzVarint(x.in)
+
+		if err != nil {
+			return err
+		}
+
+		uncompressed, err := xzVarint(x.in)
+
+		if err != nil {
+			return err
+		}
+
+		if unpadded != record.unpadded || uncompressed != record.uncompressed {
+			return errors.New("invalid xz index")
+		}
+	}
+
+	if padding, err := x.in.read(int(-(x.in.n - start) & 3)); err != nil {
+		return err
+	} else if !bytes.Equal(padding, make([]byte, len(padding))) {
+		return errors.New("invalid xz index padding")
+	}
+
+	size := x.in.n - start
+	sum := x.in.crc.Sum32()
+	x.in.crc = nil
+
+	check, err := x.in.read(4)
+
+	if err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint32(check) != sum {
+		return errors.New("invalid xz index checksum")
+	}
+
+	footer, err := x.in.read(xzFooterSize)
+
+	if err != nil {
+		return
+	}
+
+	if !bytes.Equal(footer[10:12], xzFooterMagic) {
+		return errors.New("invalid xz stream footer")
+	}
+
+	if crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[0:4]) {
+		return errors.New("invalid xz stream footer checksum")
+	}
+
+	if (int64(binary.LittleEndian.Uint32(footer[4:8]))+1)*4 != size+4 || !bytes.Equal(footer[8:10], x.flags) {
+		return errors.New("invalid xz stream footer")
+	}
+
+	x.stream = false
+
+	return
+}
+
+func xzDecompressor(src io.Reader) (r io.ReadCloser, err error) {
+	return &xzReader{in: &xzInput{r: bufio.NewReader(src)}}, nil
+}
+
+// xzWriter compresses data in a single block, with CRC64 check, made of
+// LZMA2 chunks.
+type xzWriter struct {
+	dst io.Writer
+	err error
+
+	lzma *lzmaEncoder
+	pos  int
+	hash hash.Hash64
+	size uint64
+
+	// compressed block size
+	compressed int64
+
+	dictReset  bool
+	needProps  bool
+	stateReset bool
+}
+
+func (w *xzWriter) write(buf []byte) {
+	if w.err != nil {
+		return
+	}
+
+	_, w.err = w.dst.Write(buf)
+}
+
+func (w *xzWriter) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.hash.Write(p)
+	w.size += uint64(len(p))
+
+	for len(p) > 0 {
+		// retain the dictionary window only
+		if w.pos > w.lzma.dictSize {
+			shift := w.pos - w.lzma.dictSize
+			w.lzma.buf = append(w.lzma.buf[:0], w.lzma.buf[shift:]...)
+			w.lzma.base += uint64(shift)
+			w.pos -= shift
+		}
+
+		i := min(len(p), w.pos+2*xzChunkMax-len(w.lzma.buf))
+		w.lzma.buf = append(w.lzma.buf, p[:i]...)
+		p = p[i:]
+		n += i
+
+		for w.err == nil && len(w.lzma.buf)-w.pos >= xzChunkMax {
+			w.writeChunk(w.pos + xzChunkMax)
+		}
+	}
+
+	return n, w.err
+}
+
+// writeChunk compresses window data up to end in one or more LZMA2 chunks.
+func (w *xzWriter) writeChunk(end int) {
+	start := w.pos
+
+	if w.stateReset {
+		w.lzma.reset()
+	}
+
+	w.pos = w.lzma.encode(start, end, xzChunkCompressed-xzChunkMargin)
+	data := w.lzma.rc.flush()
+	size := w.pos - start
+
+	if len(data) >= size {
+		// incompressible data is stored in uncompressed chunks
+		for i := start; i < w.pos; i += xzChunkCompressed {
+			chunk := w.lzma.buf[i:min(i+xzChunkCompressed, w.pos)]
+			control := byte(0x02)
+
+			if w.dictReset {
+				control = 0x01
+				w.dictReset = false
+				w.needProps = true
+			}
+
+			w.write([]byte{control, byte((len(chunk) - 1) >> 8), byte(len(chunk) - 1)})
+			w.write(chunk)
+			w.compressed += int64(3 + len(chunk))
+		}
+
+		w.stateReset = true
+
+		return
+	}
+
+	var control byte
+
+	switch {
+	case w.dictReset:
+		control = 0xe0
+	case w.needProps:
+		control = 0xc0
+	case w.stateReset:
+		control = 0xa0
+	default:
+		control = 0x80
+	}
+
+	header := []byte{
+		control | byte((size-1)>>16),
+		byte((size - 1) >> 8), byte(size - 1),
+		byte((len(data) - 1) >> 8), byte(len(data) - 1),
+	}
+
+	if control >= 0xc0 {
+		header = append(header, lzmaProps)
+	}
+
+	w.write(header)
+	w.write(data)
+	w.compressed += int64(len(header) + len(data))
+
+	w.dictReset = false
+	w.needProps = false
+	w.stateReset = false
+}
+
+func (w *xzWriter) Close() (err error) {
+	for w.err == nil && w.pos < len(w.lzma.buf) {
+		w.writeChunk(len(w.lzma.buf))
+	}
+
+	// end of LZMA2 data
+	w.write([]byte{0x00})
+	w.compressed++
+
+	unpadded := uint64(xzBlockHeaderSize + w.compressed + 8)
+
+	w.write(make([]byte, -w.compressed&3))
+	w.write(xzSum(w.hash))
+
+	index := []byte{0x00}
+	index = xzPutVarint(index, 1)
+	index = xzPutVarint(index, unpadded)
+	index = xzPutVarint(index, w.size)
+	index = append(index, make([]byte, -len(index)&3)...)
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, 0x00, xzCheckCRC64)
+	footer = append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(footer)), footer...)
+	footer = append(footer, xzFooterMagic...)
+
+	w.write(index)
+	w.write(footer)
+
+	return w.err
+}
+
+func xzCompressor(dst io.Writer) (w io.WriteCloser, err error) {
+	x := &xzWriter{
+		dst:       dst,
+		lzma:      newLZMAEncoder(xzDict),
+		hash:      crc64.New(xzCRC64),
+		dictReset: true,
+	}
+
+	flags := []byte{0x00, xzCheckCRC64}
+	header := append(append([]byte{}, xzHeaderMagic...), flags...)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(flags))
+
+	// single LZMA2 filter, no size fields
+	block := []byte{xzBlockHeaderSize/4 - 1, 0x00, xzFilterLZMA, 0x01, xzDictProps(xzDict), 0x00, 0x00, 0x00}
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(block))
+
+	x.write(header)
+	x.write(block)
+
+	return x, x.err
+}
+
+// xzDictProps returns the LZMA2 filter properties for a dictionary size.
+func xzDictProps(size uint64) (b byte) {
+	for b = 0; b < 40; b++ {
+		if s, _ := xzDictSize(b); s >= size {
+			break
+		}
+	}
+
+	return
+}
@@ -0,0 +1,135 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func xzDecode(data []byte) ([]byte, error) {
+	r, _ := xzDecompressor(bytes.NewReader(data))
+	out, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return out, r.Close()
+}
+
+func TestXz(t *testing.T) {
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	text, _ := os.ReadFile(filepath.Join("testdata", "xz", "input"))
+	text = bytes.Repeat(text, 64)
+
+	// exceeds the dictionary and chunk sizes, mixing compressible and
+	// incompressible data
+	mixed := append(append(bytes.Clone(text), random...), make([]byte, 3<<20)...)
+
+	for name, data := range map[string][]byte{"empty": {}, "text": text, "random": random, "mixed": mixed} {
+		buf := new(bytes.Buffer)
+		w, _ := xzCompressor(buf)
+
+		for p := data; len(p) > 0; {
+			n, _ := w.Write(p[:min(len(p), 100000)])
+			p = p[n:]
+		}
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if out, err := xzDecode(buf.Bytes()); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip failed (%v)", name, err)
+		}
+
+		// interoperability with the xz utility, when available
+		if _, err := exec.LookPath("xz"); err != nil {
+			continue
+		}
+
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = buf
+
+		if out, err := cmd.Output(); err != nil || !bytes.Equal(out, data) {
+			t.Errorf("%s: xz utility rejected stream (%v)", name, err)
+		}
+	}
+}
+
+func TestXzDecompress(t *testing.T) {
+	dir := filepath.Join("testdata", "xz")
+	input, err := os.ReadFile(filepath.Join(dir, "input"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.xz"))
+
+	if len(files) == 0 {
+		t.Fatal("missing test files")
+	}
+
+	for _, f := range files {
+		data, _ := os.ReadFile(f)
+
+		if out, err := xzDecode(data); err != nil || !bytes.Equal(out, input) {
+			t.Errorf("%s: invalid output (%v)", f, err)
+		}
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "crc64.xz"))
+
+	invalid := map[string][]byte{
+		"truncated":         data[:len(data)-1],
+		"trailing data":     append(bytes.Clone(data), 1, 2, 3, 4),
+		"unaligned padding": append(bytes.Clone(data), 0, 0),
+	}
+
+	// corrupted compressed data, check and index
+	for _, offset := range []int{100, len(data) - 30, len(data) - 20} {
+		corrupted := bytes.Clone(data)
+		corrupted[offset] ^= 0x01
+
+		if _, err := xzDecode(corrupted); err == nil {
+			t.Errorf("corruption at offset %d accepted", offset)
+		}
+	}
+
+	// LZMA2 filter alterations, with valid block header checksum
+	filter := func(id byte, props byte) []byte {
+		d := bytes.Clone(data)
+		h := d[xzHeaderSize : xzHeaderSize+(int(d[xzHeaderSize])+1)*4]
+		i := bytes.Index(h, []byte{xzFilterLZMA, 0x01})
+
+		h[i] = id
+		h[i+2] = props
+		binary.LittleEndian.PutUint32(h[len(h)-4:], crc32.ChecksumIEEE(h[:len(h)-4]))
+
+		return d
+	}
+
+	invalid["excessive dictionary size"] = filter(xzFilterLZMA, 40)
+	invalid["unsupported filter"] = filter(0x03, 0x00)
+
+	for name, d := range invalid {
+		if _, err := xzDecode(d); err == nil {
+			t.Errorf("%s: invalid stream accepted", name)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// WinZip AES encryption (AE-1/AE-2), as supported natively by most zip
+// tools, entries are created in the AE-2 format using AES-256.
+//
+// The entry data is composed as follows:
+//
+// salt (16 bytes) || password verifier (2 bytes) || ciphertext || hmac (10 bytes)
+//
+// Keys are derived with PBKDF2 using SHA1 and 1000 rounds, the ciphertext is
+// produced with AES in CTR mode using a little-endian counter starting at 1
+// and authenticated with a truncated HMAC-SHA1.
+
+const (
+	zipMethodAES   = 99
+	zipExtraAES    = 0x9901
+	zipVendorAE1   = 1
+	zipVendorAE2   = 2
+	zipAES256      = 3
+	zipAESRounds   = 1000
+	zipAESMACSize  = 10
+	zipAESPVVSize  = 2
+	zipEncrypted   = 0x1
+	zipDescriptor  = 0x8
+	zipUTF8        = 0x800
+	zipVersionAES  = 51
+	zipAESKeySize  = 32
+	zipAESSaltSize = 16
+)
+
+// aeCTR implements AES-CTR with the WinZip little-endian counter.
+type aeCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	pos     int
+}
+
+func newAECTR(block cipher.Block) *aeCTR {
+	return &aeCTR{
+		block: block,
+		pos:   aes.BlockSize,
+	}
+}
+
+func (c *aeCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.pos == aes.BlockSize {
+			for k := range c.counter {
+				c.counter[k]++
+
+				if c.counter[k] != 0 {
+					break
+				}
+			}
+
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.pos = 0
+		}
+
+		dst[i] = src[i] ^ c.stream[c.pos]
+		c.pos++
+	}
+}
+
+func deriveZipKeys(password string, salt []byte) (stream cipher.Stream, mac hash.Hash, pvv []byte, err error) {
+	keys, err := pbkdf2.Key(sha1.New, password, salt, zipAESRounds, 2*zipAESKeySize+zipAESPVVSize)
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(keys[0:zipAESKeySize])
+
+	if err != nil {
+		return
+	}
+
+	stream = newAECTR(block)
+	mac = hmac.New(sha1.New, keys[zipAESKeySize:2*zipAESKeySize])
+	pvv = keys[2*zipAESKeySize:]
+
+	return
+}
+
+func zipAESExtra(method uint16) []byte {
+	extra := make([]byte, 11)
+
+	binary.LittleEndian.PutUint16(extra[0:], zipExtraAES)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], zipVendorAE2)
+	copy(extra[6:], "AE")
+	extra[8] = zipAES256
+	binary.LittleEndian.PutUint16(extra[9:], method)
+
+	return extra
+}
+
+// zipDOSTime converts a time to the MS-DOS date and time encoding.
+func zipDOSTime(t time.Time) (date uint16, dosTime uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	dosTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+
+	return
+}
+
+// createEncrypted adds an AES-256 encrypted, deflated, entry to the archive.
+func createEncrypted(writer *zip.Writer, fh *zip.FileHeader, input io.Reader, password string) (written int64, err error) {
+	salt := make([]byte, zipAESSaltSize)
+
+	if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+		return
+	}
+
+	stream, mac, pvv, err := deriveZipKeys(password, salt)
+
+	if err != nil {
+		return
+	}
+
+	fh.Method = zipMethodAES
+	fh.Flags |= zipEncrypted | zipDescriptor
+	fh.Extra = append(fh.Extra, zipAESExtra(zip.Deflate)...)
+	fh.ReaderVersion = zipVersionAES
+	fh.CRC32 = 0
+	fh.ModifiedDate, fh.ModifiedTime = zipDOSTime(fh.Modified)
+
+	for _, c := range fh.Name {
+		if c >= 0x80 {
+			fh.Flags |= zipUTF8
+			break
+		}
+	}
+
+	w, err := writer.CreateRaw(fh)
+
+	if err != nil {
+		return
+	}
+
+	out := &countWriter{w: w}
+
+	if _, err = out.Write(append(salt, pvv...)); err != nil {
+		return
+	}
+
+	ciphertext := &cipher.StreamWriter{
+		S: stream,
+		W: io.MultiWriter(out, mac),
+	}
+
+	compressor, err := flate.NewWriter(ciphertext, flate.DefaultCompression)
+
+	if err != nil {
+		return
+	}
+
+	if written, err = io.Copy(compressor, input); err != nil {
+		return
+	}
+
+	if err = compressor.Close(); err != nil {
+		return
+	}
+
+	if _, err = out.Write(mac.Sum(nil)[0:zipAESMACSize]); err != nil {
+		return
+	}
+
+	// sizes are recorded in the data descriptor and central directory
+	fh.CompressedSize64 = uint64(out.n)
+	fh.UncompressedSize64 = uint64(written)
+
+	if fh.CompressedSize64 > uint32max || fh.UncompressedSize64 > uint32max {
+		fh.CompressedSize = uint32max
+		fh.UncompressedSize = uint32max
+	} else {
+		fh.CompressedSize = uint32(fh.CompressedSize64)
+		fh.UncompressedSize = uint32(fh.UncompressedSize64)
+	}
+
+	return
+}
+
+const uint32max = (1 << 32) - 1
+
+// zipAESInfo parses the AES extra field, returning the vendor version, the
+// key size and the actual compression method.
+func zipAESInfo(f *zip.File) (version uint16, keySize int, method uint16, err error) {
+	extra := f.Extra
+
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra[0:])
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+
+		if len(extra) < 4+size {
+			break
+		}
+
+		if id == zipExtraAES && size == 7 {
+			version = binary.LittleEndian.Uint16(extra[4:])
+			method = binary.LittleEndian.Uint16(extra[9:])
+
+			switch extra[8] {
+			case 1:
+				keySize = 16
+			case 2:
+				keySize = 24
+			case 3:
+				keySize = 32
+			default:
+				err = errors.New("invalid zip AES strength")
+			}
+
+			return
+		}
+
+		extra = extra[4+size:]
+	}
+
+	err = errors.New("missing zip AES extra field")
+
+	return
+}
+
+type zipAESReader struct {
+	io.Reader
+	closer io.Closer
+	crc    hash.Hash32
+	check  bool
+	sum    uint32
+}
+
+func (z *zipAESReader) Read(p []byte) (n int, err error) {
+	n, err = z.Reader.Read(p)
+	z.crc.Write(p[:n])
+
+	if err == io.EOF && z.check && z.crc.Sum32() != z.sum {
+		err = errors.New("zip: checksum error")
+	}
+
+	return
+}
+
+func (z *zipAESReader) Close() error {
+	return z.closer.Close()
+}
+
+// openEncrypted returns the plaintext of an AES encrypted entry, the entry
+// is authenticated before any data is returned.
+func openEncrypted(f *zip.File, password string) (r io.ReadCloser, err error) {
+	if f.Method != zipMethodAES {
+		return nil, errors.New("unsupported zip encryption method")
+	}
+
+	if password == "" {
+		return nil, fmt.Errorf("password required for encrypted entry %s", f.Name)
+	}
+
+	version, keySize, method, err := zipAESInfo(f)
+
+	if err != nil {
+		return
+	}
+
+	raw, err := f.OpenRaw()
+
+	if err != nil {
+		return
+	}
+
+	input, ok := raw.(*io.SectionReader)
+
+	if !ok {
+		return nil, errors.New("zip entry requires random access")
+	}
+
+	saltSize := keySize / 2
+	size := input.Size() - int64(saltSize+zipAESPVVSize+zipAESMACSize)
+
+	if size < 0 {
+		return nil, errors.New("invalid zip AES entry")
+	}
+
+	header := make([]byte, saltSize+zipAESPVVSize)
+
+	if _, err = io.ReadFull(input, header); err != nil {
+		return
+	}
+
+	salt := header[0:saltSize]
+	keys, err := pbkdf2.Key(sha1.New, password, salt, zipAESRounds, 2*keySize+zipAESPVVSize)
+
+	if err != nil {
+		return
+	}
+
+	if subtle.ConstantTimeCompare(keys[2*keySize:], header[saltSize:]) != 1 {
+		return nil, fmt.Errorf("invalid password for encrypted entry %s", f.Name)
+	}
+
+	block, err := aes.NewCipher(keys[0:keySize])
+
+	if err != nil {
+		return
+	}
+
+	mac := hmac.New(sha1.New, keys[keySize:2*keySize])
+	ciphertext := io.NewSectionReader(input, int64(len(header)), size)
+
+	if _, err = io.Copy(mac, ciphertext); err != nil {
+		return
+	}
+
+	sum := make([]byte, zipAESMACSize)
+
+	if _, err = input.ReadAt(sum, int64(len(header))+size); err != nil {
+		return
+	}
+
+	if !hmac.Equal(sum, mac.Sum(nil)[0:zipAESMACSize]) {
+		return nil, fmt.Errorf("invalid HMAC for encrypted entry %s", f.Name)
+	}
+
+	if _, err = ciphertext.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	plaintext := &cipher.StreamReader{
+		S: newAECTR(block),
+		R: ciphertext,
+	}
+
+	z := &zipAESReader{
+		crc: crc32.NewIEEE(),
+		// AE-2 omits the CRC, AE-1 retains it
+		check: version == zipVendorAE1,
+		sum:   f.CRC32,
+	}
+
+	switch method {
+	case zip.Store:
+		z.Reader = plaintext
+		z.closer = io.NopCloser(nil)
+	case zip.Deflate:
+		d := flate.NewReader(plaintext)
+		z.Reader = d
+		z.closer = d
+	default:
+		return nil, errors.New("unsupported zip compression method")
+	}
+
+	return z, nil
+}
@@ -0,0 +1,145 @@
+// INTERLOCK | https://github.com/usbarmory/interlock
+// Copyright (c) The INTERLOCK authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package interlock
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestZipAES(t *testing.T) {
+	password := "interlocktest"
+	cleartext := strings.Repeat("01234567890ABCDEFGHILMNOPQRSTUVZ!@#", 1000)
+
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+	src := filepath.Join(conf.MountPoint, "src")
+	dst := filepath.Join(conf.MountPoint, "dst")
+
+	os.MkdirAll(src, 0700)
+	os.WriteFile(filepath.Join(src, "cleartext"), []byte(cleartext), 0600)
+
+	archive := new(bytes.Buffer)
+
+	if _, err := zipWriter([]string{src}, archive, password, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(archive.Bytes(), []byte(cleartext[0:32])) {
+		t.Error("cleartext found in encrypted archive")
+	}
+
+	reader, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := reader.File[0]
+
+	if f.Method != zipMethodAES || f.Flags&zipEncrypted == 0 {
+		t.Fatalf("unexpected method %d, flags %x", f.Method, f.Flags)
+	}
+
+	if _, err = openEncrypted(f, "invalid"); err == nil {
+		t.Error("invalid password accepted")
+	}
+
+	r, err := openEncrypted(f, password)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := io.ReadAll(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decrypted) != cleartext {
+		t.Error("cleartext mismatch")
+	}
+
+	// tamper with the last ciphertext byte
+	data := archive.Bytes()
+	offset, _ := f.DataOffset()
+	data[offset+int64(f.CompressedSize64)-zipAESMACSize-1] ^= 0xff
+
+	reader, _ = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+	if _, err = openEncrypted(reader.File[0], password); err == nil {
+		t.Error("tampered entry accepted")
+	}
+
+	path := filepath.Join(conf.MountPoint, "test.zip")
+	data[offset+int64(f.CompressedSize64)-zipAESMACSize-1] ^= 0xff
+	os.WriteFile(path, data, 0600)
+
+	if err = extractArchive(path, dst, password, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	extracted, _ := os.ReadFile(filepath.Join(dst, "src", "cleartext"))
+
+	if string(extracted) != cleartext {
+		t.Error("extracted cleartext mismatch")
+	}
+}
+
+// TestZipAESFixtures extracts archives generated independently from the
+// INTERLOCK implementation (see testdata/zip/README).
+func TestZipAESFixtures(t *testing.T) {
+	conf.SetDefaults()
+	conf.MountPoint = t.TempDir()
+
+	text := "db0ce27784132d45d5929d854f97ca3fba44aa6cdc0b7f5adec0638e7aeeb01d"
+	binary := "68950b5dc8001f651c3884f0201a276dd63eb870c6f2d153ed52719ddbce3101"
+
+	fixtures := map[string]map[string]string{
+		"ae1-aes128-stored.zip":  {"file.txt": text},
+		"ae2-aes192-deflate.zip": {"file.txt": text},
+		"ae2-aes256-mixed.zip":   {"dir/file.txt": text, "dir/binary.bin": binary},
+	}
+
+	for name, files := range fixtures {
+		data, err := os.ReadFile(filepath.Join("testdata", "zip", name))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		src := filepath.Join(conf.MountPoint, name)
+		dst := filepath.Join(conf.MountPoint, strings.TrimSuffix(name, ".zip"))
+		os.WriteFile(src, data, 0600)
+
+		if err = extractArchive(src, dst, "invalid", nil, nil); err == nil {
+			t.Errorf("%s: invalid password accepted", name)
+		}
+
+		if err = extractArchive(src, dst, "password", nil, nil); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		for f, digest := range files {
+			extracted, _ := os.ReadFile(filepath.Join(dst, f))
+			sum := sha256.Sum256(extracted)
+
+			if hex.EncodeToString(sum[:]) != digest {
+				t.Errorf("%s: %s contents mismatch", name, f)
+			}
+		}
+	}
+}